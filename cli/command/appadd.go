@@ -26,6 +26,20 @@ var AppAddCommand = cli.Command{
 		cli.StringFlag{"R,regions", "bj,nj", "Regions"},
 		cli.IntFlag{"k,migratekey", 100, "MigrateKeysEachTime"},
 		cli.IntFlag{"t,migratetimeout", 2000, "MigrateTimeout"},
+		cli.IntFlag{"b,migratebatch", 10, "MigrateBatchSize"},
+		cli.IntFlag{"c,migrateconcurrency", 4, "MigrateConcurrency"},
+		cli.IntFlag{"throttleops", 0, "MigrateThrottleOpsPerSec"},
+		cli.IntFlag{"throttlemem", 0, "MigrateThrottleUsedMemory in MB"},
+		cli.IntFlag{"throttlelatency", 0, "MigrateThrottleLatencyUs"},
+		cli.IntFlag{"largekey", 8, "MigrateLargeKeyBytes in MB"},
+		cli.StringFlag{"failoverpolicy", "maxoffset", "FailoverPolicy, maxoffset|zone|leastloaded|priority"},
+		cli.BoolFlag{"regionfailover", "RegionFailover"},
+		cli.StringFlag{"preferredzone", "", "FailoverPreferredZone, zone or zone:room"},
+		cli.IntFlag{"largekeyretries", 5, "MigrateLargeKeyRetries"},
+		cli.IntFlag{"maxfailoverlag", 0, "MaxFailoverLagBytes in KB, 0 to disable"},
+		cli.IntFlag{"historydays", 90, "FailoverHistoryKeepDays"},
+		cli.IntFlag{"historycount", 1000, "FailoverHistoryKeepCount"},
+		cli.BoolFlag{"historyarchive", "FailoverHistoryArchive"},
 	},
 	Description: `
     add app configuration to zookeeper
@@ -42,6 +56,20 @@ func appAddAction(c *cli.Context) {
 	R := c.String("R")
 	k := c.Int("k")
 	t := c.Int("t")
+	b := c.Int("b")
+	cc := c.Int("c")
+	tops := c.Int("throttleops")
+	tmem := c.Int("throttlemem")
+	tlat := c.Int("throttlelatency")
+	lkey := c.Int("largekey")
+	lretries := c.Int("largekeyretries")
+	fpolicy := c.String("failoverpolicy")
+	pzone := c.String("preferredzone")
+	rf := c.Bool("regionfailover")
+	maxlag := c.Int("maxfailoverlag")
+	hdays := c.Int("historydays")
+	hcount := c.Int("historycount")
+	harchive := c.Bool("historyarchive")
 
 	if appname == "" {
 		fmt.Println("-n,appname must be assigned")
@@ -57,6 +85,24 @@ func appAddAction(c *cli.Context) {
 		Regions:               strings.Split(R, ","),
 		MigrateKeysEachTime:   k,
 		MigrateTimeout:        t,
+		MigrateBatchSize:      b,
+		MigrateConcurrency:    cc,
+
+		MigrateThrottleOpsPerSec:  tops,
+		MigrateThrottleUsedMemory: int64(tmem) * 1024 * 1024,
+		MigrateThrottleLatencyUs:  tlat,
+
+		MigrateLargeKeyBytes:   int64(lkey) * 1024 * 1024,
+		MigrateLargeKeyRetries: lretries,
+
+		FailoverPolicy:        fpolicy,
+		FailoverPreferredZone: pzone,
+		RegionFailover:        rf,
+		MaxFailoverLagBytes:   int64(maxlag) * 1024,
+
+		FailoverHistoryKeepDays:  hdays,
+		FailoverHistoryKeepCount: hcount,
+		FailoverHistoryArchive:   harchive,
 	}
 	out, err := json.Marshal(appConfig)
 	if err != nil {
@@ -25,6 +25,20 @@ var AppModCommand = cli.Command{
 		cli.StringFlag{"R,regions", "", "Regions"},
 		cli.IntFlag{"k,migratekey", -1, "MigrateKeysEachTime"},
 		cli.IntFlag{"t,migratetimeout", -1, "MigrateTimeout"},
+		cli.IntFlag{"b,migratebatch", -1, "MigrateBatchSize"},
+		cli.IntFlag{"c,migrateconcurrency", -1, "MigrateConcurrency"},
+		cli.IntFlag{"throttleops", -1, "MigrateThrottleOpsPerSec, 0 to disable"},
+		cli.IntFlag{"throttlemem", -1, "MigrateThrottleUsedMemory in MB, 0 to disable"},
+		cli.IntFlag{"throttlelatency", -1, "MigrateThrottleLatencyUs, 0 to disable"},
+		cli.IntFlag{"largekey", -1, "MigrateLargeKeyBytes in MB"},
+		cli.StringFlag{"failoverpolicy", "", "FailoverPolicy, maxoffset|zone|leastloaded|priority"},
+		cli.StringFlag{"regionfailover", "", "RegionFailover <true> or <false>"},
+		cli.StringFlag{"preferredzone", "", "FailoverPreferredZone, zone or zone:room"},
+		cli.IntFlag{"largekeyretries", -1, "MigrateLargeKeyRetries"},
+		cli.IntFlag{"maxfailoverlag", -1, "MaxFailoverLagBytes in KB, 0 to disable"},
+		cli.IntFlag{"historydays", -1, "FailoverHistoryKeepDays"},
+		cli.IntFlag{"historycount", -1, "FailoverHistoryKeepCount"},
+		cli.StringFlag{"historyarchive", "", "FailoverHistoryArchive <true> or <false>"},
 	},
 	Description: `
     update app configuraton in zookeeper
@@ -44,6 +58,20 @@ func appModAction(c *cli.Context) {
 	R := c.String("R")
 	k := c.Int("k")
 	t := c.Int("t")
+	b := c.Int("b")
+	cc := c.Int("c")
+	tops := c.Int("throttleops")
+	tmem := c.Int("throttlemem")
+	tlat := c.Int("throttlelatency")
+	lkey := c.Int("largekey")
+	lretries := c.Int("largekeyretries")
+	fpolicy := c.String("failoverpolicy")
+	pzone := c.String("preferredzone")
+	rf := c.String("regionfailover")
+	maxlag := c.Int("maxfailoverlag")
+	hdays := c.Int("historydays")
+	hcount := c.Int("historycount")
+	harchive := c.String("historyarchive")
 
 	appConfig := meta.AppConfig{}
 	config, version, err := context.GetApp(appname)
@@ -93,6 +121,56 @@ func appModAction(c *cli.Context) {
 	if t != -1 {
 		appConfig.MigrateTimeout = t
 	}
+	if b != -1 {
+		appConfig.MigrateBatchSize = b
+	}
+	if cc != -1 {
+		appConfig.MigrateConcurrency = cc
+	}
+	if tops != -1 {
+		appConfig.MigrateThrottleOpsPerSec = tops
+	}
+	if tmem != -1 {
+		appConfig.MigrateThrottleUsedMemory = int64(tmem) * 1024 * 1024
+	}
+	if tlat != -1 {
+		appConfig.MigrateThrottleLatencyUs = tlat
+	}
+	if lkey != -1 {
+		appConfig.MigrateLargeKeyBytes = int64(lkey) * 1024 * 1024
+	}
+	if lretries != -1 {
+		appConfig.MigrateLargeKeyRetries = lretries
+	}
+	if fpolicy != "" {
+		appConfig.FailoverPolicy = fpolicy
+	}
+	if pzone != "" {
+		appConfig.FailoverPreferredZone = pzone
+	}
+	if maxlag != -1 {
+		appConfig.MaxFailoverLagBytes = int64(maxlag) * 1024
+	}
+	if hdays != -1 {
+		appConfig.FailoverHistoryKeepDays = hdays
+	}
+	if hcount != -1 {
+		appConfig.FailoverHistoryKeepCount = hcount
+	}
+	if harchive != "" {
+		if harchive == "true" {
+			appConfig.FailoverHistoryArchive = true
+		} else if harchive == "false" {
+			appConfig.FailoverHistoryArchive = false
+		}
+	}
+	if rf != "" {
+		if rf == "true" {
+			appConfig.RegionFailover = true
+		} else if rf == "false" {
+			appConfig.RegionFailover = false
+		}
+	}
 
 	out, err := json.Marshal(appConfig)
 	if err != nil {
@@ -0,0 +1,118 @@
+package command
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/ksarch-saas/cc/cli/context"
+	"github.com/ksarch-saas/cc/controller/command"
+	"github.com/ksarch-saas/cc/frontend/api"
+	"github.com/ksarch-saas/cc/utils"
+)
+
+var BudgetCommand = cli.Command{
+	Name:   "budget",
+	Usage:  "budget [reset [bucket]|[--app n] [--host n] [--global n] set]",
+	Action: budgetAction,
+	Flags: []cli.Flag{
+		cli.IntFlag{"app", -1, "max failovers per hour per app, 0 to disable"},
+		cli.IntFlag{"host", -1, "max failovers per hour per host, 0 to disable"},
+		cli.IntFlag{"global", -1, "max failovers per hour globally, 0 to disable"},
+	},
+	Description: `
+    failover budget shared by all apps, limit auto failovers per hour by token buckets
+    budget                                    show budget config and buckets
+    budget reset [bucket]                     reset a bucket (app_<appname>, host_<hostname> or global), or all buckets
+    budget [--app n] [--host n] [--global n] set  change budget config
+    `,
+}
+
+type BucketRow struct {
+	Name       string
+	Capacity   int
+	Tokens     string
+	UpdateTime string
+}
+
+func budgetAction(c *cli.Context) {
+	args := c.Args()
+	addr := context.GetLeaderAddr()
+	extraHeader := &utils.ExtraHeader{
+		User:  context.Config.User,
+		Role:  context.Config.Role,
+		Token: context.Config.Token,
+	}
+
+	switch {
+	case len(args) == 0:
+		result, err := fetchBudget(addr)
+		if err != nil {
+			Put(err)
+			return
+		}
+		Putf("Failover budget per hour: app %d, host %d, global %d (0 means no limit)\n",
+			result.Config.AppPerHour, result.Config.HostPerHour, result.Config.GlobalPerHour)
+		rows := []interface{}{}
+		for _, b := range result.Buckets {
+			rows = append(rows, &BucketRow{b.Name, b.Capacity,
+				fmt.Sprintf("%.2f", b.Tokens), b.UpdateTime.Format("2006-01-02 15:04:05")})
+		}
+		utils.PrintJsonArray("table", []string{"Name", "Capacity", "Tokens", "UpdateTime"}, rows)
+	case args[0] == "reset" && len(args) <= 2:
+		req := api.FailoverBudgetResetParams{}
+		if len(args) == 2 {
+			req.Bucket = args[1]
+		}
+		resp, err := utils.HttpPostExtra("http://"+addr+api.FailoverBudgetResetPath, req, 5*time.Second, extraHeader)
+		if err != nil {
+			Put(err)
+			return
+		}
+		ShowResponse(resp)
+	case args[0] == "set" && len(args) == 1:
+		result, err := fetchBudget(addr)
+		if err != nil {
+			Put(err)
+			return
+		}
+		req := api.FailoverBudgetSetParams{
+			AppPerHour:    result.Config.AppPerHour,
+			HostPerHour:   result.Config.HostPerHour,
+			GlobalPerHour: result.Config.GlobalPerHour,
+		}
+		if c.Int("app") != -1 {
+			req.AppPerHour = c.Int("app")
+		}
+		if c.Int("host") != -1 {
+			req.HostPerHour = c.Int("host")
+		}
+		if c.Int("global") != -1 {
+			req.GlobalPerHour = c.Int("global")
+		}
+		resp, err := utils.HttpPostExtra("http://"+addr+api.FailoverBudgetSetPath, req, 5*time.Second, extraHeader)
+		if err != nil {
+			Put(err)
+			return
+		}
+		ShowResponse(resp)
+	default:
+		Put(ErrInvalidParameter)
+	}
+}
+
+func fetchBudget(addr string) (*command.FailoverBudgetResult, error) {
+	resp, err := utils.HttpGet("http://"+addr+api.FailoverBudgetPath, nil, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Errno != 0 {
+		return nil, fmt.Errorf("%s", resp.Errmsg)
+	}
+	var result command.FailoverBudgetResult
+	err = utils.InterfaceToStruct(resp.Body, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
@@ -0,0 +1,52 @@
+package command
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/ksarch-saas/cc/cli/context"
+	"github.com/ksarch-saas/cc/frontend/api"
+	"github.com/ksarch-saas/cc/utils"
+)
+
+var DrainCommand = cli.Command{
+	Name:   "drain",
+	Usage:  "drain <masterId>",
+	Action: drainAction,
+	Description: `
+    migrate all slots of the replicaset to other masters,
+    then forget and reset all nodes of the replicaset
+    `,
+}
+
+func drainAction(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		fmt.Println(ErrInvalidParameter)
+		return
+	}
+	addr := context.GetLeaderAddr()
+	extraHeader := &utils.ExtraHeader{
+		User:  context.Config.User,
+		Role:  context.Config.Role,
+		Token: context.Config.Token,
+	}
+
+	url := "http://" + addr + api.DrainPath
+	nodeid, err := context.GetId(c.Args()[0])
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	req := api.DrainParams{
+		NodeId: nodeid,
+	}
+	resp, err := utils.HttpPostExtra(url, req, 5*time.Second, extraHeader)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	ShowResponse(resp)
+}
@@ -0,0 +1,137 @@
+package command
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/ksarch-saas/cc/cli/context"
+	"github.com/ksarch-saas/cc/meta"
+	"github.com/ksarch-saas/cc/topo"
+	"github.com/ksarch-saas/cc/utils"
+)
+
+const timeLayout = "2006-01-02 15:04:05"
+
+var FailoverHistoryCommand = cli.Command{
+	Name:   "failover-history",
+	Usage:  "failover-history [-d appname] [-r region] [-n nodeid] [--since t] [--until t] [--offset N] [--limit N] [-o table|json|csv]",
+	Action: failoverHistoryAction,
+	Flags: []cli.Flag{
+		cli.StringFlag{"d,appname", "", "only show records of the app"},
+		cli.StringFlag{"r,region", "", "only show records in the region"},
+		cli.StringFlag{"n,node", "", "only show records of the node, prefix of node id"},
+		cli.StringFlag{"since", "", "'2006-01-02 15:04:05' or duration before now, e.g. 24h"},
+		cli.StringFlag{"until", "", "'2006-01-02 15:04:05' or duration before now, e.g. 1h"},
+		cli.IntFlag{"offset", 0, "skip the latest N records"},
+		cli.IntFlag{"l,limit", 20, "show at most N records, 0 for all"},
+		cli.BoolFlag{"a,archived", "include archived records"},
+		cli.StringFlag{"o,output", "table", "output format, table|json|csv"},
+	},
+	Description: `
+    query failover history in zookeeper, newest first, and export as json or csv
+    `,
+}
+
+type FailoverRecordRow struct {
+	Time      string
+	AppName   string
+	Region    string
+	Role      string
+	NodeId    string
+	NodeAddr  string
+	Tag       string
+	Ranges    string
+	NewRegion string
+}
+
+func toFailoverRecordRow(r *meta.FailoverHistoryEntry) *FailoverRecordRow {
+	return &FailoverRecordRow{
+		Time:      r.Timestamp.Format(timeLayout),
+		AppName:   r.AppName,
+		Region:    r.Region,
+		Role:      r.Role,
+		NodeId:    r.NodeId,
+		NodeAddr:  r.NodeAddr,
+		Tag:       r.Tag,
+		Ranges:    topo.Ranges(r.Ranges).String(),
+		NewRegion: r.NewRegion,
+	}
+}
+
+// 绝对时间或距今的时长
+func parseTimeFlag(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.ParseInLocation(timeLayout, s, time.Local)
+}
+
+func failoverHistoryAction(c *cli.Context) {
+	since, err := parseTimeFlag(c.String("since"))
+	if err != nil {
+		Put(err)
+		return
+	}
+	until, err := parseTimeFlag(c.String("until"))
+	if err != nil {
+		Put(err)
+		return
+	}
+	q := &meta.FailoverHistoryQuery{
+		AppName:  c.String("d"),
+		Region:   c.String("r"),
+		NodeId:   c.String("n"),
+		Since:    since,
+		Until:    until,
+		Offset:   c.Int("offset"),
+		Limit:    c.Int("l"),
+		Archived: c.Bool("a"),
+	}
+	result, err := context.QueryFailoverHistory(q)
+	if err != nil {
+		Put(err)
+		return
+	}
+
+	switch c.String("o") {
+	case "json":
+		out, err := json.MarshalIndent(result.Records, "", "  ")
+		if err != nil {
+			Put(err)
+			return
+		}
+		fmt.Println(string(out))
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"Time", "AppName", "Region", "Role", "NodeId", "NodeAddr", "Tag", "Ranges", "NewRegion"})
+		for _, r := range result.Records {
+			row := toFailoverRecordRow(r)
+			w.Write([]string{row.Time, row.AppName, row.Region, row.Role, row.NodeId,
+				row.NodeAddr, row.Tag, row.Ranges, row.NewRegion})
+		}
+		w.Flush()
+	case "table":
+		if len(result.Records) == 0 {
+			Putf("No failover records, total %d.\n", result.Total)
+			return
+		}
+		var rows []interface{}
+		for _, r := range result.Records {
+			rows = append(rows, toFailoverRecordRow(r))
+		}
+		utils.PrintJsonArray("table",
+			[]string{"Time", "AppName", "Region", "Role", "NodeId", "NodeAddr", "Tag", "Ranges", "NewRegion"}, rows)
+		Putf("Showing %d-%d of %d failover record(s)\n", q.Offset+1, q.Offset+len(result.Records), result.Total)
+	default:
+		Put(ErrInvalidParameter, "output should be one of "+strings.Join([]string{"table", "json", "csv"}, "|"))
+	}
+}
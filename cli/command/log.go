@@ -11,51 +11,92 @@ import (
 
 	"github.com/ksarch-saas/cc/cli/context"
 	"github.com/ksarch-saas/cc/frontend/api"
+	"github.com/ksarch-saas/cc/log"
 	"github.com/ksarch-saas/cc/streams"
 	"github.com/ksarch-saas/cc/utils"
 )
 
 var LogCommand = cli.Command{
 	Name:   "log",
-	Usage:  "log [<num>], same as 'tail -n' or 'tail -f'",
+	Usage:  "log [<num>] [--since t] [--until t] [--level L] [--node n] [--grep s]",
 	Action: logAction,
+	Flags: []cli.Flag{
+		cli.StringFlag{"since", "", "'2006-01-02 15:04:05' or duration before now, e.g. 1h"},
+		cli.StringFlag{"until", "", "'2006-01-02 15:04:05' or duration before now, e.g. 10m"},
+		cli.StringFlag{"l,level", "", "minimum level, VERBOSE|INFO|EVENT|WARNING|ERROR|FATAL"},
+		cli.StringFlag{"n,node", "", "only show logs whose target has the prefix, e.g. node address"},
+		cli.StringFlag{"g,grep", "", "only show logs containing the string"},
+	},
+	Description: `
+    with <num> or --since, query the last <num> logs in the log store of the leader, same as 'tail -n';
+    otherwise follow new logs, same as 'tail -f'
+    `,
 }
 
+const levels = "VERBOSE,INFO,EVENT,WARNING,ERROR,FATAL"
+
 func LevelGE(level, base string) bool {
-	const levels = "VERBOSE,INFO,EVENT,WARNING,ERROR,FATAL"
 	n := strings.Index(levels, level)
 	m := strings.Index(levels, strings.ToUpper(base))
 	return n >= m
 }
 
 func logAction(c *cli.Context) {
+	level := c.String("l")
+	if level != "" && !strings.Contains(","+levels+",", ","+strings.ToUpper(level)+",") {
+		Put("invalid level " + level)
+		return
+	}
+
 	// tail -n
-	if len(c.Args()) == 1 {
-		n, err := strconv.Atoi(c.Args()[0])
+	if len(c.Args()) > 0 || c.String("since") != "" || c.String("until") != "" {
+		n := 0
+		if len(c.Args()) > 0 {
+			var err error
+			n, err = strconv.Atoi(c.Args()[0])
+			if err != nil {
+				Put(err)
+				return
+			}
+		}
+		since, err := parseTimeFlag(c.String("since"))
 		if err != nil {
 			Put(err)
 			return
 		}
-		addr := context.GetLeaderAddr()
-		url := "http://" + addr + api.LogSlicePath
-		req := api.LogSliceParams{
-			Pos:   0,
-			Count: n,
+		until, err := parseTimeFlag(c.String("until"))
+		if err != nil {
+			Put(err)
+			return
+		}
+		req := api.LogQueryParams{
+			Level:    level,
+			Node:     c.String("n"),
+			Contains: c.String("g"),
+			Limit:    n,
 		}
+		if !since.IsZero() {
+			req.Since = since.Unix()
+		}
+		if !until.IsZero() {
+			req.Until = until.Unix()
+		}
+		addr := context.GetLeaderAddr()
+		url := "http://" + addr + api.LogQueryPath
 		resp, err := utils.HttpPost(url, req, 5*time.Second)
 		if err != nil {
 			Put(err)
 			return
 		}
 
-		var lines []string
-		err = utils.InterfaceToStruct(resp.Body, &lines)
+		var records []log.Record
+		err = utils.InterfaceToStruct(resp.Body, &records)
 		if err != nil {
 			Put(err)
 			return
 		}
-		for _, line := range lines {
-			Putf(line)
+		for _, r := range records {
+			Putf("%s", r.String())
 		}
 		return
 	}
@@ -70,10 +111,8 @@ func logAction(c *cli.Context) {
 		return
 	}
 
-	args := c.Args()
-	level := "VERBOSE"
-	if len(args) > 0 {
-		level = args[0]
+	if level == "" {
+		level = "VERBOSE"
 	}
 
 	var msg streams.LogStreamData
@@ -86,7 +125,8 @@ func logAction(c *cli.Context) {
 			Put("Couldn't receive msg " + err.Error())
 			break
 		}
-		if LevelGE(msg.Level, level) {
+		if LevelGE(msg.Level, level) && strings.HasPrefix(msg.Target, c.String("n")) &&
+			strings.Contains(msg.Message, c.String("g")) {
 			Putf("%s %s: [%s] - %s\n", msg.Level, msg.Time.Format("2006/01/02 15:04:05"), msg.Target, msg.Message)
 		}
 	}
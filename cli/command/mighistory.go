@@ -0,0 +1,94 @@
+package command
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/ksarch-saas/cc/cli/context"
+	"github.com/ksarch-saas/cc/frontend/api"
+	"github.com/ksarch-saas/cc/migrate"
+	"github.com/ksarch-saas/cc/utils"
+)
+
+var MigHistoryCommand = cli.Command{
+	Name:   "mighistory",
+	Usage:  "mighistory [--slot N] [--node id] [--limit N]",
+	Action: migHistoryAction,
+	Flags: []cli.Flag{
+		cli.IntFlag{"s,slot", -1, "only show records of the slot"},
+		cli.StringFlag{"n,node", "", "only show records with the node as source or target"},
+		cli.IntFlag{"l,limit", 100, "show the latest N records, 0 for all"},
+	},
+	Description: `
+    show slot migration history recorded by the cluster leader
+    `,
+}
+
+type MigRecordRow struct {
+	Time     string
+	Slot     int
+	Source   string
+	Target   string
+	Keys     int
+	Duration string
+	Error    string
+	Key      string
+}
+
+func migHistoryAction(c *cli.Context) {
+	slot := c.Int("s")
+	req := api.MigrateHistoryParams{
+		Limit: c.Int("l"),
+	}
+	if slot >= 0 {
+		req.Slot = &slot
+	}
+	if c.String("n") != "" {
+		nodeid, err := context.GetId(c.String("n"))
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		req.NodeId = nodeid
+	}
+
+	addr := context.GetLeaderAddr()
+	url := "http://" + addr + api.MigrateHistoryPath
+	resp, err := utils.HttpPost(url, req, 5*time.Second)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if resp.Errno != 0 {
+		ShowResponse(resp)
+		return
+	}
+	var records []*migrate.MigrateRecord
+	err = utils.InterfaceToStruct(resp.Body, &records)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if len(records) == 0 {
+		fmt.Println("No migration records.")
+		return
+	}
+
+	var rows []interface{}
+	for _, r := range records {
+		rows = append(rows, &MigRecordRow{
+			Time:     r.StartTime.Format("2006/01/02 15:04:05"),
+			Slot:     r.Slot,
+			Source:   r.SourceId[:6],
+			Target:   r.TargetId[:6],
+			Keys:     r.Keys,
+			Duration: r.Duration.String(),
+			Error:    r.Error,
+			Key:      r.FailedKey,
+		})
+	}
+	utils.PrintJsonArray("table",
+		[]string{"Time", "Slot", "Source", "Target", "Keys", "Duration", "Error", "Key"}, rows)
+}
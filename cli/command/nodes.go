@@ -5,13 +5,78 @@ import (
 	"sort"
 	"time"
 
+	"github.com/codegangsta/cli"
+
 	"github.com/ksarch-saas/cc/cli/context"
 	"github.com/ksarch-saas/cc/controller/command"
 	"github.com/ksarch-saas/cc/frontend/api"
+	"github.com/ksarch-saas/cc/fsm"
 	"github.com/ksarch-saas/cc/topo"
 	"github.com/ksarch-saas/cc/utils"
 )
 
+var NodesCommand = cli.Command{
+	Name:   "nodes",
+	Usage:  "nodes [--history <id>]",
+	Action: nodesAction,
+	Flags: []cli.Flag{
+		cli.StringFlag{"history", "", "show state transition timeline of the node"},
+	},
+	Description: `
+    show the nodes info group by replicaset, same as 'show nodes',
+    with --history, show recent state transitions of the node
+    `,
+}
+
+func nodesAction(c *cli.Context) {
+	if c.String("history") != "" {
+		showNodeHistory(c.String("history"))
+		return
+	}
+	showNodes("table")
+}
+
+func showNodeHistory(id string) {
+	nodeid, err := context.GetId(id)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	addr := context.GetLeaderAddr()
+	url := "http://" + addr + api.NodeHistoryPath
+	req := api.NodeHistoryParams{
+		NodeId: nodeid,
+	}
+	resp, err := utils.HttpPost(url, req, 5*time.Second)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if resp.Errno != 0 {
+		ShowResponse(resp)
+		return
+	}
+	var records []fsm.TransitionRecord
+	err = utils.InterfaceToStruct(resp.Body, &records)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if len(records) == 0 {
+		fmt.Println("No state transitions.")
+		return
+	}
+	// 时间线，每行一次状态转换，并标出在前一个状态停留的时间
+	for i, r := range records {
+		stay := ""
+		if i > 0 {
+			stay = fmt.Sprintf("(after %v)", r.Time.Sub(records[i-1].Time)/time.Second*time.Second)
+		}
+		fmt.Printf("%s  %-20s -> %-20s input:%s priority:%d %s\n",
+			r.Time.Format("2006/01/02 15:04:05"), r.From, r.To, r.Input, r.Priority, stay)
+	}
+}
+
 /// Show Nodes
 
 type RNode struct {
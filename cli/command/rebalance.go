@@ -2,25 +2,77 @@ package command
 
 import (
 	"fmt"
+	"io"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/codegangsta/cli"
+	"golang.org/x/net/websocket"
+
 	"github.com/ksarch-saas/cc/cli/context"
 	"github.com/ksarch-saas/cc/frontend/api"
+	"github.com/ksarch-saas/cc/migrate"
+	"github.com/ksarch-saas/cc/topo"
 	"github.com/ksarch-saas/cc/utils"
 )
 
 var RebalanceCommand = cli.Command{
 	Name:   "rebalance",
-	Usage:  "rebalance",
+	Usage:  "rebalance [-m method] [-w id=weight,...] [--dry-run] | rebalance status | rebalance cancel",
 	Action: rebalanceAction,
+	Flags: []cli.Flag{
+		cli.StringFlag{"m,method", "default", "rebalance method, default|cuttail|weighted|keys"},
+		cli.StringFlag{"w,weights", "", "weights of masters for weighted method, id1=w1,id2=w2"},
+		cli.BoolFlag{"dry-run", "only show the plans and slot distribution, do not migrate"},
+	},
+	Description: `
+    rebalance slots between masters, weighted method uses weights from -w,
+    then the weight attribute in node tag (region:zone:room:weight=N), default 1.
+    keys method balances keys (or estimated bytes) of masters instead of slots,
+    with the same weights, keys are counted in sampled slots of each master.
+    'rebalance status' shows the progress of current rebalance task until it ends
+    'rebalance cancel' stops the current rebalance task, running migrations stop after the current slot
+    `,
+}
+
+func parseWeights(s string) (map[string]int, error) {
+	weights := map[string]int{}
+	if s == "" {
+		return weights, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		xs := strings.Split(kv, "=")
+		if len(xs) != 2 {
+			return nil, fmt.Errorf("invalid weight %s", kv)
+		}
+		w, err := strconv.Atoi(xs[1])
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("invalid weight %s", kv)
+		}
+		weights[xs[0]] = w
+	}
+	return weights, nil
 }
 
 func rebalanceAction(c *cli.Context) {
+	if len(c.Args()) == 1 && c.Args()[0] == "status" {
+		rebalanceStatus()
+		return
+	}
+	if len(c.Args()) == 1 && c.Args()[0] == "cancel" {
+		rebalanceCancel()
+		return
+	}
 	if len(c.Args()) != 0 {
 		fmt.Println(ErrInvalidParameter)
 		return
 	}
+	weights, err := parseWeights(c.String("w"))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 	addr := context.GetLeaderAddr()
 
 	extraHeader := &utils.ExtraHeader{
@@ -32,13 +84,148 @@ func rebalanceAction(c *cli.Context) {
 	url := "http://" + addr + api.RebalancePath
 
 	req := api.RebalanceParams{
-		Method:       "default",
+		Method:       c.String("m"),
+		Weights:      weights,
 		ShowPlanOnly: false,
+		DryRun:       c.Bool("dry-run"),
 	}
 	resp, err := utils.HttpPostExtra(url, req, 5*time.Second, extraHeader)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
+	if req.DryRun && resp.Errno == 0 {
+		showPlansPreview(resp)
+		return
+	}
+	ShowResponse(resp)
+}
+
+type PlanRow struct {
+	Source string
+	Target string
+	Slots  int
+	Keys   int
+	Ranges string
+}
+
+type DistributionRow struct {
+	Id     string
+	Before int
+	After  int
+}
+
+func showPlansPreview(resp *api.Response) {
+	var preview migrate.PlansPreview
+	err := utils.InterfaceToStruct(resp.Body, &preview)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if len(preview.Plans) == 0 {
+		fmt.Println("Nothing to migrate.")
+		return
+	}
+
+	var plans []interface{}
+	for _, p := range preview.Plans {
+		plans = append(plans, &PlanRow{p.SourceId, p.TargetId, p.NumSlots, p.NumKeys, topo.Ranges(p.Ranges).String()})
+	}
+	utils.PrintJsonArray("table", []string{"Source", "Target", "Slots", "Keys", "Ranges"}, plans)
+
+	var dist []interface{}
+	for _, d := range preview.Distribution {
+		dist = append(dist, &DistributionRow{d.Id, d.Before, d.After})
+	}
+	utils.PrintJsonArray("table", []string{"Id", "Before", "After"}, dist)
+}
+
+func rebalanceProgress(rbtask *migrate.RebalanceTask) string {
+	width := 40
+	ratio := 0.0
+	if rbtask.TotalSlots > 0 {
+		ratio = float64(rbtask.DoneSlots) / float64(rbtask.TotalSlots)
+	}
+	n := int(ratio * float64(width))
+	bar := strings.Repeat("=", n) + strings.Repeat(" ", width-n)
+	eta := "-"
+	if rbtask.EndTime != nil {
+		eta = "done"
+	} else if rbtask.ETA != nil {
+		left := rbtask.ETA.Sub(time.Now())
+		if left < 0 {
+			left = 0
+		}
+		eta = (left / time.Second * time.Second).String()
+	}
+	return fmt.Sprintf("[%s] %5.1f%% %d/%d slots, %d keys, %.0f keys/s, ETA %s",
+		bar, ratio*100, rbtask.DoneSlots, rbtask.TotalSlots, rbtask.KeysMoved, rbtask.Throughput, eta)
+}
+
+func rebalanceStatus() {
+	addr := context.GetLeaderAddr()
+	url := "http://" + addr + api.RebalanceStatusPath
+	resp, err := utils.HttpGet(url, nil, 5*time.Second)
+	if err != nil {
+		Put(err)
+		return
+	}
+	if resp.Errno != 0 {
+		ShowResponse(resp)
+		return
+	}
+	var rbtask migrate.RebalanceTask
+	err = utils.InterfaceToStruct(resp.Body, &rbtask)
+	if err != nil {
+		Put(err)
+		return
+	}
+	Putf("\r%s", rebalanceProgress(&rbtask))
+	if rbtask.EndTime != nil {
+		Put()
+		return
+	}
+
+	// 订阅RebalanceStateStream，实时刷新进度条直到任务结束
+	wsAddr := context.GetLeaderWebSocketAddr()
+	wsUrl := "ws://" + wsAddr + "/rebalance/state"
+	conn, err := websocket.Dial(wsUrl, "", wsUrl)
+	if err != nil {
+		Put()
+		Put(err)
+		return
+	}
+	defer conn.Close()
+	for {
+		var rbtask migrate.RebalanceTask
+		err := websocket.JSON.Receive(conn, &rbtask)
+		if err != nil {
+			Put()
+			if err != io.EOF {
+				Put("Couldn't receive msg " + err.Error())
+			}
+			return
+		}
+		Putf("\r%s", rebalanceProgress(&rbtask))
+		if rbtask.EndTime != nil {
+			Put()
+			return
+		}
+	}
+}
+
+func rebalanceCancel() {
+	addr := context.GetLeaderAddr()
+	extraHeader := &utils.ExtraHeader{
+		User:  context.Config.User,
+		Role:  context.Config.Role,
+		Token: context.Config.Token,
+	}
+	url := "http://" + addr + api.RebalanceCancelPath
+	resp, err := utils.HttpPostExtra(url, struct{}{}, 5*time.Second, extraHeader)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 	ShowResponse(resp)
 }
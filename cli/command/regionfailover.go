@@ -0,0 +1,132 @@
+package command
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/ksarch-saas/cc/cli/context"
+	"github.com/ksarch-saas/cc/frontend/api"
+	"github.com/ksarch-saas/cc/meta"
+	"github.com/ksarch-saas/cc/utils"
+)
+
+const regionFailoverUsage = "regionfailover -d <appname> <propose <newRegion>|vote|confirm <newRegion> <token>|status <newRegion>>"
+
+var RegionFailoverCommand = cli.Command{
+	Name:   "regionfailover",
+	Usage:  regionFailoverUsage,
+	Action: regionFailoverAction,
+	Flags: []cli.Flag{
+		cli.StringFlag{"d,appname", "", "appname"},
+	},
+	Description: `
+    failover all masters to another region when the whole master region is lost.
+    only works when RegionFailover is enabled in app config.
+    1. propose <newRegion>          create a proposal on region leader of newRegion, print the token
+    2. vote                         ask every region leader to vote, agree only if all masters in master region failed
+    3. confirm <newRegion> <token>  start promoting slaves in newRegion in background, needs majority votes,
+                                    MasterRegion is changed only if all replicasets are promoted
+    4. status <newRegion>           show progress and result of the region failover
+    commands are sent to region leaders directly, since there is no cluster leader when master region is lost
+    `,
+}
+
+type VoteRow struct {
+	Region string
+	Agree  bool
+	Reason string
+}
+
+func regionFailoverPost(addr, path string, req interface{}, timeout time.Duration) (*api.Response, error) {
+	extraHeader := &utils.ExtraHeader{
+		User:  context.Config.User,
+		Role:  context.Config.Role,
+		Token: context.Config.Token,
+	}
+	return utils.HttpPostExtra("http://"+addr+path, req, timeout, extraHeader)
+}
+
+func regionFailoverAction(c *cli.Context) {
+	appname := c.String("d")
+	args := c.Args()
+	if appname == "" || len(args) == 0 {
+		Put(ErrInvalidParameter, "usage: \n"+regionFailoverUsage)
+		return
+	}
+	leaders, err := context.GetRegionLeaderAddrs(appname)
+	if err != nil {
+		Put(err)
+		return
+	}
+
+	switch {
+	case args[0] == "propose" && len(args) == 2:
+		addr, ok := leaders[args[1]]
+		if !ok {
+			Putf("No controller found in region %s\n", args[1])
+			return
+		}
+		req := api.RegionFailoverParams{NewRegion: args[1]}
+		resp, err := regionFailoverPost(addr, api.RegionProposePath, req, 5*time.Second)
+		if err != nil {
+			Put(err)
+			return
+		}
+		ShowResponse(resp)
+	case args[0] == "vote" && len(args) == 1:
+		regions := []string{}
+		for region := range leaders {
+			regions = append(regions, region)
+		}
+		sort.Strings(regions)
+		var rows []interface{}
+		for _, region := range regions {
+			resp, err := regionFailoverPost(leaders[region], api.RegionVotePath, struct{}{}, 30*time.Second)
+			if err == nil && resp.Errno != 0 {
+				err = fmt.Errorf("%s", resp.Errmsg)
+			}
+			if err != nil {
+				rows = append(rows, &VoteRow{region, false, err.Error()})
+				continue
+			}
+			var vote meta.RegionFailoverVote
+			err = utils.InterfaceToStruct(resp.Body, &vote)
+			if err != nil {
+				rows = append(rows, &VoteRow{region, false, err.Error()})
+				continue
+			}
+			rows = append(rows, &VoteRow{vote.Region, vote.Agree, vote.Reason})
+		}
+		utils.PrintJsonArray("table", []string{"Region", "Agree", "Reason"}, rows)
+	case args[0] == "confirm" && len(args) == 3:
+		addr, ok := leaders[args[1]]
+		if !ok {
+			Putf("No controller found in region %s\n", args[1])
+			return
+		}
+		req := api.RegionFailoverParams{NewRegion: args[1], Token: args[2]}
+		resp, err := regionFailoverPost(addr, api.RegionConfirmPath, req, 15*time.Second)
+		if err != nil {
+			Put(err)
+			return
+		}
+		ShowResponse(resp)
+	case args[0] == "status" && len(args) == 2:
+		addr, ok := leaders[args[1]]
+		if !ok {
+			Putf("No controller found in region %s\n", args[1])
+			return
+		}
+		resp, err := utils.HttpGet("http://"+addr+api.RegionStatusPath, nil, 5*time.Second)
+		if err != nil {
+			Put(err)
+			return
+		}
+		ShowResponse(resp)
+	default:
+		Put(ErrInvalidParameter, "usage: \n"+regionFailoverUsage)
+	}
+}
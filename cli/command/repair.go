@@ -0,0 +1,65 @@
+package command
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/ksarch-saas/cc/cli/context"
+	"github.com/ksarch-saas/cc/frontend/api"
+	"github.com/ksarch-saas/cc/state"
+	"github.com/ksarch-saas/cc/utils"
+)
+
+var RepairsCommand = cli.Command{
+	Name:   "repairs",
+	Usage:  "repairs [-l N]",
+	Action: repairsAction,
+	Flags: []cli.Flag{
+		cli.IntFlag{"l,limit", 3, "show at most N reports"},
+	},
+	Description: `
+    show what was changed by the topology repair after recent failovers,
+    replication fixed, stale slots of the old master cleared and reads enabled
+    `,
+}
+
+func repairsAction(c *cli.Context) {
+	addr := context.GetLeaderAddr()
+	resp, err := utils.HttpGet("http://"+addr+api.FailoverRepairsPath, nil, 5*time.Second)
+	if err != nil {
+		Put(err)
+		return
+	}
+	if resp.Errno != 0 {
+		ShowResponse(resp)
+		return
+	}
+	var reports []*state.RepairReport
+	err = utils.InterfaceToStruct(resp.Body, &reports)
+	if err != nil {
+		Put(err)
+		return
+	}
+	if len(reports) == 0 {
+		Put("No repair after failover.")
+		return
+	}
+	if n := c.Int("l"); n > 0 && n < len(reports) {
+		reports = reports[:n]
+	}
+	for _, r := range reports {
+		Putf("%s  old master %s, new master %s, %d changes, took %v\n",
+			r.StartTime.Format(timeLayout), r.OldMasterId, r.NewMasterId,
+			r.NumChanged(), r.EndTime.Sub(r.StartTime))
+		if len(r.Actions) == 0 {
+			continue
+		}
+		var rows []interface{}
+		for _, a := range r.Actions {
+			rows = append(rows, a)
+		}
+		utils.PrintJsonArray("table", []string{"NodeId", "Addr", "Action", "Detail", "Error"}, rows)
+		fmt.Println()
+	}
+}
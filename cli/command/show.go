@@ -36,8 +36,14 @@ func showMigrationTasks() {
 	}
 
 	for _, plan := range res.Plans {
-		Putf("[%s:%d] %s->%s %v\n",
-			plan.State, plan.CurrSlot, plan.SourceId, plan.TargetId, plan.Ranges)
+		Putf("[%s:%d] %s->%s %v throttle:%d\n",
+			plan.State, plan.CurrSlot, plan.SourceId, plan.TargetId, plan.Ranges, plan.ThrottleLevel)
+		if plan.BlockedKey != "" {
+			Putf("  blocked on key: %s\n", plan.BlockedKey)
+		}
+		if len(plan.SkippedKeys) > 0 {
+			Putf("  skipped keys: %v, slots left migrating: %v\n", plan.SkippedKeys, plan.SkippedSlots)
+		}
 	}
 }
 
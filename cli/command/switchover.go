@@ -0,0 +1,54 @@
+package command
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/ksarch-saas/cc/cli/context"
+	"github.com/ksarch-saas/cc/frontend/api"
+	"github.com/ksarch-saas/cc/utils"
+)
+
+var SwitchoverCommand = cli.Command{
+	Name:   "switchover",
+	Usage:  "switchover <slaveId>",
+	Action: switchoverAction,
+	Description: `
+    planned switchover without data loss, disable writes of the master,
+    wait for the slave catching up, then promote the slave with CLUSTER FAILOVER.
+    writes of the master are enabled again if anything fails.
+    the switchover runs in background, check the result in log or failover history
+    `,
+}
+
+func switchoverAction(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		fmt.Println(ErrInvalidParameter)
+		return
+	}
+	addr := context.GetLeaderAddr()
+
+	extraHeader := &utils.ExtraHeader{
+		User:  context.Config.User,
+		Role:  context.Config.Role,
+		Token: context.Config.Token,
+	}
+
+	url := "http://" + addr + api.SwitchoverPath
+	nodeid, err := context.GetId(c.Args()[0])
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	req := api.SwitchoverParams{
+		NodeId: nodeid,
+	}
+	resp, err := utils.HttpPostExtra(url, req, 10*time.Second, extraHeader)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	ShowResponse(resp)
+}
@@ -10,13 +10,18 @@ import (
 	"github.com/ksarch-saas/cc/utils"
 )
 
-const taskCommandUsage = "task <pause|resume|cancel> <sourceId>"
+const taskCommandUsage = "task <pause|resume|cancel|skip|retry|force> <sourceId>"
 
 // Task actions
 var TaskCommand = cli.Command{
 	Name:   "task",
 	Usage:  taskCommandUsage,
 	Action: taskAction,
+	Description: `
+    skip, retry and force handle the task blocked on a large key:
+    skip leaves the key in source node, the slot stays in migrating state if only skipped keys remain,
+    retry migrates the key again, force migrates the key with a much longer timeout
+    `,
 }
 
 func doTaskAction(path, sourceId string) {
@@ -43,6 +48,31 @@ func doTaskAction(path, sourceId string) {
 	ShowResponse(resp)
 }
 
+func doKeyAction(action, sourceId string) {
+	addr := context.GetLeaderAddr()
+	url := "http://" + addr + api.MigrateKeyActionPath
+	nodeid, err := context.GetId(sourceId)
+	if err != nil {
+		Put(err)
+		return
+	}
+	req := api.MigrateKeyActionParams{
+		SourceId: nodeid,
+		Action:   action,
+	}
+	extraHeader := &utils.ExtraHeader{
+		User:  context.Config.User,
+		Role:  context.Config.Role,
+		Token: context.Config.Token,
+	}
+	resp, err := utils.HttpPostExtra(url, req, 5*time.Second, extraHeader)
+	if err != nil {
+		Put(err)
+		return
+	}
+	ShowResponse(resp)
+}
+
 func taskAction(c *cli.Context) {
 	if len(c.Args()) != 2 {
 		Put(ErrInvalidParameter)
@@ -58,6 +88,8 @@ func taskAction(c *cli.Context) {
 		doTaskAction(api.MigrateResumePath, sourceId)
 	case "cancel":
 		doTaskAction(api.MigrateCancelPath, sourceId)
+	case "skip", "retry", "force":
+		doKeyAction(action, sourceId)
 	default:
 		Put(ErrInvalidParameter, "usage: \n"+taskCommandUsage)
 	}
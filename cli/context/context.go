@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -166,6 +167,19 @@ func GetFailoverRecord(record string) (string, int32, error) {
 	return string(config), stat.Version, nil
 }
 
+func QueryFailoverHistory(q *meta.FailoverHistoryQuery) (*meta.FailoverHistoryResult, error) {
+	zconn, _, err := meta.DialZk(ZkAddr)
+	defer func() {
+		if zconn != nil {
+			zconn.Close()
+		}
+	}()
+	if err != nil {
+		return nil, fmt.Errorf("zk: can't connect: %v", err)
+	}
+	return meta.QueryFailoverHistory(zconn, q)
+}
+
 func ListApp() ([]string, error) {
 	zconn, _, err := meta.DialZk(ZkAddr)
 	defer func() {
@@ -254,6 +268,52 @@ func DelApp(appName string, version int32) error {
 	return nil
 }
 
+// 各地域的Region Leader地址，与Controller选举规则相同，取每个地域中序号最小的Controller
+func GetRegionLeaderAddrs(appName string) (map[string]string, error) {
+	zconn, _, err := meta.DialZk(ZkAddr)
+	defer func() {
+		if zconn != nil {
+			zconn.Close()
+		}
+	}()
+	if err != nil {
+		return nil, fmt.Errorf("zk: can't connect: %v", err)
+	}
+	zkPath := "/r3/app/" + appName + "/controller"
+	children, _, err := zconn.Children(zkPath)
+	if err != nil {
+		return nil, fmt.Errorf("zk: call children failed %v", err)
+	}
+	minSeqs := map[string]int{}
+	leaders := map[string]string{}
+	for _, child := range children {
+		xs := strings.Split(child, "_")
+		if len(xs) != 3 {
+			continue
+		}
+		seq, err := strconv.Atoi(xs[2])
+		if err != nil {
+			continue
+		}
+		region := xs[1]
+		if minSeq, ok := minSeqs[region]; ok && seq >= minSeq {
+			continue
+		}
+		data, _, err := zconn.Get(zkPath + "/" + child)
+		if err != nil {
+			continue
+		}
+		var cc meta.ControllerConfig
+		err = json.Unmarshal(data, &cc)
+		if err != nil {
+			continue
+		}
+		minSeqs[region] = seq
+		leaders[region] = fmt.Sprintf("%s:%d", cc.Ip, cc.HttpPort)
+	}
+	return leaders, nil
+}
+
 func GetLeaderAddr() string {
 	return fmt.Sprintf("%s:%d", controllerConfig.Ip, controllerConfig.HttpPort)
 }
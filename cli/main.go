@@ -18,13 +18,19 @@ var cmds = []cli.Command{
 	c.ChmodCommand,
 	c.FailoverCommand,
 	c.TakeoverCommand,
+	c.SwitchoverCommand,
+	c.BudgetCommand,
+	c.RepairsCommand,
 	c.MigrateCommand,
 	c.ReplicateCommand,
 	c.RebalanceCommand,
+	c.DrainCommand,
+	c.MigHistoryCommand,
 	c.MeetCommand,
 	c.ForgetAndResetCommand,
 	c.AppInfoCommand,
 	c.ShowCommand,
+	c.NodesCommand,
 	c.LogCommand,
 	c.AppDelCommand,
 	c.AppModCommand,
@@ -84,6 +90,8 @@ func main() {
 			c.UserGetCommand,
 			c.ListFailoverRecordCommand,
 			c.GetFailoverRecordCommand,
+			c.FailoverHistoryCommand,
+			c.RegionFailoverCommand,
 		}
 		arg := append(os.Args)
 		for _, cmd := range app.Commands {
@@ -105,6 +113,7 @@ func main() {
         cli userdel -u <username>, -h  for more details
         cli listfailover, -h for more details
         cli getfailover, -h for more details
+        cli regionfailover -d <AppName> <propose|vote|confirm>, -h for more details
         cli <AppName> [<Command>] [options], -h for more details
         `
 		fmt.Println(help)
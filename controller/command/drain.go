@@ -0,0 +1,103 @@
+package command
+
+import (
+	"time"
+
+	cc "github.com/ksarch-saas/cc/controller"
+	"github.com/ksarch-saas/cc/log"
+	"github.com/ksarch-saas/cc/migrate"
+	"github.com/ksarch-saas/cc/topo"
+)
+
+const (
+	// 迁移结束后等待拓扑中该分片的slots清空的最长时间
+	DRAIN_EMPTY_TIMEOUT = 2 * time.Minute
+)
+
+type DrainCommand struct {
+	NodeId string
+}
+
+// 缩容：将分片的slots迁到其余Master上，迁移结束后Forget并Reset该分片的所有节点
+func (self *DrainCommand) Execute(c *cc.Controller) (cc.Result, error) {
+	mm := c.MigrateManager
+	cs := c.ClusterState
+	cluster := cs.GetClusterSnapshot()
+	if cluster == nil {
+		return nil, ErrClusterSnapshotNotReady
+	}
+
+	master := cluster.FindNode(self.NodeId)
+	if master == nil {
+		return nil, ErrNodeNotExist
+	}
+	if !master.IsMaster() {
+		return nil, ErrNodeNotMaster
+	}
+	rs := cluster.FindReplicaSetByNode(self.NodeId)
+	if rs == nil {
+		return nil, ErrNodeNotExist
+	}
+
+	plans, err := migrate.GenerateDrainPlan(cluster, self.NodeId, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// 没有slot时也创建任务，由checkDrain统一下线
+	err = mm.RunDrainTask(master.Id, plans, cluster)
+	if err != nil {
+		return nil, err
+	}
+	log.Eventf(master.Addr(), "Drain replicaset, %d migrate plans.", len(plans))
+
+	return plans, nil
+}
+
+// 在更新拓扑时检查迁移已经结束的缩容任务，分片的slots清空后Forget并Reset当前的所有成员。
+// 任务保存在ZK中，Leader切换后由新的Leader继续
+func checkDrain(c *cc.Controller, cluster *topo.Cluster) {
+	mm := c.MigrateManager
+	rbtask := mm.DrainTask()
+	if rbtask == nil {
+		return
+	}
+	masterId := rbtask.DrainId
+
+	// 期间可能发生过主从切换，按分片查找当前的主
+	rs := cluster.FindReplicaSetByNode(masterId)
+	if rs == nil {
+		log.Warningf(masterId, "Drain aborted, replicaset not found.")
+		mm.FinishDrainTask()
+		return
+	}
+	// 等待拓扑更新，确认slots已全部迁走，有计划被放弃时不会清空，放弃下线
+	master := rs.Master
+	if !master.Empty() {
+		if time.Since(*rbtask.EndTime) > DRAIN_EMPTY_TIMEOUT {
+			log.Warningf(master.Addr(), "Drain aborted, master still has slots %v.", master.Ranges)
+			mm.FinishDrainTask()
+		}
+		return
+	}
+
+	// 先下线从节点，最后下线主节点
+	nodeIds := []string{}
+	for _, node := range rs.Slaves {
+		nodeIds = append(nodeIds, node.Id)
+	}
+	nodeIds = append(nodeIds, master.Id)
+	for _, id := range nodeIds {
+		cmd := ForgetAndResetNodeCommand{
+			NodeId: id,
+		}
+		_, err := cmd.Execute(c)
+		if err != nil {
+			log.Warningf(id, "Drain aborted, forget and reset node failed, %v", err)
+			mm.FinishDrainTask()
+			return
+		}
+	}
+	mm.FinishDrainTask()
+	log.Eventf(masterId, "Drain replicaset done, %d nodes removed.", len(nodeIds))
+}
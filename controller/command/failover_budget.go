@@ -0,0 +1,55 @@
+package command
+
+import (
+	cc "github.com/ksarch-saas/cc/controller"
+	"github.com/ksarch-saas/cc/log"
+	"github.com/ksarch-saas/cc/meta"
+)
+
+/// Failover预算保存在ZK中，所有Controller共享，修改由Cluster Leader执行，与Failover串行
+
+type FailoverBudgetResult struct {
+	Config  *meta.FailoverBudgetConfig
+	Buckets []*meta.FailoverBucket
+}
+
+type FetchFailoverBudgetCommand struct{}
+
+func (self *FetchFailoverBudgetCommand) Execute(c *cc.Controller) (cc.Result, error) {
+	config, err := meta.GetFailoverBudgetConfig()
+	if err != nil {
+		return nil, err
+	}
+	buckets, err := meta.FailoverBuckets()
+	if err != nil {
+		return nil, err
+	}
+	return &FailoverBudgetResult{config, buckets}, nil
+}
+
+type ResetFailoverBudgetCommand struct {
+	Bucket string // 为空时重置所有
+}
+
+func (self *ResetFailoverBudgetCommand) Execute(c *cc.Controller) (cc.Result, error) {
+	err := meta.ResetFailoverBudget(self.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	log.Eventf("CLUSTER", "Failover budget reset, bucket: %q", self.Bucket)
+	return nil, nil
+}
+
+type SetFailoverBudgetCommand struct {
+	Config meta.FailoverBudgetConfig
+}
+
+func (self *SetFailoverBudgetCommand) Execute(c *cc.Controller) (cc.Result, error) {
+	err := meta.SetFailoverBudgetConfig(&self.Config)
+	if err != nil {
+		return nil, err
+	}
+	log.Eventf("CLUSTER", "Failover budget changed, app %d/h, host %d/h, global %d/h",
+		self.Config.AppPerHour, self.Config.HostPerHour, self.Config.GlobalPerHour)
+	return nil, nil
+}
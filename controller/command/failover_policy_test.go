@@ -0,0 +1,128 @@
+package command_test
+
+import (
+	"testing"
+
+	"github.com/ksarch-saas/cc/meta"
+	"github.com/ksarch-saas/cc/redis"
+	"github.com/ksarch-saas/cc/redis/fake"
+	"github.com/ksarch-saas/cc/state"
+)
+
+/// Failover策略的选择顺序，state包的测试文件已过时无法编译，放在这里
+/// m1挂掉，候选的从节点(都在bj)：
+///   a  10.0.0.2  z1:r1 priority=2  offset 100
+///   b  10.0.0.3  z2:r1             offset 300
+///   c  10.0.0.4  z1:r1 priority=1  offset 200  机器上还有Master m3
+///   d  10.0.0.5  z1:r2 priority=1  offset 250  机器上还有Master m2
+/// m1最后一次看到的偏移量为400
+
+func setupPolicy(t *testing.T, app *meta.AppConfig) *state.ClusterState {
+	fc := fake.NewCluster("bj")
+	fc.AddMaster("m1", "10.0.0.1:7000", "bj:z1:r1", 0, 8191)
+	fc.AddMaster("m2", "10.0.0.5:7001", "bj:z9:r9", 8192, 12287)
+	fc.AddMaster("m3", "10.0.0.4:7001", "bj:z9:r9", 12288, 16383)
+	fc.AddSlave("a", "10.0.0.2:7000", "bj:z1:r1:priority=2", "m1")
+	fc.AddSlave("b", "10.0.0.3:7000", "bj:z2:r1", "m1")
+	fc.AddSlave("c", "10.0.0.4:7000", "bj:z1:r1:priority=1", "m1")
+	fc.AddSlave("d", "10.0.0.5:7000", "bj:z1:r2:priority=1", "m1")
+	for id, offset := range map[string]int64{"m1": 400, "a": 100, "b": 300, "c": 200, "d": 250} {
+		fc.SetOffset(id, offset)
+	}
+	redis.SetDialer(fc)
+
+	app.AppName = "test"
+	app.MasterRegion = "bj"
+	app.Regions = []string{"bj"}
+	meta.RunWithZk("test", "bj", meta.NewFakeZk(), app)
+
+	cs := state.NewClusterState()
+	cs.UpdateRegionNodes("bj", fc.Snapshot("bj"))
+	return cs
+}
+
+func candidates(cs *state.ClusterState, offsets map[string]int64) []*state.FailoverCandidate {
+	cands := []*state.FailoverCandidate{}
+	for _, id := range []string{"a", "b", "c", "d"} {
+		offset, ok := offsets[id]
+		if !ok {
+			continue
+		}
+		cands = append(cands, &state.FailoverCandidate{Node: cs.FindNode(id), Offset: offset, Lag: 400 - offset})
+	}
+	return cands
+}
+
+func TestFailoverPolicyChoose(t *testing.T) {
+	all := map[string]int64{"a": 100, "b": 300, "c": 200, "d": 250}
+	tests := []struct {
+		policy    string
+		preferred string // FailoverPreferredZone
+		offsets   map[string]int64
+		expect    string
+	}{
+		{"maxoffset", "", all, "b"},
+		// 未知策略使用maxoffset
+		{"unknown", "", all, "b"},
+		// 与旧主相同zone和room的a、c中选偏移量大的
+		{"zone", "", all, "c"},
+		{"zone", "", map[string]int64{"a": 100, "b": 300, "d": 250}, "a"},
+		// 同zone不同room优先于其他zone
+		{"zone", "", map[string]int64{"b": 300, "d": 250}, "d"},
+		{"zone", "z2", all, "b"},
+		{"zone", "z1:r2", all, "d"},
+		// 没有节点在指定的zone，按偏移量
+		{"zone", "z3", all, "b"},
+		// a、b所在机器上没有Master，选偏移量大的
+		{"leastloaded", "", all, "b"},
+		{"leastloaded", "", map[string]int64{"a": 100, "c": 200, "d": 250}, "a"},
+		{"leastloaded", "", map[string]int64{"c": 200, "d": 250}, "d"},
+		// 偏移量也相同时选先出现的
+		{"leastloaded", "", map[string]int64{"c": 250, "d": 250}, "c"},
+		// c、d的priority相同，选偏移量大的
+		{"priority", "", all, "d"},
+		{"priority", "", map[string]int64{"a": 100, "b": 300}, "a"},
+		// 都没有设置priority时按偏移量
+		{"priority", "", map[string]int64{"b": 300}, "b"},
+	}
+	defer redis.SetDialer(nil)
+	for i, test := range tests {
+		cs := setupPolicy(t, &meta.AppConfig{FailoverPreferredZone: test.preferred})
+		policy := state.GetFailoverPolicy(test.policy)
+		best, reason := policy.Choose(cs, cs.FindNode("m1"), candidates(cs, test.offsets))
+		if best.Node.Id != test.expect {
+			t.Errorf("case %d: %s(%s) expect %s, got %s, %s",
+				i, test.policy, test.preferred, test.expect, best.Node.Id, reason)
+		}
+	}
+}
+
+func TestChooseNewMasterWithinLag(t *testing.T) {
+	defer redis.SetDialer(nil)
+	tests := []struct {
+		policy string
+		maxLag int64
+		expect string
+	}{
+		{"zone", 0, "c"},
+		// 延迟相对m1最后的偏移量400计算，c落后200
+		{"zone", 150, "d"},
+		{"priority", 150, "d"},
+		{"zone", 100, "b"},
+		{"priority", 100, "b"},
+		// 都不满足时从所有节点中选择
+		{"zone", 50, "c"},
+	}
+	for i, test := range tests {
+		cs := setupPolicy(t, &meta.AppConfig{FailoverPolicy: test.policy, MaxFailoverLagBytes: test.maxLag})
+		id, err := cs.ChooseNewMaster("m1", "bj")
+		if err != nil || id != test.expect {
+			t.Errorf("case %d: %s with max lag %d expect %s, got %s, %v",
+				i, test.policy, test.maxLag, test.expect, id, err)
+		}
+		ok, reason := cs.CheckFailoverLag("m1", "bj")
+		if ok != (test.maxLag == 0 || test.maxLag >= 100) {
+			t.Errorf("case %d: unexpected lag check %v, %s", i, ok, reason)
+		}
+	}
+}
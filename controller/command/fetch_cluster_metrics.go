@@ -0,0 +1,67 @@
+package command
+
+import (
+	cc "github.com/ksarch-saas/cc/controller"
+	"github.com/ksarch-saas/cc/topo"
+)
+
+type FetchClusterMetricsCommand struct{}
+
+type NodeMetrics struct {
+	Id     string
+	Addr   string
+	Region string
+	Role   string
+	State  string
+	topo.SummaryInfo
+}
+
+type MigrateMetrics struct {
+	SourceId   string
+	TargetId   string
+	State      string
+	TotalSlots int
+	SlotsDone  int
+	KeysMoved  int64
+	KeysPerSec float64
+}
+
+type FetchClusterMetricsResult struct {
+	Nodes    []*NodeMetrics
+	Migrates []*MigrateMetrics
+}
+
+func (self *FetchClusterMetricsCommand) Execute(c *cc.Controller) (cc.Result, error) {
+	result := FetchClusterMetricsResult{
+		Nodes:    []*NodeMetrics{},
+		Migrates: []*MigrateMetrics{},
+	}
+	for _, ns := range c.ClusterState.AllNodeStates() {
+		n := ns.Node()
+		result.Nodes = append(result.Nodes, &NodeMetrics{
+			Id:          n.Id,
+			Addr:        n.Addr(),
+			Region:      n.Region,
+			Role:        n.Role,
+			State:       ns.CurrentState(),
+			SummaryInfo: n.SummaryInfo,
+		})
+	}
+	for _, t := range c.MigrateManager.AllTasks() {
+		plan := t.ToPlan()
+		total := 0
+		for _, r := range plan.Ranges {
+			total += r.NumSlots()
+		}
+		result.Migrates = append(result.Migrates, &MigrateMetrics{
+			SourceId:   plan.SourceId,
+			TargetId:   plan.TargetId,
+			State:      plan.State,
+			TotalSlots: total,
+			SlotsDone:  t.SlotsDone(),
+			KeysMoved:  t.KeysMoved(),
+			KeysPerSec: t.KeysPerSec(),
+		})
+	}
+	return result, nil
+}
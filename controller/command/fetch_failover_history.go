@@ -0,0 +1,19 @@
+package command
+
+import (
+	cc "github.com/ksarch-saas/cc/controller"
+	"github.com/ksarch-saas/cc/meta"
+)
+
+// Failover历史保存在ZK中，所有App共享，由Cluster Leader查询
+type FetchFailoverHistoryCommand struct {
+	Query meta.FailoverHistoryQuery
+}
+
+func (self *FetchFailoverHistoryCommand) Execute(c *cc.Controller) (cc.Result, error) {
+	result, err := meta.QueryFailoverRecords(&self.Query)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,20 @@
+package command
+
+import (
+	cc "github.com/ksarch-saas/cc/controller"
+	"github.com/ksarch-saas/cc/migrate"
+)
+
+type FetchMigrateHistoryCommand struct {
+	Slot   int // <0表示所有slot
+	NodeId string
+	Limit  int
+}
+
+func (self *FetchMigrateHistoryCommand) Execute(c *cc.Controller) (cc.Result, error) {
+	records, err := migrate.QueryMigrateRecords(self.Slot, self.NodeId, self.Limit)
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
@@ -0,0 +1,17 @@
+package command
+
+import (
+	cc "github.com/ksarch-saas/cc/controller"
+)
+
+type FetchNodeHistoryCommand struct {
+	NodeId string
+}
+
+func (self *FetchNodeHistoryCommand) Execute(c *cc.Controller) (cc.Result, error) {
+	records, err := c.ClusterState.NodeHistory(self.NodeId)
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
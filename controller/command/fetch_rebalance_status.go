@@ -0,0 +1,27 @@
+package command
+
+import (
+	cc "github.com/ksarch-saas/cc/controller"
+)
+
+type FetchRebalanceStatusCommand struct{}
+
+func (self *FetchRebalanceStatusCommand) Execute(c *cc.Controller) (cc.Result, error) {
+	mm := c.MigrateManager
+	rbtask, err := mm.RebalanceStatus()
+	if err != nil {
+		return nil, err
+	}
+	return *rbtask, nil
+}
+
+type CancelRebalanceCommand struct{}
+
+func (self *CancelRebalanceCommand) Execute(c *cc.Controller) (cc.Result, error) {
+	mm := c.MigrateManager
+	err := mm.CancelRebalanceTask()
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
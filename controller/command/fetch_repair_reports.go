@@ -0,0 +1,11 @@
+package command
+
+import (
+	cc "github.com/ksarch-saas/cc/controller"
+)
+
+type FetchRepairReportsCommand struct{}
+
+func (self *FetchRepairReportsCommand) Execute(c *cc.Controller) (cc.Result, error) {
+	return c.ClusterState.RepairReports(), nil
+}
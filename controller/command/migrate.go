@@ -2,6 +2,7 @@ package command
 
 import (
 	cc "github.com/ksarch-saas/cc/controller"
+	"github.com/ksarch-saas/cc/log"
 	"github.com/ksarch-saas/cc/migrate"
 	"github.com/ksarch-saas/cc/topo"
 )
@@ -10,11 +11,25 @@ type MigrateCommand struct {
 	SourceId string
 	TargetId string
 	Ranges   []topo.Range
+	DryRun   bool // 只返回计划的预览，不执行
 }
 
 func (self *MigrateCommand) Execute(c *cc.Controller) (cc.Result, error) {
 	cs := c.ClusterState
 	cluster := cs.GetClusterSnapshot()
+	if cluster != nil && self.DryRun {
+		if cluster.FindNode(self.SourceId) == nil || cluster.FindNode(self.TargetId) == nil {
+			return nil, ErrNodeNotExist
+		}
+		plans := []*migrate.MigratePlan{
+			&migrate.MigratePlan{
+				SourceId: self.SourceId,
+				TargetId: self.TargetId,
+				Ranges:   self.Ranges,
+			},
+		}
+		return migrate.PreviewPlans(plans, cluster), nil
+	}
 	if cluster != nil {
 		mm := c.MigrateManager
 		task, err := mm.CreateTask(self.SourceId, self.TargetId, self.Ranges, cluster)
@@ -72,3 +87,28 @@ func (self *MigrateCancelCommand) Execute(c *cc.Controller) (cc.Result, error) {
 	task.SetState(migrate.StateCancelling)
 	return nil, nil
 }
+
+type MigrateKeyActionCommand struct {
+	SourceId string
+	Action   string
+}
+
+// 处理挂起在大key上的任务，skip/retry/force
+func (self *MigrateKeyActionCommand) Execute(c *cc.Controller) (cc.Result, error) {
+	action, ok := migrate.KeyActions[self.Action]
+	if !ok {
+		return nil, migrate.ErrInvalidAction
+	}
+	mm := c.MigrateManager
+	task := mm.FindTaskBySource(self.SourceId)
+	if task == nil {
+		return nil, ErrMigrateTaskNotExist
+	}
+	key := task.BlockedKey()
+	err := task.ResolveBlockedKey(action)
+	if err != nil {
+		return nil, err
+	}
+	log.Eventf(task.TaskName(), "Resolve blocked key:%s with %s", key, self.Action)
+	return nil, nil
+}
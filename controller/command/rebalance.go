@@ -8,7 +8,9 @@ import (
 type RebalanceCommand struct {
 	Method       string
 	TargetIds    []string
+	Weights      map[string]int
 	ShowPlanOnly bool
+	DryRun       bool // 只返回计划的预览，不执行
 }
 
 // Rebalance任务同时只能有一个
@@ -21,11 +23,18 @@ func (self *RebalanceCommand) Execute(c *cc.Controller) (cc.Result, error) {
 		self.Method = "default"
 	}
 
-	plans, err := migrate.GenerateRebalancePlan(self.Method, cluster, self.TargetIds)
+	opts := &migrate.RebalanceOptions{
+		Weights: self.Weights,
+	}
+	plans, err := migrate.GenerateRebalancePlan(self.Method, cluster, self.TargetIds, opts)
 	if err != nil {
 		return nil, err
 	}
 
+	if self.DryRun {
+		return migrate.PreviewPlans(plans, cluster), nil
+	}
+
 	// 是否立即执行？
 	if !self.ShowPlanOnly && len(plans) > 0 {
 		err = mm.RunRebalanceTask(plans, cluster)
@@ -0,0 +1,352 @@
+package command
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	cc "github.com/ksarch-saas/cc/controller"
+	"github.com/ksarch-saas/cc/inspector"
+	"github.com/ksarch-saas/cc/log"
+	"github.com/ksarch-saas/cc/meta"
+	"github.com/ksarch-saas/cc/redis"
+	"github.com/ksarch-saas/cc/state"
+	"github.com/ksarch-saas/cc/topo"
+	"github.com/ksarch-saas/cc/utils/clock"
+)
+
+/// 地域级Failover，主地域整体故障时将所有分片的主切换到备地域:
+/// 1. propose 在新主地域的Region Leader上创建提议，生成确认Token
+/// 2. vote    各地域Region Leader根据本地域看到的拓扑投票，主地域的Master全部FAIL才同意
+/// 3. confirm 多数存活地域同意后，运维使用Token确认，在新主地域的Region Leader上后台执行:
+///            每个分片选一个新主地域的从节点Takeover，记录一条汇总的FailoverRecord，
+///            全部分片提升成功后修改ZK中的MasterRegion
+/// 4. status  查询后台任务的进度和结果
+/// 主地域故障时没有Cluster Leader，这些命令都由Region Leader执行
+
+const REGION_FAILOVER_PROPOSAL_TTL = 30 * time.Minute
+
+var (
+	ErrRegionFailoverDisabled = errors.New("region failover disabled, set RegionFailover in app config")
+	ErrInvalidNewRegion       = errors.New("invalid new master region")
+	ErrTokenMismatch          = errors.New("region failover token mismatch")
+	ErrProposalExpired        = errors.New("region failover proposal expired")
+	ErrNoRegionFailoverJob    = errors.New("no region failover job on this controller")
+)
+
+type RegionProposeCommand struct {
+	NewRegion string
+}
+
+func (self *RegionProposeCommand) Execute(c *cc.Controller) (cc.Result, error) {
+	app := meta.GetAppConfig()
+	if !app.RegionFailover {
+		return nil, ErrRegionFailoverDisabled
+	}
+	if self.NewRegion != meta.LocalRegion() || self.NewRegion == app.MasterRegion {
+		return nil, ErrInvalidNewRegion
+	}
+	buf := make([]byte, 8)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	proposal := &meta.RegionFailoverProposal{
+		DeadRegion: app.MasterRegion,
+		NewRegion:  self.NewRegion,
+		Token:      hex.EncodeToString(buf),
+		CreateTime: clock.Now(),
+	}
+	err = meta.SaveRegionFailoverProposal(proposal)
+	if err != nil {
+		return nil, err
+	}
+	log.Eventf("REGION", "Region failover proposed, %s -> %s", proposal.DeadRegion, proposal.NewRegion)
+	return proposal, nil
+}
+
+type RegionVoteCommand struct{}
+
+func (self *RegionVoteCommand) Execute(c *cc.Controller) (cc.Result, error) {
+	proposal, err := meta.GetRegionFailoverProposal()
+	if err != nil {
+		return nil, err
+	}
+	vote := &meta.RegionFailoverVote{
+		Region: meta.LocalRegion(),
+		Token:  proposal.Token,
+		Time:   clock.Now(),
+	}
+	if vote.Region == proposal.DeadRegion {
+		vote.Reason = "local region is the dead region"
+	} else {
+		cluster, _, err := inspector.NewInspector().BuildClusterTopo()
+		if cluster == nil {
+			vote.Reason = fmt.Sprintf("build cluster topo failed, %v", err)
+		} else {
+			vote.Agree, vote.Reason = regionDead(cluster, proposal.DeadRegion)
+		}
+	}
+	err = meta.VoteRegionFailover(vote)
+	if err != nil {
+		return nil, err
+	}
+	log.Eventf("REGION", "Vote for region failover %s -> %s, agree %v, %s",
+		proposal.DeadRegion, proposal.NewRegion, vote.Agree, vote.Reason)
+	return vote, nil
+}
+
+// 主地域中有slots的Master全部FAIL才认为主地域故障
+func regionDead(cluster *topo.Cluster, region string) (bool, string) {
+	n := 0
+	for _, node := range cluster.MasterNodes() {
+		if node.Region != region || node.Free || node.Empty() {
+			continue
+		}
+		if !node.Fail {
+			return false, fmt.Sprintf("master %s in %s is alive", node.Addr(), region)
+		}
+		n++
+	}
+	if n == 0 {
+		return false, fmt.Sprintf("no master found in %s", region)
+	}
+	return true, fmt.Sprintf("all %d masters in %s failed", n, region)
+}
+
+type RegionConfirmCommand struct {
+	Token string
+}
+
+type RegionFailoverResult struct {
+	Promoted map[string]string
+	Failed   map[string]string // 旧主ID -> 错误
+}
+
+const (
+	REGION_JOB_RUNNING = "running"
+	REGION_JOB_DONE    = "done"
+	REGION_JOB_PARTIAL = "partial" // 有分片提升失败，没有修改MasterRegion，可以再次confirm重试
+	REGION_JOB_FAILED  = "failed"
+)
+
+// 后台执行的地域级Failover，确认命令只做检查并启动，进度通过RegionStatusCommand查询
+type RegionFailoverJob struct {
+	DeadRegion string
+	NewRegion  string
+	State      string
+	Error      string `json:",omitempty"`
+	StartTime  time.Time
+	EndTime    *time.Time `json:",omitempty"`
+	RegionFailoverResult
+}
+
+var (
+	regionJobMutex sync.Mutex
+	regionJob      *RegionFailoverJob
+)
+
+func (job *RegionFailoverJob) copy() *RegionFailoverJob {
+	j := *job
+	j.Promoted = map[string]string{}
+	for k, v := range job.Promoted {
+		j.Promoted[k] = v
+	}
+	j.Failed = map[string]string{}
+	for k, v := range job.Failed {
+		j.Failed[k] = v
+	}
+	return &j
+}
+
+func updateRegionJob(fn func(job *RegionFailoverJob)) {
+	regionJobMutex.Lock()
+	defer regionJobMutex.Unlock()
+	fn(regionJob)
+}
+
+func (self *RegionConfirmCommand) Execute(c *cc.Controller) (cc.Result, error) {
+	app := meta.GetAppConfig()
+	if !app.RegionFailover {
+		return nil, ErrRegionFailoverDisabled
+	}
+	proposal, err := meta.GetRegionFailoverProposal()
+	if err != nil {
+		return nil, err
+	}
+	if proposal.Token != self.Token {
+		return nil, ErrTokenMismatch
+	}
+	if clock.Since(proposal.CreateTime) > REGION_FAILOVER_PROPOSAL_TTL {
+		return nil, ErrProposalExpired
+	}
+	if proposal.NewRegion != meta.LocalRegion() || proposal.DeadRegion != app.MasterRegion {
+		return nil, ErrInvalidNewRegion
+	}
+
+	// 多数存活地域同意
+	votes, err := meta.RegionFailoverVotes()
+	if err != nil {
+		return nil, err
+	}
+	agree := 0
+	for _, vote := range votes {
+		if vote.Token == proposal.Token && vote.Agree && vote.Region != proposal.DeadRegion {
+			agree++
+		}
+	}
+	quorum := (len(app.Regions)-1)/2 + 1
+	if agree < quorum {
+		return nil, fmt.Errorf("region failover needs %d agreed votes, got %d", quorum, agree)
+	}
+
+	regionJobMutex.Lock()
+	defer regionJobMutex.Unlock()
+	if regionJob != nil && regionJob.State == REGION_JOB_RUNNING {
+		return nil, fmt.Errorf("region failover %s -> %s is running", regionJob.DeadRegion, regionJob.NewRegion)
+	}
+	doing, err := meta.IsDoingFailover()
+	if err != nil {
+		return nil, err
+	}
+	if doing {
+		return nil, fmt.Errorf("another failover is doing")
+	}
+	record := &meta.FailoverRecord{
+		AppName:   meta.AppName(),
+		NodeId:    proposal.DeadRegion,
+		Timestamp: clock.Now(),
+		Region:    proposal.DeadRegion,
+		Role:      "region",
+		NewRegion: proposal.NewRegion,
+	}
+	err = meta.MarkFailoverDoing(record)
+	if err != nil {
+		return nil, err
+	}
+
+	// 逐个分片探测和Takeover可能很久，不占用命令锁
+	regionJob = &RegionFailoverJob{
+		DeadRegion: proposal.DeadRegion,
+		NewRegion:  proposal.NewRegion,
+		State:      REGION_JOB_RUNNING,
+		StartTime:  record.Timestamp,
+		RegionFailoverResult: RegionFailoverResult{
+			Promoted: map[string]string{},
+			Failed:   map[string]string{},
+		},
+	}
+	go runRegionFailover(proposal, record)
+	return regionJob.copy(), nil
+}
+
+func runRegionFailover(proposal *meta.RegionFailoverProposal, record *meta.FailoverRecord) {
+	defer meta.UnmarkFailoverDoing()
+	state, reason := regionFailover(proposal, record)
+	now := clock.Now()
+	updateRegionJob(func(job *RegionFailoverJob) {
+		job.State = state
+		job.Error = reason
+		job.EndTime = &now
+	})
+}
+
+// 返回任务的最终状态和失败原因
+func regionFailover(proposal *meta.RegionFailoverProposal, record *meta.FailoverRecord) (string, string) {
+	// 重新检查一次拓扑
+	cluster, _, err := inspector.NewInspector().BuildClusterTopo()
+	if cluster == nil {
+		log.Warningf("REGION", "Region failover aborted, build cluster topo failed, %v", err)
+		return REGION_JOB_FAILED, fmt.Sprintf("build cluster topo failed, %v", err)
+	}
+	dead, reason := regionDead(cluster, proposal.DeadRegion)
+	if !dead {
+		log.Warningf("REGION", "Region failover aborted, %s", reason)
+		return REGION_JOB_FAILED, fmt.Sprintf("region %s is not dead, %s", proposal.DeadRegion, reason)
+	}
+	log.Eventf("REGION", "Region failover started, %s -> %s", proposal.DeadRegion, proposal.NewRegion)
+
+	// 开始提升后，无论结果如何都记录一条汇总的FailoverRecord
+	result := promoteRegion(cluster, proposal.DeadRegion, proposal.NewRegion)
+	record.Promoted = result.Promoted
+	record.Failed = result.Failed
+	err = meta.AddFailoverRecord(record)
+	if err != nil {
+		log.Warningf("REGION", "Add failover record failed, %v", err)
+	}
+
+	// 有分片没有提升时不修改MasterRegion，保留提议，运维处理后可以再次confirm
+	if len(result.Failed) > 0 {
+		log.Eventf("REGION", "Region failover partially done, %s -> %s, %d promoted, %d failed, master region not changed",
+			proposal.DeadRegion, proposal.NewRegion, len(result.Promoted), len(result.Failed))
+		return REGION_JOB_PARTIAL, fmt.Sprintf("%d replicasets failed to promote", len(result.Failed))
+	}
+	err = meta.UpdateMasterRegion(proposal.NewRegion)
+	if err != nil {
+		log.Warningf("REGION", "Update master region failed, %v", err)
+		return REGION_JOB_FAILED, fmt.Sprintf("update master region failed, %v", err)
+	}
+	meta.ClearRegionFailover()
+	log.Eventf("REGION", "Region failover done, %s -> %s, %d promoted",
+		proposal.DeadRegion, proposal.NewRegion, len(result.Promoted))
+	return REGION_JOB_DONE, ""
+}
+
+type RegionStatusCommand struct{}
+
+// 本Region Leader上最近一次地域级Failover的进度
+func (self *RegionStatusCommand) Execute(c *cc.Controller) (cc.Result, error) {
+	regionJobMutex.Lock()
+	defer regionJobMutex.Unlock()
+	if regionJob == nil {
+		return nil, ErrNoRegionFailoverJob
+	}
+	return regionJob.copy(), nil
+}
+
+// 每个分片按Failover策略选新地域中的从节点，使用Takeover提升为主，每个分片的结果同步到后台任务
+func promoteRegion(cluster *topo.Cluster, deadRegion, newRegion string) *RegionFailoverResult {
+	cs := state.NewClusterState()
+	regionNodes := map[string][]*topo.Node{}
+	for _, node := range cluster.AllNodes() {
+		regionNodes[node.Region] = append(regionNodes[node.Region], node)
+	}
+	for region, nodes := range regionNodes {
+		cs.UpdateRegionNodes(region, nodes)
+	}
+
+	result := &RegionFailoverResult{
+		Promoted: map[string]string{},
+		Failed:   map[string]string{},
+	}
+	for _, master := range cluster.MasterNodes() {
+		if master.Region != deadRegion || master.Free || master.Empty() {
+			continue
+		}
+		newId, err := cs.ChooseNewMaster(master.Id, newRegion)
+		if err == nil {
+			node := cs.FindNode(newId)
+			_, err = redis.ClusterTakeover(node.Addr())
+			if err == nil {
+				redis.EnableWrite(node.Addr(), node.Id)
+			}
+		}
+		if err != nil {
+			log.Warningf(master.Addr(), "Region failover of replicaset failed, %v", err)
+			result.Failed[master.Id] = err.Error()
+		} else {
+			result.Promoted[master.Id] = newId
+		}
+		updateRegionJob(func(job *RegionFailoverJob) {
+			if err != nil {
+				job.Failed[master.Id] = err.Error()
+			} else {
+				job.Promoted[master.Id] = newId
+			}
+		})
+	}
+	return result
+}
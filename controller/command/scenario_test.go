@@ -0,0 +1,453 @@
+package command_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	cc "github.com/ksarch-saas/cc/controller"
+	"github.com/ksarch-saas/cc/controller/command"
+	"github.com/ksarch-saas/cc/meta"
+	"github.com/ksarch-saas/cc/redis"
+	"github.com/ksarch-saas/cc/redis/fake"
+	"github.com/ksarch-saas/cc/state"
+	"github.com/ksarch-saas/cc/streams"
+	"github.com/ksarch-saas/cc/utils/clock"
+	zookeeper "github.com/samuel/go-zookeeper/zk"
+)
+
+/// 故障注入场景测试，Redis、ZK和时钟都是模拟的
+/// 两个分片，主地域bj，从地域nj：
+///   m1 [0-8191]      s1(bj) s2(bj) s3(nj)
+///   m2 [8192-16383]  s4(bj) s5(bj) s6(nj)
+/// 每个tick把各地域Inspector看到的节点通过UpdateRegionCommand交给Controller，
+/// 等待后台的Failover任务结束，再推进1秒
+
+type scenario struct {
+	t       *testing.T
+	c       *cc.Controller
+	cluster *fake.Cluster
+	zk      *meta.FakeZk
+	clock   *clock.Fake
+}
+
+// configs用于修改默认的App配置
+func newScenario(t *testing.T, configs ...func(*meta.AppConfig)) *scenario {
+	cluster := fake.NewCluster("bj")
+	cluster.AddMaster("m1", "127.0.0.1:7001", "bj:z1:r1", 0, 8191)
+	cluster.AddSlave("s1", "127.0.0.1:7002", "bj:z1:r2", "m1")
+	cluster.AddSlave("s2", "127.0.0.1:7003", "bj:z2:r1", "m1")
+	cluster.AddSlave("s3", "127.0.0.1:7004", "nj:z1:r1", "m1")
+	cluster.AddMaster("m2", "127.0.0.1:7011", "bj:z2:r1", 8192, 16383)
+	cluster.AddSlave("s4", "127.0.0.1:7012", "bj:z1:r1", "m2")
+	cluster.AddSlave("s5", "127.0.0.1:7013", "bj:z1:r2", "m2")
+	cluster.AddSlave("s6", "127.0.0.1:7014", "nj:z1:r1", "m2")
+	// s1复制得最快，Failover时应选它
+	for id, offset := range map[string]int64{"m1": 1000, "s1": 1000, "s2": 900, "s3": 800} {
+		cluster.SetOffset(id, offset)
+	}
+
+	zk := meta.NewFakeZk()
+	for _, dir := range []string{meta.FAILOVER_HISTORY_DIR, "/r3/app/test/controller"} {
+		_, err := meta.CreateRecursive(zk, dir, "", 0, zookeeper.WorldACL(zookeeper.PermAll))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	app := &meta.AppConfig{
+		AppName:               "test",
+		AutoEnableSlaveRead:   true,
+		AutoEnableMasterWrite: true,
+		AutoFailover:          true,
+		AutoFailoverInterval:  10 * time.Minute,
+		MasterRegion:          "bj",
+		Regions:               []string{"bj", "nj"},
+	}
+	for _, config := range configs {
+		config(app)
+	}
+	meta.RunWithZk("test", "bj", zk, app)
+
+	sc := &scenario{
+		t:       t,
+		c:       cc.NewController(),
+		cluster: cluster,
+		zk:      zk,
+		clock:   clock.NewFake(time.Date(2016, 1, 1, 0, 0, 0, 0, time.Local)),
+	}
+	redis.SetDialer(cluster)
+	clock.Set(sc.clock)
+	sc.tick(1)
+	return sc
+}
+
+func (sc *scenario) close() {
+	redis.SetDialer(nil)
+	clock.Set(nil)
+}
+
+// 与本地域分区的地域，Inspector无法上报
+func (sc *scenario) tick(n int) {
+	for i := 0; i < n; i++ {
+		for _, region := range []string{"bj", "nj"} {
+			if !sc.cluster.Reachable(region) {
+				continue
+			}
+			cmd := &command.UpdateRegionCommand{Region: region, Nodes: sc.cluster.Snapshot(region)}
+			_, err := sc.c.ProcessCommand(cmd, 5*time.Second)
+			if err != nil {
+				sc.t.Fatalf("update region %s failed, %v", region, err)
+			}
+			sc.c.ClusterState.WaitTasks()
+		}
+		sc.clock.Advance(time.Second)
+	}
+}
+
+func (sc *scenario) records() []*meta.FailoverHistoryEntry {
+	result, err := meta.QueryFailoverRecords(&meta.FailoverHistoryQuery{AppName: "test"})
+	if err != nil {
+		sc.t.Fatal(err)
+	}
+	return result.Records
+}
+
+// 测试中没有启动LogStream，直接取出缓存的日志，返回以prefix开头的事件数
+func (sc *scenario) events(prefix string) int {
+	n := 0
+	for {
+		select {
+		case data := <-streams.LogStream.C:
+			e := data.(*streams.LogStreamData)
+			if e.Level == "EVENT" && strings.HasPrefix(e.Message, prefix) {
+				n++
+			}
+		default:
+			return n
+		}
+	}
+}
+
+func (sc *scenario) expectState(id, expected string) {
+	ns := sc.c.ClusterState.FindNodeState(id)
+	if ns == nil {
+		sc.t.Fatalf("node %s not found", id)
+	}
+	if s := ns.CurrentState(); s != expected {
+		sc.t.Errorf("node %s should be %s, got %s", id, expected, s)
+	}
+}
+
+func (sc *scenario) expectMaster(slot int, id string) {
+	if m := sc.cluster.MasterOf(slot); m != id {
+		sc.t.Errorf("slot %d should be served by %s, got %s", slot, id, m)
+	}
+}
+
+func (sc *scenario) expectSlaves(master string, slaves ...string) {
+	if got := sc.cluster.SlavesOf(master); !reflect.DeepEqual(got, slaves) {
+		sc.t.Errorf("slaves of %s should be %v, got %v", master, slaves, got)
+	}
+}
+
+func (sc *scenario) expectDoingFailover(expected bool) {
+	doing, err := meta.IsDoingFailover()
+	if err != nil || doing != expected {
+		sc.t.Errorf("doing failover should be %v, got %v, %v", expected, doing, err)
+	}
+}
+
+func TestScenarioMasterDies(t *testing.T) {
+	sc := newScenario(t)
+	defer sc.close()
+
+	sc.cluster.Kill("m1")
+	sc.tick(2)
+
+	records := sc.records()
+	if len(records) != 1 || records[0].NodeId != "m1" {
+		t.Fatalf("should have one failover record of m1, got %v", records)
+	}
+	sc.expectMaster(0, "s1")
+	sc.expectMaster(16383, "m2")
+	sc.expectSlaves("s1", "s2", "s3")
+	sc.expectState("m1", state.StateOffline)
+	sc.expectDoingFailover(false)
+
+	// 旧主恢复后作为新主的从，打开读之后回到RUNNING
+	sc.cluster.Revive("m1")
+	sc.tick(2)
+	sc.expectSlaves("s1", "m1", "s2", "s3")
+	sc.expectState("m1", state.StateRunning)
+	if !sc.cluster.Node("m1").Readable {
+		t.Error("read of the old master should be enabled")
+	}
+	if len(sc.records()) != 1 {
+		t.Error("should not failover again")
+	}
+}
+
+func TestScenarioRepairStaleSiblings(t *testing.T) {
+	sc := newScenario(t)
+	defer sc.close()
+
+	sc.cluster.StaleSiblings = true
+	sc.cluster.Kill("m1")
+	sc.tick(1)
+
+	sc.expectMaster(0, "s1")
+	sc.expectSlaves("s1", "s2", "s3")
+	reports := sc.c.ClusterState.RepairReports()
+	if len(reports) != 1 || reports[0].NumChanged() != 2 {
+		t.Fatalf("repair should re-point s2 and s3, got %+v", reports)
+	}
+}
+
+func TestScenarioSlaveFlaps(t *testing.T) {
+	sc := newScenario(t)
+	defer sc.close()
+
+	for i := 0; i < 3; i++ {
+		sc.cluster.Kill("s2")
+		sc.tick(1)
+		sc.expectState("s2", state.StateWaitFailoverEnd)
+		sc.cluster.Revive("s2")
+		sc.tick(2)
+		sc.expectState("s2", state.StateRunning)
+	}
+
+	records := sc.records()
+	if len(records) != 3 {
+		t.Fatalf("should have 3 failover records, got %d", len(records))
+	}
+	for _, r := range records {
+		if r.NodeId != "s2" || r.Role != "slave" {
+			t.Errorf("unexpected failover record %+v", r)
+		}
+	}
+	sc.expectMaster(0, "m1")
+	sc.expectSlaves("m1", "s1", "s2", "s3")
+	if !sc.cluster.Node("s2").Readable {
+		t.Error("read of s2 should be enabled")
+	}
+}
+
+func TestScenarioRegionPartition(t *testing.T) {
+	sc := newScenario(t)
+	defer sc.close()
+
+	// 复制中断不是故障，不应该Failover
+	sc.cluster.Partition("nj")
+	sc.tick(3)
+	if len(sc.records()) != 0 {
+		t.Fatal("partition should not cause failover")
+	}
+	for _, id := range sc.cluster.NodeIds() {
+		sc.expectState(id, state.StateRunning)
+	}
+
+	// 分区期间主挂了，主地域内照常Failover，连不上的nj节点在修复报告中体现
+	sc.cluster.Kill("m1")
+	sc.tick(1)
+	sc.expectMaster(0, "s1")
+	reports := sc.c.ClusterState.RepairReports()
+	if len(reports) != 1 {
+		t.Fatalf("should have one repair report, got %d", len(reports))
+	}
+	// s3连不上无法改复制关系，s3和s6都无法修正slots
+	failed := map[string]bool{}
+	for _, a := range reports[0].Actions {
+		if a.Error != "" {
+			failed[a.NodeId] = true
+		}
+	}
+	if !reflect.DeepEqual(failed, map[string]bool{"s3": true, "s6": true}) {
+		t.Errorf("repair should fail on nodes in nj only, got %v", failed)
+	}
+
+	sc.cluster.Heal("nj")
+	sc.tick(2)
+	if len(sc.records()) != 1 {
+		t.Error("heal should not cause failover")
+	}
+}
+
+func TestScenarioZkLost(t *testing.T) {
+	sc := newScenario(t)
+	defer sc.close()
+
+	// ZK不可用时无法加锁，不能Failover
+	sc.zk.SetLost(true)
+	sc.cluster.Kill("m1")
+	sc.tick(3)
+	sc.expectMaster(0, "m1")
+	sc.expectState("m1", state.StateWaitFailoverBegin)
+
+	// Failover后旧主的读写标记要等下一轮上报才更新，所以推进两轮
+	sc.zk.SetLost(false)
+	sc.tick(2)
+	sc.expectMaster(0, "s1")
+	sc.expectState("m1", state.StateOffline)
+	if records := sc.records(); len(records) != 1 || records[0].NodeId != "m1" {
+		t.Errorf("should have one failover record of m1, got %v", records)
+	}
+	sc.expectDoingFailover(false)
+}
+
+func TestScenarioFailoverLag(t *testing.T) {
+	sc := newScenario(t, func(app *meta.AppConfig) {
+		app.MaxFailoverLagBytes = 100
+	})
+	defer sc.close()
+
+	// bj的从节点都落后m1超过100字节，拒绝自动Failover
+	sc.cluster.SetOffset("s1", 500)
+	sc.cluster.SetOffset("s2", 400)
+	sc.events("")
+	sc.cluster.Kill("m1")
+	sc.tick(30)
+	sc.expectMaster(0, "m1")
+	sc.expectState("m1", state.StateWaitFailoverBegin)
+	if len(sc.records()) != 0 {
+		t.Fatal("should not failover with large repl lag")
+	}
+	// 每个tick都拒绝，但LAG_ALERT_INTERVAL内只告警一次
+	if n := sc.events("Refuse auto failover"); n != 1 {
+		t.Errorf("expect 1 lag alert in %v, got %d", state.LAG_ALERT_INTERVAL, n)
+	}
+	sc.tick(31)
+	if n := sc.events("Refuse auto failover"); n != 1 {
+		t.Errorf("expect another lag alert after %v, got %d", state.LAG_ALERT_INTERVAL, n)
+	}
+
+	// 追上之后，LAG_RECHECK_INTERVAL内沿用拒绝的结果，之后再检查并继续Failover
+	sc.cluster.SetOffset("s2", 950)
+	sc.tick(1)
+	sc.expectMaster(0, "m1")
+	sc.tick(int(state.LAG_RECHECK_INTERVAL / time.Second))
+	sc.expectMaster(0, "s2")
+	if records := sc.records(); len(records) != 1 || records[0].NodeId != "m1" {
+		t.Errorf("should have one failover record of m1, got %v", records)
+	}
+}
+
+func TestScenarioFailoverLagAfterInterval(t *testing.T) {
+	sc := newScenario(t, func(app *meta.AppConfig) {
+		app.MaxFailoverLagBytes = 100
+	})
+	defer sc.close()
+
+	err := meta.AddFailoverRecord(&meta.FailoverRecord{AppName: "test", NodeId: "m2", Timestamp: sc.clock.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.cluster.SetOffset("s1", 500)
+	sc.cluster.SetOffset("s2", 400)
+	sc.events("")
+	sc.cluster.Kill("m1")
+
+	// AutoFailoverInterval内不检查复制延迟
+	sc.tick(3)
+	sc.expectState("m1", state.StateWaitFailoverBegin)
+	if n := sc.events("Refuse auto failover"); n != 0 {
+		t.Errorf("lag should not be checked within AutoFailoverInterval, got %d alerts", n)
+	}
+	sc.clock.Advance(10 * time.Minute)
+	sc.tick(1)
+	sc.expectMaster(0, "m1")
+	if n := sc.events("Refuse auto failover"); n != 1 {
+		t.Errorf("lag should be checked after AutoFailoverInterval, got %d alerts", n)
+	}
+}
+
+func TestScenarioFailoverBudgetExhausted(t *testing.T) {
+	sc := newScenario(t)
+	defer sc.close()
+
+	// App的预算已经用完
+	err := meta.SetFailoverBudgetConfig(&meta.FailoverBudgetConfig{AppPerHour: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = meta.ConsumeFailoverBudget("test", "host"); err != nil {
+		t.Fatal(err)
+	}
+	sc.events("")
+	sc.cluster.Kill("m1")
+	sc.tick(30)
+	sc.expectMaster(0, "m1")
+	// 每个tick都拒绝，但BUDGET_ALERT_INTERVAL内只发一次事件
+	if n := sc.events("Refuse auto failover"); n != 1 {
+		t.Errorf("expect 1 budget alert in %v, got %d", state.BUDGET_ALERT_INTERVAL, n)
+	}
+	sc.tick(31)
+	if n := sc.events("Refuse auto failover"); n != 1 {
+		t.Errorf("expect another budget alert after %v, got %d", state.BUDGET_ALERT_INTERVAL, n)
+	}
+}
+
+func TestScenarioRepairKeepsReadDisabled(t *testing.T) {
+	sc := newScenario(t, func(app *meta.AppConfig) {
+		app.AutoEnableSlaveRead = false
+	})
+	defer sc.close()
+
+	// 运维关闭了s2的读，Failover后的修复不应打开
+	if _, err := redis.DisableRead("127.0.0.1:7003", "s2"); err != nil {
+		t.Fatal(err)
+	}
+	sc.cluster.Kill("m1")
+	sc.tick(1)
+	sc.expectMaster(0, "s1")
+	reports := sc.c.ClusterState.RepairReports()
+	if len(reports) != 1 {
+		t.Fatalf("should have one repair report, got %d", len(reports))
+	}
+	for _, a := range reports[0].Actions {
+		if a.Action == state.REPAIR_ENABLE_READ {
+			t.Errorf("read should not be enabled with AutoEnableSlaveRead off, %+v", a)
+		}
+	}
+	if sc.cluster.Node("s2").Readable {
+		t.Error("read of s2 should be kept disabled")
+	}
+}
+
+func TestScenarioSwitchover(t *testing.T) {
+	sc := newScenario(t)
+	defer sc.close()
+
+	// 正在Failover时拒绝
+	meta.MarkFailoverDoing(&meta.FailoverRecord{AppName: "test", NodeId: "m2"})
+	_, err := sc.c.ProcessCommand(&command.SwitchoverCommand{NodeId: "s1"}, 5*time.Second)
+	if err == nil {
+		t.Fatal("switchover should be refused while another failover is doing")
+	}
+	meta.UnmarkFailoverDoing()
+
+	_, err = sc.c.ProcessCommand(&command.SwitchoverCommand{NodeId: "s1"}, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 后台执行，结束后清除FAILOVER_DOING
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		doing, _ := meta.IsDoingFailover()
+		if !doing {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("switchover not finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sc.expectMaster(0, "s1")
+	records := sc.records()
+	if len(records) != 1 || records[0].NodeId != "m1" || records[0].Role != "switchover" {
+		t.Fatalf("should have one switchover record of m1, got %v", records)
+	}
+	if !sc.cluster.Node("s1").Writable {
+		t.Error("write of the new master should be enabled")
+	}
+}
@@ -0,0 +1,161 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	cc "github.com/ksarch-saas/cc/controller"
+	"github.com/ksarch-saas/cc/log"
+	"github.com/ksarch-saas/cc/meta"
+	"github.com/ksarch-saas/cc/redis"
+	"github.com/ksarch-saas/cc/topo"
+	"github.com/ksarch-saas/cc/utils/clock"
+)
+
+const (
+	SWITCHOVER_SYNC_TIMEOUT = 30 * time.Second
+	SWITCHOVER_ROLE_TIMEOUT = 30 * time.Second
+	SWITCHOVER_CHECK_PERIOD = 200 * time.Millisecond
+)
+
+var (
+	ErrSwitchoverSyncTimeout = errors.New("switchover: wait for slave catching up timeout")
+	ErrSwitchoverRoleTimeout = errors.New("switchover: wait for role change timeout")
+)
+
+type SwitchoverCommand struct {
+	NodeId string
+}
+
+/// 计划内主从切换，不丢数据:
+/// 1. 禁止旧主写入
+/// 2. 等待从的复制偏移量追上主
+/// 3. 在从上执行CLUSTER FAILOVER（不带FORCE）
+/// 4. 确认角色变化后打开新主的写入
+/// 任何一步失败或超时，恢复旧主的写入
+/// 命令只做检查并标记FAILOVER_DOING，避免与自动Failover同时进行，切换在后台执行不占用命令锁，
+/// 成功后记录一条FailoverRecord，AutoFailoverInterval和Failover历史都能看到
+func (self *SwitchoverCommand) Execute(c *cc.Controller) (cc.Result, error) {
+	cs := c.ClusterState
+	node := cs.FindNode(self.NodeId)
+	if node == nil {
+		return nil, ErrNodeNotExist
+	}
+	if node.IsMaster() {
+		return nil, ErrNodeIsMaster
+	}
+	if node.Fail {
+		return nil, ErrNodeIsDead
+	}
+	master := cs.FindNode(node.ParentId)
+	if master == nil {
+		return nil, ErrNodeNotExist
+	}
+	if master.Fail {
+		return nil, ErrNodeIsDead
+	}
+	mm := c.MigrateManager
+	if len(mm.AllTasks()) > 0 {
+		return nil, fmt.Errorf("Migrate task exists, cancel task to continue.")
+	}
+
+	doing, err := meta.IsDoingFailover()
+	if err != nil {
+		return nil, err
+	}
+	if doing {
+		return nil, fmt.Errorf("another failover is doing")
+	}
+	record := &meta.FailoverRecord{
+		AppName:   meta.AppName(),
+		NodeId:    master.Id,
+		NodeAddr:  master.Addr(),
+		Timestamp: clock.Now(),
+		Region:    master.Region,
+		Tag:       master.Tag,
+		Role:      "switchover",
+		Ranges:    master.Ranges,
+	}
+	err = meta.MarkFailoverDoing(record)
+	if err != nil {
+		return nil, err
+	}
+	go runSwitchover(master, node, record)
+	return fmt.Sprintf("Switchover to %s(%s) started", node.Id, node.Addr()), nil
+}
+
+func runSwitchover(master, node *topo.Node, record *meta.FailoverRecord) {
+	defer meta.UnmarkFailoverDoing()
+
+	_, err := redis.DisableWrite(master.Addr(), master.Id)
+	if err != nil {
+		log.Eventf(master.Addr(), "Switchover to %s(%s) failed, disable writes failed, %v", node.Id, node.Addr(), err)
+		return
+	}
+	log.Eventf(master.Addr(), "Switchover to %s(%s), writes disabled.", node.Id, node.Addr())
+
+	err = switchover(master, node)
+	if err != nil {
+		_, e := redis.EnableWrite(master.Addr(), master.Id)
+		if e != nil {
+			log.Warningf(master.Addr(), "Switchover failed, enable writes of old master failed, %v", e)
+		}
+		log.Eventf(master.Addr(), "Switchover to %s(%s) failed, writes enabled, %v", node.Id, node.Addr(), err)
+		return
+	}
+
+	// 角色已经切换，无论后续是否成功都记录
+	err = meta.AddFailoverRecord(record)
+	if err != nil {
+		log.Warningf(master.Addr(), "Add failover record failed, %v", err)
+	}
+
+	// 新主开放写入；旧主已是从，对其加写权限没有影响，恢复后便于再切回
+	_, err = redis.EnableWrite(node.Addr(), node.Id)
+	if err != nil {
+		log.Eventf(node.Addr(), "Switchover done, enable writes of new master failed, %v", err)
+		return
+	}
+	redis.EnableWrite(node.Addr(), master.Id)
+	log.Eventf(master.Addr(), "Switchover done, new master %s(%s).", node.Id, node.Addr())
+}
+
+func switchover(master, slave *topo.Node) error {
+	deadline := time.Now().Add(SWITCHOVER_SYNC_TIMEOUT)
+	for {
+		moff, err := redis.FetchReplOffset(master.Addr())
+		if err != nil {
+			return err
+		}
+		soff, err := redis.FetchReplOffset(slave.Addr())
+		if err != nil {
+			return err
+		}
+		if soff >= moff {
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Warningf(slave.Addr(), "Slave offset %d, master offset %d", soff, moff)
+			return ErrSwitchoverSyncTimeout
+		}
+		time.Sleep(SWITCHOVER_CHECK_PERIOD)
+	}
+
+	_, err := redis.ClusterManualFailover(slave.Addr())
+	if err != nil {
+		return err
+	}
+
+	deadline = time.Now().Add(SWITCHOVER_ROLE_TIMEOUT)
+	for {
+		info, err := redis.FetchInfo(slave.Addr(), "Replication")
+		if err == nil && info.Get("role") == "master" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return ErrSwitchoverRoleTimeout
+		}
+		time.Sleep(1 * time.Second)
+	}
+}
@@ -28,6 +28,7 @@ func (self *UpdateRegionCommand) Execute(c *cc.Controller) (cc.Result, error) {
 	if cluster != nil {
 		mm := c.MigrateManager
 		mm.HandleNodeStateChange(cluster)
+		checkDrain(c, cluster)
 	}
 
 	for _, ns := range cs.AllNodeStates() {
@@ -35,12 +35,18 @@ type MigrateParams struct {
 	SourceId string   `json:"source_id"`
 	TargetId string   `json:"target_id"`
 	Ranges   []string `json:"ranges"`
+	DryRun   bool     `json:"dry_run"`
 }
 
 type MigrateActionParams struct {
 	SourceId string `json:"source_id"`
 }
 
+type MigrateKeyActionParams struct {
+	SourceId string `json:"source_id"`
+	Action   string `json:"action"` // skip, retry or force
+}
+
 type ToggleModeParams struct {
 	Action string `json:"action"`
 	Perm   string `json:"perm"`
@@ -52,9 +58,25 @@ type MakeReplicaSetParams struct {
 }
 
 type RebalanceParams struct {
-	Method       string   `json:"method"`
-	TargetIds    []string `json:"target_ids"`
-	ShowPlanOnly bool     `json:"show_plan_only"`
+	Method       string         `json:"method"`
+	TargetIds    []string       `json:"target_ids"`
+	Weights      map[string]int `json:"weights"`
+	ShowPlanOnly bool           `json:"show_plan_only"`
+	DryRun       bool           `json:"dry_run"`
+}
+
+type MigrateHistoryParams struct {
+	Slot   *int   `json:"slot"` // 不指定时返回所有slot的记录
+	NodeId string `json:"node_id"`
+	Limit  int    `json:"limit"`
+}
+
+type NodeHistoryParams struct {
+	NodeId string `json:"node_id"`
+}
+
+type DrainParams struct {
+	NodeId string `json:"node_id"`
 }
 
 type MeetNodeParams struct {
@@ -78,6 +100,36 @@ type FailoverTakeoverParams struct {
 	NodeId string `json:"node_id"`
 }
 
+type SwitchoverParams struct {
+	NodeId string `json:"node_id"`
+}
+
+type RegionFailoverParams struct {
+	NewRegion string `json:"new_region"`
+	Token     string `json:"token"`
+}
+
+type FailoverHistoryParams struct {
+	AppName  string `json:"app_name"`
+	Region   string `json:"region"`
+	NodeId   string `json:"node_id"`
+	Since    int64  `json:"since"` // unix时间戳，0表示不限制
+	Until    int64  `json:"until"`
+	Offset   int    `json:"offset"`
+	Limit    int    `json:"limit"`
+	Archived bool   `json:"archived"`
+}
+
+type FailoverBudgetResetParams struct {
+	Bucket string `json:"bucket"`
+}
+
+type FailoverBudgetSetParams struct {
+	AppPerHour    int `json:"app_per_hour"`
+	HostPerHour   int `json:"host_per_hour"`
+	GlobalPerHour int `json:"global_per_hour"`
+}
+
 type MergeSeedsParams struct {
 	Region string       `json:"region"`
 	Seeds  []*topo.Node `json:"seeds"`
@@ -88,3 +140,12 @@ type LogSliceParams struct {
 	Pos   int // Pos is the position of the last log, last log position is 0
 	Count int // how many lines to return before Pos
 }
+
+type LogQueryParams struct {
+	Level    string `json:"level"` // 最低级别，为空时不过滤
+	Node     string `json:"node"`  // Target前缀，节点地址或迁移任务名等
+	Since    int64  `json:"since"` // unix时间戳，0表示不限制
+	Until    int64  `json:"until"`
+	Contains string `json:"contains"` // 消息中包含的子串
+	Limit    int    `json:"limit"`
+}
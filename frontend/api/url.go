@@ -9,16 +9,36 @@ const (
 	MigratePausePath        = "/migrate/pause"
 	MigrateResumePath       = "/migrate/resume"
 	MigrateCancelPath       = "/migrate/cancel"
+	MigrateKeyActionPath    = "/migrate/key"
 	FetchMigrationTasksPath = "/migrate/tasks"
 	RebalancePath           = "/migrate/rebalance"
+	DrainPath               = "/migrate/drain"
+	RebalanceStatusPath     = "/migrate/rebalance/status"
+	RebalanceCancelPath     = "/migrate/rebalance/cancel"
+	MigrateHistoryPath      = "/migrate/history"
 	NodePermPath            = "/node/perm"
 	NodeMeetPath            = "/node/meet"
 	NodeForgetAndResetPath  = "/node/forgetAndReset"
 	NodeReplicatePath       = "/node/replicate"
+	NodeHistoryPath         = "/node/history"
 	NodeResetPath           = "/node/reset"
 	NodeSetAsMasterPath     = "/node/setAsMaster"
 	FetchReplicaSetsPath    = "/replicasets"
 	MakeReplicaSetPath      = "/replicaset/make"
 	FailoverTakeoverPath    = "/failover/takeover"
+	SwitchoverPath          = "/failover/switchover"
+	RegionProposePath       = "/failover/region/propose"
+	RegionVotePath          = "/failover/region/vote"
+	RegionConfirmPath       = "/failover/region/confirm"
+	RegionStatusPath        = "/failover/region/status"
+	FailoverHistoryPath     = "/failover/history"
+	FailoverBudgetPath      = "/failover/budget"
+	FailoverBudgetResetPath = "/failover/budget/reset"
+	FailoverBudgetSetPath   = "/failover/budget/set"
+	FailoverRepairsPath     = "/failover/repairs"
 	LogSlicePath            = "/log/slice"
+	LogQueryPath            = "/log"
+	FsmModelDotPath         = "/fsm/model.dot"
+	DebugRedisPath          = "/debug/redis"
+	MetricsPath             = "/metrics"
 )
@@ -12,6 +12,9 @@ import (
 	"github.com/ksarch-saas/cc/frontend/api"
 	"github.com/ksarch-saas/cc/frontend/auth"
 	"github.com/ksarch-saas/cc/log"
+	"github.com/ksarch-saas/cc/meta"
+	"github.com/ksarch-saas/cc/redis"
+	"github.com/ksarch-saas/cc/state"
 	"github.com/ksarch-saas/cc/topo"
 )
 
@@ -36,13 +39,23 @@ func NewFrontEnd(c *cc.Controller, httpPort, wsPort int) *FrontEnd {
 	fe.Router.GET(api.AppInfoPath, fe.HandleAppInfo)
 	fe.Router.GET(api.FetchReplicaSetsPath, fe.HandleFetchReplicaSets)
 	fe.Router.POST(api.LogSlicePath, fe.HandleLogSlice)
+	fe.Router.POST(api.LogQueryPath, fe.HandleLogQuery)
+	fe.Router.GET(api.FsmModelDotPath, fe.HandleFsmModelDot)
+	fe.Router.GET(api.DebugRedisPath, fe.HandleDebugRedis)
+	fe.Router.GET(api.MetricsPath, fe.HandleMetrics)
 	fe.Router.POST(api.RegionSnapshotPath, fe.HandleRegionSnapshot)
 	fe.Router.POST(api.MigrateCreatePath, tokenAuth.HandleFunc(fe.HandleMigrateCreate))
 	fe.Router.POST(api.MigratePausePath, tokenAuth.HandleFunc(fe.HandleMigratePause))
 	fe.Router.POST(api.MigrateResumePath, tokenAuth.HandleFunc(fe.HandleMigrateResume))
 	fe.Router.POST(api.MigrateCancelPath, tokenAuth.HandleFunc(fe.HandleMigrateCancel))
+	fe.Router.POST(api.MigrateKeyActionPath, tokenAuth.HandleFunc(fe.HandleMigrateKeyAction))
 	fe.Router.GET(api.FetchMigrationTasksPath, fe.HandleFetchMigrationTasks)
 	fe.Router.POST(api.RebalancePath, tokenAuth.HandleFunc(fe.HandleRebalance))
+	fe.Router.POST(api.DrainPath, tokenAuth.HandleFunc(fe.HandleDrain))
+	fe.Router.GET(api.RebalanceStatusPath, fe.HandleRebalanceStatus)
+	fe.Router.POST(api.RebalanceCancelPath, tokenAuth.HandleFunc(fe.HandleRebalanceCancel))
+	fe.Router.POST(api.MigrateHistoryPath, fe.HandleMigrateHistory)
+	fe.Router.POST(api.NodeHistoryPath, fe.HandleNodeHistory)
 	fe.Router.POST(api.NodePermPath, tokenAuth.HandleFunc(fe.HandleToggleMode))
 	fe.Router.POST(api.NodeMeetPath, tokenAuth.HandleFunc(fe.HandleMeetNode))
 	fe.Router.POST(api.NodeSetAsMasterPath, tokenAuth.HandleFunc(fe.HandleSetAsMaster))
@@ -50,6 +63,16 @@ func NewFrontEnd(c *cc.Controller, httpPort, wsPort int) *FrontEnd {
 	fe.Router.POST(api.NodeReplicatePath, tokenAuth.HandleFunc(fe.HandleReplicate))
 	fe.Router.POST(api.MakeReplicaSetPath, tokenAuth.HandleFunc(fe.HandleMakeReplicaSet))
 	fe.Router.POST(api.FailoverTakeoverPath, tokenAuth.HandleFunc(fe.HandleFailoverTakeover))
+	fe.Router.POST(api.SwitchoverPath, tokenAuth.HandleFunc(fe.HandleSwitchover))
+	fe.Router.POST(api.RegionProposePath, tokenAuth.HandleFunc(fe.HandleRegionPropose))
+	fe.Router.POST(api.RegionVotePath, tokenAuth.HandleFunc(fe.HandleRegionVote))
+	fe.Router.POST(api.RegionConfirmPath, tokenAuth.HandleFunc(fe.HandleRegionConfirm))
+	fe.Router.GET(api.RegionStatusPath, fe.HandleRegionStatus)
+	fe.Router.POST(api.FailoverHistoryPath, fe.HandleFailoverHistory)
+	fe.Router.GET(api.FailoverBudgetPath, fe.HandleFailoverBudget)
+	fe.Router.POST(api.FailoverBudgetResetPath, tokenAuth.HandleFunc(fe.HandleFailoverBudgetReset))
+	fe.Router.POST(api.FailoverBudgetSetPath, tokenAuth.HandleFunc(fe.HandleFailoverBudgetSet))
+	fe.Router.GET(api.FailoverRepairsPath, fe.HandleFailoverRepairs)
 	fe.Router.POST(api.MergeSeedsPath, fe.HandleMergeSeeds)
 
 	return fe
@@ -128,6 +151,7 @@ func (fe *FrontEnd) HandleMigrateCreate(c *gin.Context) {
 		SourceId: params.SourceId,
 		TargetId: params.TargetId,
 		Ranges:   ranges,
+		DryRun:   params.DryRun,
 	}
 
 	result, err := fe.C.ProcessCommand(&cmd, 5*time.Second)
@@ -190,6 +214,24 @@ func (fe *FrontEnd) HandleMigrateCancel(c *gin.Context) {
 	c.JSON(200, api.MakeSuccessResponse(result))
 }
 
+func (fe *FrontEnd) HandleMigrateKeyAction(c *gin.Context) {
+	var params api.MigrateKeyActionParams
+	c.Bind(&params)
+
+	cmd := command.MigrateKeyActionCommand{
+		SourceId: params.SourceId,
+		Action:   params.Action,
+	}
+
+	result, err := fe.C.ProcessCommand(&cmd, 5*time.Second)
+	if err != nil {
+		c.JSON(200, api.MakeFailureResponse(err.Error()))
+		return
+	}
+
+	c.JSON(200, api.MakeSuccessResponse(result))
+}
+
 func (fe *FrontEnd) HandleMakeReplicaSet(c *gin.Context) {
 	var params api.MakeReplicaSetParams
 	c.Bind(&params)
@@ -214,7 +256,26 @@ func (fe *FrontEnd) HandleRebalance(c *gin.Context) {
 	cmd := command.RebalanceCommand{
 		Method:       params.Method,
 		TargetIds:    params.TargetIds,
+		Weights:      params.Weights,
 		ShowPlanOnly: params.ShowPlanOnly,
+		DryRun:       params.DryRun,
+	}
+
+	result, err := fe.C.ProcessCommand(&cmd, 5*time.Second)
+	if err != nil {
+		c.JSON(200, api.MakeFailureResponse(err.Error()))
+		return
+	}
+
+	c.JSON(200, api.MakeSuccessResponse(result))
+}
+
+func (fe *FrontEnd) HandleDrain(c *gin.Context) {
+	var params api.DrainParams
+	c.Bind(&params)
+
+	cmd := command.DrainCommand{
+		NodeId: params.NodeId,
 	}
 
 	result, err := fe.C.ProcessCommand(&cmd, 5*time.Second)
@@ -262,6 +323,69 @@ func (fe *FrontEnd) HandleFetchMigrationTasks(c *gin.Context) {
 	c.JSON(200, api.MakeSuccessResponse(result))
 }
 
+func (fe *FrontEnd) HandleRebalanceStatus(c *gin.Context) {
+	cmd := command.FetchRebalanceStatusCommand{}
+
+	result, err := fe.C.ProcessCommand(&cmd, 5*time.Second)
+	if err != nil {
+		c.JSON(200, api.MakeFailureResponse(err.Error()))
+		return
+	}
+
+	c.JSON(200, api.MakeSuccessResponse(result))
+}
+
+func (fe *FrontEnd) HandleRebalanceCancel(c *gin.Context) {
+	cmd := command.CancelRebalanceCommand{}
+
+	result, err := fe.C.ProcessCommand(&cmd, 5*time.Second)
+	if err != nil {
+		c.JSON(200, api.MakeFailureResponse(err.Error()))
+		return
+	}
+
+	c.JSON(200, api.MakeSuccessResponse(result))
+}
+
+func (fe *FrontEnd) HandleMigrateHistory(c *gin.Context) {
+	var params api.MigrateHistoryParams
+	c.Bind(&params)
+
+	cmd := command.FetchMigrateHistoryCommand{
+		Slot:   -1,
+		NodeId: params.NodeId,
+		Limit:  params.Limit,
+	}
+	if params.Slot != nil {
+		cmd.Slot = *params.Slot
+	}
+
+	result, err := fe.C.ProcessCommand(&cmd, 5*time.Second)
+	if err != nil {
+		c.JSON(200, api.MakeFailureResponse(err.Error()))
+		return
+	}
+
+	c.JSON(200, api.MakeSuccessResponse(result))
+}
+
+func (fe *FrontEnd) HandleNodeHistory(c *gin.Context) {
+	var params api.NodeHistoryParams
+	c.Bind(&params)
+
+	cmd := command.FetchNodeHistoryCommand{
+		NodeId: params.NodeId,
+	}
+
+	result, err := fe.C.ProcessCommand(&cmd, 5*time.Second)
+	if err != nil {
+		c.JSON(200, api.MakeFailureResponse(err.Error()))
+		return
+	}
+
+	c.JSON(200, api.MakeSuccessResponse(result))
+}
+
 func (fe *FrontEnd) HandleMeetNode(c *gin.Context) {
 	var params api.MeetNodeParams
 	c.Bind(&params)
@@ -337,6 +461,173 @@ func (fe *FrontEnd) HandleFailoverTakeover(c *gin.Context) {
 	c.JSON(200, api.MakeSuccessResponse(result))
 }
 
+func (fe *FrontEnd) HandleSwitchover(c *gin.Context) {
+	var params api.SwitchoverParams
+	c.Bind(&params)
+
+	cmd := command.SwitchoverCommand{params.NodeId}
+
+	// 只做检查，等待从追上主和角色变化在后台执行
+	result, err := fe.C.ProcessCommand(&cmd, 5*time.Second)
+	if err != nil {
+		c.JSON(200, api.MakeFailureResponse(err.Error()))
+		return
+	}
+
+	c.JSON(200, api.MakeSuccessResponse(result))
+}
+
+func (fe *FrontEnd) HandleRegionPropose(c *gin.Context) {
+	var params api.RegionFailoverParams
+	c.Bind(&params)
+
+	cmd := command.RegionProposeCommand{
+		NewRegion: params.NewRegion,
+	}
+
+	result, err := fe.C.ProcessCommand(&cmd, 5*time.Second)
+	if err != nil {
+		c.JSON(200, api.MakeFailureResponse(err.Error()))
+		return
+	}
+
+	c.JSON(200, api.MakeSuccessResponse(result))
+}
+
+func (fe *FrontEnd) HandleRegionVote(c *gin.Context) {
+	cmd := command.RegionVoteCommand{}
+
+	result, err := fe.C.ProcessCommand(&cmd, 30*time.Second)
+	if err != nil {
+		c.JSON(200, api.MakeFailureResponse(err.Error()))
+		return
+	}
+
+	c.JSON(200, api.MakeSuccessResponse(result))
+}
+
+func (fe *FrontEnd) HandleRegionConfirm(c *gin.Context) {
+	var params api.RegionFailoverParams
+	c.Bind(&params)
+
+	cmd := command.RegionConfirmCommand{
+		Token: params.Token,
+	}
+
+	// 只做检查，Takeover在后台执行
+	result, err := fe.C.ProcessCommand(&cmd, 10*time.Second)
+	if err != nil {
+		c.JSON(200, api.MakeFailureResponse(err.Error()))
+		return
+	}
+
+	c.JSON(200, api.MakeSuccessResponse(result))
+}
+
+func (fe *FrontEnd) HandleRegionStatus(c *gin.Context) {
+	cmd := command.RegionStatusCommand{}
+
+	result, err := fe.C.ProcessCommand(&cmd, 5*time.Second)
+	if err != nil {
+		c.JSON(200, api.MakeFailureResponse(err.Error()))
+		return
+	}
+
+	c.JSON(200, api.MakeSuccessResponse(result))
+}
+
+func (fe *FrontEnd) HandleFailoverHistory(c *gin.Context) {
+	var params api.FailoverHistoryParams
+	c.Bind(&params)
+
+	cmd := command.FetchFailoverHistoryCommand{
+		Query: meta.FailoverHistoryQuery{
+			AppName:  params.AppName,
+			Region:   params.Region,
+			NodeId:   params.NodeId,
+			Offset:   params.Offset,
+			Limit:    params.Limit,
+			Archived: params.Archived,
+		},
+	}
+	if params.Since > 0 {
+		cmd.Query.Since = time.Unix(params.Since, 0)
+	}
+	if params.Until > 0 {
+		cmd.Query.Until = time.Unix(params.Until, 0)
+	}
+
+	result, err := fe.C.ProcessCommand(&cmd, 5*time.Second)
+	if err != nil {
+		c.JSON(200, api.MakeFailureResponse(err.Error()))
+		return
+	}
+
+	c.JSON(200, api.MakeSuccessResponse(result))
+}
+
+func (fe *FrontEnd) HandleFailoverBudget(c *gin.Context) {
+	cmd := command.FetchFailoverBudgetCommand{}
+
+	result, err := fe.C.ProcessCommand(&cmd, 5*time.Second)
+	if err != nil {
+		c.JSON(200, api.MakeFailureResponse(err.Error()))
+		return
+	}
+
+	c.JSON(200, api.MakeSuccessResponse(result))
+}
+
+func (fe *FrontEnd) HandleFailoverRepairs(c *gin.Context) {
+	cmd := command.FetchRepairReportsCommand{}
+
+	result, err := fe.C.ProcessCommand(&cmd, 5*time.Second)
+	if err != nil {
+		c.JSON(200, api.MakeFailureResponse(err.Error()))
+		return
+	}
+
+	c.JSON(200, api.MakeSuccessResponse(result))
+}
+
+func (fe *FrontEnd) HandleFailoverBudgetReset(c *gin.Context) {
+	var params api.FailoverBudgetResetParams
+	c.Bind(&params)
+
+	cmd := command.ResetFailoverBudgetCommand{
+		Bucket: params.Bucket,
+	}
+
+	result, err := fe.C.ProcessCommand(&cmd, 5*time.Second)
+	if err != nil {
+		c.JSON(200, api.MakeFailureResponse(err.Error()))
+		return
+	}
+
+	c.JSON(200, api.MakeSuccessResponse(result))
+}
+
+func (fe *FrontEnd) HandleFailoverBudgetSet(c *gin.Context) {
+	var params api.FailoverBudgetSetParams
+	c.Bind(&params)
+
+	cmd := command.SetFailoverBudgetCommand{
+		Config: meta.FailoverBudgetConfig{
+			AppPerHour:    params.AppPerHour,
+			HostPerHour:   params.HostPerHour,
+			GlobalPerHour: params.GlobalPerHour,
+		},
+	}
+
+	result, err := fe.C.ProcessCommand(&cmd, 5*time.Second)
+	if err != nil {
+		c.JSON(200, api.MakeFailureResponse(err.Error()))
+		return
+	}
+
+	c.JSON(200, api.MakeSuccessResponse(result))
+}
+
 func (fe *FrontEnd) HandleMergeSeeds(c *gin.Context) {
 	var params api.MergeSeedsParams
 	c.Bind(&params)
@@ -356,8 +647,63 @@ func (fe *FrontEnd) HandleLogSlice(c *gin.Context) {
 	var params api.LogSliceParams
 	c.Bind(&params)
 
-	n := len(log.LogRingBuffer)
-	lines := log.LogRingBuffer[n-params.Pos-params.Count : n-params.Pos]
-
+	lines := []string{}
+	s := log.GetStore()
+	if s == nil || params.Count <= 0 || params.Pos < 0 {
+		c.JSON(200, api.MakeSuccessResponse(lines))
+		return
+	}
+	if params.Count > log.MAX_QUERY_LIMIT {
+		c.JSON(200, api.MakeFailureResponse(fmt.Sprintf("count should not exceed %d", log.MAX_QUERY_LIMIT)))
+		return
+	}
+	// 跳过最近的Pos条
+	records, err := s.Query(&log.Query{Offset: params.Pos, Limit: params.Count})
+	if err != nil {
+		c.JSON(200, api.MakeFailureResponse(err.Error()))
+		return
+	}
+	for _, r := range records {
+		lines = append(lines, r.String())
+	}
 	c.JSON(200, api.MakeSuccessResponse(lines))
 }
+
+func (fe *FrontEnd) HandleLogQuery(c *gin.Context) {
+	var params api.LogQueryParams
+	c.Bind(&params)
+
+	s := log.GetStore()
+	if s == nil {
+		c.JSON(200, api.MakeFailureResponse("log store disabled"))
+		return
+	}
+	q := &log.Query{
+		Level:    params.Level,
+		Target:   params.Node,
+		Contains: params.Contains,
+		Limit:    params.Limit,
+	}
+	if params.Since > 0 {
+		q.Since = time.Unix(params.Since, 0)
+	}
+	if params.Until > 0 {
+		q.Until = time.Unix(params.Until, 0)
+	}
+	records, err := s.Query(q)
+	if err != nil {
+		c.JSON(200, api.MakeFailureResponse(err.Error()))
+		return
+	}
+	c.JSON(200, api.MakeSuccessResponse(records))
+}
+
+// 节点状态机的Graphviz描述，供控制台绘图
+func (fe *FrontEnd) HandleFsmModelDot(c *gin.Context) {
+	c.Data(200, "text/vnd.graphviz; charset=utf-8", []byte(state.RedisNodeStateModel.Dot()))
+}
+
+// 本进程到各Redis节点的连接池统计
+func (fe *FrontEnd) HandleDebugRedis(c *gin.Context) {
+	c.JSON(200, api.MakeSuccessResponse(redis.Stats()))
+}
@@ -0,0 +1,130 @@
+package frontend
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ksarch-saas/cc/controller/command"
+	"github.com/ksarch-saas/cc/log"
+	"github.com/ksarch-saas/cc/meta"
+	"github.com/ksarch-saas/cc/metrics"
+	"github.com/ksarch-saas/cc/state"
+)
+
+/// Prometheus抓取接口
+/// 每个controller都输出本进程的指标：leader状态、Failover计数和耗时、Inspector周期耗时
+/// 集群leader另外输出节点状态机、节点INFO和迁移进度，其他controller上这些数据不是最新的，
+/// 获取失败时cc_cluster_metrics_up为0
+
+var nodeStateNames = []string{
+	state.StateRunning,
+	state.StateWaitFailoverBegin,
+	state.StateWaitFailoverEnd,
+	state.StateOffline,
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (fe *FrontEnd) HandleMetrics(c *gin.Context) {
+	w := metrics.NewWriter()
+	labels := metrics.Labels{"app": meta.AppName(), "region": meta.LocalRegion()}
+	w.Gauge("cc_cluster_leader", "Whether this controller is the cluster leader.",
+		labels, boolValue(meta.IsClusterLeader()))
+	w.Gauge("cc_region_leader", "Whether this controller is the leader of its region.",
+		labels, boolValue(meta.IsRegionLeader()))
+	metrics.WriteAll(w)
+
+	// 命令超时或失败时集群指标缺失，通过cc_cluster_metrics_up区分
+	if meta.IsClusterLeader() {
+		cmd := command.FetchClusterMetricsCommand{}
+		result, err := fe.C.ProcessCommand(&cmd, 5*time.Second)
+		if err != nil {
+			log.Warningf("METRICS", "Fetch cluster metrics failed, %v", err)
+		}
+		w.Gauge("cc_cluster_metrics_up", "Whether the cluster metrics were collected in this scrape.",
+			labels, boolValue(err == nil))
+		if err == nil {
+			writeClusterMetrics(w, result.(command.FetchClusterMetricsResult))
+		}
+	}
+	c.Data(200, metrics.ContentType, w.Bytes())
+}
+
+func writeClusterMetrics(w *metrics.Writer, result command.FetchClusterMetricsResult) {
+	counts := map[string]int{}
+	for _, n := range result.Nodes {
+		counts[n.State]++
+	}
+	w.Describe("cc_node_state_count", "gauge", "Number of nodes in each FSM state.")
+	for _, s := range nodeStateNames {
+		w.Sample("cc_node_state_count", metrics.Labels{"state": s}, float64(counts[s]))
+	}
+
+	w.Describe("cc_node_state", "gauge", "FSM state of the node, 1 for the current state.")
+	for _, n := range result.Nodes {
+		labels := nodeLabels(n)
+		labels["state"] = n.State
+		w.Sample("cc_node_state", labels, 1)
+	}
+
+	nodeGauges := []struct {
+		name  string
+		help  string
+		value func(n *command.NodeMetrics) float64
+	}{
+		{"cc_node_used_memory_bytes", "Memory used by the node.",
+			func(n *command.NodeMetrics) float64 { return float64(n.UsedMemory) }},
+		{"cc_node_keys", "Number of keys on the node.",
+			func(n *command.NodeMetrics) float64 { return float64(n.Keys) }},
+		{"cc_node_ops_per_sec", "Instantaneous ops per second of the node.",
+			func(n *command.NodeMetrics) float64 { return float64(n.InstantaneousOpsPerSec) }},
+		{"cc_node_master_sync_left_bytes", "Bytes left to transfer in the running full sync.",
+			func(n *command.NodeMetrics) float64 { return float64(n.MasterSyncLeftBytes) }},
+	}
+	for _, g := range nodeGauges {
+		w.Describe(g.name, "gauge", g.help)
+		for _, n := range result.Nodes {
+			w.Sample(g.name, nodeLabels(n), g.value(n))
+		}
+	}
+
+	// 只有从节点有复制链接
+	w.Describe("cc_node_master_link_up", "gauge", "Whether the replication link to the master is up.")
+	for _, n := range result.Nodes {
+		if n.Role == "master" {
+			continue
+		}
+		w.Sample("cc_node_master_link_up", nodeLabels(n), boolValue(n.MasterLinkStatus == "up"))
+	}
+
+	migrateGauges := []struct {
+		name  string
+		help  string
+		value func(m *command.MigrateMetrics) float64
+	}{
+		{"cc_migrate_slots_total", "Number of slots to migrate in the task.",
+			func(m *command.MigrateMetrics) float64 { return float64(m.TotalSlots) }},
+		{"cc_migrate_slots_done", "Number of slots migrated in the task.",
+			func(m *command.MigrateMetrics) float64 { return float64(m.SlotsDone) }},
+		{"cc_migrate_keys_moved", "Number of keys migrated in the task.",
+			func(m *command.MigrateMetrics) float64 { return float64(m.KeysMoved) }},
+		{"cc_migrate_keys_per_sec", "Average keys migrated per second since the task started.",
+			func(m *command.MigrateMetrics) float64 { return m.KeysPerSec }},
+	}
+	for _, g := range migrateGauges {
+		w.Describe(g.name, "gauge", g.help)
+		for _, m := range result.Migrates {
+			labels := metrics.Labels{"source": m.SourceId, "target": m.TargetId, "state": m.State}
+			w.Sample(g.name, labels, g.value(m))
+		}
+	}
+}
+
+func nodeLabels(n *command.NodeMetrics) metrics.Labels {
+	return metrics.Labels{"id": n.Id, "addr": n.Addr, "region": n.Region, "role": n.Role}
+}
@@ -0,0 +1,168 @@
+package fsm
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/// 状态模型校验
+/// 1. 初始状态和转换的目标状态必须存在
+/// 2. 从初始状态出发不可达的状态
+/// 3. 同一状态下相同优先级的转换输入有重叠，且无法区分。以下两种情况认为可以区分：
+///    - 目标状态和Apply相同，且都没有约束条件，先匹配哪个结果都一样
+///    - 都有约束条件且约束条件不同，由约束条件决定
+
+func (m *StateModel) sortedStates() []string {
+	names := []string{}
+	for name := range m.States {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func transName(t *Transition) string {
+	if t.Name != "" {
+		return t.Name
+	}
+	return fmt.Sprintf("%s-%v->%s", t.From, t.Input, t.To)
+}
+
+func (m *StateModel) Validate() []error {
+	errs := []error{}
+
+	if m.Initial != "" {
+		if _, ok := m.States[m.Initial]; !ok {
+			errs = append(errs, fmt.Errorf("initial state %s not exist", m.Initial))
+		}
+	}
+	for _, from := range m.sortedStates() {
+		for _, t := range m.TransTable[from] {
+			if _, ok := m.States[t.To]; !ok {
+				errs = append(errs, fmt.Errorf("transition %s to unknown state %s", transName(t), t.To))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	for _, name := range m.UnreachableStates() {
+		errs = append(errs, fmt.Errorf("state %s is unreachable from %s", name, m.Initial))
+	}
+	for _, pair := range m.OverlappedTransitions() {
+		errs = append(errs, fmt.Errorf("transition %s and %s overlap at priority %d",
+			transName(pair[0]), transName(pair[1]), pair[0].Priority))
+	}
+	return errs
+}
+
+// 从初始状态出发不可达的状态，未设置初始状态时返回空
+func (m *StateModel) UnreachableStates() []string {
+	if m.Initial == "" {
+		return nil
+	}
+	visited := map[string]bool{m.Initial: true}
+	queue := []string{m.Initial}
+	for len(queue) > 0 {
+		curr := queue[0]
+		queue = queue[1:]
+		for _, t := range m.TransTable[curr] {
+			if !visited[t.To] {
+				visited[t.To] = true
+				queue = append(queue, t.To)
+			}
+		}
+	}
+	states := []string{}
+	for _, name := range m.sortedStates() {
+		if !visited[name] {
+			states = append(states, name)
+		}
+	}
+	return states
+}
+
+func distinguishable(a, b *Transition) bool {
+	if a.To == b.To && a.Constraint == nil && b.Constraint == nil {
+		if (a.Apply == nil && b.Apply == nil) || (a.ApplyName != "" && a.ApplyName == b.ApplyName) {
+			return true
+		}
+	}
+	if a.Constraint != nil && b.Constraint != nil &&
+		a.ConstraintName != "" && a.ConstraintName != b.ConstraintName {
+		return true
+	}
+	return false
+}
+
+// 输入有重叠且无法区分的转换，Input.Eq需要支持通配
+func (m *StateModel) OverlappedTransitions() [][2]*Transition {
+	pairs := [][2]*Transition{}
+	for _, from := range m.sortedStates() {
+		ts := m.TransTable[from]
+		for i := 0; i < len(ts); i++ {
+			for j := i + 1; j < len(ts); j++ {
+				a, b := ts[i], ts[j]
+				if a.Priority != b.Priority || !a.Input.Eq(b.Input) {
+					continue
+				}
+				if !distinguishable(a, b) {
+					pairs = append(pairs, [2]*Transition{a, b})
+				}
+			}
+		}
+	}
+	return pairs
+}
+
+/// Graphviz导出
+
+func dotQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	return `"` + s + `"`
+}
+
+// 导出DOT格式，边上标注名字、输入、优先级、约束条件和Apply
+func (m *StateModel) Dot() string {
+	var buf bytes.Buffer
+	name := m.Name
+	if name == "" {
+		name = "fsm"
+	}
+	fmt.Fprintf(&buf, "digraph %s {\n", dotQuote(name))
+	buf.WriteString("\trankdir=LR;\n")
+	buf.WriteString("\tnode [shape=box, style=rounded];\n")
+	for _, state := range m.sortedStates() {
+		if state == m.Initial {
+			fmt.Fprintf(&buf, "\t%s [peripheries=2];\n", dotQuote(state))
+		} else {
+			fmt.Fprintf(&buf, "\t%s;\n", dotQuote(state))
+		}
+	}
+	for _, from := range m.sortedStates() {
+		for _, t := range m.TransTable[from] {
+			label := fmt.Sprintf("%v p%d", t.Input, t.Priority)
+			if t.Name != "" {
+				label = t.Name + " " + label
+			}
+			if t.ConstraintName != "" {
+				label += "\n[" + t.ConstraintName + "]"
+			} else if t.Constraint != nil {
+				label += "\n[constraint]"
+			}
+			if t.ApplyName != "" {
+				label += "\n/" + t.ApplyName
+			} else if t.Apply != nil {
+				label += "\n/apply"
+			}
+			fmt.Fprintf(&buf, "\t%s -> %s [label=%s];\n", dotQuote(t.From), dotQuote(t.To), dotQuote(label))
+		}
+	}
+	buf.WriteString("}\n")
+	return buf.String()
+}
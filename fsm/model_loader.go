@@ -0,0 +1,167 @@
+package fsm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v1"
+)
+
+/// 声明式的状态模型
+/// 状态模型可以用YAML或JSON描述，约束条件和Apply函数按名字在Registry中查找，如：
+///
+///   name: redis-node
+///   initial: RUNNING
+///   states: [RUNNING, OFFLINE]
+///   transitions:
+///     # 封禁了，进入Offline状态
+///     - name: a0
+///       from: RUNNING
+///       to: OFFLINE
+///       input: (F,F,*,*,*)
+///       priority: 0
+///       constraint: SomeConstraint
+///       apply: SomeHandler
+///
+/// input的格式由Registry的ParseInput决定
+
+type TransitionDef struct {
+	Name       string `yaml:"name" json:"name"`
+	From       string `yaml:"from" json:"from"`
+	To         string `yaml:"to" json:"to"`
+	Input      string `yaml:"input" json:"input"`
+	Priority   int    `yaml:"priority" json:"priority"`
+	Constraint string `yaml:"constraint,omitempty" json:"constraint,omitempty"`
+	Apply      string `yaml:"apply,omitempty" json:"apply,omitempty"`
+}
+
+type StateModelDef struct {
+	Name        string          `yaml:"name" json:"name"`
+	Initial     string          `yaml:"initial" json:"initial"`
+	States      []string        `yaml:"states" json:"states"`
+	Transitions []TransitionDef `yaml:"transitions" json:"transitions"`
+}
+
+type Registry struct {
+	ParseInput  func(s string) (Input, error)
+	states      map[string]*State
+	constraints map[string]func(ctx interface{}) bool
+	applies     map[string]func(ctx interface{})
+}
+
+func NewRegistry(parseInput func(s string) (Input, error)) *Registry {
+	r := &Registry{
+		ParseInput:  parseInput,
+		states:      map[string]*State{},
+		constraints: map[string]func(ctx interface{}) bool{},
+		applies:     map[string]func(ctx interface{}){},
+	}
+	return r
+}
+
+// 注册带OnEnter/OnLeave的状态，描述中未注册的状态使用空的回调
+func (r *Registry) RegisterState(s *State) {
+	r.states[s.Name] = s
+}
+
+func (r *Registry) RegisterConstraint(name string, f func(ctx interface{}) bool) {
+	r.constraints[name] = f
+}
+
+func (r *Registry) RegisterApply(name string, f func(ctx interface{})) {
+	r.applies[name] = f
+}
+
+// 解析YAML或JSON描述，以'{'开头的按JSON解析
+func ParseStateModelDef(data []byte) (*StateModelDef, error) {
+	def := &StateModelDef{}
+	var err error
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		err = json.Unmarshal(data, def)
+	} else {
+		err = yaml.Unmarshal(data, def)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return def, nil
+}
+
+// 从描述构建状态模型，并进行校验
+func LoadStateModel(data []byte, r *Registry) (*StateModel, error) {
+	def, err := ParseStateModelDef(data)
+	if err != nil {
+		return nil, err
+	}
+	return BuildStateModel(def, r)
+}
+
+func BuildStateModel(def *StateModelDef, r *Registry) (*StateModel, error) {
+	m := NewStateModel()
+	m.Name = def.Name
+	m.Initial = def.Initial
+
+	noop := func(ctx interface{}) {}
+	for _, name := range def.States {
+		if _, ok := m.States[name]; ok {
+			return nil, fmt.Errorf("fsm: duplicate state %s", name)
+		}
+		s, ok := r.states[name]
+		if !ok {
+			s = &State{Name: name, OnEnter: noop, OnLeave: noop}
+		}
+		m.AddState(s)
+	}
+
+	names := map[string]bool{}
+	for _, td := range def.Transitions {
+		if td.Name != "" {
+			if names[td.Name] {
+				return nil, fmt.Errorf("fsm: duplicate transition %s", td.Name)
+			}
+			names[td.Name] = true
+		}
+		if _, ok := m.States[td.From]; !ok {
+			return nil, fmt.Errorf("fsm: transition %s from unknown state %s", td.Name, td.From)
+		}
+		input, err := r.ParseInput(td.Input)
+		if err != nil {
+			return nil, fmt.Errorf("fsm: transition %s has bad input %s, %v", td.Name, td.Input, err)
+		}
+		t := &Transition{
+			Name:           td.Name,
+			From:           td.From,
+			To:             td.To,
+			Input:          input,
+			Priority:       td.Priority,
+			ConstraintName: td.Constraint,
+			ApplyName:      td.Apply,
+		}
+		var ok bool
+		if td.Constraint != "" {
+			t.Constraint, ok = r.constraints[td.Constraint]
+			if !ok {
+				return nil, fmt.Errorf("fsm: transition %s has unknown constraint %s", td.Name, td.Constraint)
+			}
+		}
+		if td.Apply != "" {
+			t.Apply, ok = r.applies[td.Apply]
+			if !ok {
+				return nil, fmt.Errorf("fsm: transition %s has unknown apply %s", td.Name, td.Apply)
+			}
+		}
+		m.AddTransition(t)
+	}
+
+	errs := m.Validate()
+	if len(errs) > 0 {
+		msgs := []string{}
+		for _, e := range errs {
+			msgs = append(msgs, e.Error())
+		}
+		return nil, fmt.Errorf("fsm: invalid state model %s, %s", m.Name, strings.Join(msgs, "; "))
+	}
+	return m, nil
+}
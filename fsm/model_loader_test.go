@@ -0,0 +1,125 @@
+package fsm
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// 0为通配
+type wildInput int
+
+func (i wildInput) Eq(t Input) bool {
+	j := t.(wildInput)
+	return i == 0 || j == 0 || i == j
+}
+
+func parseWildInput(s string) (Input, error) {
+	if s == "*" {
+		return wildInput(0), nil
+	}
+	n, err := strconv.Atoi(s)
+	return wildInput(n), err
+}
+
+func testRegistry() *Registry {
+	r := NewRegistry(parseWildInput)
+	r.RegisterConstraint("yes", func(ctx interface{}) bool { return true })
+	r.RegisterConstraint("no", func(ctx interface{}) bool { return false })
+	r.RegisterApply("count", func(ctx interface{}) { *ctx.(*int)++ })
+	return r
+}
+
+const testModelYAML = `
+name: test
+initial: A
+states: [A, B, C]
+transitions:
+  - {name: t0, from: A, to: B, input: "1", constraint: no}
+  - {name: t1, from: A, to: C, input: "*", constraint: yes, apply: count}
+  - {name: t2, from: B, to: A, input: "2"}
+  - {name: t3, from: B, to: A, input: "*"}
+  - {name: t4, from: C, to: A, input: "3", priority: 1}
+`
+
+func TestLoadStateModel(t *testing.T) {
+	m, err := LoadStateModel([]byte(testModelYAML), testRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	sm := NewStateMachine(m.Initial, m)
+	if s, _ := sm.Advance(&n, wildInput(1)); s != "C" || n != 1 {
+		t.Error("constraint and apply should be looked up by name", s, n)
+	}
+	if s, _ := sm.Advance(&n, wildInput(3)); s != "A" {
+		t.Error("unexpected state", s)
+	}
+
+	json := `{"name": "test", "initial": "A", "states": ["A", "B"],
+		"transitions": [{"name": "t0", "from": "A", "to": "B", "input": "1"},
+		                {"name": "t1", "from": "B", "to": "A", "input": "2"}]}`
+	m, err = LoadStateModel([]byte(json), testRegistry())
+	if err != nil || len(m.TransTable["A"]) != 1 {
+		t.Error("load json model failed", err)
+	}
+
+	_, err = LoadStateModel([]byte(strings.Replace(testModelYAML, "apply: count", "apply: nothing", 1)), testRegistry())
+	if err == nil || !strings.Contains(err.Error(), "unknown apply nothing") {
+		t.Error("unknown apply should fail", err)
+	}
+}
+
+func TestValidateStateModel(t *testing.T) {
+	bad := `
+name: bad
+initial: A
+states: [A, B, C, D]
+transitions:
+  - {name: t0, from: A, to: B, input: "1"}
+  - {name: t1, from: A, to: C, input: "*"}
+  - {name: t2, from: A, to: C, input: "2", priority: 1, constraint: yes}
+  - {name: t3, from: A, to: B, input: "2", priority: 1, constraint: yes}
+  - {name: t4, from: B, to: A, input: "*"}
+  - {name: t5, from: B, to: A, input: "1"}
+  - {name: t6, from: C, to: A, input: "1", constraint: yes}
+  - {name: t7, from: C, to: B, input: "1", constraint: no}
+`
+	_, err := LoadStateModel([]byte(bad), testRegistry())
+	if err == nil {
+		t.Fatal("bad model should fail")
+	}
+	for _, s := range []string{
+		"state D is unreachable",
+		"t0 and t1 overlap at priority 0",
+		"t2 and t3 overlap at priority 1",
+	} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("should report %q, got %v", s, err)
+		}
+	}
+	// 目标相同且无约束，或约束不同，可以区分
+	for _, s := range []string{"t4 and t5", "t6 and t7"} {
+		if strings.Contains(err.Error(), s) {
+			t.Errorf("should not report %q, got %v", s, err)
+		}
+	}
+}
+
+func TestStateModelDot(t *testing.T) {
+	m, err := LoadStateModel([]byte(testModelYAML), testRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dot := m.Dot()
+	for _, s := range []string{
+		`digraph "test" {`,
+		`"A" [peripheries=2];`,
+		`"A" -> "C" [label="t1 0 p0\n[yes]\n/count"];`,
+		`"C" -> "A" [label="t4 3 p1"];`,
+	} {
+		if !strings.Contains(dot, s) {
+			t.Errorf("dot should contain %s, got\n%s", s, dot)
+		}
+	}
+}
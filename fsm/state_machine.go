@@ -3,6 +3,8 @@ package fsm
 import (
 	"errors"
 	"fmt"
+	"sync"
+	"time"
 )
 
 var (
@@ -18,12 +20,16 @@ type State struct {
 }
 
 type Transition struct {
+	Name       string // 可选，用于校验和导出
 	From       string
 	To         string
 	Input      Input
 	Priority   int
 	Constraint func(ctx interface{}) bool
 	Apply      func(ctx interface{})
+	// 从描述文件加载时记录注册的名字，用于校验和导出
+	ConstraintName string
+	ApplyName      string
 }
 
 type Input interface {
@@ -33,6 +39,8 @@ type Input interface {
 /// StateModel
 
 type StateModel struct {
+	Name       string
+	Initial    string // 初始状态，用于检查不可达状态
 	States     map[string]*State
 	TransTable map[string][]*Transition
 }
@@ -84,15 +92,32 @@ func (m *StateModel) DumpTransitions() {
 
 /// StateMachine
 
+// 每个状态机最多保留的状态转换记录数
+const DEFAULT_HISTORY_SIZE = 64
+
+type TransitionRecord struct {
+	From     string
+	To       string
+	Input    string
+	Priority int
+	Time     time.Time
+}
+
 type StateMachine struct {
-	model   *StateModel
-	current string
+	model       *StateModel
+	current     string
+	history     []TransitionRecord // 环形缓冲
+	historyNext int
+	historySize int
+	mutex       *sync.Mutex // 保护history
 }
 
 func NewStateMachine(initalState string, model *StateModel) *StateMachine {
 	m := &StateMachine{
-		model:   model,
-		current: initalState,
+		model:       model,
+		current:     initalState,
+		historySize: DEFAULT_HISTORY_SIZE,
+		mutex:       &sync.Mutex{},
 	}
 
 	return m
@@ -102,6 +127,39 @@ func (m *StateMachine) CurrentState() string {
 	return m.current
 }
 
+// 修改保留的记录数，已有的记录会被清空
+func (m *StateMachine) SetHistorySize(n int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.historySize = n
+	m.history = nil
+	m.historyNext = 0
+}
+
+func (m *StateMachine) addHistory(r TransitionRecord) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.historySize <= 0 {
+		return
+	}
+	if len(m.history) < m.historySize {
+		m.history = append(m.history, r)
+		return
+	}
+	m.history[m.historyNext] = r
+	m.historyNext = (m.historyNext + 1) % m.historySize
+}
+
+// 按时间先后返回状态转换记录
+func (m *StateMachine) History() []TransitionRecord {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	records := make([]TransitionRecord, 0, len(m.history))
+	records = append(records, m.history[m.historyNext:]...)
+	records = append(records, m.history[:m.historyNext]...)
+	return records
+}
+
 func (m *StateMachine) Advance(ctx interface{}, input Input) (string, error) {
 	model := m.model
 	if model == nil {
@@ -122,6 +180,14 @@ func (m *StateMachine) Advance(ctx interface{}, input Input) (string, error) {
 	// 按状态转换函数的优先级，顺序检查是否可进行状态变换
 	for _, t := range ts {
 		if t.Input.Eq(input) && (t.Constraint == nil || t.Constraint(ctx)) {
+			m.addHistory(TransitionRecord{
+				From:     t.From,
+				To:       t.To,
+				Input:    fmt.Sprint(input),
+				Priority: t.Priority,
+				Time:     time.Now(),
+			})
+
 			// 状态转换
 			m.model.States[t.From].OnLeave(ctx)
 			m.current = t.To
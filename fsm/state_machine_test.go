@@ -0,0 +1,42 @@
+package fsm
+
+import (
+	"testing"
+)
+
+type testInput int
+
+func (i testInput) Eq(t Input) bool {
+	return i == t.(testInput)
+}
+
+func TestStateMachineHistory(t *testing.T) {
+	model := NewStateModel()
+	noop := func(ctx interface{}) {}
+	model.AddState(&State{"A", noop, noop})
+	model.AddState(&State{"B", noop, noop})
+	model.AddTransition(&Transition{From: "A", To: "B", Input: testInput(1), Priority: 1})
+	model.AddTransition(&Transition{From: "B", To: "A", Input: testInput(2)})
+
+	m := NewStateMachine("A", model)
+	m.SetHistorySize(3)
+	for i := 0; i < 5; i++ {
+		m.Advance(nil, testInput(1))
+		m.Advance(nil, testInput(2))
+	}
+	m.Advance(nil, testInput(1))
+
+	history := m.History()
+	if len(history) != 3 {
+		t.Fatal("history should be bounded", history)
+	}
+	last := history[2]
+	if last.From != "A" || last.To != "B" || last.Input != "1" || last.Priority != 1 {
+		t.Error("unexpected last record", last)
+	}
+	for i := 1; i < len(history); i++ {
+		if history[i].Time.Before(history[i-1].Time) || history[i].From != history[i-1].To {
+			t.Error("history should be in order", history)
+		}
+	}
+}
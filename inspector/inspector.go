@@ -1,11 +1,13 @@
 package inspector
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/ksarch-saas/cc/meta"
@@ -25,6 +27,9 @@ var (
 	ErrUnknown          = errors.New("inspector: unknown error")
 )
 
+// 一轮拓扑检查的总时间，超时的节点本轮视为不可用
+const INSPECT_TIMEOUT = 10 * time.Second
+
 type Inspector struct {
 	mutex       *sync.RWMutex
 	LocalRegion string
@@ -101,7 +106,7 @@ func (self *Inspector) buildNode(line string) (*topo.Node, bool, error) {
 		node.IncrPFailCount()
 	}
 	xs = strings.Split(tag, ":")
-	if len(xs) == 3 {
+	if len(xs) == 3 || len(xs) == 4 {
 		node.SetRegion(xs[0])
 		node.SetZone(xs[1])
 		node.SetRoom(xs[2])
@@ -117,15 +122,15 @@ func (self *Inspector) MeetNode(node *topo.Node) {
 		if seed.Ip == node.Ip && seed.Port == node.Port {
 			continue
 		}
-		_, err := redis.ClusterMeet(seed.Addr(), node.Ip, node.Port)
+		_, err := redis.Default().ClusterMeet(context.Background(), seed.Addr(), node.Ip, node.Port)
 		if err == nil {
 			break
 		}
 	}
 }
 
-func (self *Inspector) initClusterTopo(seed *topo.Node) (*topo.Cluster, error) {
-	resp, err := redis.ClusterNodes(seed.Addr())
+func (self *Inspector) initClusterTopo(ctx context.Context, seed *topo.Node) (*topo.Cluster, error) {
+	resp, err := redis.Default().ClusterNodes(ctx, seed.Addr())
 	if err != nil {
 		return nil, err
 	}
@@ -152,7 +157,7 @@ func (self *Inspector) initClusterTopo(seed *topo.Node) (*topo.Cluster, error) {
 		}
 		// 遇到myself，读取该节点的ClusterInfo
 		if myself {
-			info, err := redis.FetchClusterInfo(node.Addr())
+			info, err := redis.Default().FetchClusterInfo(ctx, node.Addr())
 			if err != nil {
 				return nil, err
 			}
@@ -165,8 +170,8 @@ func (self *Inspector) initClusterTopo(seed *topo.Node) (*topo.Cluster, error) {
 	return cluster, nil
 }
 
-func (self *Inspector) isFreeNode(seed *topo.Node) (bool, *topo.Node) {
-	resp, err := redis.ClusterNodes(seed.Addr())
+func (self *Inspector) isFreeNode(ctx context.Context, seed *topo.Node) (bool, *topo.Node) {
+	resp, err := redis.Default().ClusterNodes(ctx, seed.Addr())
 	if err != nil {
 		return false, nil
 	}
@@ -204,8 +209,8 @@ func (self *Inspector) isFreeNode(seed *topo.Node) (bool, *topo.Node) {
 	return false, nil
 }
 
-func (self *Inspector) checkClusterTopo(seed *topo.Node, cluster *topo.Cluster) error {
-	resp, err := redis.ClusterNodes(seed.Addr())
+func (self *Inspector) checkClusterTopo(ctx context.Context, seed *topo.Node, cluster *topo.Cluster) error {
+	resp, err := redis.Default().ClusterNodes(ctx, seed.Addr())
 	if err != nil {
 		return err
 	}
@@ -233,7 +238,7 @@ func (self *Inspector) checkClusterTopo(seed *topo.Node, cluster *topo.Cluster)
 		if node == nil {
 			if s.PFail {
 				glog.Warningf("forget dead node %s(%s)", s.Id, s.Addr())
-				redis.ClusterForget(seed.Addr(), s.Id)
+				redis.Default().ClusterForget(ctx, seed.Addr(), s.Id)
 			}
 			return fmt.Errorf("node not exist %s(%s)", s.Id, s.Addr())
 		}
@@ -256,7 +261,7 @@ func (self *Inspector) checkClusterTopo(seed *topo.Node, cluster *topo.Cluster)
 		}
 
 		if myself {
-			info, err := redis.FetchClusterInfo(node.Addr())
+			info, err := redis.Default().FetchClusterInfo(ctx, node.Addr())
 			if err != nil {
 				return err
 			}
@@ -287,10 +292,13 @@ func (self *Inspector) BuildClusterTopo() (*topo.Cluster, []*topo.Node, error) {
 		return nil, nil, ErrNoSeed
 	}
 
+	ctx, cancel := context.WithTimeout(context.Background(), INSPECT_TIMEOUT)
+	defer cancel()
+
 	// 过滤掉连接不上的节点
 	seeds := []*topo.Node{}
 	for _, s := range meta.Seeds() {
-		if redis.IsAlive(s.Addr()) {
+		if redis.Default().IsAlive(ctx, s.Addr()) {
 			seeds = append(seeds, s)
 		}
 	}
@@ -314,7 +322,7 @@ func (self *Inspector) BuildClusterTopo() (*topo.Cluster, []*topo.Node, error) {
 			break
 		}
 	}
-	cluster, err := self.initClusterTopo(seed)
+	cluster, err := self.initClusterTopo(ctx, seed)
 	if err != nil {
 		return nil, seeds, err
 	}
@@ -325,9 +333,9 @@ func (self *Inspector) BuildClusterTopo() (*topo.Cluster, []*topo.Node, error) {
 			if s == seed {
 				continue
 			}
-			err := self.checkClusterTopo(s, cluster)
+			err := self.checkClusterTopo(ctx, s, cluster)
 			if err != nil {
-				free, node := self.isFreeNode(s)
+				free, node := self.isFreeNode(ctx, s)
 				if free {
 					node.Free = true
 					glog.Infof("Found free node %s", node.Addr())
@@ -1,12 +1,15 @@
 package inspector
 
 import (
+	"context"
 	"fmt"
 	"time"
 
 	"github.com/golang/glog"
 	"github.com/ksarch-saas/cc/frontend/api"
 	"github.com/ksarch-saas/cc/meta"
+	"github.com/ksarch-saas/cc/metrics"
+	"github.com/ksarch-saas/cc/redis"
 	"github.com/ksarch-saas/cc/topo"
 	"github.com/ksarch-saas/cc/utils"
 )
@@ -58,8 +61,10 @@ func (self *Inspector) IsClusterDamaged(cluster *topo.Cluster, seeds []*topo.Nod
 	if len(seeds) > cluster.NumLocalRegionNode()/2 {
 		return false
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), INSPECT_TIMEOUT)
+	defer cancel()
 	for _, seed := range seeds {
-		c, err := self.initClusterTopo(seed)
+		c, err := self.initClusterTopo(ctx, seed)
 		if err != nil {
 			return false
 		}
@@ -74,6 +79,21 @@ func (self *Inspector) IsClusterDamaged(cluster *topo.Cluster, seeds []*topo.Nod
 	return true
 }
 
+// 关闭已经不在集群中的节点的连接池
+func (self *Inspector) evictPools(cluster *topo.Cluster) {
+	keep := []string{}
+	for _, node := range cluster.AllNodes() {
+		keep = append(keep, node.Addr())
+	}
+	for _, seed := range meta.Seeds() {
+		keep = append(keep, seed.Addr())
+	}
+	evicted := redis.EvictPools(keep)
+	if len(evicted) > 0 {
+		glog.Infof("evict redis pools of %v", evicted)
+	}
+}
+
 func (self *Inspector) Run() {
 	tickChan := time.NewTicker(time.Second * 1).C
 	for {
@@ -82,8 +102,11 @@ func (self *Inspector) Run() {
 			if !meta.IsRegionLeader() {
 				continue
 			}
+			start := time.Now()
 			cluster, seeds, err := self.BuildClusterTopo()
+			metrics.InspectorCycle.Observe(time.Since(start).Seconds())
 			if err != nil {
+				metrics.InspectorErrors.Inc()
 				glog.Infof("build cluster topo failed, %v", err)
 			}
 			if cluster == nil {
@@ -96,6 +119,7 @@ func (self *Inspector) Run() {
 			var nodes []*topo.Node
 			if err == nil {
 				nodes = cluster.LocalRegionNodes()
+				self.evictPools(cluster)
 			}
 			err = SendRegionTopoSnapshot(nodes, failureInfo)
 			if err != nil {
@@ -15,12 +15,6 @@ import (
 // - FATAL
 // - EVENT
 
-var LogRingBuffer []string
-
-func init() {
-	LogRingBuffer = make([]string, 40000)
-}
-
 func WriteFileHandler(i interface{}) bool {
 	data := i.(*streams.LogStreamData)
 	switch data.Level {
@@ -40,23 +34,6 @@ func WriteFileHandler(i interface{}) bool {
 	return true
 }
 
-func WriteRingBufferHandler(i interface{}) bool {
-	msg := i.(*streams.LogStreamData)
-	if msg.Level == "VERBOSE" {
-		return true
-	}
-
-	line := fmt.Sprintf("%s %s: [%s] - %s\n", msg.Level,
-		msg.Time.Format("2006/01/02 15:04:05"), msg.Target, msg.Message)
-
-	if len(LogRingBuffer) >= cap(LogRingBuffer)-1 {
-		LogRingBuffer = LogRingBuffer[1:]
-	}
-	LogRingBuffer = append(LogRingBuffer, line)
-
-	return true
-}
-
 func Verbose(target string, args ...interface{}) {
 	level := "VERBOSE"
 	message := fmt.Sprint(args...)
@@ -0,0 +1,356 @@
+package log
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/ksarch-saas/cc/streams"
+)
+
+/// 日志和事件的磁盘存储
+/// 目录下按序号分段，每段是一个JSON行文件(00000001.log)，当前段超过MaxSegmentBytes时切换到新段，
+/// 最多保留MaxSegments段，超出时删除最旧的段
+/// 查询从最新的段往前读，按段的起始时间跳过时间范围之外的段
+
+const (
+	DEFAULT_SEGMENT_BYTES = 16 * 1024 * 1024
+	DEFAULT_SEGMENTS      = 16
+	MAX_QUERY_LIMIT       = 10000
+	segmentSuffix         = ".log"
+)
+
+var levels = []string{"VERBOSE", "INFO", "EVENT", "WARNING", "ERROR", "FATAL"}
+
+func levelRank(level string) int {
+	level = strings.ToUpper(level)
+	for i, l := range levels {
+		if l == level {
+			return i
+		}
+	}
+	return -1
+}
+
+type Record struct {
+	Level   string
+	Time    time.Time
+	Target  string
+	Message string
+	App     string
+	Region  string
+}
+
+func (r *Record) String() string {
+	return fmt.Sprintf("%s %s: [%s] - %s\n", r.Level,
+		r.Time.Format("2006/01/02 15:04:05"), r.Target, r.Message)
+}
+
+type Query struct {
+	Level    string    // 最低级别，为空时不过滤
+	Target   string    // Target前缀，如节点地址或迁移任务名
+	Since    time.Time // 为零时不限制
+	Until    time.Time
+	Contains string // 消息中包含的子串
+	Limit    int    // 返回最近的条数，<=0时为MAX_QUERY_LIMIT
+	Offset   int    // 跳过最近满足条件的条数，用于从新到旧分页
+}
+
+func (q *Query) match(r *Record) bool {
+	if q.Level != "" && levelRank(r.Level) < levelRank(q.Level) {
+		return false
+	}
+	if q.Target != "" && !strings.HasPrefix(r.Target, q.Target) {
+		return false
+	}
+	if !q.Since.IsZero() && r.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && r.Time.After(q.Until) {
+		return false
+	}
+	if q.Contains != "" && !strings.Contains(r.Message, q.Contains) {
+		return false
+	}
+	return true
+}
+
+type segment struct {
+	seq   int
+	path  string
+	start time.Time // 第一条记录的时间，空段为零
+}
+
+type Store struct {
+	MaxSegmentBytes int64
+	MaxSegments     int
+
+	dir      string
+	app      string
+	region   string
+	mutex    sync.Mutex
+	segments []*segment // 按序号递增，最后一个是当前段
+	file     *os.File
+	size     int64
+}
+
+// 打开目录下的存储，新写入的记录带上app和region
+func OpenStore(dir, app, region string) (*Store, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{
+		MaxSegmentBytes: DEFAULT_SEGMENT_BYTES,
+		MaxSegments:     DEFAULT_SEGMENTS,
+		dir:             dir,
+		app:             app,
+		region:          region,
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		seq, err := strconv.Atoi(strings.TrimSuffix(name, segmentSuffix))
+		if err != nil {
+			continue
+		}
+		seg := &segment{seq: seq, path: filepath.Join(dir, name)}
+		seg.start = firstRecordTime(seg.path)
+		s.segments = append(s.segments, seg)
+	}
+	sort.Sort(bySeq(s.segments))
+
+	if len(s.segments) == 0 {
+		return s, s.newSegment(1)
+	}
+	last := s.segments[len(s.segments)-1]
+	s.file, err = os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.file.Stat()
+	if err != nil {
+		s.file.Close()
+		return nil, err
+	}
+	s.size = info.Size()
+	return s, nil
+}
+
+func firstRecordTime(path string) time.Time {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return time.Time{}
+	}
+	var r Record
+	if json.Unmarshal(line, &r) != nil {
+		return time.Time{}
+	}
+	return r.Time
+}
+
+func (s *Store) newSegment(seq int) error {
+	path := filepath.Join(s.dir, fmt.Sprintf("%08d%s", seq, segmentSuffix))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	s.file = f
+	s.size = 0
+	s.segments = append(s.segments, &segment{seq: seq, path: path})
+	for len(s.segments) > s.MaxSegments && s.MaxSegments > 0 {
+		os.Remove(s.segments[0].path)
+		s.segments = s.segments[1:]
+	}
+	return nil
+}
+
+func (s *Store) Append(r *Record) error {
+	if r.App == "" {
+		r.App = s.app
+	}
+	if r.Region == "" {
+		r.Region = s.region
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		return fmt.Errorf("log: store closed")
+	}
+	if s.size > 0 && s.size+int64(len(data)) > s.MaxSegmentBytes {
+		s.file.Close()
+		err = s.newSegment(s.segments[len(s.segments)-1].seq + 1)
+		if err != nil {
+			s.file = nil
+			return err
+		}
+	}
+	cur := s.segments[len(s.segments)-1]
+	if cur.start.IsZero() {
+		cur.start = r.Time
+	}
+	n, err := s.file.Write(data)
+	s.size += int64(n)
+	return err
+}
+
+// 返回满足条件的最近Limit条记录，按时间从旧到新
+func (s *Store) Query(q *Query) ([]*Record, error) {
+	limit := q.Limit
+	if limit <= 0 || limit > MAX_QUERY_LIMIT {
+		limit = MAX_QUERY_LIMIT
+	}
+
+	// 读文件时不持锁，当前段只读到此刻的大小
+	s.mutex.Lock()
+	segs := make([]segment, len(s.segments))
+	for i, seg := range s.segments {
+		segs[i] = *seg
+	}
+	size := s.size
+	s.mutex.Unlock()
+
+	records := []*Record{}
+	skip := q.Offset
+	for i := len(segs) - 1; i >= 0 && len(records) < limit; i-- {
+		seg := segs[i]
+		// 段内的记录都早于下一段的起始时间
+		if i+1 < len(segs) && !q.Since.IsZero() && !segs[i+1].start.IsZero() && segs[i+1].start.Before(q.Since) {
+			break
+		}
+		if !q.Until.IsZero() && !seg.start.IsZero() && seg.start.After(q.Until) {
+			continue
+		}
+		max := int64(-1)
+		if i == len(segs)-1 {
+			max = size
+		}
+		lines, err := readSegment(seg.path, max)
+		if err != nil {
+			return nil, err
+		}
+		// 从后往前解析，够数后不再解析更早的行
+		for j := len(lines) - 1; j >= 0 && len(records) < limit; j-- {
+			var r Record
+			if json.Unmarshal(lines[j], &r) != nil || !q.match(&r) {
+				continue
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			records = append(records, &r)
+		}
+	}
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return records, nil
+}
+
+// 读取段中的行，max>=0时只读前max字节，段已被删除时返回空
+func readSegment(path string, max int64) ([][]byte, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if max >= 0 {
+		r = io.LimitReader(f, max)
+	}
+	lines := [][]byte{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := make([]byte, len(scanner.Bytes()))
+		copy(line, scanner.Bytes())
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+func (s *Store) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+type bySeq []*segment
+
+func (a bySeq) Len() int           { return len(a) }
+func (a bySeq) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a bySeq) Less(i, j int) bool { return a[i].seq < a[j].seq }
+
+/// 默认存储，由main设置
+
+var (
+	storeMutex   sync.RWMutex
+	defaultStore *Store
+)
+
+func SetStore(s *Store) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	defaultStore = s
+}
+
+func GetStore() *Store {
+	storeMutex.RLock()
+	defer storeMutex.RUnlock()
+	return defaultStore
+}
+
+// LogStream的回调，VERBOSE级别不存储
+func WriteStoreHandler(i interface{}) bool {
+	data := i.(*streams.LogStreamData)
+	s := GetStore()
+	if s == nil || data.Level == "VERBOSE" {
+		return true
+	}
+	err := s.Append(&Record{
+		Level:   data.Level,
+		Time:    data.Time,
+		Target:  data.Target,
+		Message: data.Message,
+	})
+	if err != nil {
+		glog.Warningf("log: append to store failed, %v", err)
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStoreRotateAndQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := OpenStore(dir, "app", "bj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.MaxSegmentBytes = 1024
+	s.MaxSegments = 4
+
+	base := time.Date(2016, 1, 1, 0, 0, 0, 0, time.Local)
+	for i := 0; i < 100; i++ {
+		level := "INFO"
+		if i%10 == 0 {
+			level = "EVENT"
+		}
+		err := s.Append(&Record{
+			Level:   level,
+			Time:    base.Add(time.Duration(i) * time.Second),
+			Target:  fmt.Sprintf("127.0.0.1:%d", 7000+i%2),
+			Message: fmt.Sprintf("message %d", i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	if len(files) != 4 {
+		t.Errorf("should keep 4 segments, got %d", len(files))
+	}
+
+	// 最近的3条，按时间从旧到新
+	rs, err := s.Query(&Query{Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 3 || rs[0].Message != "message 97" || rs[2].Message != "message 99" {
+		t.Errorf("unexpected records %v", rs)
+	}
+	if rs[0].App != "app" || rs[0].Region != "bj" {
+		t.Errorf("app and region should be filled, got %+v", rs[0])
+	}
+
+	rs, _ = s.Query(&Query{
+		Level:  "event",
+		Target: "127.0.0.1:7000",
+		Since:  base.Add(75 * time.Second),
+		Until:  base.Add(95 * time.Second),
+	})
+	if len(rs) != 2 || rs[0].Message != "message 80" || rs[1].Message != "message 90" {
+		t.Errorf("unexpected records %v", rs)
+	}
+
+	// 跳过最近的5条，跨段分页
+	rs, _ = s.Query(&Query{Offset: 5, Limit: 20})
+	if len(rs) != 20 || rs[0].Message != "message 75" || rs[19].Message != "message 94" {
+		t.Errorf("unexpected records with offset %v", rs)
+	}
+
+	// message 9所在的段已被删除
+	rs, _ = s.Query(&Query{Contains: "message 9"})
+	if len(rs) != 10 || rs[0].Message != "message 90" {
+		t.Errorf("expect 10 records containing 'message 9', got %v", rs)
+	}
+	s.Close()
+
+	// 重新打开后继续追加到最后一段
+	s, err = OpenStore(dir, "app", "bj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Append(&Record{Level: "ERROR", Time: base.Add(100 * time.Second), Target: "CLUSTER", Message: "after reopen"})
+	rs, _ = s.Query(&Query{Level: "ERROR"})
+	if len(rs) != 1 || rs[0].Message != "after reopen" {
+		t.Errorf("unexpected records after reopen %v", rs)
+	}
+	rs, _ = s.Query(&Query{Limit: 2})
+	if len(rs) != 2 || rs[0].Message != "message 99" {
+		t.Errorf("old records should be kept after reopen, got %v", rs)
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"github.com/ksarch-saas/cc/inspector"
 	"github.com/ksarch-saas/cc/log"
 	"github.com/ksarch-saas/cc/meta"
+	"github.com/ksarch-saas/cc/migrate"
+	"github.com/ksarch-saas/cc/notify"
 	"github.com/ksarch-saas/cc/streams"
 	"github.com/ksarch-saas/cc/topo"
 )
@@ -21,6 +23,8 @@ var (
 	zkHosts     string
 	httpPort    int
 	wsPort      int
+	migHistory  string
+	logStore    string
 )
 
 func init() {
@@ -30,6 +34,8 @@ func init() {
 	flag.StringVar(&zkHosts, "zkhosts", "", "zk hosts, seperate by comma")
 	flag.IntVar(&httpPort, "http-port", 0, "http port")
 	flag.IntVar(&wsPort, "ws-port", 0, "ws port")
+	flag.StringVar(&migHistory, "migrate-history", "migrate_history.log", "slot migration history file, empty to disable")
+	flag.StringVar(&logStore, "log-store", "log_store", "directory of the log and event store, empty to disable")
 }
 
 func main() {
@@ -60,9 +66,21 @@ func main() {
 		glog.Warning(err)
 	}
 
+	migrate.SetHistoryFile(migHistory)
+
+	if logStore != "" {
+		store, err := log.OpenStore(logStore, appName, localRegion)
+		if err != nil {
+			glog.Warningf("open log store failed, %v", err)
+		} else {
+			log.SetStore(store)
+		}
+	}
+
 	streams.StartAllStreams()
 	streams.LogStream.Sub(log.WriteFileHandler)
-	streams.LogStream.Sub(log.WriteRingBufferHandler)
+	streams.LogStream.Sub(log.WriteStoreHandler)
+	notify.NewNotifier(notify.AppConfig).Start()
 
 	sp := inspector.NewInspector()
 	go sp.Run()
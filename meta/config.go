@@ -12,9 +12,17 @@ import (
 )
 
 const (
-	DEFAULT_AUTOFAILOVER_INTERVAL  time.Duration = 5 * time.Minute // 5min
-	DEFAULT_MIGRATE_KEYS_EACH_TIME               = 100
-	DEFAULT_MIGRATE_TIMEOUT                      = 2000
+	DEFAULT_AUTOFAILOVER_INTERVAL     time.Duration = 5 * time.Minute // 5min
+	DEFAULT_MIGRATE_KEYS_EACH_TIME                  = 100
+	DEFAULT_MIGRATE_BATCH_SIZE                      = 10
+	DEFAULT_MIGRATE_CONCURRENCY                     = 4
+	DEFAULT_MIGRATE_TIMEOUT                         = 2000
+	DEFAULT_MIGRATE_LARGE_KEY_BYTES                 = 8 * 1024 * 1024
+	DEFAULT_MIGRATE_LARGE_KEY_RETRIES               = 5
+	DEFAULT_FAILOVER_KEEP_DAYS                      = 90
+	DEFAULT_FAILOVER_KEEP_COUNT                     = 1000
+	DEFAULT_ALERT_RETRIES                           = 3
+	DEFAULT_ALERT_SILENCE_INTERVAL                  = 5 * time.Minute
 )
 
 type AppConfig struct {
@@ -25,8 +33,37 @@ type AppConfig struct {
 	AutoFailoverInterval  time.Duration
 	MasterRegion          string
 	Regions               []string
-	MigrateKeysEachTime   int
+	MigrateKeysEachTime   int // 每次GETKEYSINSLOT取多少个key
+	MigrateBatchSize      int // 每条MIGRATE ... KEYS命令迁移多少个key
+	MigrateConcurrency    int // 每次pipeline中同时发送多少条MIGRATE命令
 	MigrateTimeout        int
+	// 迁移限速阈值，Source或Target节点超过任一阈值时降低迁移速度，0表示不检查
+	MigrateThrottleOpsPerSec  int   // instantaneous_ops_per_sec
+	MigrateThrottleUsedMemory int64 // used_memory，单位字节
+	MigrateThrottleLatencyUs  int   // 命令平均耗时，单位微秒
+	// 超过该大小(字节)的key单独迁移，超时时间按大小放大
+	MigrateLargeKeyBytes int64
+	// 大key连续失败多少次后挂起任务，等待人工处理
+	MigrateLargeKeyRetries int
+	// 选择新主的策略：maxoffset, zone, leastloaded, priority，为空时使用maxoffset
+	FailoverPolicy string
+	// zone策略优先的zone或zone:room，为空时取挂掉的主所在的zone和room
+	FailoverPreferredZone string
+	// 自动Failover时从节点最多落后的复制偏移量(字节)，没有满足条件的从节点时不自动Failover，0表示不检查
+	MaxFailoverLagBytes int64
+	// Failover历史保留的天数和条数，超过任一限制的记录会被清理
+	FailoverHistoryKeepDays  int
+	FailoverHistoryKeepCount int
+	// 清理Failover历史前是否归档
+	FailoverHistoryArchive bool
+	// 是否允许主地域整体故障时，将主切换到其他地域，需要多数地域投票和人工确认
+	RegionFailover bool
+	// 告警通知的webhook地址，为空时不发送
+	AlertWebhooks []string
+	// 每个webhook发送失败后的重试次数
+	AlertRetries int
+	// 同一节点同类告警的静默时间，期间的重复告警只计数
+	AlertSilenceInterval time.Duration
 }
 
 type ControllerConfig struct {
@@ -45,6 +82,10 @@ type FailoverRecord struct {
 	Tag       string
 	Role      string
 	Ranges    []topo.Range
+	// 地域级Failover的汇总记录，旧主ID -> 新主ID
+	NewRegion string            `json:",omitempty"`
+	Promoted  map[string]string `json:",omitempty"`
+	Failed    map[string]string `json:",omitempty"` // 旧主ID -> 错误，有失败时不修改MasterRegion
 }
 
 func (m *Meta) handleAppConfigChanged(watch <-chan zookeeper.Event) {
@@ -53,15 +94,6 @@ func (m *Meta) handleAppConfigChanged(watch <-chan zookeeper.Event) {
 		if event.Type == zookeeper.EventNodeDataChanged {
 			a, w, err := m.FetchAppConfig()
 			if err == nil {
-				if a.MigrateKeysEachTime == 0 {
-					a.MigrateKeysEachTime = DEFAULT_MIGRATE_KEYS_EACH_TIME
-				}
-				if a.MigrateTimeout == 0 {
-					a.MigrateTimeout = DEFAULT_MIGRATE_TIMEOUT
-				}
-				if a.AutoFailoverInterval == 0 {
-					a.AutoFailoverInterval = DEFAULT_AUTOFAILOVER_INTERVAL
-				}
 				m.appConfig.Store(a)
 				glog.Warning("meta: app config changed.", a)
 			} else {
@@ -96,21 +128,50 @@ func (m *Meta) FetchAppConfig() (*AppConfig, <-chan zookeeper.Event, error) {
 	if len(c.Regions) == 0 {
 		return nil, watch, fmt.Errorf("meta: regions empty")
 	}
+	c.setDefaults()
+	return &c, watch, nil
+}
+
+// 未配置的项使用默认值
+func (c *AppConfig) setDefaults() {
 	if c.MigrateKeysEachTime == 0 {
 		c.MigrateKeysEachTime = DEFAULT_MIGRATE_KEYS_EACH_TIME
 	}
+	if c.MigrateBatchSize == 0 {
+		c.MigrateBatchSize = DEFAULT_MIGRATE_BATCH_SIZE
+	}
+	if c.MigrateConcurrency == 0 {
+		c.MigrateConcurrency = DEFAULT_MIGRATE_CONCURRENCY
+	}
 	if c.MigrateTimeout == 0 {
 		c.MigrateTimeout = DEFAULT_MIGRATE_TIMEOUT
 	}
+	if c.MigrateLargeKeyBytes == 0 {
+		c.MigrateLargeKeyBytes = DEFAULT_MIGRATE_LARGE_KEY_BYTES
+	}
+	if c.MigrateLargeKeyRetries == 0 {
+		c.MigrateLargeKeyRetries = DEFAULT_MIGRATE_LARGE_KEY_RETRIES
+	}
+	if c.FailoverHistoryKeepDays == 0 {
+		c.FailoverHistoryKeepDays = DEFAULT_FAILOVER_KEEP_DAYS
+	}
+	if c.FailoverHistoryKeepCount == 0 {
+		c.FailoverHistoryKeepCount = DEFAULT_FAILOVER_KEEP_COUNT
+	}
 	if c.AutoFailoverInterval == 0 {
 		c.AutoFailoverInterval = DEFAULT_AUTOFAILOVER_INTERVAL
 	}
-	return &c, watch, nil
+	if c.AlertRetries == 0 {
+		c.AlertRetries = DEFAULT_ALERT_RETRIES
+	}
+	if c.AlertSilenceInterval == 0 {
+		c.AlertSilenceInterval = DEFAULT_ALERT_SILENCE_INTERVAL
+	}
 }
 
 func (m *Meta) RegisterLocalController() error {
 	zconn := m.zconn
-	zkPath := fmt.Sprintf(m.ccDirPath + "/cc_" + m.localRegion + "_")
+	zkPath := m.ccDirPath + "/cc_" + m.localRegion + "_"
 	conf := &ControllerConfig{
 		Ip:       m.localIp,
 		HttpPort: m.httpPort,
@@ -173,37 +234,3 @@ func (m *Meta) UnmarkFailoverDoing() error {
 	glog.Warning("meta: unmark doing failover")
 	return nil
 }
-
-func (m *Meta) LastFailoverRecord() (*FailoverRecord, error) {
-	children, stat, err := m.zconn.Children("/r3/failover/history")
-	if err != nil {
-		return nil, err
-	}
-	if stat.NumChildren == 0 {
-		return nil, nil
-	}
-
-	last := children[len(children)-1]
-	data, _, err := m.zconn.Get("/r3/failover/history/" + last)
-	if err != nil {
-		return nil, err
-	}
-
-	var record FailoverRecord
-	err = json.Unmarshal([]byte(data), &record)
-	if err != nil {
-		return nil, err
-	}
-	return &record, nil
-}
-
-func (m *Meta) AddFailoverRecord(record *FailoverRecord) error {
-	zkPath := fmt.Sprintf("/r3/failover/history/record_%s_%s", record.AppName, record.Region)
-	data, err := json.Marshal(record)
-	if err != nil {
-		return err
-	}
-	path, err := m.zconn.Create(zkPath, data, zookeeper.FlagSequence, zookeeper.WorldACL(PERM_FILE))
-	glog.Warningf("meta: failover record created at %s", path)
-	return nil
-}
@@ -0,0 +1,246 @@
+package meta
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/ksarch-saas/cc/utils/clock"
+	zookeeper "github.com/samuel/go-zookeeper/zk"
+)
+
+/// Failover预算，所有App共享，按令牌桶限制每小时自动Failover的次数
+/// /r3/failover/budget/config           各维度每小时最多Failover次数，0表示不限制
+/// /r3/failover/budget/app_<appname>    App维度
+/// /r3/failover/budget/host_<hostname>  机器维度，按挂掉的主所在机器
+/// /r3/failover/budget/global           全局
+/// 令牌桶不存在时认为是满的，重置即删除对应的令牌桶
+
+const (
+	FAILOVER_BUDGET_DIR     = "/r3/failover/budget"
+	FAILOVER_BUDGET_RETRIES = 3
+)
+
+type FailoverBudgetConfig struct {
+	AppPerHour    int
+	HostPerHour   int
+	GlobalPerHour int
+}
+
+type FailoverBucket struct {
+	Name       string
+	Capacity   int
+	Tokens     float64
+	UpdateTime time.Time
+	version    int32 // 不存在时为-1
+}
+
+// 按经过的时间补充令牌，每小时补充Capacity个
+func (b *FailoverBucket) refill(capacity int, now time.Time) {
+	if b.version < 0 || b.Capacity != capacity {
+		b.Tokens = float64(capacity)
+	} else {
+		b.Tokens += now.Sub(b.UpdateTime).Hours() * float64(capacity)
+		if b.Tokens > float64(capacity) {
+			b.Tokens = float64(capacity)
+		}
+	}
+	b.Capacity = capacity
+	b.UpdateTime = now
+}
+
+type ErrFailoverBudgetExhausted struct {
+	Bucket string
+	Limit  int
+}
+
+func (e *ErrFailoverBudgetExhausted) Error() string {
+	return fmt.Sprintf("meta: failover budget %s exhausted, limit %d per hour", e.Bucket, e.Limit)
+}
+
+func (m *Meta) FailoverBudgetConfig() (*FailoverBudgetConfig, error) {
+	var c FailoverBudgetConfig
+	data, _, err := m.zconn.Get(FAILOVER_BUDGET_DIR + "/config")
+	if err == zookeeper.ErrNoNode {
+		return &c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &c)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (m *Meta) SetFailoverBudgetConfig(c *FailoverBudgetConfig) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	glog.Warningf("meta: failover budget config changed, %s", string(data))
+	return m.setOrCreate(FAILOVER_BUDGET_DIR+"/config", data)
+}
+
+func (m *Meta) fetchFailoverBucket(name string) (*FailoverBucket, error) {
+	b := &FailoverBucket{Name: name, version: -1}
+	data, stat, err := m.zconn.Get(FAILOVER_BUDGET_DIR + "/" + name)
+	if err == zookeeper.ErrNoNode {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, b)
+	if err != nil {
+		return nil, err
+	}
+	b.version = stat.Version
+	return b, nil
+}
+
+// 从App、机器和全局三个令牌桶中各取一个令牌，任一不足时都不扣除
+func (m *Meta) ConsumeFailoverBudget(appName, hostname string) error {
+	c, err := m.FailoverBudgetConfig()
+	if err != nil {
+		return err
+	}
+	limits := map[string]int{
+		"app_" + appName:   c.AppPerHour,
+		"host_" + hostname: c.HostPerHour,
+		"global":           c.GlobalPerHour,
+	}
+
+	for i := 0; i < FAILOVER_BUDGET_RETRIES; i++ {
+		ops := []interface{}{}
+		now := clock.Now()
+		for name, limit := range limits {
+			if limit <= 0 {
+				continue
+			}
+			b, err := m.fetchFailoverBucket(name)
+			if err != nil {
+				return err
+			}
+			b.refill(limit, now)
+			if b.Tokens < 1 {
+				return &ErrFailoverBudgetExhausted{name, limit}
+			}
+			b.Tokens--
+			data, err := json.Marshal(b)
+			if err != nil {
+				return err
+			}
+			path := FAILOVER_BUDGET_DIR + "/" + name
+			if b.version < 0 {
+				ops = append(ops, &zookeeper.CreateRequest{Path: path, Data: data, Acl: zookeeper.WorldACL(PERM_FILE)})
+			} else {
+				ops = append(ops, &zookeeper.SetDataRequest{Path: path, Data: data, Version: b.version})
+			}
+		}
+		if len(ops) == 0 {
+			return nil
+		}
+		_, err = CreateRecursive(m.zconn, FAILOVER_BUDGET_DIR, "", 0, zookeeper.WorldACL(PERM_DIRECTORY))
+		if err != nil && err != zookeeper.ErrNodeExists {
+			return err
+		}
+		// 失败一般是被其他Controller修改了，重新计算
+		_, err = m.zconn.Multi(ops...)
+		if err == nil {
+			return nil
+		}
+		glog.Warningf("meta: update failover budget failed, retry, %v", err)
+	}
+	return fmt.Errorf("meta: consume failover budget failed after %d retries, %v", FAILOVER_BUDGET_RETRIES, err)
+}
+
+// 返回已有的令牌桶，令牌数按当前时间补充后计算
+func (m *Meta) FailoverBuckets() ([]*FailoverBucket, error) {
+	c, err := m.FailoverBudgetConfig()
+	if err != nil {
+		return nil, err
+	}
+	children, _, err := m.zconn.Children(FAILOVER_BUDGET_DIR)
+	if err == zookeeper.ErrNoNode {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(children)
+	now := clock.Now()
+	buckets := []*FailoverBucket{}
+	for _, child := range children {
+		if child == "config" {
+			continue
+		}
+		b, err := m.fetchFailoverBucket(child)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case strings.HasPrefix(child, "app_"):
+			b.refill(c.AppPerHour, now)
+		case strings.HasPrefix(child, "host_"):
+			b.refill(c.HostPerHour, now)
+		default:
+			b.refill(c.GlobalPerHour, now)
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, nil
+}
+
+// 重置令牌桶，name为空时重置所有
+func (m *Meta) ResetFailoverBudget(name string) error {
+	if name != "" {
+		if name == "config" || strings.Contains(name, "/") {
+			return fmt.Errorf("meta: invalid failover bucket %s", name)
+		}
+		glog.Warningf("meta: reset failover budget %s", name)
+		return m.deleteIfExist(FAILOVER_BUDGET_DIR + "/" + name)
+	}
+	children, _, err := m.zconn.Children(FAILOVER_BUDGET_DIR)
+	if err == zookeeper.ErrNoNode {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if child == "config" {
+			continue
+		}
+		err = m.deleteIfExist(FAILOVER_BUDGET_DIR + "/" + child)
+		if err != nil {
+			return err
+		}
+	}
+	glog.Warning("meta: reset all failover budgets")
+	return nil
+}
+
+func GetFailoverBudgetConfig() (*FailoverBudgetConfig, error) {
+	return meta.FailoverBudgetConfig()
+}
+
+func SetFailoverBudgetConfig(c *FailoverBudgetConfig) error {
+	return meta.SetFailoverBudgetConfig(c)
+}
+
+func ConsumeFailoverBudget(appName, hostname string) error {
+	return meta.ConsumeFailoverBudget(appName, hostname)
+}
+
+func FailoverBuckets() ([]*FailoverBucket, error) {
+	return meta.FailoverBuckets()
+}
+
+func ResetFailoverBudget(name string) error {
+	return meta.ResetFailoverBudget(name)
+}
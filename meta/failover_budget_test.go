@@ -0,0 +1,175 @@
+package meta
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ksarch-saas/cc/utils/clock"
+	zookeeper "github.com/samuel/go-zookeeper/zk"
+)
+
+// 每次Multi之前修改global令牌桶，模拟其他Controller并发扣除
+type racyZk struct {
+	*FakeZk
+	multis    int
+	conflicts int // 前几次Multi前制造冲突
+}
+
+func (z *racyZk) Multi(ops ...interface{}) ([]zookeeper.MultiResponse, error) {
+	z.multis++
+	if z.multis <= z.conflicts {
+		data, _, err := z.Get(FAILOVER_BUDGET_DIR + "/global")
+		if err == nil {
+			z.Set(FAILOVER_BUDGET_DIR+"/global", data, -1)
+		}
+	}
+	return z.FakeZk.Multi(ops...)
+}
+
+func setupBudget(t *testing.T, zk ZkConn) *clock.Fake {
+	fake := clock.NewFake(time.Date(2016, 1, 1, 0, 0, 0, 0, time.Local))
+	clock.Set(fake)
+	RunWithZk("test", "bj", zk, &AppConfig{AppName: "test", MasterRegion: "bj", Regions: []string{"bj"}})
+	err := SetFailoverBudgetConfig(&FailoverBudgetConfig{AppPerHour: 2, GlobalPerHour: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake
+}
+
+func bucketTokens(t *testing.T) map[string]float64 {
+	buckets, err := FailoverBuckets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := map[string]float64{}
+	for _, b := range buckets {
+		tokens[b.Name] = b.Tokens
+	}
+	return tokens
+}
+
+func TestFailoverBucketRefill(t *testing.T) {
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.Local)
+	tests := []struct {
+		bucket   FailoverBucket
+		capacity int
+		elapsed  time.Duration
+		tokens   float64
+	}{
+		// 不存在的令牌桶是满的
+		{FailoverBucket{version: -1}, 4, 0, 4},
+		{FailoverBucket{Capacity: 4, Tokens: 1}, 4, 30 * time.Minute, 3},
+		{FailoverBucket{Capacity: 4, Tokens: 0}, 4, 15 * time.Minute, 1},
+		// 不超过容量
+		{FailoverBucket{Capacity: 4, Tokens: 3}, 4, time.Hour, 4},
+		// 容量变化后重新装满
+		{FailoverBucket{Capacity: 4, Tokens: 0}, 10, 0, 10},
+	}
+	for i, test := range tests {
+		b := test.bucket
+		b.UpdateTime = now.Add(-test.elapsed)
+		b.refill(test.capacity, now)
+		if b.Tokens != test.tokens || b.Capacity != test.capacity || !b.UpdateTime.Equal(now) {
+			t.Errorf("case %d: expect %v tokens, got %+v", i, test.tokens, b)
+		}
+	}
+}
+
+func TestConsumeFailoverBudget(t *testing.T) {
+	fake := setupBudget(t, NewFakeZk())
+	defer clock.Set(nil)
+
+	for i := 0; i < 2; i++ {
+		if err := ConsumeFailoverBudget("test", "host1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := ConsumeFailoverBudget("test", "host1")
+	if e, ok := err.(*ErrFailoverBudgetExhausted); !ok || e.Bucket != "app_test" || e.Limit != 2 {
+		t.Fatalf("app budget should be exhausted, got %v", err)
+	}
+	// 失败时其他令牌桶不扣除，HostPerHour为0不限制
+	tokens := bucketTokens(t)
+	if len(tokens) != 2 || tokens["app_test"] != 0 || tokens["global"] != 1 {
+		t.Errorf("unexpected buckets %v", tokens)
+	}
+
+	// 半小时后App补充1个，全局补充1.5个
+	fake.Advance(30 * time.Minute)
+	if err := ConsumeFailoverBudget("test", "host1"); err != nil {
+		t.Fatal(err)
+	}
+	tokens = bucketTokens(t)
+	if tokens["app_test"] != 0 || tokens["global"] != 1.5 {
+		t.Errorf("unexpected buckets after refill %v", tokens)
+	}
+	// 其他App只受全局限制
+	if err := ConsumeFailoverBudget("other", "host2"); err != nil {
+		t.Fatal(err)
+	}
+	err = ConsumeFailoverBudget("other", "host2")
+	if e, ok := err.(*ErrFailoverBudgetExhausted); !ok || e.Bucket != "global" {
+		t.Errorf("global budget should be exhausted, got %v", err)
+	}
+}
+
+func TestConsumeFailoverBudgetRetry(t *testing.T) {
+	zk := &racyZk{FakeZk: NewFakeZk(), conflicts: 1}
+	setupBudget(t, zk)
+	defer clock.Set(nil)
+
+	// 第一次令牌桶不存在，创建时无冲突
+	if err := ConsumeFailoverBudget("test", "host1"); err != nil {
+		t.Fatal(err)
+	}
+	zk.multis = 0
+	if err := ConsumeFailoverBudget("test", "host1"); err != nil {
+		t.Fatal(err)
+	}
+	if zk.multis != 2 {
+		t.Errorf("should retry once after conflict, got %d multis", zk.multis)
+	}
+	if tokens := bucketTokens(t); tokens["global"] != 1 {
+		t.Errorf("global bucket should be consumed twice, got %v", tokens)
+	}
+
+	// 一直冲突时放弃
+	zk.multis = 0
+	zk.conflicts = FAILOVER_BUDGET_RETRIES
+	err := ConsumeFailoverBudget("other", "host1")
+	if err == nil || zk.multis != FAILOVER_BUDGET_RETRIES {
+		t.Errorf("should fail after %d retries, got %v", FAILOVER_BUDGET_RETRIES, err)
+	}
+	if tokens := bucketTokens(t); len(tokens) != 2 || tokens["global"] != 1 {
+		t.Errorf("buckets should not change on failure, got %v", tokens)
+	}
+}
+
+func TestResetFailoverBudget(t *testing.T) {
+	setupBudget(t, NewFakeZk())
+	defer clock.Set(nil)
+
+	ConsumeFailoverBudget("test", "host1")
+	ConsumeFailoverBudget("other", "host1")
+	if err := ResetFailoverBudget("config"); err == nil {
+		t.Error("config should not be reset")
+	}
+	if err := ResetFailoverBudget("app_test"); err != nil {
+		t.Fatal(err)
+	}
+	tokens := bucketTokens(t)
+	if _, ok := tokens["app_test"]; ok || len(tokens) != 2 {
+		t.Errorf("only app_test should be reset, got %v", tokens)
+	}
+	if err := ResetFailoverBudget(""); err != nil {
+		t.Fatal(err)
+	}
+	if tokens := bucketTokens(t); len(tokens) != 0 {
+		t.Errorf("all buckets should be reset, got %v", tokens)
+	}
+	c, err := GetFailoverBudgetConfig()
+	if err != nil || c.AppPerHour != 2 {
+		t.Errorf("config should be kept, got %v, %v", c, err)
+	}
+}
@@ -0,0 +1,346 @@
+package meta
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/ksarch-saas/cc/utils/clock"
+	zookeeper "github.com/samuel/go-zookeeper/zk"
+)
+
+/// Failover历史，所有App共享
+/// /r3/failover/history/record_<appname>_<region><seq>  每次Failover一条记录，seq为10位序号
+/// /r3/failover/archive/<appname>_<seq>                 归档，每个节点保存一批记录的JSON数组
+/// 各App的Cluster Leader定期清理本App超过FailoverHistoryKeepDays或FailoverHistoryKeepCount的记录，
+/// 开启FailoverHistoryArchive时清理前先归档
+
+const (
+	FAILOVER_HISTORY_DIR    = "/r3/failover/history"
+	FAILOVER_ARCHIVE_DIR    = "/r3/failover/archive"
+	FAILOVER_ARCHIVE_BATCH  = 500 // 每个归档节点最多保存的记录数，避免超过ZK节点大小限制
+	FAILOVER_PRUNE_INTERVAL = time.Hour
+
+	zkSeqLen = 10
+)
+
+type FailoverHistoryQuery struct {
+	AppName  string
+	Region   string
+	NodeId   string // 前缀匹配
+	Since    time.Time
+	Until    time.Time
+	Offset   int
+	Limit    int  // 0表示不限制
+	Archived bool // 是否包含已归档的记录
+}
+
+type FailoverHistoryEntry struct {
+	Name string // znode名字，已归档的记录为空
+	FailoverRecord
+}
+
+type FailoverHistoryResult struct {
+	Total   int
+	Records []*FailoverHistoryEntry // 按时间从新到旧
+}
+
+type historyName struct {
+	Name   string
+	App    string
+	Region string
+	Seq    string
+}
+
+// record_<appname>_<region><seq>，appname中可能有下划线，region中没有
+func parseHistoryName(name string) (*historyName, bool) {
+	if !strings.HasPrefix(name, "record_") || len(name) < len("record_")+zkSeqLen {
+		return nil, false
+	}
+	s := strings.TrimPrefix(name, "record_")
+	seq := s[len(s)-zkSeqLen:]
+	s = s[:len(s)-zkSeqLen]
+	i := strings.LastIndex(s, "_")
+	if i < 0 {
+		return nil, false
+	}
+	return &historyName{name, s[:i], s[i+1:], seq}, true
+}
+
+type bySeq []*historyName
+
+func (a bySeq) Len() int           { return len(a) }
+func (a bySeq) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a bySeq) Less(i, j int) bool { return a[i].Seq < a[j].Seq }
+
+// 按序号从旧到新返回符合App和Region的记录名，为空时不过滤
+func listFailoverHistory(zconn ZkConn, appName, region string) ([]*historyName, error) {
+	children, _, err := zconn.Children(FAILOVER_HISTORY_DIR)
+	if err == zookeeper.ErrNoNode {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := []*historyName{}
+	for _, child := range children {
+		hn, ok := parseHistoryName(child)
+		if !ok {
+			continue
+		}
+		if (appName != "" && hn.App != appName) || (region != "" && hn.Region != region) {
+			continue
+		}
+		names = append(names, hn)
+	}
+	sort.Sort(bySeq(names))
+	return names, nil
+}
+
+// 无法解析的记录返回nil
+func getFailoverRecord(zconn ZkConn, name string) (*FailoverRecord, error) {
+	data, _, err := zconn.Get(FAILOVER_HISTORY_DIR + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	var record FailoverRecord
+	err = json.Unmarshal(data, &record)
+	if err != nil {
+		glog.Warningf("meta: decode failover record %s failed, %v", name, err)
+		return nil, nil
+	}
+	return &record, nil
+}
+
+func (q *FailoverHistoryQuery) match(r *FailoverRecord) bool {
+	if q.NodeId != "" && !strings.HasPrefix(r.NodeId, q.NodeId) {
+		return false
+	}
+	if !q.Since.IsZero() && r.Timestamp.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && r.Timestamp.After(q.Until) {
+		return false
+	}
+	return true
+}
+
+// 序号和时间基本一致，从新到旧扫描，早于Since时即可结束
+func QueryFailoverHistory(zconn ZkConn, q *FailoverHistoryQuery) (*FailoverHistoryResult, error) {
+	if q.Offset < 0 || q.Limit < 0 {
+		return nil, fmt.Errorf("meta: invalid offset %d or limit %d", q.Offset, q.Limit)
+	}
+	names, err := listFailoverHistory(zconn, q.AppName, q.Region)
+	if err != nil {
+		return nil, err
+	}
+	entries := []*FailoverHistoryEntry{}
+	for i := len(names) - 1; i >= 0; i-- {
+		record, err := getFailoverRecord(zconn, names[i].Name)
+		if err == zookeeper.ErrNoNode {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if record == nil {
+			continue
+		}
+		if q.match(record) {
+			entries = append(entries, &FailoverHistoryEntry{names[i].Name, *record})
+		}
+		if !q.Since.IsZero() && record.Timestamp.Before(q.Since) {
+			break
+		}
+	}
+	if q.Archived {
+		archived, err := queryFailoverArchive(zconn, q)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, archived...)
+	}
+
+	result := &FailoverHistoryResult{Total: len(entries)}
+	if q.Offset < len(entries) {
+		entries = entries[q.Offset:]
+		if q.Limit > 0 && q.Limit < len(entries) {
+			entries = entries[:q.Limit]
+		}
+		result.Records = entries
+	}
+	return result, nil
+}
+
+// 归档节点名为<appname>_<seq>，按从新到旧返回
+func queryFailoverArchive(zconn ZkConn, q *FailoverHistoryQuery) ([]*FailoverHistoryEntry, error) {
+	children, _, err := zconn.Children(FAILOVER_ARCHIVE_DIR)
+	if err == zookeeper.ErrNoNode {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(byArchiveSeq(children)))
+	entries := []*FailoverHistoryEntry{}
+	for _, child := range children {
+		if q.AppName != "" && !strings.HasPrefix(child, q.AppName+"_") {
+			continue
+		}
+		data, _, err := zconn.Get(FAILOVER_ARCHIVE_DIR + "/" + child)
+		if err != nil {
+			return nil, err
+		}
+		var records []*FailoverRecord
+		err = json.Unmarshal(data, &records)
+		if err != nil {
+			glog.Warningf("meta: decode failover archive %s failed, %v", child, err)
+			continue
+		}
+		for i := len(records) - 1; i >= 0; i-- {
+			r := records[i]
+			if (q.Region == "" || r.Region == q.Region) && q.match(r) {
+				entries = append(entries, &FailoverHistoryEntry{"", *r})
+			}
+		}
+	}
+	return entries, nil
+}
+
+type byArchiveSeq []string
+
+func (a byArchiveSeq) Len() int      { return len(a) }
+func (a byArchiveSeq) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byArchiveSeq) Less(i, j int) bool {
+	return a[i][len(a[i])-zkSeqLen:] < a[j][len(a[j])-zkSeqLen:]
+}
+
+// 本App最近一次Failover记录，按序号取最后一条
+func (m *Meta) LastFailoverRecord() (*FailoverRecord, error) {
+	names, err := listFailoverHistory(m.zconn, m.appName, "")
+	if err != nil {
+		return nil, err
+	}
+	for i := len(names) - 1; i >= 0; i-- {
+		record, err := getFailoverRecord(m.zconn, names[i].Name)
+		if err == zookeeper.ErrNoNode || (err == nil && record == nil) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return record, nil
+	}
+	return nil, nil
+}
+
+func (m *Meta) AddFailoverRecord(record *FailoverRecord) error {
+	zkPath := fmt.Sprintf(FAILOVER_HISTORY_DIR+"/record_%s_%s", record.AppName, record.Region)
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	path, err := m.zconn.Create(zkPath, data, zookeeper.FlagSequence, zookeeper.WorldACL(PERM_FILE))
+	if err != nil {
+		return err
+	}
+	glog.Warningf("meta: failover record created at %s", path)
+	return nil
+}
+
+// 清理本App过期的记录，记录按序号从旧到新检查，遇到第一条需要保留的即停止
+func (m *Meta) PruneFailoverHistory() (int, error) {
+	app := m.appConfig.Load().(*AppConfig)
+	names, err := listFailoverHistory(m.zconn, m.appName, "")
+	if err != nil {
+		return 0, err
+	}
+	deadline := clock.Now().Add(-time.Duration(app.FailoverHistoryKeepDays) * 24 * time.Hour)
+
+	pruned := []*historyName{}
+	records := []*FailoverRecord{}
+	for i, hn := range names {
+		record, err := getFailoverRecord(m.zconn, hn.Name)
+		if err == zookeeper.ErrNoNode {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		// 无法解析的记录直接清理，不归档
+		if record == nil {
+			m.deleteIfExist(FAILOVER_HISTORY_DIR + "/" + hn.Name)
+			continue
+		}
+		if len(names)-i <= app.FailoverHistoryKeepCount && record.Timestamp.After(deadline) {
+			break
+		}
+		pruned = append(pruned, hn)
+		records = append(records, record)
+	}
+
+	n := 0
+	for len(pruned) > 0 {
+		batch := len(pruned)
+		if batch > FAILOVER_ARCHIVE_BATCH {
+			batch = FAILOVER_ARCHIVE_BATCH
+		}
+		if app.FailoverHistoryArchive {
+			err = m.archiveFailoverRecords(records[:batch])
+			if err != nil {
+				return n, err
+			}
+		}
+		for _, hn := range pruned[:batch] {
+			err = m.deleteIfExist(FAILOVER_HISTORY_DIR + "/" + hn.Name)
+			if err != nil {
+				return n, err
+			}
+			n++
+		}
+		pruned = pruned[batch:]
+		records = records[batch:]
+	}
+	if n > 0 {
+		glog.Warningf("meta: pruned %d failover records of %s, archive %v", n, m.appName, app.FailoverHistoryArchive)
+	}
+	return n, nil
+}
+
+// Cluster Leader定期清理本App的Failover历史
+func pruneFailoverHistoryLoop() {
+	for range time.Tick(FAILOVER_PRUNE_INTERVAL) {
+		if !IsClusterLeader() {
+			continue
+		}
+		_, err := meta.PruneFailoverHistory()
+		if err != nil {
+			glog.Warning("Prune failover history failed,", err)
+		}
+	}
+}
+
+func (m *Meta) archiveFailoverRecords(records []*FailoverRecord) error {
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	_, err = CreateRecursive(m.zconn, FAILOVER_ARCHIVE_DIR, "", 0, zookeeper.WorldACL(PERM_DIRECTORY))
+	if err != nil && err != zookeeper.ErrNodeExists {
+		return err
+	}
+	zkPath := FAILOVER_ARCHIVE_DIR + "/" + m.appName + "_"
+	_, err = m.zconn.Create(zkPath, data, zookeeper.FlagSequence, zookeeper.WorldACL(PERM_FILE))
+	return err
+}
+
+func QueryFailoverRecords(q *FailoverHistoryQuery) (*FailoverHistoryResult, error) {
+	return QueryFailoverHistory(meta.zconn, q)
+}
+
+func PruneFailoverHistory() (int, error) {
+	return meta.PruneFailoverHistory()
+}
@@ -0,0 +1,153 @@
+package meta
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ksarch-saas/cc/utils/clock"
+	zookeeper "github.com/samuel/go-zookeeper/zk"
+)
+
+func TestParseHistoryName(t *testing.T) {
+	tests := []struct {
+		name   string
+		ok     bool
+		app    string
+		region string
+		seq    string
+	}{
+		{"record_test_bj0000000012", true, "test", "bj", "0000000012"},
+		// appname中的下划线
+		{"record_my_app_v2_nj0000000003", true, "my_app_v2", "nj", "0000000003"},
+		{"record_test_0000000001", true, "test", "", "0000000001"},
+		{"record_testbj0000000001", false, "", "", ""},
+		{"record_test_bj", false, "", "", ""},
+		{"test_bj0000000001", false, "", "", ""},
+	}
+	for _, test := range tests {
+		hn, ok := parseHistoryName(test.name)
+		if ok != test.ok {
+			t.Errorf("%s: expect ok %v, got %v", test.name, test.ok, ok)
+			continue
+		}
+		if ok && (hn.App != test.app || hn.Region != test.region || hn.Seq != test.seq || hn.Name != test.name) {
+			t.Errorf("%s: unexpected %+v", test.name, hn)
+		}
+	}
+}
+
+// 在本App(my_app)下按天添加n条记录，第i条在n-i天前，另有一条其他App的记录
+func setupHistory(t *testing.T, n int) (ZkConn, time.Time) {
+	now := time.Date(2016, 1, 10, 0, 0, 0, 0, time.Local)
+	clock.Set(clock.NewFake(now))
+	zk := NewFakeZk()
+	_, err := CreateRecursive(zk, FAILOVER_HISTORY_DIR, "", 0, zookeeper.WorldACL(zookeeper.PermAll))
+	if err != nil {
+		t.Fatal(err)
+	}
+	runHistory(zk, 100)
+	for i := 0; i < n; i++ {
+		err := meta.AddFailoverRecord(&FailoverRecord{
+			AppName:   "my_app",
+			Region:    []string{"bj", "nj"}[i%2],
+			NodeId:    fmt.Sprintf("node%d", i),
+			Timestamp: now.Add(-time.Duration(n-i) * 24 * time.Hour),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	meta.AddFailoverRecord(&FailoverRecord{AppName: "my", Region: "bj", NodeId: "other", Timestamp: now.Add(-100 * 24 * time.Hour)})
+	return zk, now
+}
+
+func runHistory(zk ZkConn, keepCount int) {
+	RunWithZk("my_app", "bj", zk, &AppConfig{
+		AppName:                  "my_app",
+		MasterRegion:             "bj",
+		Regions:                  []string{"bj", "nj"},
+		FailoverHistoryKeepDays:  7,
+		FailoverHistoryKeepCount: keepCount,
+		FailoverHistoryArchive:   true,
+	})
+}
+
+func nodeIds(entries []*FailoverHistoryEntry) string {
+	ids := ""
+	for _, e := range entries {
+		ids += e.NodeId + " "
+	}
+	return ids
+}
+
+func TestQueryFailoverHistory(t *testing.T) {
+	zk, now := setupHistory(t, 6)
+	defer clock.Set(nil)
+
+	r, err := QueryFailoverRecords(&FailoverHistoryQuery{AppName: "my_app", Offset: 1, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Total != 6 || nodeIds(r.Records) != "node4 node3 " {
+		t.Errorf("unexpected page, total %d, %s", r.Total, nodeIds(r.Records))
+	}
+	r, _ = QueryFailoverRecords(&FailoverHistoryQuery{AppName: "my_app", Region: "nj", Since: now.Add(-4 * 24 * time.Hour)})
+	if r.Total != 2 || nodeIds(r.Records) != "node5 node3 " {
+		t.Errorf("unexpected records of nj, total %d, %s", r.Total, nodeIds(r.Records))
+	}
+	// "my"不应匹配my_app的记录
+	r, _ = QueryFailoverHistory(zk, &FailoverHistoryQuery{AppName: "my"})
+	if r.Total != 1 || r.Records[0].NodeId != "other" {
+		t.Errorf("unexpected records of app my, %+v", r)
+	}
+	r, _ = QueryFailoverRecords(&FailoverHistoryQuery{AppName: "my_app", Offset: 10})
+	if r.Total != 6 || len(r.Records) != 0 {
+		t.Errorf("offset beyond total should return no records, %+v", r)
+	}
+	for _, q := range []*FailoverHistoryQuery{{Offset: -1}, {Limit: -1}} {
+		if _, err := QueryFailoverRecords(q); err == nil {
+			t.Errorf("negative offset or limit should be rejected, %+v", q)
+		}
+	}
+}
+
+func TestPruneFailoverHistory(t *testing.T) {
+	zk, _ := setupHistory(t, 9)
+	defer clock.Set(nil)
+
+	// 超过7天的清理：9天前和8天前的两条，正好7天前的也清理
+	n, err := PruneFailoverHistory()
+	if err != nil || n != 3 {
+		t.Fatalf("expect 3 records pruned by keep days, got %d, %v", n, err)
+	}
+	// 再只保留最近4条
+	runHistory(zk, 4)
+	n, err = PruneFailoverHistory()
+	if err != nil || n != 2 {
+		t.Fatalf("expect 2 records pruned by keep count, got %d, %v", n, err)
+	}
+
+	r, _ := QueryFailoverRecords(&FailoverHistoryQuery{AppName: "my_app"})
+	if r.Total != 4 || nodeIds(r.Records) != "node8 node7 node6 node5 " {
+		t.Errorf("unexpected records after prune, %s", nodeIds(r.Records))
+	}
+	// 其他App的记录不清理
+	r, _ = QueryFailoverRecords(&FailoverHistoryQuery{AppName: "my"})
+	if r.Total != 1 {
+		t.Errorf("records of other app should be kept, %+v", r)
+	}
+
+	// 清理的记录按批归档，查询时排在最后
+	children, _, err := zk.Children(FAILOVER_ARCHIVE_DIR)
+	if err != nil || len(children) != 2 {
+		t.Fatalf("expect 2 archive nodes, got %v, %v", children, err)
+	}
+	r, _ = QueryFailoverRecords(&FailoverHistoryQuery{AppName: "my_app", Archived: true})
+	if r.Total != 9 || nodeIds(r.Records) != "node8 node7 node6 node5 node4 node3 node2 node1 node0 " {
+		t.Errorf("unexpected records with archive, %s", nodeIds(r.Records))
+	}
+	if r.Records[4].Name != "" || r.Records[0].Name == "" {
+		t.Errorf("archived records should have no name")
+	}
+}
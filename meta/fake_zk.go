@@ -0,0 +1,237 @@
+package meta
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	zookeeper "github.com/samuel/go-zookeeper/zk"
+)
+
+/// 内存中的ZK，用于测试，不需要启动ZooKeeper
+/// 支持顺序节点、版本检查和Multi，临时节点按普通节点处理，Watch不会触发
+/// SetLost(true)模拟与ZK断开，之后所有操作都返回ErrConnectionClosed
+
+type fakeZnode struct {
+	data     []byte
+	version  int32
+	cversion int32
+}
+
+type FakeZk struct {
+	mutex  sync.Mutex
+	znodes map[string]*fakeZnode
+	lost   bool
+}
+
+func NewFakeZk() *FakeZk {
+	return &FakeZk{
+		znodes: map[string]*fakeZnode{"/": &fakeZnode{}},
+	}
+}
+
+func (z *FakeZk) SetLost(lost bool) {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	z.lost = lost
+}
+
+func (z *FakeZk) stat(n *fakeZnode) *zookeeper.Stat {
+	return &zookeeper.Stat{
+		Version:    n.version,
+		Cversion:   n.cversion,
+		DataLength: int32(len(n.data)),
+	}
+}
+
+func (z *FakeZk) children(zkPath string) []string {
+	prefix := strings.TrimSuffix(zkPath, "/") + "/"
+	children := []string{}
+	for p := range z.znodes {
+		if p != "/" && strings.HasPrefix(p, prefix) && !strings.Contains(p[len(prefix):], "/") {
+			children = append(children, p[len(prefix):])
+		}
+	}
+	sort.Strings(children)
+	return children
+}
+
+func (z *FakeZk) get(zkPath string) ([]byte, *zookeeper.Stat, error) {
+	if z.lost {
+		return nil, nil, zookeeper.ErrConnectionClosed
+	}
+	n, ok := z.znodes[zkPath]
+	if !ok {
+		return nil, nil, zookeeper.ErrNoNode
+	}
+	return n.data, z.stat(n), nil
+}
+
+func (z *FakeZk) set(zkPath string, data []byte, version int32) (*zookeeper.Stat, error) {
+	if z.lost {
+		return nil, zookeeper.ErrConnectionClosed
+	}
+	n, ok := z.znodes[zkPath]
+	if !ok {
+		return nil, zookeeper.ErrNoNode
+	}
+	if version >= 0 && version != n.version {
+		return nil, zookeeper.ErrBadVersion
+	}
+	n.data = data
+	n.version++
+	return z.stat(n), nil
+}
+
+func (z *FakeZk) create(zkPath string, data []byte, flags int32) (string, error) {
+	if z.lost {
+		return "", zookeeper.ErrConnectionClosed
+	}
+	parent, ok := z.znodes[path.Dir(zkPath)]
+	if !ok {
+		return "", zookeeper.ErrNoNode
+	}
+	if flags&zookeeper.FlagSequence != 0 {
+		zkPath = fmt.Sprintf("%s%010d", zkPath, parent.cversion)
+	}
+	if _, ok := z.znodes[zkPath]; ok {
+		return "", zookeeper.ErrNodeExists
+	}
+	parent.cversion++
+	z.znodes[zkPath] = &fakeZnode{data: data}
+	return zkPath, nil
+}
+
+func (z *FakeZk) delete(zkPath string, version int32) error {
+	if z.lost {
+		return zookeeper.ErrConnectionClosed
+	}
+	n, ok := z.znodes[zkPath]
+	if !ok {
+		return zookeeper.ErrNoNode
+	}
+	if version >= 0 && version != n.version {
+		return zookeeper.ErrBadVersion
+	}
+	if len(z.children(zkPath)) > 0 {
+		return zookeeper.ErrNotEmpty
+	}
+	delete(z.znodes, zkPath)
+	return nil
+}
+
+func (z *FakeZk) Get(zkPath string) ([]byte, *zookeeper.Stat, error) {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	return z.get(zkPath)
+}
+
+func (z *FakeZk) GetW(zkPath string) ([]byte, *zookeeper.Stat, <-chan zookeeper.Event, error) {
+	data, stat, err := z.Get(zkPath)
+	return data, stat, make(chan zookeeper.Event), err
+}
+
+func (z *FakeZk) Set(zkPath string, data []byte, version int32) (*zookeeper.Stat, error) {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	return z.set(zkPath, data, version)
+}
+
+func (z *FakeZk) Create(zkPath string, data []byte, flags int32, acl []zookeeper.ACL) (string, error) {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	return z.create(zkPath, data, flags)
+}
+
+func (z *FakeZk) Delete(zkPath string, version int32) error {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	return z.delete(zkPath, version)
+}
+
+func (z *FakeZk) Exists(zkPath string) (bool, *zookeeper.Stat, error) {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	_, stat, err := z.get(zkPath)
+	if err == zookeeper.ErrNoNode {
+		return false, nil, nil
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	return true, stat, nil
+}
+
+func (z *FakeZk) Children(zkPath string) ([]string, *zookeeper.Stat, error) {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	_, stat, err := z.get(zkPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return z.children(zkPath), stat, nil
+}
+
+func (z *FakeZk) ChildrenW(zkPath string) ([]string, *zookeeper.Stat, <-chan zookeeper.Event, error) {
+	children, stat, err := z.Children(zkPath)
+	return children, stat, make(chan zookeeper.Event), err
+}
+
+// 任一操作失败时恢复所有修改
+func (z *FakeZk) Multi(ops ...interface{}) ([]zookeeper.MultiResponse, error) {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+
+	saved := make(map[string]*fakeZnode, len(z.znodes))
+	for p, n := range z.znodes {
+		copied := *n
+		saved[p] = &copied
+	}
+	resps := make([]zookeeper.MultiResponse, len(ops))
+	var err error
+	for i, op := range ops {
+		switch req := op.(type) {
+		case *zookeeper.CreateRequest:
+			resps[i].String, err = z.create(req.Path, req.Data, req.Flags)
+		case *zookeeper.SetDataRequest:
+			resps[i].Stat, err = z.set(req.Path, req.Data, req.Version)
+		case *zookeeper.DeleteRequest:
+			err = z.delete(req.Path, req.Version)
+		case *zookeeper.CheckVersionRequest:
+			_, resps[i].Stat, err = z.get(req.Path)
+			if err == nil && req.Version >= 0 && req.Version != resps[i].Stat.Version {
+				err = zookeeper.ErrBadVersion
+			}
+		default:
+			err = fmt.Errorf("fakezk: unknown operation type %T", op)
+		}
+		if err != nil {
+			z.znodes = saved
+			return nil, err
+		}
+	}
+	return resps, nil
+}
+
+func (z *FakeZk) Close() {}
+
+// 使用给定的ZK连接和App配置初始化meta，本Controller同时作为Cluster Leader和Region Leader，
+// 不选举，也不监听配置变化，用于测试
+func RunWithZk(appName, localRegion string, zconn ZkConn, app *AppConfig) {
+	m := &Meta{
+		appName:                appName,
+		localRegion:            localRegion,
+		ccDirPath:              "/r3/app/" + appName + "/controller",
+		selfZNodeName:          "cc_" + localRegion + "_0000000000",
+		clusterLeaderZNodeName: "cc_" + localRegion + "_0000000000",
+		regionLeaderZNodeName:  "cc_" + localRegion + "_0000000000",
+		clusterLeaderConfig:    &ControllerConfig{Ip: "127.0.0.1", Region: localRegion},
+		regionLeaderConfig:     &ControllerConfig{Ip: "127.0.0.1", Region: localRegion},
+		zconn:                  zconn,
+	}
+	app.setDefaults()
+	m.appConfig.Store(app)
+	meta = m
+}
@@ -40,7 +40,7 @@ type Meta struct {
 	regionLeaderConfig  *ControllerConfig
 
 	/// zk connection
-	zconn    *zookeeper.Conn
+	zconn    ZkConn
 	zsession <-chan zookeeper.Event
 }
 
@@ -207,6 +207,8 @@ func Run(appName, localRegion string, httpPort, wsPort int, zkAddr string, seeds
 
 	// 开始各种Watch
 	tickChan := time.NewTicker(time.Second * 60).C
+	// 清理可能要访问大量ZNode，不阻塞Session和选主的处理
+	go pruneFailoverHistoryLoop()
 	for {
 		select {
 		case event := <-meta.zsession:
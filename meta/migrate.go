@@ -0,0 +1,148 @@
+package meta
+
+import (
+	"strings"
+
+	"github.com/golang/glog"
+	zookeeper "github.com/samuel/go-zookeeper/zk"
+)
+
+/// 迁移任务持久化
+/// /r3/app/<appname>/migrate/task_<sourceId>_<targetId>  单个迁移任务的进度
+/// /r3/app/<appname>/migrate/rebalance        Rebalance任务及其所有计划
+/// /r3/app/<appname>/migrate/skipped          只剩被跳过的key、保持迁移状态的slot
+/// meta不依赖migrate包，这里只存取序列化后的数据
+
+func (m *Meta) migrateDirPath() string {
+	return "/r3/app/" + m.appName + "/migrate"
+}
+
+func (m *Meta) setOrCreate(zkPath string, data []byte) error {
+	_, err := m.zconn.Set(zkPath, data, -1)
+	if err == zookeeper.ErrNoNode {
+		_, err = CreateRecursive(m.zconn, zkPath, string(data), 0, zookeeper.WorldACL(PERM_FILE))
+	}
+	return err
+}
+
+func (m *Meta) deleteIfExist(zkPath string) error {
+	err := m.zconn.Delete(zkPath, -1)
+	if err == zookeeper.ErrNoNode {
+		return nil
+	}
+	return err
+}
+
+func (m *Meta) migrateTaskPath(sourceId, targetId string) string {
+	return m.migrateDirPath() + "/task_" + sourceId + "_" + targetId
+}
+
+func (m *Meta) SaveMigrateTask(sourceId, targetId string, data []byte) error {
+	return m.setOrCreate(m.migrateTaskPath(sourceId, targetId), data)
+}
+
+func (m *Meta) RemoveMigrateTask(sourceId, targetId string) error {
+	err := m.deleteIfExist(m.migrateTaskPath(sourceId, targetId))
+	if err != nil {
+		return err
+	}
+	glog.Infof("meta: migrate task of %s to %s removed", sourceId, targetId)
+	return nil
+}
+
+// 返回 <sourceId>_<targetId> -> data
+func (m *Meta) LoadMigrateTasks() (map[string][]byte, error) {
+	dir := m.migrateDirPath()
+	children, _, err := m.zconn.Children(dir)
+	if err == zookeeper.ErrNoNode {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	tasks := map[string][]byte{}
+	for _, child := range children {
+		if !strings.HasPrefix(child, "task_") {
+			continue
+		}
+		data, _, err := m.zconn.Get(dir + "/" + child)
+		if err != nil {
+			return nil, err
+		}
+		tasks[strings.TrimPrefix(child, "task_")] = data
+	}
+	return tasks, nil
+}
+
+func (m *Meta) SaveRebalanceTask(data []byte) error {
+	return m.setOrCreate(m.migrateDirPath()+"/rebalance", data)
+}
+
+func (m *Meta) RemoveRebalanceTask() error {
+	err := m.deleteIfExist(m.migrateDirPath() + "/rebalance")
+	if err != nil {
+		return err
+	}
+	glog.Info("meta: rebalance task removed")
+	return nil
+}
+
+// 不存在时返回nil
+func (m *Meta) LoadRebalanceTask() ([]byte, error) {
+	data, _, err := m.zconn.Get(m.migrateDirPath() + "/rebalance")
+	if err == zookeeper.ErrNoNode {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (m *Meta) SaveSkippedSlots(data []byte) error {
+	return m.setOrCreate(m.migrateDirPath()+"/skipped", data)
+}
+
+// 不存在时返回nil
+func (m *Meta) LoadSkippedSlots() ([]byte, error) {
+	data, _, err := m.zconn.Get(m.migrateDirPath() + "/skipped")
+	if err == zookeeper.ErrNoNode {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func SaveMigrateTask(sourceId, targetId string, data []byte) error {
+	return meta.SaveMigrateTask(sourceId, targetId, data)
+}
+
+func RemoveMigrateTask(sourceId, targetId string) error {
+	return meta.RemoveMigrateTask(sourceId, targetId)
+}
+
+func LoadMigrateTasks() (map[string][]byte, error) {
+	return meta.LoadMigrateTasks()
+}
+
+func SaveRebalanceTask(data []byte) error {
+	return meta.SaveRebalanceTask(data)
+}
+
+func RemoveRebalanceTask() error {
+	return meta.RemoveRebalanceTask()
+}
+
+func LoadRebalanceTask() ([]byte, error) {
+	return meta.LoadRebalanceTask()
+}
+
+func SaveSkippedSlots(data []byte) error {
+	return meta.SaveSkippedSlots(data)
+}
+
+func LoadSkippedSlots() ([]byte, error) {
+	return meta.LoadSkippedSlots()
+}
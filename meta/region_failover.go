@@ -0,0 +1,175 @@
+package meta
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/golang/glog"
+	zookeeper "github.com/samuel/go-zookeeper/zk"
+)
+
+/// 地域级Failover
+/// /r3/app/<appname>/regionfailover/proposal         提议，包含确认用的Token
+/// /r3/app/<appname>/regionfailover/votes/<region>   各地域Region Leader的投票
+
+var (
+	ErrNoRegionFailoverProposal = errors.New("meta: no region failover proposal")
+)
+
+type RegionFailoverProposal struct {
+	DeadRegion string
+	NewRegion  string
+	Token      string
+	CreateTime time.Time
+}
+
+type RegionFailoverVote struct {
+	Region string
+	Token  string // 对应的提议
+	Agree  bool
+	Reason string
+	Time   time.Time
+}
+
+func (m *Meta) regionFailoverDirPath() string {
+	return "/r3/app/" + m.appName + "/regionfailover"
+}
+
+// 新的提议会清除之前的投票
+func (m *Meta) SaveRegionFailoverProposal(p *RegionFailoverProposal) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	err = m.clearRegionFailoverVotes()
+	if err != nil {
+		return err
+	}
+	return m.setOrCreate(m.regionFailoverDirPath()+"/proposal", data)
+}
+
+func (m *Meta) RegionFailoverProposal() (*RegionFailoverProposal, error) {
+	data, _, err := m.zconn.Get(m.regionFailoverDirPath() + "/proposal")
+	if err == zookeeper.ErrNoNode {
+		return nil, ErrNoRegionFailoverProposal
+	}
+	if err != nil {
+		return nil, err
+	}
+	var p RegionFailoverProposal
+	err = json.Unmarshal(data, &p)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (m *Meta) VoteRegionFailover(vote *RegionFailoverVote) error {
+	data, err := json.Marshal(vote)
+	if err != nil {
+		return err
+	}
+	return m.setOrCreate(m.regionFailoverDirPath()+"/votes/"+vote.Region, data)
+}
+
+func (m *Meta) RegionFailoverVotes() ([]*RegionFailoverVote, error) {
+	dir := m.regionFailoverDirPath() + "/votes"
+	children, _, err := m.zconn.Children(dir)
+	if err == zookeeper.ErrNoNode {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	votes := []*RegionFailoverVote{}
+	for _, child := range children {
+		data, _, err := m.zconn.Get(dir + "/" + child)
+		if err != nil {
+			return nil, err
+		}
+		var vote RegionFailoverVote
+		err = json.Unmarshal(data, &vote)
+		if err != nil {
+			glog.Warningf("meta: decode region failover vote of %s failed, %v", child, err)
+			continue
+		}
+		votes = append(votes, &vote)
+	}
+	return votes, nil
+}
+
+func (m *Meta) clearRegionFailoverVotes() error {
+	dir := m.regionFailoverDirPath() + "/votes"
+	children, _, err := m.zconn.Children(dir)
+	if err == zookeeper.ErrNoNode {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		err := m.deleteIfExist(dir + "/" + child)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Meta) ClearRegionFailover() error {
+	err := m.clearRegionFailoverVotes()
+	if err != nil {
+		return err
+	}
+	return m.deleteIfExist(m.regionFailoverDirPath() + "/proposal")
+}
+
+// 修改ZK中的MasterRegion，其余配置保持不变，本地配置通过Watch更新
+func (m *Meta) UpdateMasterRegion(region string) error {
+	zkPath := "/r3/app/" + m.appName
+	data, stat, err := m.zconn.Get(zkPath)
+	if err != nil {
+		return err
+	}
+	var c AppConfig
+	err = json.Unmarshal(data, &c)
+	if err != nil {
+		return err
+	}
+	c.MasterRegion = region
+	data, err = json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = m.zconn.Set(zkPath, data, stat.Version)
+	if err != nil {
+		return err
+	}
+	glog.Warningf("meta: master region changed to %s", region)
+	return nil
+}
+
+func SaveRegionFailoverProposal(p *RegionFailoverProposal) error {
+	return meta.SaveRegionFailoverProposal(p)
+}
+
+func GetRegionFailoverProposal() (*RegionFailoverProposal, error) {
+	return meta.RegionFailoverProposal()
+}
+
+func VoteRegionFailover(vote *RegionFailoverVote) error {
+	return meta.VoteRegionFailover(vote)
+}
+
+func RegionFailoverVotes() ([]*RegionFailoverVote, error) {
+	return meta.RegionFailoverVotes()
+}
+
+func ClearRegionFailover() error {
+	return meta.ClearRegionFailover()
+}
+
+func UpdateMasterRegion(region string) error {
+	return meta.UpdateMasterRegion(region)
+}
@@ -47,6 +47,20 @@ func resolveZkAddr(zkAddr string) ([]string, error) {
 	return resolved, nil
 }
 
+// 对ZK的访问都通过ZkConn，测试时可用FakeZk代替
+type ZkConn interface {
+	Get(path string) ([]byte, *zookeeper.Stat, error)
+	GetW(path string) ([]byte, *zookeeper.Stat, <-chan zookeeper.Event, error)
+	Set(path string, data []byte, version int32) (*zookeeper.Stat, error)
+	Create(path string, data []byte, flags int32, acl []zookeeper.ACL) (string, error)
+	Delete(path string, version int32) error
+	Exists(path string) (bool, *zookeeper.Stat, error)
+	Children(path string) ([]string, *zookeeper.Stat, error)
+	ChildrenW(path string) ([]string, *zookeeper.Stat, <-chan zookeeper.Event, error)
+	Multi(ops ...interface{}) ([]zookeeper.MultiResponse, error)
+	Close()
+}
+
 func DialZk(zkAddr string) (*zookeeper.Conn, <-chan zookeeper.Event, error) {
 	resolvedZkAddr, err := resolveZkAddr(zkAddr)
 	if err != nil {
@@ -69,7 +83,7 @@ func DialZk(zkAddr string) (*zookeeper.Conn, <-chan zookeeper.Event, error) {
 	return nil, nil, err
 }
 
-func CreateRecursive(zconn *zookeeper.Conn, zkPath, value string, flags int32, aclv []zookeeper.ACL) (pathCreated string, err error) {
+func CreateRecursive(zconn ZkConn, zkPath, value string, flags int32, aclv []zookeeper.ACL) (pathCreated string, err error) {
 	pathCreated, err = zconn.Create(zkPath, []byte(value), flags, aclv)
 	if err == zookeeper.ErrNoNode {
 		dirAclv := make([]zookeeper.ACL, len(aclv))
@@ -0,0 +1,251 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/// Prometheus文本格式(0.0.4)的指标，不依赖client库
+/// 计数器和直方图在事件发生时更新，注册后由WriteAll输出；
+/// 节点状态、迁移进度这类快照数据在抓取时由调用方通过Writer直接输出
+
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type Labels map[string]string
+
+func (l Labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	xs := make([]string, len(keys))
+	for i, k := range keys {
+		xs[i] = fmt.Sprintf("%s=\"%s\"", k, escapeLabel(l[k]))
+	}
+	return "{" + strings.Join(xs, ",") + "}"
+}
+
+func escapeLabel(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	return strings.Replace(s, `"`, `\"`, -1)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+/// Writer
+
+type Writer struct {
+	buf       bytes.Buffer
+	described map[string]bool
+}
+
+func NewWriter() *Writer {
+	return &Writer{described: map[string]bool{}}
+}
+
+// 输出HELP和TYPE，同名指标只输出一次
+func (w *Writer) Describe(name, typ, help string) {
+	if w.described[name] {
+		return
+	}
+	w.described[name] = true
+	fmt.Fprintf(&w.buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(&w.buf, "# TYPE %s %s\n", name, typ)
+}
+
+func (w *Writer) Sample(name string, labels Labels, v float64) {
+	fmt.Fprintf(&w.buf, "%s%s %s\n", name, labels.String(), formatFloat(v))
+}
+
+// 单个样本的gauge
+func (w *Writer) Gauge(name, help string, labels Labels, v float64) {
+	w.Describe(name, "gauge", help)
+	w.Sample(name, labels, v)
+}
+
+func (w *Writer) Bytes() []byte {
+	return w.buf.Bytes()
+}
+
+/// Registry
+
+type collector interface {
+	write(w *Writer)
+}
+
+var (
+	registryMutex sync.Mutex
+	registry      []collector
+)
+
+func register(c collector) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	registry = append(registry, c)
+}
+
+// 输出所有注册的计数器和直方图
+func WriteAll(w *Writer) {
+	registryMutex.Lock()
+	cs := append([]collector{}, registry...)
+	registryMutex.Unlock()
+	for _, c := range cs {
+		c.write(w)
+	}
+}
+
+/// CounterVec
+
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	mutex  sync.Mutex
+	values map[string]float64 // 按标签值索引
+	keys   map[string][]string
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: map[string]float64{},
+		keys:   map[string][]string{},
+	}
+	register(c)
+	return c
+}
+
+// 标签值与定义时的标签名一一对应
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *CounterVec) Add(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.values[key] += v
+	c.keys[key] = values
+}
+
+func (c *CounterVec) Get(values ...string) float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.values[strings.Join(values, "\xff")]
+}
+
+func (c *CounterVec) write(w *Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	w.Describe(c.name, "counter", c.help)
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		labels := Labels{}
+		for i, name := range c.labels {
+			if i < len(c.keys[key]) {
+				labels[name] = c.keys[key][i]
+			}
+		}
+		w.Sample(c.name, labels, c.values[key])
+	}
+}
+
+/// Histogram
+
+// 默认的桶，单位秒
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	mutex   sync.Mutex
+	counts  []uint64 // 非累计，最后一个是+Inf
+	sum     float64
+}
+
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)+1),
+	}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.counts[i]++
+	h.sum += v
+}
+
+func (h *Histogram) Count() uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	n := uint64(0)
+	for _, c := range h.counts {
+		n += c
+	}
+	return n
+}
+
+func (h *Histogram) write(w *Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	w.Describe(h.name, "histogram", h.help)
+	n := uint64(0)
+	for i, c := range h.counts {
+		n += c
+		le := math.Inf(1)
+		if i < len(h.buckets) {
+			le = h.buckets[i]
+		}
+		w.Sample(h.name+"_bucket", Labels{"le": formatFloat(le)}, float64(n))
+	}
+	w.Sample(h.name+"_sum", nil, h.sum)
+	w.Sample(h.name+"_count", nil, float64(n))
+}
+
+/// 各模块在事件发生时更新的指标
+
+var (
+	FailoverTotal = NewCounterVec("cc_failover_total",
+		"Number of failovers handled by the controller.", "role", "result")
+	FailoverDuration = NewHistogram("cc_master_failover_duration_seconds",
+		"Time from choosing a new master to the end of the failover task.",
+		[]float64{1, 5, 10, 30, 60, 120, 300, 600, 1200})
+	InspectorCycle = NewHistogram("cc_inspector_cycle_seconds",
+		"Time to build the cluster topology in one inspector cycle.", DefaultBuckets)
+	InspectorErrors = NewCounterVec("cc_inspector_cycle_errors_total",
+		"Number of inspector cycles that failed to build the cluster topology.")
+)
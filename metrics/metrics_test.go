@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteCounterAndHistogram(t *testing.T) {
+	c := NewCounterVec("test_total", "Test counter.", "role", "result")
+	c.Inc("master", "success")
+	c.Inc("master", "success")
+	c.Inc("slave", "fail\"ed")
+	h := NewHistogram("test_seconds", "Test histogram.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(3)
+
+	w := NewWriter()
+	WriteAll(w)
+	w.Gauge("test_leader", "Test gauge.", Labels{"app": "a"}, 1)
+	out := string(w.Bytes())
+
+	for _, line := range []string{
+		"# TYPE test_total counter",
+		`test_total{result="success",role="master"} 2`,
+		`test_total{result="fail\"ed",role="slave"} 1`,
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{le="0.1"} 1`,
+		`test_seconds_bucket{le="1"} 2`,
+		`test_seconds_bucket{le="+Inf"} 3`,
+		"test_seconds_sum 3.55",
+		"test_seconds_count 3",
+		`test_leader{app="a"} 1`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing line %q in:\n%s", line, out)
+		}
+	}
+	if strings.Count(out, "# TYPE test_total") != 1 {
+		t.Errorf("type of a metric should be written once")
+	}
+}
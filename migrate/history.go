@@ -0,0 +1,119 @@
+package migrate
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+/// 迁移历史
+/// 每个slot迁移完成或失败时追加一条记录到本地文件，每行一个JSON，
+/// 只记录在当前Controller上执行的迁移，Leader切换后新的记录写在新Leader上
+/// 文件超过HISTORY_MAX_BYTES时改名为<file>.1，只保留这一个旧文件，查询时两个文件都读
+
+type MigrateRecord struct {
+	Slot      int
+	SourceId  string
+	TargetId  string
+	Keys      int // 本次迁移的key数
+	StartTime time.Time
+	Duration  time.Duration
+	Error     string // 为空表示该slot迁移完成
+	FailedKey string // 迁移失败的key
+}
+
+const HISTORY_MAX_BYTES = 16 * 1024 * 1024
+
+var (
+	historyFile     string
+	historyMutex    sync.Mutex
+	historyMaxBytes int64 = HISTORY_MAX_BYTES
+)
+
+// 设置迁移历史文件，为空时不记录
+func SetHistoryFile(path string) {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	historyFile = path
+}
+
+func AddMigrateRecord(record *MigrateRecord) error {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	if historyFile == "" {
+		return nil
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	info, err := os.Stat(historyFile)
+	if err == nil && info.Size()+int64(len(data)) > historyMaxBytes {
+		err = os.Rename(historyFile, historyFile+".1")
+		if err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(historyFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	return err
+}
+
+// 按slot和节点过滤，slot<0表示不过滤，nodeId可以是源或目标节点；
+// 返回最近的limit条记录，limit<=0表示全部
+func QueryMigrateRecords(slot int, nodeId string, limit int) ([]*MigrateRecord, error) {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	records := []*MigrateRecord{}
+	if historyFile == "" {
+		return records, nil
+	}
+	for _, path := range []string{historyFile + ".1", historyFile} {
+		err := readMigrateRecords(path, func(r *MigrateRecord) {
+			if slot >= 0 && r.Slot != slot {
+				return
+			}
+			if nodeId != "" && r.SourceId != nodeId && r.TargetId != nodeId {
+				return
+			}
+			records = append(records, r)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if limit > 0 && len(records) > limit {
+		records = records[len(records)-limit:]
+	}
+	return records, nil
+}
+
+// 按顺序读取文件中的记录，文件不存在时返回nil
+func readMigrateRecords(path string, fn func(*MigrateRecord)) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r MigrateRecord
+		err := json.Unmarshal(scanner.Bytes(), &r)
+		if err != nil {
+			continue
+		}
+		fn(&r)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,199 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ksarch-saas/cc/log"
+	"github.com/ksarch-saas/cc/meta"
+	"github.com/ksarch-saas/cc/redis"
+)
+
+/// 大key迁移
+/// 迁移前探测每个key的大小，超过MigrateLargeKeyBytes的key单独迁移，超时时间按大小放大，
+/// 失败后退避重试；批量迁移超时(IOERR)的key也按大key处理。
+/// 同一个key连续失败MigrateLargeKeyRetries次后，任务挂起为StateBlockedOnKey，
+/// 由运维选择：
+///   skip  跳过该key，该slot中只剩被跳过的key时，slot保持MIGRATING状态，继续下一个slot
+///   retry 清零失败次数，重新迁移
+///   force 使用LARGE_KEY_FORCE_TIMEOUT迁移一次，失败则再次挂起
+
+const (
+	KeyActionSkip int32 = iota + 1
+	KeyActionRetry
+	KeyActionForce
+)
+
+var KeyActions = map[string]int32{
+	"skip":  KeyActionSkip,
+	"retry": KeyActionRetry,
+	"force": KeyActionForce,
+}
+
+const (
+	LARGE_KEY_MAX_TIMEOUT   = 10 * 60 * 1000 // 毫秒
+	LARGE_KEY_FORCE_TIMEOUT = 60 * 60 * 1000 // 毫秒
+	LARGE_KEY_BACKOFF       = 1 * time.Second
+	LARGE_KEY_MAX_BACKOFF   = 30 * time.Second
+)
+
+var (
+	ErrTaskNotBlocked = errors.New("mig: task is not blocked on key")
+	ErrInvalidAction  = errors.New("mig: invalid key action")
+	errKeyBlocked     = errors.New("mig: blocked on large key")
+	errSlotSkipped    = errors.New("mig: only skipped keys left in slot")
+	errTaskCancelled  = errors.New("mig: task cancelled")
+)
+
+// 大key的超时时间，每满threshold字节增加一倍MigrateTimeout，第n次重试再乘以n
+func largeKeyTimeout(size, threshold int64, timeout, attempt int) int {
+	scale := int64(1)
+	if threshold > 0 {
+		scale = size/threshold + 1
+	}
+	if attempt > 1 {
+		scale *= int64(attempt)
+	}
+	t := int64(timeout) * scale
+	if t > LARGE_KEY_MAX_TIMEOUT {
+		t = LARGE_KEY_MAX_TIMEOUT
+	}
+	return int(t)
+}
+
+// 第attempt次失败后的等待时间，指数退避
+func largeKeyBackoff(attempt int) time.Duration {
+	d := LARGE_KEY_BACKOFF
+	for i := 1; i < attempt && d < LARGE_KEY_MAX_BACKOFF; i++ {
+		d *= 2
+	}
+	if d > LARGE_KEY_MAX_BACKOFF {
+		d = LARGE_KEY_MAX_BACKOFF
+	}
+	return d
+}
+
+// 去掉已跳过的key，并按大小分成普通key和大key
+func (t *MigrateTask) splitLargeKeys(conn *redis.MigrateConn, keys []string) ([]string, []string, map[string]int64) {
+	app := meta.GetAppConfig()
+	small := []string{}
+	large := []string{}
+	sizes := map[string]int64{}
+
+	candidates := []string{}
+	for _, key := range keys {
+		if !t.skipKeys[key] {
+			candidates = append(candidates, key)
+		}
+	}
+	ss, err := conn.KeySizes(candidates)
+	if err != nil {
+		// 探测失败时不影响迁移，只按已知的可疑key处理
+		log.Warningf(t.TaskName(), "Probe key size failed, %v", err)
+		ss = nil
+	}
+	for i, key := range candidates {
+		if ss != nil {
+			sizes[key] = ss[i]
+		}
+		if sizes[key] >= app.MigrateLargeKeyBytes || t.suspectKeys[key] || t.forceKeys[key] {
+			large = append(large, key)
+		} else {
+			small = append(small, key)
+		}
+	}
+	return small, large, sizes
+}
+
+// 迁移单个大key，失败时退避重试，超过次数后返回errKeyBlocked
+func (t *MigrateTask) migrateLargeKey(key string, size int64) error {
+	rc := redis.Default()
+	ctx := context.Background()
+	app := meta.GetAppConfig()
+	sourceNode := t.SourceNode()
+	targetNode := t.TargetNode()
+
+	if t.forceKeys[key] {
+		delete(t.forceKeys, key)
+		log.Eventf(t.TaskName(), "Force migrating large key:%s, size %d", key, size)
+		err := rc.MigrateKey(ctx, sourceNode.Addr(), targetNode.Ip, targetNode.Port, key, LARGE_KEY_FORCE_TIMEOUT)
+		if err != nil {
+			log.Warningf(t.TaskName(), "Force migrating key:%s failed, %v", key, err)
+			t.blockedKey.Store(key)
+			return errKeyBlocked
+		}
+		t.keyMigrated(key)
+		return nil
+	}
+
+	for t.keyFailures[key] < app.MigrateLargeKeyRetries {
+		if t.CurrentState() == StateCancelling {
+			return errTaskCancelled
+		}
+		attempt := t.keyFailures[key] + 1
+		timeout := largeKeyTimeout(size, app.MigrateLargeKeyBytes, app.MigrateTimeout, attempt)
+		log.Infof(t.TaskName(), "Migrating large key:%s, size %d, timeout %dms, attempt %d",
+			key, size, timeout, attempt)
+		err := rc.MigrateKey(ctx, sourceNode.Addr(), targetNode.Ip, targetNode.Port, key, timeout)
+		if err == nil {
+			t.keyMigrated(key)
+			return nil
+		}
+		// 非超时错误交给上层处理
+		if !strings.HasPrefix(err.Error(), "IOERR") {
+			return err
+		}
+		t.keyFailures[key]++
+		log.Warningf(t.TaskName(), "Migrating large key:%s timeout, %d failures", key, t.keyFailures[key])
+		time.Sleep(largeKeyBackoff(attempt))
+	}
+	t.blockedKey.Store(key)
+	return errKeyBlocked
+}
+
+func (t *MigrateTask) keyMigrated(key string) {
+	delete(t.keyFailures, key)
+	delete(t.suspectKeys, key)
+}
+
+// 在Run中调用，处理运维对挂起key的选择
+func (t *MigrateTask) applyKeyAction() {
+	action := atomic.SwapInt32(&t.keyAction, 0)
+	key := t.BlockedKey()
+	if action == 0 || key == "" {
+		return
+	}
+	switch action {
+	case KeyActionSkip:
+		t.skipKeys[key] = true
+		t.skippedKeys = append(t.skippedKeys, key)
+		log.Eventf(t.TaskName(), "Skip large key:%s in slot %d", key, t.currSlot)
+	case KeyActionRetry:
+		delete(t.keyFailures, key)
+		log.Eventf(t.TaskName(), "Retry large key:%s", key)
+	case KeyActionForce:
+		t.forceKeys[key] = true
+	}
+	t.blockedKey.Store("")
+}
+
+// 运维处理挂起的key，由Run所在的goroutine执行具体动作
+func (t *MigrateTask) ResolveBlockedKey(action int32) error {
+	if action < KeyActionSkip || action > KeyActionForce {
+		return ErrInvalidAction
+	}
+	if t.CurrentState() != StateBlockedOnKey {
+		return ErrTaskNotBlocked
+	}
+	atomic.StoreInt32(&t.keyAction, action)
+	t.SetState(StateRunning)
+	return nil
+}
+
+func (t *MigrateTask) BlockedKey() string {
+	key, _ := t.blockedKey.Load().(string)
+	return key
+}
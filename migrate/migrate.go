@@ -1,6 +1,7 @@
 package migrate
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"sync/atomic"
@@ -21,6 +22,7 @@ const (
 	StateCancelled
 	StateDone
 	StateTargetNodeFailure
+	StateBlockedOnKey
 )
 
 var stateNames = map[int32]string{
@@ -31,15 +33,22 @@ var stateNames = map[int32]string{
 	StateCancelled:         "Cancelled",
 	StateDone:              "Done",
 	StateTargetNodeFailure: "TargetNodeFailure",
+	StateBlockedOnKey:      "BlockedOnKey",
 }
 
 type MigratePlan struct {
-	SourceId string
-	TargetId string
-	Ranges   []topo.Range
-	CurrSlot int
-	State    string
-	task     *MigrateTask
+	SourceId       string
+	TargetId       string
+	Ranges         []topo.Range
+	CurrSlot       int
+	CurrRangeIndex int // 当前处理的range下标，与CurrSlot一起用于任务恢复
+	State          string
+	ThrottleLevel  int      // 限速级别，0表示不限速，THROTTLE_MAX_LEVEL表示因负载过高暂停
+	BlockedKey     string   // StateBlockedOnKey时挂起的key
+	SkippedKeys    []string // 运维选择跳过的key
+	SkippedSlots   []int    // 只剩被跳过的key，仍处于MIGRATING状态的slot
+	Error          string   `json:",omitempty"` // Rebalance中无法执行而放弃的原因
+	task           *MigrateTask
 }
 
 type MigrateTask struct {
@@ -52,7 +61,22 @@ type MigrateTask struct {
 	state            int32
 	backupReplicaSet *topo.ReplicaSet
 	lastPubTime      time.Time
-	totalKeysInSlot  int // counter of total keys migrated
+	totalKeysInSlot  int    // counter of keys migrated in current slot
+	slotFailed       bool   // 当前slot是否已记录过失败，重试时不再重复记录
+	failedKey        string // 当前slot最近一次失败的key，放弃slot时记录
+	throttle         *Throttle
+	keysMoved        int64        // 已迁移的key数，原子操作
+	slotsDone        int32        // 已完成的slot数，原子操作
+	startTime        int64        // 开始运行的时间(UnixNano)，原子操作
+	blockedKey       atomic.Value // 挂起的大key，原子操作
+	keyAction        int32        // 运维对挂起key的选择，原子操作
+	keyFailures      map[string]int
+	suspectKeys      map[string]bool // 批量迁移超时的key，按大key处理
+	forceKeys        map[string]bool
+	skipKeys         map[string]bool
+	skippedKeys      []string
+	skippedSlots     []int  // 因只剩被跳过的key而未完成的slot
+	checkpointTarget string // 进度在ZK中按Source和Target保存，Target故障切换后换到新的节点下
 }
 
 func NewMigrateTask(cluster *topo.Cluster, sourceRS, targetRS *topo.ReplicaSet, ranges []topo.Range) *MigrateTask {
@@ -61,6 +85,11 @@ func NewMigrateTask(cluster *topo.Cluster, sourceRS, targetRS *topo.ReplicaSet,
 		ranges:      ranges,
 		state:       StateRunning,
 		lastPubTime: time.Now(),
+		throttle:    NewThrottle(),
+		keyFailures: map[string]int{},
+		suspectKeys: map[string]bool{},
+		forceKeys:   map[string]bool{},
+		skipKeys:    map[string]bool{},
 	}
 	t.ReplaceSourceReplicaSet(sourceRS)
 	t.ReplaceTargetReplicaSet(targetRS)
@@ -73,11 +102,16 @@ func (t *MigrateTask) TaskName() string {
 
 func (t *MigrateTask) ToPlan() *MigratePlan {
 	return &MigratePlan{
-		SourceId: t.SourceNode().Id,
-		TargetId: t.TargetNode().Id,
-		Ranges:   t.ranges,
-		CurrSlot: t.currSlot,
-		State:    stateNames[t.state],
+		SourceId:       t.SourceNode().Id,
+		TargetId:       t.TargetNode().Id,
+		Ranges:         t.ranges,
+		CurrSlot:       t.currSlot,
+		CurrRangeIndex: t.currRangeIndex,
+		State:          stateNames[t.CurrentState()],
+		ThrottleLevel:  t.throttle.Level(),
+		BlockedKey:     t.BlockedKey(),
+		SkippedKeys:    t.skippedKeys,
+		SkippedSlots:   t.skippedSlots,
 	}
 }
 
@@ -101,8 +135,10 @@ func (t *MigrateTask) migrateSlot(slot int, keysPer int) (int, error, string) {
 	rs := t.SourceReplicaSet()
 	sourceNode := t.SourceNode()
 	targetNode := t.TargetNode()
+	rc := redis.Default()
+	ctx := context.Background()
 
-	err := redis.SetSlot(targetNode.Addr(), slot, redis.SLOT_IMPORTING, sourceNode.Id)
+	err := rc.SetSlot(ctx, targetNode.Addr(), slot, redis.SLOT_IMPORTING, sourceNode.Id)
 	if err != nil {
 		if strings.HasPrefix(err.Error(), "ERR I'm already the owner of hash slot") {
 			log.Warningf(t.TaskName(), "%s already the owner of hash slot %d",
@@ -131,7 +167,7 @@ func (t *MigrateTask) migrateSlot(slot int, keysPer int) (int, error, string) {
 
 	// 需要将Source分片的所有节点标记为MIGRATING，最大限度避免从地域的读造成的数据不一致
 	for _, node := range rs.AllNodes() {
-		err := redis.SetSlot(node.Addr(), slot, redis.SLOT_MIGRATING, targetNode.Id)
+		err := rc.SetSlot(ctx, node.Addr(), slot, redis.SLOT_MIGRATING, targetNode.Id)
 		if err != nil {
 			if strings.HasPrefix(err.Error(), "ERR I'm not the owner of hash slot") {
 				log.Warningf(t.TaskName(), "%s is not the owner of hash slot %d",
@@ -154,74 +190,122 @@ func (t *MigrateTask) migrateSlot(slot int, keysPer int) (int, error, string) {
 		}
 	}
 
-	/// 迁移的速度甚至迁移超时的配置可能都有不小问题，目前所有命令是短连接，且一次只迁移一个key
+	// 使用专用连接，以MIGRATE ... KEYS批量迁移，并pipeline发送命令
+	conn, err := rc.DialMigrateConn(ctx, sourceNode.Addr())
+	if err != nil {
+		return 0, err, ""
+	}
+	defer conn.Close()
 
 	// 一共迁移多少个key
 	nkeys := 0
 	app := meta.GetAppConfig()
-	for {
-		keys, err := redis.GetKeysInSlot(sourceNode.Addr(), slot, keysPer)
-		if err != nil {
-			return nkeys, err, ""
+	keys, err := conn.GetKeysInSlot(slot, keysPer)
+	if err != nil {
+		return nkeys, err, ""
+	}
+	for len(keys) > 0 {
+		t.throttleWait()
+		small, large, sizes := t.splitLargeKeys(conn, keys)
+		if len(small) == 0 && len(large) == 0 {
+			return nkeys, errSlotSkipped, keys[0]
 		}
-		for _, key := range keys {
-			_, err := redis.Migrate(sourceNode.Addr(), targetNode.Ip, targetNode.Port, key, app.MigrateTimeout)
+		for _, key := range large {
+			err := t.migrateLargeKey(key, sizes[key])
 			if err != nil {
 				return nkeys, err, key
 			}
 			nkeys++
+			t.totalKeysInSlot++
+			atomic.AddInt64(&t.keysMoved, 1)
+			t.streamPub(true)
 		}
-		if len(keys) == 0 {
-			// 迁移完成，需要等SourceSlaves同步(DEL)完成，即SourceSlaves节点中该slot内已无key
-			slaveSyncDone := true
-			srs := t.SourceReplicaSet()
-			for _, node := range srs.AllNodes() {
-				nkeys, err := redis.CountKeysInSlot(node.Addr(), slot)
-				if err != nil {
-					return nkeys, err, ""
-				}
-				if nkeys > 0 {
-					slaveSyncDone = false
-				}
-			}
-			if !slaveSyncDone {
-				return nkeys, fmt.Errorf("mig: source nodes not all empty, will retry."), ""
-			}
-			// 设置slot归属到新节点，该操作自动清理IMPORTING和MIGRATING状态
-			// 如果设置的是Source节点，设置slot归属时，Redis会确保该slot中已无剩余的key
-			trs := t.TargetReplicaSet()
-			// 优先设置从节点，保证当主的数据分布还未广播到从节点时主挂掉，slot信息也不会丢失
-			for _, node := range trs.Slaves {
-				if node.Fail {
-					continue
-				}
-				err = redis.SetSlot(node.Addr(), slot, redis.SLOT_NODE, targetNode.Id)
-				if err != nil {
-					return nkeys, err, ""
-				}
+		batches := splitKeys(small, app.MigrateBatchSize)
+		n, next, key, err := conn.MigrateKeys(targetNode.Ip, targetNode.Port, batches,
+			app.MigrateTimeout, app.MigrateConcurrency, slot, keysPer)
+		nkeys += n
+		t.totalKeysInSlot += n
+		atomic.AddInt64(&t.keysMoved, int64(n))
+		t.streamPub(true)
+		if err != nil {
+			// 超时的key可能是大key但未被探测出来，下次单独迁移
+			if key != "" && strings.HasPrefix(err.Error(), "IOERR") {
+				t.suspectKeys[key] = true
 			}
-			// 该操作增加Epoch并广播出去
-			err = redis.SetSlot(trs.Master.Addr(), slot, redis.SLOT_NODE, targetNode.Id)
+			return nkeys, err, key
+		}
+		if len(batches) == 0 {
+			// 只有大key时MigrateKeys不会附带GETKEYSINSLOT
+			next, err = conn.GetKeysInSlot(slot, keysPer)
 			if err != nil {
 				return nkeys, err, ""
 			}
-			// 更新节点上slot的归属
-			for _, rs := range t.cluster.ReplicaSets() {
-				if rs.Master.IsStandbyMaster() {
-					continue
-				}
-				err = SetSlotToNode(rs, slot, targetNode.Id)
-				if err != nil {
-					return nkeys, err, ""
-				}
-			}
-			break
 		}
+		keys = next
 	}
 
+	// 迁移完成，需要等SourceSlaves同步(DEL)完成，即SourceSlaves节点中该slot内已无key
+	slaveSyncDone := true
+	srs := t.SourceReplicaSet()
+	for _, node := range srs.AllNodes() {
+		nkeys, err := rc.CountKeysInSlot(ctx, node.Addr(), slot)
+		if err != nil {
+			return nkeys, err, ""
+		}
+		if nkeys > 0 {
+			slaveSyncDone = false
+		}
+	}
+	if !slaveSyncDone {
+		return nkeys, fmt.Errorf("mig: source nodes not all empty, will retry."), ""
+	}
+	// 设置slot归属到新节点，该操作自动清理IMPORTING和MIGRATING状态
+	// 如果设置的是Source节点，设置slot归属时，Redis会确保该slot中已无剩余的key
+	trs := t.TargetReplicaSet()
+	// 优先设置从节点，保证当主的数据分布还未广播到从节点时主挂掉，slot信息也不会丢失
+	for _, node := range trs.Slaves {
+		if node.Fail {
+			continue
+		}
+		err = rc.SetSlot(ctx, node.Addr(), slot, redis.SLOT_NODE, targetNode.Id)
+		if err != nil {
+			return nkeys, err, ""
+		}
+	}
+	// 该操作增加Epoch并广播出去
+	err = rc.SetSlot(ctx, trs.Master.Addr(), slot, redis.SLOT_NODE, targetNode.Id)
+	if err != nil {
+		return nkeys, err, ""
+	}
+	// 更新节点上slot的归属
+	for _, rs := range t.cluster.ReplicaSets() {
+		if rs.Master.IsStandbyMaster() {
+			continue
+		}
+		err = SetSlotToNode(rs, slot, targetNode.Id)
+		if err != nil {
+			return nkeys, err, ""
+		}
+	}
 	return nkeys, nil, ""
 }
 
+// 将keys按batchSize分组，每组用一条MIGRATE命令迁移
+func splitKeys(keys []string, batchSize int) [][]string {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	batches := [][]string{}
+	for len(keys) > batchSize {
+		batches = append(batches, keys[:batchSize])
+		keys = keys[batchSize:]
+	}
+	if len(keys) > 0 {
+		batches = append(batches, keys)
+	}
+	return batches
+}
+
 func (t *MigrateTask) streamPub(careSpeed bool) {
 	data := &streams.MigrateStateStreamData{
 		SourceId:       t.SourceNode().Id,
@@ -230,6 +314,9 @@ func (t *MigrateTask) streamPub(careSpeed bool) {
 		Ranges:         t.ranges,
 		CurrRangeIndex: t.currRangeIndex,
 		CurrSlot:       t.currSlot,
+		CurrSlotKeys:   t.totalKeysInSlot,
+		ThrottleLevel:  t.throttle.Level(),
+		BlockedKey:     t.BlockedKey(),
 	}
 	if careSpeed {
 		now := time.Now()
@@ -243,8 +330,8 @@ func (t *MigrateTask) streamPub(careSpeed bool) {
 }
 
 func (t *MigrateTask) Run() {
-	prev_key := ""
-	timeout_cnt := 0
+	atomic.StoreInt64(&t.startTime, time.Now().UnixNano())
+	t.checkpoint()
 	for i, r := range t.ranges {
 		if r.Left < 0 {
 			r.Left = 0
@@ -255,11 +342,18 @@ func (t *MigrateTask) Run() {
 		t.currRangeIndex = i
 		t.currSlot = r.Left
 		t.totalKeysInSlot = 0
+		t.slotFailed = false
+		t.failedKey = ""
+		slotStart := time.Now()
 		for t.currSlot <= r.Right {
 			t.streamPub(true)
 
 			// 尽量在迁移完一个完整Slot或遇到错误时，再进行状态的转换
 			if t.CurrentState() == StateCancelling {
+				// 当前slot失败过，记录放弃时的结果
+				if t.slotFailed {
+					t.addRecord(t.totalKeysInSlot, slotStart, errTaskCancelled, t.failedKey)
+				}
 				t.SetState(StateCancelled)
 				t.streamPub(false)
 				return
@@ -268,22 +362,61 @@ func (t *MigrateTask) Run() {
 			// 暂停，sleep一会继续检查
 			if t.CurrentState() == StatePausing {
 				t.SetState(StatePaused)
+				t.checkpoint()
 			}
 			if t.CurrentState() == StatePaused {
 				time.Sleep(100 * time.Millisecond)
 				continue
 			}
 
+			// 挂起在大key上，等待运维选择skip/retry/force
+			if t.CurrentState() == StateBlockedOnKey {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			t.applyKeyAction()
+
 			// 正常运行
 			app := meta.GetAppConfig()
+			start := time.Now()
 			nkeys, err, key := t.migrateSlot(t.currSlot, app.MigrateKeysEachTime)
-			t.totalKeysInSlot += nkeys
 			// Check remains again
 			seed := t.SourceNode()
-			remains, err2 := redis.CountKeysInSlot(seed.Addr(), t.currSlot)
+			remains, err2 := redis.Default().CountKeysInSlot(context.Background(), seed.Addr(), t.currSlot)
 			if err2 != nil {
 				remains = -1
 			}
+			// 重试时只记录第一次失败，slot被挂起、跳过或任务因错误退出时再记录最终的结果
+			if err != nil {
+				t.failedKey = key
+				if !t.slotFailed || err == errKeyBlocked || err == errSlotSkipped || isQuitError(err) {
+					t.addRecord(nkeys, start, err, key)
+				}
+				t.slotFailed = true
+			} else if remains == 0 {
+				t.addRecord(t.totalKeysInSlot, slotStart, nil, "")
+			}
+			if err == errKeyBlocked {
+				log.Eventf(t.TaskName(), "Migrating slot %d blocked on large key:%s, "+
+					"waiting for skip, retry or force", t.currSlot, key)
+				t.SetState(StateBlockedOnKey)
+				t.checkpoint()
+				t.streamPub(false)
+				continue
+			}
+			if err == errSlotSkipped {
+				// slot保持MIGRATING/IMPORTING状态，被跳过的key仍可在Source上访问，其余key通过ASK访问Target
+				log.Eventf(t.TaskName(), "Slot %d left in migrating state, only skipped keys remain", t.currSlot)
+				t.skippedSlots = append(t.skippedSlots, t.currSlot)
+				t.currSlot++
+				t.totalKeysInSlot = 0
+				t.slotFailed = false
+				t.failedKey = ""
+				atomic.AddInt32(&t.slotsDone, 1)
+				t.checkpoint()
+				slotStart = time.Now()
+				continue
+			}
 			if err != nil || remains > 0 {
 				log.Warningf(t.TaskName(),
 					"Migrate slot %d error, %d keys done, total %d keys, remains %d keys, %v",
@@ -300,18 +433,8 @@ func (t *MigrateTask) Run() {
 					t.SetState(StateCancelled)
 					goto quit
 				} else if err != nil && strings.HasPrefix(err.Error(), "IOERR") {
-					log.Warningf(t.TaskName(), "Migrating key:%s timeout", key)
-					if timeout_cnt > 10 {
-						log.Warningf(t.TaskName(), "Migrating key:%s timeout too frequently, task cancelled")
-						t.SetState(StateCancelled)
-						goto quit
-					}
-					if prev_key == key {
-						timeout_cnt++
-					} else {
-						timeout_cnt = 0
-						prev_key = key
-					}
+					// 下次该key会单独迁移，多次失败后任务挂起
+					log.Warningf(t.TaskName(), "Migrating key:%s timeout, will migrate it as large key", key)
 				}
 				time.Sleep(500 * time.Millisecond)
 			} else {
@@ -319,6 +442,11 @@ func (t *MigrateTask) Run() {
 					t.currSlot, nkeys, t.totalKeysInSlot, remains)
 				t.currSlot++
 				t.totalKeysInSlot = 0
+				t.slotFailed = false
+				t.failedKey = ""
+				atomic.AddInt32(&t.slotsDone, 1)
+				t.checkpoint()
+				slotStart = time.Now()
 			}
 		}
 	}
@@ -328,6 +456,30 @@ quit:
 	t.streamPub(false)
 }
 
+// 迁移任务遇到这些错误时退出
+func isQuitError(err error) bool {
+	return strings.HasPrefix(err.Error(), "READONLY") || strings.HasPrefix(err.Error(), "CLUSTERDOWN")
+}
+
+func (t *MigrateTask) addRecord(nkeys int, start time.Time, err error, key string) {
+	record := &MigrateRecord{
+		Slot:      t.currSlot,
+		SourceId:  t.SourceNode().Id,
+		TargetId:  t.TargetNode().Id,
+		Keys:      nkeys,
+		StartTime: start,
+		Duration:  time.Since(start),
+		FailedKey: key,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	e := AddMigrateRecord(record)
+	if e != nil {
+		log.Warningf(t.TaskName(), "Add migrate record failed, %v", e)
+	}
+}
+
 func (t *MigrateTask) BackupReplicaSet() *topo.ReplicaSet {
 	return t.backupReplicaSet
 }
@@ -346,6 +498,27 @@ func (t *MigrateTask) SetState(state int32) {
 	atomic.StoreInt32(&t.state, state)
 }
 
+func (t *MigrateTask) KeysMoved() int64 {
+	return atomic.LoadInt64(&t.keysMoved)
+}
+
+func (t *MigrateTask) SlotsDone() int {
+	return int(atomic.LoadInt32(&t.slotsDone))
+}
+
+// 任务开始以来平均每秒迁移的key数，未开始时为0
+func (t *MigrateTask) KeysPerSec() float64 {
+	start := atomic.LoadInt64(&t.startTime)
+	if start == 0 {
+		return 0
+	}
+	elapsed := time.Since(time.Unix(0, start)).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(t.KeysMoved()) / elapsed
+}
+
 func (t *MigrateTask) ReplaceSourceReplicaSet(rs *topo.ReplicaSet) {
 	t.source.Store(rs)
 }
@@ -1,10 +1,13 @@
 package migrate
 
 import (
+	"context"
 	"errors"
+	"sync"
 	"time"
 
 	"github.com/ksarch-saas/cc/log"
+	"github.com/ksarch-saas/cc/meta"
 	"github.com/ksarch-saas/cc/redis"
 	"github.com/ksarch-saas/cc/streams"
 	"github.com/ksarch-saas/cc/topo"
@@ -19,18 +22,33 @@ var (
 	ErrTargetNodeFail      = errors.New("mig: target node failure")
 	ErrCanNotRecover       = errors.New("mig: can not recover")
 	ErrRebalanceTaskExist  = errors.New("mig: rebalancing task exist")
+	ErrRebalanceNotExist   = errors.New("mig: no rebalancing task")
 )
 
 /// Migrate
 
+const (
+	REBALANCE_CHECK_INTERVAL = 1 * time.Second
+)
+
 type MigrateManager struct {
 	tasks           []*MigrateTask
 	rebalanceTask   *RebalanceTask
+	lastRebalance   *RebalanceTask // 最近结束的Rebalance任务，用于查看结果
 	lastTaskEndTime time.Time
+	loadedBy        string // 从ZK加载持久化任务时的Leader，失去Leader后再次当选需要重新加载
+	// 只剩被跳过的key、保持MIGRATING/IMPORTING状态的slot，不根据标记重建任务
+	skippedSlots map[int]bool
+	// 迁移已经结束、等待下线分片的缩容任务，仍保存在ZK中，Leader切换后继续
+	drainTask *RebalanceTask
+	// 最新的拓扑快照，rebalance创建迁移任务时使用
+	cluster *topo.Cluster
+	// 保护rebalanceTask、lastRebalance、drainTask、cluster及进度，rebalance在后台更新，状态查询在命令中读取
+	rbMutex sync.Mutex
 }
 
 func NewMigrateManager() *MigrateManager {
-	m := &MigrateManager{tasks: []*MigrateTask{}}
+	m := &MigrateManager{tasks: []*MigrateTask{}, skippedSlots: map[int]bool{}}
 	return m
 }
 
@@ -71,6 +89,11 @@ func (m *MigrateManager) RemoveTask(task *MigrateTask) {
 	if pos != -1 {
 		m.lastTaskEndTime = time.Now()
 		m.tasks = append(m.tasks[:pos], m.tasks[pos+1:]...)
+		err := task.removeCheckpoint()
+		if err != nil {
+			log.Warningf(task.TaskName(), "Remove migrate task from zk failed, %v", err)
+		}
+		m.addSkippedSlots(task.skippedSlots)
 	}
 }
 
@@ -142,7 +165,8 @@ func (m *MigrateManager) handleTaskChange(task *MigrateTask, cluster *topo.Clust
 			task.SetBackupReplicaSet(task.TargetReplicaSet())
 			return ErrTargetNodeFail
 		}
-	} else {
+	} else if task.CurrentState() == StateTargetNodeFailure {
+		// 只从TargetNodeFailure恢复，暂停和挂起在大key上的任务保持原状态
 		task.SetState(StateRunning)
 		task.SetBackupReplicaSet(nil)
 	}
@@ -176,6 +200,21 @@ func (m *MigrateManager) handleTaskChange(task *MigrateTask, cluster *topo.Clust
 }
 
 func (m *MigrateManager) HandleNodeStateChange(cluster *topo.Cluster) {
+	m.rbMutex.Lock()
+	m.cluster = cluster
+	m.rbMutex.Unlock()
+	// 成为Leader后首次处理时，先恢复上一任Leader持久化的任务，再根据MIGRATING/IMPORTING标记重建
+	// 失去Leader后ZNode会重新注册，再次当选时名字不同
+	leader := meta.ClusterLeaderZNodeName()
+	if m.loadedBy != leader {
+		err := m.loadTasks(cluster)
+		if err != nil {
+			log.Warningf("MIGRATE", "Load migrate tasks from zk failed, %v", err)
+		} else {
+			m.loadedBy = leader
+		}
+	}
+	m.cleanSkippedSlots(cluster)
 	// 处理主节点的迁移任务重建
 	for _, node := range cluster.AllNodes() {
 		// 如果存在迁移任务，先跳过，等结束后再处理
@@ -195,11 +234,14 @@ func (m *MigrateManager) HandleNodeStateChange(cluster *topo.Cluster) {
 			for _, slot := range slots {
 				// 如果是自己
 				if id == node.Id {
-					redis.SetSlot(node.Addr(), slot, redis.SLOT_STABLE, "")
-				} else {
+					redis.Default().SetSlot(context.Background(), node.Addr(), slot, redis.SLOT_STABLE, "")
+				} else if !m.skippedSlots[slot] {
 					ranges = append(ranges, topo.Range{Left: slot, Right: slot})
 				}
 			}
+			if len(ranges) == 0 {
+				continue
+			}
 			// Source
 			source := node
 			if !node.IsMaster() {
@@ -233,11 +275,14 @@ func (m *MigrateManager) HandleNodeStateChange(cluster *topo.Cluster) {
 			for _, slot := range slots {
 				// 如果是自己
 				if id == node.Id {
-					redis.SetSlot(node.Addr(), slot, redis.SLOT_STABLE, "")
-				} else {
+					redis.Default().SetSlot(context.Background(), node.Addr(), slot, redis.SLOT_STABLE, "")
+				} else if !m.skippedSlots[slot] {
 					ranges = append(ranges, topo.Range{Left: slot, Right: slot})
 				}
 			}
+			if len(ranges) == 0 {
+				continue
+			}
 			// Target
 			target := node
 			if !node.IsMaster() {
@@ -279,76 +324,207 @@ done:
 	}
 }
 
+func (m *MigrateManager) RebalanceTask() *RebalanceTask {
+	m.rbMutex.Lock()
+	defer m.rbMutex.Unlock()
+	return m.rebalanceTask
+}
+
+// 正在进行的Rebalance任务，没有时返回最近结束的；返回副本，可以在锁外编码
+func (m *MigrateManager) RebalanceStatus() (*RebalanceTask, error) {
+	m.rbMutex.Lock()
+	defer m.rbMutex.Unlock()
+	rbtask := m.rebalanceTask
+	if rbtask == nil {
+		rbtask = m.lastRebalance
+	}
+	if rbtask == nil {
+		return nil, ErrRebalanceNotExist
+	}
+	return rbtask.copy(), nil
+}
+
+// 取消正在进行的Rebalance任务，运行中的迁移在当前slot结束后停止，未开始的计划不再执行
+func (m *MigrateManager) CancelRebalanceTask() error {
+	m.rbMutex.Lock()
+	defer m.rbMutex.Unlock()
+	if m.rebalanceTask == nil {
+		return ErrRebalanceNotExist
+	}
+	m.rebalanceTask.Cancelled = true
+	return nil
+}
+
+// 调用时持有rbMutex
+func (m *MigrateManager) pubRebalanceState(rbtask *RebalanceTask) {
+	rbtask.updateProgress()
+	streams.RebalanceStateStream.Pub(*rbtask.copy())
+}
+
 func (m *MigrateManager) RunRebalanceTask(plans []*MigratePlan, cluster *topo.Cluster) error {
-	if m.rebalanceTask != nil {
+	return m.runRebalanceTask(plans, cluster, "")
+}
+
+// 缩容：迁走masterId分片的slots，迁移结束后保留任务，等待DrainTask的调用者下线该分片
+func (m *MigrateManager) RunDrainTask(masterId string, plans []*MigratePlan, cluster *topo.Cluster) error {
+	return m.runRebalanceTask(plans, cluster, masterId)
+}
+
+func (m *MigrateManager) runRebalanceTask(plans []*MigratePlan, cluster *topo.Cluster, drainId string) error {
+	m.rbMutex.Lock()
+	defer m.rbMutex.Unlock()
+	// 等待下线的缩容任务还保存在ZK中，不能覆盖
+	if m.rebalanceTask != nil || m.drainTask != nil {
 		return ErrRebalanceTaskExist
 	}
 	now := time.Now()
-	rbtask := &RebalanceTask{plans, &now, nil}
+	rbtask := &RebalanceTask{
+		Plans:     plans,
+		StartTime: &now,
+		DrainId:   drainId,
+	}
 	m.rebalanceTask = rbtask
+	m.saveRebalanceTask(rbtask)
 	go m.rebalance(rbtask, cluster)
 	return nil
 }
 
-func (m *MigrateManager) rebalance(rbtask *RebalanceTask, cluster *topo.Cluster) {
-	// 启动所有任务，失败则等待一会进行重试
-	for {
-		allRunning := true
-		for _, plan := range rbtask.Plans {
-			if plan.task == nil {
-				task, err := m.CreateTask(plan.SourceId, plan.TargetId, plan.Ranges, cluster)
-				if err == nil {
-					log.Infof(task.TaskName(), "Rebalance task created, %v", task)
-					plan.task = task
-					go task.Run()
-				} else {
-					allRunning = false
-				}
+// 计划无法再执行，例如Source或Target分片已经不存在
+func isPermanentError(err error) bool {
+	return err == ErrReplicatSetNotFound
+}
+
+// 检查一遍所有计划，返回是否都已结束，调用时持有rbMutex
+func (m *MigrateManager) checkRebalance(rbtask *RebalanceTask, cluster *topo.Cluster) bool {
+	allDone := true
+	for _, plan := range rbtask.Plans {
+		if plan.task == nil {
+			// 恢复的Rebalance任务中已经结束的计划
+			if plan.finished() {
+				continue
+			}
+			if rbtask.Cancelled {
+				plan.State = stateNames[StateCancelled]
+				continue
+			}
+			allDone = false
+			task, err := m.CreateTask(plan.SourceId, plan.TargetId, plan.Ranges, cluster)
+			if isPermanentError(err) {
+				log.Eventf("REBALANCE", "Give up migrate plan %s -> %s, %v", plan.SourceId, plan.TargetId, err)
+				plan.State = stateNames[StateCancelled]
+				plan.Error = err.Error()
+				continue
+			}
+			if err != nil {
+				continue
 			}
+			log.Infof(task.TaskName(), "Rebalance task created, %v", task)
+			plan.task = task
+			task.restore(plan)
+			go task.Run()
+			continue
 		}
-		if allRunning {
-			break
+		state := plan.task.CurrentState()
+		if state != StateDone && state != StateCancelled {
+			allDone = false
+			if rbtask.Cancelled && state != StateCancelling {
+				plan.task.SetState(StateCancelling)
+			}
+		} else {
+			m.RemoveTask(plan.task)
 		}
-		streams.RebalanceStateStream.Pub(*m.rebalanceTask)
-		time.Sleep(5 * time.Second)
 	}
-	// 等待结束
+	return allDone
+}
+
+func (m *MigrateManager) rebalance(rbtask *RebalanceTask, cluster *topo.Cluster) {
+	m.rbMutex.Lock()
+	rbtask.runStart = time.Now()
+	rbtask.updateProgress()
+	rbtask.runDone = rbtask.DoneSlots
+	m.rbMutex.Unlock()
+	// 同一Source同时只能有一个迁移任务，共用Source的计划依次执行：
+	// 每秒检查一次，移除已结束的任务，Source空闲后启动它的下一个计划，
+	// 发布进度，有slot完成时写入ZK
+	saved := -1
 	for {
-		allDone := true
-		for _, plan := range rbtask.Plans {
-			state := plan.task.CurrentState()
-			if state != StateDone && state != StateCancelled {
-				allDone = false
-			} else {
-				m.RemoveTask(plan.task)
-			}
+		m.rbMutex.Lock()
+		if m.cluster != nil {
+			cluster = m.cluster
 		}
+		allDone := m.checkRebalance(rbtask, cluster)
 		if allDone {
 			break
 		}
-		streams.RebalanceStateStream.Pub(*m.rebalanceTask)
-		time.Sleep(5 * time.Second)
+		m.pubRebalanceState(rbtask)
+		if rbtask.DoneSlots != saved {
+			m.saveRebalanceTask(rbtask)
+			saved = rbtask.DoneSlots
+		}
+		m.rbMutex.Unlock()
+		time.Sleep(REBALANCE_CHECK_INTERVAL)
 	}
+	defer m.rbMutex.Unlock()
 	now := time.Now()
-	m.rebalanceTask.EndTime = &now
-	streams.RebalanceStateStream.Pub(*m.rebalanceTask)
+	rbtask.EndTime = &now
+	m.pubRebalanceState(rbtask)
+	if rbtask.Cancelled {
+		log.Eventf("REBALANCE", "Rebalance task cancelled, %d/%d slots done", rbtask.DoneSlots, rbtask.TotalSlots)
+	}
+	m.lastRebalance = rbtask
 	m.rebalanceTask = nil
+	// 缩容任务带着结束时间留在ZK中，分片下线后再删除
+	if rbtask.DrainId != "" && !rbtask.Cancelled {
+		m.drainTask = rbtask
+		m.saveRebalanceTask(rbtask)
+		return
+	}
+	err := meta.RemoveRebalanceTask()
+	if err != nil {
+		log.Warningf("REBALANCE", "Remove rebalance task from zk failed, %v", err)
+	}
+}
+
+// 迁移已经结束、等待下线分片的缩容任务
+func (m *MigrateManager) DrainTask() *RebalanceTask {
+	m.rbMutex.Lock()
+	defer m.rbMutex.Unlock()
+	if m.drainTask == nil {
+		return nil
+	}
+	return m.drainTask.copy()
+}
+
+// 分片已经下线或放弃下线，从ZK中删除缩容任务
+func (m *MigrateManager) FinishDrainTask() {
+	m.rbMutex.Lock()
+	defer m.rbMutex.Unlock()
+	if m.drainTask == nil {
+		return
+	}
+	m.drainTask = nil
+	err := meta.RemoveRebalanceTask()
+	if err != nil {
+		log.Warningf("REBALANCE", "Remove drain task from zk failed, %v", err)
+	}
 }
 
 /// helpers
 
 func SetSlotToNode(rs *topo.ReplicaSet, slot int, targetId string) error {
+	rc := redis.Default()
+	ctx := context.Background()
 	// 先清理从节点的MIGRATING状态
 	for _, node := range rs.Slaves {
 		if node.Fail {
 			continue
 		}
-		err := redis.SetSlot(node.Addr(), slot, redis.SLOT_NODE, targetId)
+		err := rc.SetSlot(ctx, node.Addr(), slot, redis.SLOT_NODE, targetId)
 		if err != nil {
 			return err
 		}
 	}
-	err := redis.SetSlot(rs.Master.Addr(), slot, redis.SLOT_NODE, targetId)
+	err := rc.SetSlot(ctx, rs.Master.Addr(), slot, redis.SLOT_NODE, targetId)
 	if err != nil {
 		return err
 	}
@@ -356,17 +532,19 @@ func SetSlotToNode(rs *topo.ReplicaSet, slot int, targetId string) error {
 }
 
 func SetSlotStable(rs *topo.ReplicaSet, slot int) error {
+	rc := redis.Default()
+	ctx := context.Background()
 	// 先清理从节点的MIGRATING状态
 	for _, node := range rs.Slaves {
 		if node.Fail {
 			continue
 		}
-		err := redis.SetSlot(node.Addr(), slot, redis.SLOT_STABLE, "")
+		err := rc.SetSlot(ctx, node.Addr(), slot, redis.SLOT_STABLE, "")
 		if err != nil {
 			return err
 		}
 	}
-	err := redis.SetSlot(rs.Master.Addr(), slot, redis.SLOT_STABLE, "")
+	err := rc.SetSlot(ctx, rs.Master.Addr(), slot, redis.SLOT_STABLE, "")
 	if err != nil {
 		return err
 	}
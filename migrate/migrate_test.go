@@ -1,10 +1,18 @@
 package migrate
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 
+	"github.com/ksarch-saas/cc/meta"
+	"github.com/ksarch-saas/cc/redis"
+	"github.com/ksarch-saas/cc/redis/fake"
 	"github.com/ksarch-saas/cc/topo"
+	zookeeper "github.com/samuel/go-zookeeper/zk"
 )
 
 func TestCreate(t *testing.T) {
@@ -88,3 +96,638 @@ func TestCutTailRebalancer__2(t *testing.T) {
 	plans := CutTailRebalancer(ss, ts)
 	fmt.Println(plans)
 }
+
+func TestRemainingRanges(t *testing.T) {
+	plan := &MigratePlan{
+		Ranges: []topo.Range{
+			topo.Range{0, 100},
+			topo.Range{200, 300},
+		},
+		CurrRangeIndex: 0,
+		CurrSlot:       50,
+	}
+	ranges := plan.RemainingRanges()
+	fmt.Println(ranges)
+	if len(ranges) != 2 || ranges[0].Left != 50 {
+		t.Error("unexpected remaining ranges", ranges)
+	}
+
+	// 第一个range已迁移完
+	plan.CurrSlot = 101
+	ranges = plan.RemainingRanges()
+	if len(ranges) != 1 || ranges[0].Left != 200 {
+		t.Error("unexpected remaining ranges", ranges)
+	}
+
+	plan.CurrRangeIndex = 2
+	if len(plan.RemainingRanges()) != 0 {
+		t.Error("should have no remaining ranges")
+	}
+}
+
+func TestWeightedRebalancer(t *testing.T) {
+	ss := []*topo.Node{
+		&topo.Node{Id: "s0", Ranges: []topo.Range{
+			topo.Range{0, 8191},
+		}},
+		&topo.Node{Id: "s1", Ranges: []topo.Range{
+			topo.Range{8192, 16383},
+		}},
+	}
+	ts := []*topo.Node{
+		&topo.Node{Id: "t0", Tag: "bj:bj01:room1:weight=2", Ranges: []topo.Range{}},
+	}
+	opts := &RebalanceOptions{Weights: map[string]int{"s1": 2}}
+	plans := WeightedRebalancer(ss, ts, opts)
+	fmt.Println(plans)
+
+	// 权重 1:2:2，期望slot数 3277:6554:6553
+	moved := map[string]int{}
+	for _, plan := range plans {
+		n := topo.Ranges(plan.Ranges).NumSlots()
+		moved[plan.SourceId] -= n
+		moved[plan.TargetId] += n
+	}
+	if 8192+moved["s0"] != 3277 || 8192+moved["s1"] != 6554 || moved["t0"] != 6553 {
+		t.Error("unexpected weighted plans", moved)
+	}
+}
+
+func TestSampleSlots(t *testing.T) {
+	slots := []int{}
+	for slot := 100; slot < 1100; slot++ {
+		slots = append(slots, slot)
+	}
+	sampled := sampleSlots(slots, 4)
+	if len(sampled) != 4 || sampled[0] != 100 || sampled[1] != 350 || sampled[3] != 850 {
+		t.Errorf("should sample evenly, got %v", sampled)
+	}
+	if len(sampleSlots(slots[:3], 4)) != 3 {
+		t.Error("should sample all slots when fewer than n")
+	}
+
+	// 未采样的slot也有估算的代价
+	_, cluster := setupRebalance(t, map[string][2]int{"m0": {0, 8191}, "m1": {8192, 16383}})
+	defer redis.SetDialer(nil)
+	cost, err := SampleSlotCost(cluster.MasterNodes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cost) != 16384 {
+		t.Errorf("expect cost of all slots, got %d", len(cost))
+	}
+}
+
+func TestNegativeWeight(t *testing.T) {
+	_, cluster := setupRebalance(t, map[string][2]int{"m0": {0, 16383}, "m1": {0, -1}})
+	defer redis.SetDialer(nil)
+
+	opts := &RebalanceOptions{Weights: map[string]int{nodeId("m1"): -1}}
+	if _, err := GenerateRebalancePlan("weighted", cluster, nil, opts); err == nil {
+		t.Error("negative weight should be rejected")
+	}
+	node := &topo.Node{Id: "t0", Tag: "bj:bj01:room1:weight=2"}
+	if w := nodeWeight(node, &RebalanceOptions{Weights: map[string]int{"t0": -1}}); w != 2 {
+		t.Errorf("negative weight should be ignored, got %d", w)
+	}
+}
+
+func TestKeysRebalancer(t *testing.T) {
+	ss := []*topo.Node{
+		&topo.Node{Id: "s0", Ranges: []topo.Range{
+			topo.Range{0, 99},
+		}},
+		&topo.Node{Id: "s1", Ranges: []topo.Range{
+			topo.Range{100, 199},
+		}},
+	}
+	ts := []*topo.Node{
+		&topo.Node{Id: "t0", Ranges: []topo.Range{}},
+	}
+	// s0的key集中在尾部的10个slot里
+	cost := map[int]int64{}
+	for slot := 0; slot < 200; slot++ {
+		cost[slot] = 1
+	}
+	for slot := 90; slot < 100; slot++ {
+		cost[slot] = 100
+	}
+	plans := KeysRebalancer(ss, ts, &RebalanceOptions{SlotCost: cost})
+	fmt.Println(plans)
+
+	moved := map[string]int64{}
+	for _, plan := range plans {
+		for _, r := range plan.Ranges {
+			for slot := r.Left; slot <= r.Right; slot++ {
+				moved[plan.SourceId] -= cost[slot]
+				moved[plan.TargetId] += cost[slot]
+			}
+		}
+	}
+	// 总代价1190，每个节点期望约396，偏差不超过一个大slot
+	final := map[string]int64{
+		"s0": 1090 + moved["s0"],
+		"s1": 100 + moved["s1"],
+		"t0": moved["t0"],
+	}
+	for id, c := range final {
+		if c < 296 || c > 496 {
+			t.Error("unexpected keys plans", id, final)
+		}
+	}
+}
+
+func TestMigrateHistory(t *testing.T) {
+	f, err := ioutil.TempFile("", "mighistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	SetHistoryFile(f.Name())
+	defer SetHistoryFile("")
+
+	AddMigrateRecord(&MigrateRecord{Slot: 1, SourceId: "s0", TargetId: "t0", Keys: 10})
+	AddMigrateRecord(&MigrateRecord{Slot: 2, SourceId: "s0", TargetId: "t1", Error: "IOERR", FailedKey: "k"})
+	AddMigrateRecord(&MigrateRecord{Slot: 2, SourceId: "s0", TargetId: "t1", Keys: 5})
+
+	records, _ := QueryMigrateRecords(-1, "", 0)
+	if len(records) != 3 {
+		t.Error("should have 3 records", records)
+	}
+	records, _ = QueryMigrateRecords(2, "", 0)
+	if len(records) != 2 || records[0].FailedKey != "k" {
+		t.Error("unexpected records of slot 2", records)
+	}
+	records, _ = QueryMigrateRecords(-1, "t0", 0)
+	if len(records) != 1 {
+		t.Error("unexpected records of t0", records)
+	}
+	records, _ = QueryMigrateRecords(-1, "s0", 1)
+	if len(records) != 1 || records[0].Keys != 5 {
+		t.Error("should return the latest record", records)
+	}
+}
+
+func TestMigrateHistoryRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mighistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	SetHistoryFile(dir + "/history")
+	defer SetHistoryFile("")
+	historyMaxBytes = 300
+	defer func() { historyMaxBytes = HISTORY_MAX_BYTES }()
+
+	// 每条记录一百多字节，每两条轮转一次，只保留一个旧文件
+	for i := 0; i < 5; i++ {
+		AddMigrateRecord(&MigrateRecord{Slot: i, SourceId: "s0", TargetId: "t0"})
+	}
+	for _, name := range []string{"history", "history.1"} {
+		info, err := os.Stat(dir + "/" + name)
+		if err != nil || info.Size() > historyMaxBytes {
+			t.Errorf("unexpected %s, %v", name, err)
+		}
+	}
+	records, _ := QueryMigrateRecords(-1, "", 0)
+	if len(records) != 3 || records[0].Slot != 2 || records[2].Slot != 4 {
+		t.Errorf("should keep the latest 3 records in order, got %v", records)
+	}
+}
+
+func TestMigrateFailureRecordedOnce(t *testing.T) {
+	fc, cluster := setupRebalance(t, map[string][2]int{"m0": {0, 8191}, "m1": {8192, 16383}})
+	defer redis.SetDialer(nil)
+	f, err := ioutil.TempFile("", "mighistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	SetHistoryFile(f.Name())
+	defer SetHistoryFile("")
+
+	// Target连不上时每500ms重试一次，恢复后完成迁移
+	fc.Kill(nodeId("m1"))
+	task := NewMigrateTask(cluster, cluster.FindReplicaSetByNode(nodeId("m0")),
+		cluster.FindReplicaSetByNode(nodeId("m1")), []topo.Range{{Left: 0, Right: 0}})
+	done := make(chan bool)
+	go func() {
+		task.Run()
+		close(done)
+	}()
+	time.Sleep(1200 * time.Millisecond)
+	fc.Revive(nodeId("m1"))
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("migrate not finished")
+	}
+
+	records, _ := QueryMigrateRecords(0, "", 0)
+	if len(records) != 2 || records[0].Error == "" || records[1].Error != "" {
+		t.Errorf("expect one failure and one done record, got %v", records)
+	}
+}
+
+func TestMigrateCancelRecordsFailure(t *testing.T) {
+	fc, cluster := setupRebalance(t, map[string][2]int{"m0": {0, 8191}, "m1": {8192, 16383}})
+	defer redis.SetDialer(nil)
+	f, err := ioutil.TempFile("", "mighistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	SetHistoryFile(f.Name())
+	defer SetHistoryFile("")
+
+	// Target一直连不上，重试期间取消任务，记录第一次失败和放弃slot的结果
+	fc.Kill(nodeId("m1"))
+	task := NewMigrateTask(cluster, cluster.FindReplicaSetByNode(nodeId("m0")),
+		cluster.FindReplicaSetByNode(nodeId("m1")), []topo.Range{{Left: 0, Right: 0}})
+	done := make(chan bool)
+	go func() {
+		task.Run()
+		close(done)
+	}()
+	time.Sleep(1200 * time.Millisecond)
+	task.SetState(StateCancelling)
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("migrate not cancelled")
+	}
+
+	records, _ := QueryMigrateRecords(0, "", 0)
+	if len(records) != 2 || records[0].Error == "" || records[1].Error != errTaskCancelled.Error() {
+		t.Errorf("expect first failure and cancelled records, got %v", records)
+	}
+}
+
+func TestLargeKeyTimeout(t *testing.T) {
+	mb := int64(1024 * 1024)
+	if largeKeyTimeout(mb, 8*mb, 2000, 1) != 2000 {
+		t.Error("small key should use MigrateTimeout")
+	}
+	if largeKeyTimeout(20*mb, 8*mb, 2000, 1) != 6000 {
+		t.Error("timeout should scale with size")
+	}
+	if largeKeyTimeout(20*mb, 8*mb, 2000, 2) != 12000 {
+		t.Error("timeout should grow with attempts")
+	}
+	if largeKeyTimeout(1024*mb, 8*mb, 2000, 5) != LARGE_KEY_MAX_TIMEOUT {
+		t.Error("timeout should not exceed LARGE_KEY_MAX_TIMEOUT")
+	}
+	if largeKeyBackoff(1) != LARGE_KEY_BACKOFF || largeKeyBackoff(3) != 4*LARGE_KEY_BACKOFF {
+		t.Error("backoff should double each attempt")
+	}
+	if largeKeyBackoff(100) != LARGE_KEY_MAX_BACKOFF {
+		t.Error("backoff should not exceed LARGE_KEY_MAX_BACKOFF")
+	}
+}
+
+// 只有主的模拟集群，每个主负责slots中的一段，slot中没有key
+func setupRebalance(t *testing.T, slots map[string][2]int) (*fake.Cluster, *topo.Cluster) {
+	fc := fake.NewCluster("bj")
+	for i, id := range []string{"m0", "m1", "m2", "m3"} {
+		r, ok := slots[id]
+		if !ok {
+			continue
+		}
+		fc.AddMaster(nodeId(id), fmt.Sprintf("127.0.0.1:%d", 7000+i), "bj:z1:r1", r[0], r[1])
+	}
+	zk := meta.NewFakeZk()
+	_, err := meta.CreateRecursive(zk, "/r3/app/test/migrate", "", 0, zookeeper.WorldACL(zookeeper.PermAll))
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta.RunWithZk("test", "bj", zk, &meta.AppConfig{
+		AppName:      "test",
+		MasterRegion: "bj",
+		Regions:      []string{"bj"},
+	})
+	redis.SetDialer(fc)
+
+	cluster := topo.NewCluster("bj")
+	for _, node := range fc.Snapshot("bj") {
+		cluster.AddNode(node)
+	}
+	err = cluster.BuildReplicaSets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fc, cluster
+}
+
+// 任务名中使用Id的前6位
+func nodeId(name string) string {
+	return name + "00000000"
+}
+
+// 执行Rebalance任务直到结束，与RunRebalanceTask相同，只是等待调度结束
+func runRebalance(t *testing.T, plans []*MigratePlan, cluster *topo.Cluster) *RebalanceTask {
+	m := NewMigrateManager()
+	now := time.Now()
+	rbtask := &RebalanceTask{Plans: plans, StartTime: &now}
+	m.rebalanceTask = rbtask
+	done := make(chan bool)
+	go func() {
+		m.rebalance(rbtask, cluster)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("rebalance not finished")
+	}
+	if m.RebalanceTask() != nil || len(m.AllTasks()) != 0 {
+		t.Errorf("rebalance task and migrate tasks should be removed, got %d tasks", len(m.AllTasks()))
+	}
+	return rbtask
+}
+
+// 统计每个节点负责的slot数
+func slotCounts(fc *fake.Cluster, n int) map[string]int {
+	counts := map[string]int{}
+	for slot := 0; slot < n; slot++ {
+		counts[fc.MasterOf(slot)[:2]]++
+	}
+	return counts
+}
+
+func TestDrainToMultipleMasters(t *testing.T) {
+	fc, cluster := setupRebalance(t, map[string][2]int{
+		"m0": {0, 99},
+		"m1": {100, 199},
+		"m2": {200, 299},
+	})
+	defer redis.SetDialer(nil)
+
+	plans, err := GenerateDrainPlan(cluster, nodeId("m0"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plans) != 2 {
+		t.Fatalf("should drain to 2 masters, got %v", plans)
+	}
+	rbtask := runRebalance(t, plans, cluster)
+	if rbtask.DoneSlots != 100 || rbtask.TotalSlots != 100 {
+		t.Errorf("expect 100 slots done, got %d/%d", rbtask.DoneSlots, rbtask.TotalSlots)
+	}
+	counts := slotCounts(fc, 300)
+	if counts["m0"] != 0 || counts["m1"] != 150 || counts["m2"] != 150 {
+		t.Errorf("unexpected slots after drain %v", counts)
+	}
+}
+
+func TestWeightedRebalanceRun(t *testing.T) {
+	fc, cluster := setupRebalance(t, map[string][2]int{
+		"m0": {0, 299},
+		"m1": {0, -1},
+		"m2": {0, -1},
+	})
+	defer redis.SetDialer(nil)
+
+	ss := []*topo.Node{cluster.FindNode(nodeId("m0"))}
+	ts := []*topo.Node{cluster.FindNode(nodeId("m1")), cluster.FindNode(nodeId("m2"))}
+	plans := WeightedRebalancer(ss, ts, &RebalanceOptions{})
+	// m0同时分给两个节点，两个计划共用Source
+	if len(plans) != 2 || plans[0].SourceId != plans[1].SourceId {
+		t.Fatalf("m0 should donate to 2 masters, got %v", plans)
+	}
+	rbtask := runRebalance(t, plans, cluster)
+	if rbtask.DoneSlots != 200 {
+		t.Errorf("expect 200 slots done, got %d", rbtask.DoneSlots)
+	}
+	counts := slotCounts(fc, 300)
+	if counts["m0"] != 100 || counts["m1"] != 100 || counts["m2"] != 100 {
+		t.Errorf("unexpected slots after rebalance %v", counts)
+	}
+}
+
+func TestKeysRebalanceRun(t *testing.T) {
+	fc, cluster := setupRebalance(t, map[string][2]int{
+		"m0": {0, 299},
+		"m1": {0, -1},
+		"m2": {0, -1},
+	})
+	defer redis.SetDialer(nil)
+
+	cost := map[int]int64{}
+	for slot := 0; slot < 300; slot++ {
+		cost[slot] = 1
+	}
+	ss := []*topo.Node{cluster.FindNode(nodeId("m0"))}
+	ts := []*topo.Node{cluster.FindNode(nodeId("m1")), cluster.FindNode(nodeId("m2"))}
+	plans := KeysRebalancer(ss, ts, &RebalanceOptions{SlotCost: cost})
+	if len(plans) != 2 || plans[0].SourceId != plans[1].SourceId {
+		t.Fatalf("m0 should donate to 2 masters, got %v", plans)
+	}
+	runRebalance(t, plans, cluster)
+	counts := slotCounts(fc, 300)
+	if counts["m0"] != 100 || counts["m1"] != 100 || counts["m2"] != 100 {
+		t.Errorf("unexpected slots after rebalance %v", counts)
+	}
+}
+
+func TestHandleTaskChangeKeepState(t *testing.T) {
+	_, cluster := setupRebalance(t, map[string][2]int{
+		"m0": {0, 99},
+		"m1": {100, 199},
+	})
+	defer redis.SetDialer(nil)
+
+	m := NewMigrateManager()
+	task, err := m.CreateTask(nodeId("m0"), nodeId("m1"), []topo.Range{{Left: 0, Right: 9}}, cluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, state := range []int32{StateBlockedOnKey, StatePaused} {
+		task.SetState(state)
+		m.handleTaskChange(task, cluster)
+		if task.CurrentState() != state {
+			t.Errorf("state %s should be kept, got %s", stateNames[state], stateNames[task.CurrentState()])
+		}
+	}
+	task.SetState(StateTargetNodeFailure)
+	m.handleTaskChange(task, cluster)
+	if task.CurrentState() != StateRunning {
+		t.Errorf("should recover from TargetNodeFailure, got %s", stateNames[task.CurrentState()])
+	}
+}
+
+func TestSkippedSlotsNotRebuilt(t *testing.T) {
+	_, cluster := setupRebalance(t, map[string][2]int{
+		"m0": {0, 99},
+		"m1": {100, 199},
+	})
+	defer redis.SetDialer(nil)
+
+	m := NewMigrateManager()
+	m.addSkippedSlots([]int{5})
+	source := cluster.FindNode(nodeId("m0"))
+	source.Migrating = map[string][]int{nodeId("m1"): {5}}
+	m.HandleNodeStateChange(cluster)
+	if len(m.AllTasks()) != 0 {
+		t.Errorf("should not rebuild task for skipped slot, got %v", m.AllTasks())
+	}
+
+	// 新的Leader从ZK加载
+	m = NewMigrateManager()
+	m.HandleNodeStateChange(cluster)
+	if !m.skippedSlots[5] || len(m.AllTasks()) != 0 {
+		t.Errorf("skipped slots should be loaded, got %v", m.skippedSlots)
+	}
+
+	// 标记被清理后移除
+	source.Migrating = nil
+	m.HandleNodeStateChange(cluster)
+	if len(m.skippedSlots) != 0 {
+		t.Errorf("skipped slot should be removed, got %v", m.skippedSlots)
+	}
+}
+
+func TestCheckpointBySourceAndTarget(t *testing.T) {
+	_, cluster := setupRebalance(t, map[string][2]int{
+		"m0": {0, 99},
+		"m1": {0, -1},
+		"m2": {0, -1},
+	})
+	defer redis.SetDialer(nil)
+
+	rs0 := cluster.FindReplicaSetByNode(nodeId("m0"))
+	t1 := NewMigrateTask(cluster, rs0, cluster.FindReplicaSetByNode(nodeId("m1")), []topo.Range{{Left: 0, Right: 49}})
+	t2 := NewMigrateTask(cluster, rs0, cluster.FindReplicaSetByNode(nodeId("m2")), []topo.Range{{Left: 50, Right: 99}})
+	t1.checkpoint()
+	t2.checkpoint()
+
+	datas, err := meta.LoadMigrateTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(datas) != 2 {
+		t.Fatalf("plans sharing a source should be saved separately, got %d", len(datas))
+	}
+	plan := &MigratePlan{}
+	err = json.Unmarshal(datas[nodeId("m0")+"_"+nodeId("m2")], plan)
+	if err != nil || plan.Ranges[0].Left != 50 {
+		t.Errorf("unexpected plan %v, %v", plan, err)
+	}
+
+	// Target故障切换后，进度保存到新Target下
+	t2.ReplaceTargetReplicaSet(cluster.FindReplicaSetByNode(nodeId("m1")))
+	t2.checkpoint()
+	datas, _ = meta.LoadMigrateTasks()
+	if _, ok := datas[nodeId("m0")+"_"+nodeId("m2")]; ok || len(datas) != 1 {
+		t.Errorf("checkpoint of old target should be removed, got %d", len(datas))
+	}
+	t2.removeCheckpoint()
+	datas, _ = meta.LoadMigrateTasks()
+	if len(datas) != 0 {
+		t.Errorf("checkpoint should be removed, got %d", len(datas))
+	}
+}
+
+func TestRebalanceGiveUpPlan(t *testing.T) {
+	fc, cluster := setupRebalance(t, map[string][2]int{
+		"m0": {0, 99},
+		"m1": {100, 199},
+	})
+	defer redis.SetDialer(nil)
+
+	// 目标分片不存在的计划不能执行，放弃后Rebalance任务正常结束
+	plans := []*MigratePlan{
+		{SourceId: nodeId("m0"), TargetId: nodeId("m1"), Ranges: []topo.Range{{Left: 0, Right: 9}}},
+		{SourceId: nodeId("m1"), TargetId: nodeId("m3"), Ranges: []topo.Range{{Left: 100, Right: 109}}},
+	}
+	runRebalance(t, plans, cluster)
+	if plans[0].State != stateNames[StateDone] {
+		t.Errorf("first plan should be done, got %s", plans[0].State)
+	}
+	if plans[1].State != stateNames[StateCancelled] || plans[1].Error != ErrReplicatSetNotFound.Error() {
+		t.Errorf("second plan should be given up, got %s %s", plans[1].State, plans[1].Error)
+	}
+	counts := slotCounts(fc, 200)
+	if counts["m0"] != 90 || counts["m1"] != 110 {
+		t.Errorf("unexpected slots after rebalance %v", counts)
+	}
+}
+
+func TestCancelRebalance(t *testing.T) {
+	fc, cluster := setupRebalance(t, map[string][2]int{
+		"m0": {0, 99},
+		"m1": {100, 199},
+	})
+	defer redis.SetDialer(nil)
+
+	m := NewMigrateManager()
+	if m.CancelRebalanceTask() != ErrRebalanceNotExist {
+		t.Error("cancel should fail without rebalance task")
+	}
+	plans := []*MigratePlan{
+		{SourceId: nodeId("m0"), TargetId: nodeId("m1"), Ranges: []topo.Range{{Left: 0, Right: 9}}},
+	}
+	now := time.Now()
+	m.rebalanceTask = &RebalanceTask{Plans: plans, StartTime: &now}
+	// 没有开始的计划直接取消
+	if err := m.CancelRebalanceTask(); err != nil {
+		t.Fatal(err)
+	}
+	m.rebalance(m.rebalanceTask, cluster)
+	rbtask, err := m.RebalanceStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rbtask.Cancelled || rbtask.EndTime == nil || rbtask.Plans[0].State != stateNames[StateCancelled] {
+		t.Errorf("rebalance should be cancelled, %+v", rbtask)
+	}
+	if fc.MasterOf(0)[:2] != "m0" {
+		t.Error("cancelled plan should not migrate slots")
+	}
+}
+
+func TestDrainTaskRecover(t *testing.T) {
+	fc, cluster := setupRebalance(t, map[string][2]int{
+		"m0": {0, 9},
+		"m1": {10, 19},
+	})
+	defer redis.SetDialer(nil)
+
+	m := NewMigrateManager()
+	plans, err := GenerateDrainPlan(cluster, nodeId("m0"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.RunDrainTask(nodeId("m0"), plans, cluster); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(30 * time.Second)
+	for m.DrainTask() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("drain migration not finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if fc.MasterOf(0)[:2] != "m1" {
+		t.Errorf("slots should be migrated to m1")
+	}
+	// 等待下线时不能开始新的Rebalance
+	if m.RunRebalanceTask(nil, cluster) != ErrRebalanceTaskExist {
+		t.Error("rebalance should be refused before drain finished")
+	}
+
+	// 新的Leader从ZK恢复等待下线的缩容任务
+	m2 := NewMigrateManager()
+	m2.HandleNodeStateChange(cluster)
+	rbtask := m2.DrainTask()
+	if rbtask == nil || rbtask.DrainId != nodeId("m0") || m2.RebalanceTask() != nil {
+		t.Fatalf("drain task should be recovered, got %+v", rbtask)
+	}
+	m2.FinishDrainTask()
+	data, err := meta.LoadRebalanceTask()
+	if err != nil || data != nil {
+		t.Errorf("drain task should be removed from zk, %s %v", data, err)
+	}
+}
@@ -0,0 +1,263 @@
+package migrate
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/ksarch-saas/cc/log"
+	"github.com/ksarch-saas/cc/meta"
+	"github.com/ksarch-saas/cc/topo"
+)
+
+/// 任务持久化
+/// 迁移任务每迁移完一个slot就把进度写入ZK，Rebalance任务在创建和计划状态变化时写入，
+/// Leader切换后，新的Leader从ZK加载这些任务，从中断的slot继续迁移
+
+// 剩余待迁移的ranges，CurrSlot之前的slot已经迁移完成
+func (p *MigratePlan) RemainingRanges() []topo.Range {
+	if p.CurrRangeIndex >= len(p.Ranges) {
+		return nil
+	}
+	ranges := []topo.Range{}
+	r := p.Ranges[p.CurrRangeIndex]
+	if p.CurrSlot > r.Left {
+		r.Left = p.CurrSlot
+	}
+	if r.Left <= r.Right {
+		ranges = append(ranges, r)
+	}
+	return append(ranges, p.Ranges[p.CurrRangeIndex+1:]...)
+}
+
+func planKey(p *MigratePlan) string {
+	return p.SourceId + "_" + p.TargetId
+}
+
+func (p *MigratePlan) finished() bool {
+	return p.State == stateNames[StateDone] || p.State == stateNames[StateCancelled]
+}
+
+func (t *MigrateTask) checkpoint() {
+	data, err := json.Marshal(t.ToPlan())
+	if err != nil {
+		log.Warningf(t.TaskName(), "Encode migrate task failed, %v", err)
+		return
+	}
+	sourceId := t.SourceNode().Id
+	targetId := t.TargetNode().Id
+	err = meta.SaveMigrateTask(sourceId, targetId, data)
+	if err != nil {
+		log.Warningf(t.TaskName(), "Checkpoint migrate task failed, %v", err)
+		return
+	}
+	if t.checkpointTarget != "" && t.checkpointTarget != targetId {
+		meta.RemoveMigrateTask(sourceId, t.checkpointTarget)
+	}
+	t.checkpointTarget = targetId
+}
+
+// 删除ZK中保存的进度
+func (t *MigrateTask) removeCheckpoint() error {
+	if t.checkpointTarget == "" {
+		return nil
+	}
+	return meta.RemoveMigrateTask(t.SourceNode().Id, t.checkpointTarget)
+}
+
+// 按保存的计划恢复任务状态，挂起在大key上的任务重新开始迁移，会再次探测并挂起
+func (t *MigrateTask) restore(plan *MigratePlan) {
+	if plan.State == stateNames[StatePaused] {
+		t.SetState(StatePaused)
+	}
+	for _, key := range plan.SkippedKeys {
+		t.skipKeys[key] = true
+	}
+	t.skippedKeys = plan.SkippedKeys
+	t.skippedSlots = plan.SkippedSlots
+}
+
+func (m *MigrateManager) saveRebalanceTask(rbtask *RebalanceTask) {
+	// 已启动的计划以任务的实时进度为准
+	plans := []*MigratePlan{}
+	for _, plan := range rbtask.Plans {
+		if plan.task != nil {
+			plans = append(plans, plan.task.ToPlan())
+		} else {
+			plans = append(plans, plan)
+		}
+	}
+	data, err := json.Marshal(RebalanceTask{
+		Plans:     plans,
+		StartTime: rbtask.StartTime,
+		EndTime:   rbtask.EndTime,
+		Cancelled: rbtask.Cancelled,
+		DrainId:   rbtask.DrainId,
+	})
+	if err != nil {
+		log.Warningf("REBALANCE", "Encode rebalance task failed, %v", err)
+		return
+	}
+	err = meta.SaveRebalanceTask(data)
+	if err != nil {
+		log.Warningf("REBALANCE", "Save rebalance task failed, %v", err)
+	}
+}
+
+/// 被跳过的slot
+/// 任务结束后这些slot仍处于MIGRATING/IMPORTING状态，记录下来避免根据标记重建任务后
+/// 再次挂起在同一个大key上；slot的标记被运维清理后移除
+
+func (m *MigrateManager) addSkippedSlots(slots []int) {
+	changed := false
+	for _, slot := range slots {
+		if !m.skippedSlots[slot] {
+			m.skippedSlots[slot] = true
+			changed = true
+		}
+	}
+	if changed {
+		m.saveSkippedSlots()
+	}
+}
+
+func (m *MigrateManager) saveSkippedSlots() {
+	slots := []int{}
+	for slot := range m.skippedSlots {
+		slots = append(slots, slot)
+	}
+	sort.Ints(slots)
+	data, err := json.Marshal(slots)
+	if err != nil {
+		log.Warningf("MIGRATE", "Encode skipped slots failed, %v", err)
+		return
+	}
+	err = meta.SaveSkippedSlots(data)
+	if err != nil {
+		log.Warningf("MIGRATE", "Save skipped slots failed, %v", err)
+	}
+}
+
+// 移除已经没有MIGRATING/IMPORTING标记的slot
+func (m *MigrateManager) cleanSkippedSlots(cluster *topo.Cluster) {
+	if len(m.skippedSlots) == 0 {
+		return
+	}
+	marked := map[int]bool{}
+	for _, node := range cluster.AllNodes() {
+		for _, slots := range node.Migrating {
+			for _, slot := range slots {
+				marked[slot] = true
+			}
+		}
+		for _, slots := range node.Importing {
+			for _, slot := range slots {
+				marked[slot] = true
+			}
+		}
+	}
+	changed := false
+	for slot := range m.skippedSlots {
+		if !marked[slot] {
+			delete(m.skippedSlots, slot)
+			changed = true
+		}
+	}
+	if changed {
+		m.saveSkippedSlots()
+	}
+}
+
+// 从ZK加载上一任Leader未完成的任务并继续执行
+func (m *MigrateManager) loadTasks(cluster *topo.Cluster) error {
+	data, err := meta.LoadSkippedSlots()
+	if err != nil {
+		return err
+	}
+	if data != nil {
+		slots := []int{}
+		err = json.Unmarshal(data, &slots)
+		if err != nil {
+			log.Warningf("MIGRATE", "Decode skipped slots failed, %v", err)
+		}
+		for _, slot := range slots {
+			m.skippedSlots[slot] = true
+		}
+	}
+
+	datas, err := meta.LoadMigrateTasks()
+	if err != nil {
+		return err
+	}
+	// 同一Source可能有多个计划，按Source和Target匹配
+	saved := map[string]*MigratePlan{}
+	for name, data := range datas {
+		var plan MigratePlan
+		err := json.Unmarshal(data, &plan)
+		if err != nil {
+			log.Warningf("MIGRATE", "Decode migrate task %s failed, %v", name, err)
+			continue
+		}
+		saved[planKey(&plan)] = &plan
+	}
+
+	data, err = meta.LoadRebalanceTask()
+	if err != nil {
+		return err
+	}
+	if data != nil {
+		var rbtask RebalanceTask
+		err = json.Unmarshal(data, &rbtask)
+		if err != nil {
+			log.Warningf("REBALANCE", "Decode rebalance task failed, %v", err)
+		} else if rbtask.EndTime != nil && rbtask.DrainId != "" {
+			// 迁移已经结束，只剩下线分片
+			log.Warningf("REBALANCE", "Recover drain of %s", rbtask.DrainId)
+			m.rbMutex.Lock()
+			m.drainTask = &rbtask
+			m.rbMutex.Unlock()
+		} else if m.RebalanceTask() == nil {
+			for _, plan := range rbtask.Plans {
+				if p := saved[planKey(plan)]; p != nil {
+					plan.CurrRangeIndex = p.CurrRangeIndex
+					plan.CurrSlot = p.CurrSlot
+					plan.State = p.State
+					plan.SkippedKeys = p.SkippedKeys
+					plan.SkippedSlots = p.SkippedSlots
+					delete(saved, planKey(plan))
+				}
+				if plan.finished() {
+					continue
+				}
+				plan.Ranges = plan.RemainingRanges()
+				plan.CurrRangeIndex = 0
+				plan.CurrSlot = 0
+			}
+			log.Warningf("REBALANCE", "Recover rebalance task started at %v with %d plans",
+				rbtask.StartTime, len(rbtask.Plans))
+			m.rbMutex.Lock()
+			m.rebalanceTask = &rbtask
+			m.rbMutex.Unlock()
+			go m.rebalance(&rbtask, cluster)
+		}
+	}
+
+	for _, plan := range saved {
+		ranges := plan.RemainingRanges()
+		if len(ranges) == 0 || plan.finished() {
+			meta.RemoveMigrateTask(plan.SourceId, plan.TargetId)
+			continue
+		}
+		task, err := m.CreateTask(plan.SourceId, plan.TargetId, ranges, cluster)
+		if err != nil {
+			log.Warningf("MIGRATE", "Can not recover migrate task of %s, %v", plan.SourceId, err)
+			continue
+		}
+		task.restore(plan)
+		log.Warningf(task.TaskName(), "Recover migrate task from zk, ranges %v", ranges)
+		go func(t *MigrateTask) {
+			t.Run()
+			m.RemoveTask(t)
+		}(task)
+	}
+	return nil
+}
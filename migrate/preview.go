@@ -0,0 +1,82 @@
+package migrate
+
+import (
+	"context"
+	"github.com/ksarch-saas/cc/log"
+	"github.com/ksarch-saas/cc/redis"
+	"github.com/ksarch-saas/cc/topo"
+)
+
+/// 迁移计划预览，只做统计，不执行任何迁移
+
+type PlanPreview struct {
+	SourceId string
+	TargetId string
+	Ranges   []topo.Range
+	NumSlots int
+	NumKeys  int // 根据CountKeysInSlot估算，-1表示统计失败
+}
+
+type SlotDistribution struct {
+	Id     string
+	Before int
+	After  int
+}
+
+type PlansPreview struct {
+	Plans        []*PlanPreview
+	Distribution []*SlotDistribution // 执行计划前后每个Master的slot数
+}
+
+func PreviewPlans(plans []*MigratePlan, cluster *topo.Cluster) *PlansPreview {
+	preview := &PlansPreview{
+		Plans:        []*PlanPreview{},
+		Distribution: []*SlotDistribution{},
+	}
+	delta := map[string]int{}
+	for _, plan := range plans {
+		p := &PlanPreview{
+			SourceId: plan.SourceId,
+			TargetId: plan.TargetId,
+			Ranges:   plan.Ranges,
+			NumSlots: topo.Ranges(plan.Ranges).NumSlots(),
+			NumKeys:  -1,
+		}
+		delta[plan.SourceId] -= p.NumSlots
+		delta[plan.TargetId] += p.NumSlots
+
+		source := cluster.FindNode(plan.SourceId)
+		if source != nil {
+			slots := []int{}
+			for _, r := range plan.Ranges {
+				for slot := r.Left; slot <= r.Right; slot++ {
+					slots = append(slots, slot)
+				}
+			}
+			counts, err := redis.Default().CountKeysInSlots(context.Background(), source.Addr(), slots)
+			if err == nil {
+				p.NumKeys = 0
+				for _, n := range counts {
+					p.NumKeys += n
+				}
+			} else {
+				log.Warningf(source.Addr(), "Count keys for plan preview failed, %v", err)
+			}
+		}
+		preview.Plans = append(preview.Plans, p)
+	}
+
+	for _, rs := range cluster.ReplicaSets() {
+		master := rs.Master
+		if master.Free || master.IsStandbyMaster() {
+			continue
+		}
+		n := master.NumSlots()
+		preview.Distribution = append(preview.Distribution, &SlotDistribution{
+			Id:     master.Id,
+			Before: n,
+			After:  n + delta[master.Id],
+		})
+	}
+	return preview
+}
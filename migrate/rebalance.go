@@ -1,27 +1,210 @@
 package migrate
 
 import (
+	"context"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ksarch-saas/cc/meta"
+	"github.com/ksarch-saas/cc/redis"
 	"github.com/ksarch-saas/cc/topo"
 )
 
 type RebalanceTask struct {
-	Plans     []*MigratePlan
-	StartTime *time.Time
-	EndTime   *time.Time
+	Plans      []*MigratePlan
+	StartTime  *time.Time
+	EndTime    *time.Time
+	TotalSlots int
+	DoneSlots  int
+	KeysMoved  int64
+	Throughput float64    // 平均每秒迁移的key数
+	ETA        *time.Time // 按slot迁移速度估算的完成时间
+	Cancelled  bool       `json:",omitempty"` // 已被取消，运行中的迁移结束当前slot后停止
+	DrainId    string     `json:",omitempty"` // 缩容的Master，迁移结束后下线该分片
+	runStart   time.Time  // 本次运行的开始时间，Leader切换恢复后重新计时
+	runDone    int        // 本次运行开始时已完成的slot数
 }
 
-type Rebalancer func(ss []*topo.Node, ts []*topo.Node) []*MigratePlan
+// 进度由rebalance在后台更新，查询和发布时使用副本
+func (rt *RebalanceTask) copy() *RebalanceTask {
+	c := *rt
+	c.Plans = make([]*MigratePlan, len(rt.Plans))
+	for i, plan := range rt.Plans {
+		p := *plan
+		c.Plans[i] = &p
+	}
+	return &c
+}
+
+// 汇总所有计划的进度，并估算完成时间
+func (rt *RebalanceTask) updateProgress() {
+	total := 0
+	done := 0
+	keys := int64(0)
+	for _, plan := range rt.Plans {
+		n := topo.Ranges(plan.Ranges).NumSlots()
+		total += n
+		if plan.task == nil {
+			if plan.finished() {
+				done += n
+			}
+			continue
+		}
+		t := plan.task
+		done += t.SlotsDone()
+		keys += t.KeysMoved()
+		p := t.ToPlan()
+		plan.CurrSlot = p.CurrSlot
+		plan.CurrRangeIndex = p.CurrRangeIndex
+		plan.State = p.State
+		plan.ThrottleLevel = p.ThrottleLevel
+	}
+	rt.TotalSlots = total
+	rt.DoneSlots = done
+	rt.KeysMoved = keys
+
+	elapsed := time.Since(rt.runStart).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	rt.Throughput = float64(keys) / elapsed
+	rate := float64(done-rt.runDone) / elapsed
+	if rate > 0 && done < total {
+		eta := time.Now().Add(time.Duration(float64(total-done) / rate * float64(time.Second)))
+		rt.ETA = &eta
+	} else {
+		rt.ETA = nil
+	}
+}
+
+type RebalanceOptions struct {
+	Weights  map[string]int // 节点Id -> 权重，weighted和keys方法使用
+	SlotCost map[int]int64  // slot -> 代价(key数或估算的字节数)，keys方法使用
+}
+
+type Rebalancer func(ss []*topo.Node, ts []*topo.Node, opts *RebalanceOptions) []*MigratePlan
 
 var RebalancerTable = map[string]Rebalancer{
-	"default": CutTailRebalancer,
-	"cuttail": CutTailRebalancer,
+	"default":  cutTailRebalancer,
+	"cuttail":  cutTailRebalancer,
+	"weighted": WeightedRebalancer,
+	"keys":     KeysRebalancer,
+}
+
+// 这些方法可以在非空的Master之间迁移，不要求有空的目标节点
+var nonEmptyRebalancers = map[string]bool{
+	"weighted": true,
+	"keys":     true,
+}
+
+// 这些方法需要先统计每个slot的代价
+var slotCostRebalancers = map[string]bool{
+	"keys": true,
+}
+
+// 从info中取平均每个key占用的内存，取不到时返回0
+func avgKeySize(node *topo.Node) int64 {
+	info, err := redis.Default().FetchInfo(context.Background(), node.Addr(), "all")
+	if err != nil {
+		return 0
+	}
+	used, err := info.GetInt64("used_memory")
+	if err != nil {
+		return 0
+	}
+	// db0:keys=100,expires=0,avg_ttl=0
+	keys := int64(0)
+	for _, kv := range strings.Split(info.Get("db0"), ",") {
+		if strings.HasPrefix(kv, "keys=") {
+			keys, _ = strconv.ParseInt(strings.TrimPrefix(kv, "keys="), 10, 64)
+		}
+	}
+	if keys == 0 {
+		return 0
+	}
+	return used / keys
+}
+
+// 每个节点采样统计key数的slot数
+const SLOT_COST_SAMPLES = 128
+
+// 从slots中均匀取最多n个
+func sampleSlots(slots []int, n int) []int {
+	if len(slots) <= n {
+		return slots
+	}
+	sampled := make([]int, n)
+	for i := range sampled {
+		sampled[i] = slots[i*len(slots)/n]
+	}
+	return sampled
+}
+
+// 在各Master上均匀采样最多SLOT_COST_SAMPLES个slot统计key数，未采样的slot取节点上采样的平均值，
+// 所有节点都取到内存信息时，按 key数*节点平均key大小 估算每个slot占用的字节数
+func SampleSlotCost(nodes []*topo.Node) (map[int]int64, error) {
+	counts := map[string]map[int]int{}
+	avgs := map[string]int64{}
+	useMemory := true
+	for _, node := range nodes {
+		slots := []int{}
+		for _, r := range node.Ranges {
+			for slot := r.Left; slot <= r.Right; slot++ {
+				slots = append(slots, slot)
+			}
+		}
+		if len(slots) == 0 {
+			continue
+		}
+		sampled := sampleSlots(slots, SLOT_COST_SAMPLES)
+		c, err := redis.Default().CountKeysInSlots(context.Background(), node.Addr(), sampled)
+		if err != nil {
+			return nil, fmt.Errorf("Count keys of %s failed, %v", node.Addr(), err)
+		}
+		total := 0
+		for _, n := range c {
+			total += n
+		}
+		avg := total / len(sampled)
+		for _, slot := range slots {
+			if _, ok := c[slot]; !ok {
+				c[slot] = avg
+			}
+		}
+		counts[node.Id] = c
+		avgs[node.Id] = avgKeySize(node)
+		if avgs[node.Id] == 0 {
+			useMemory = false
+		}
+	}
+
+	cost := map[int]int64{}
+	for id, c := range counts {
+		for slot, n := range c {
+			if useMemory {
+				cost[slot] = int64(n) * avgs[id]
+			} else {
+				cost[slot] = int64(n)
+			}
+		}
+	}
+	return cost, nil
 }
 
-func GenerateRebalancePlan(method string, cluster *topo.Cluster, targetIds []string) ([]*MigratePlan, error) {
+func cutTailRebalancer(ss []*topo.Node, ts []*topo.Node, opts *RebalanceOptions) []*MigratePlan {
+	return CutTailRebalancer(ss, ts)
+}
+
+func GenerateRebalancePlan(method string, cluster *topo.Cluster, targetIds []string, opts *RebalanceOptions) ([]*MigratePlan, error) {
+	if opts != nil {
+		for id, w := range opts.Weights {
+			if w < 0 {
+				return nil, fmt.Errorf("Invalid weight %d of %s, should not be negative.", w, id)
+			}
+		}
+	}
 	rss := cluster.ReplicaSets()
 	regions := meta.AllRegions()
 
@@ -56,7 +239,7 @@ func GenerateRebalancePlan(method string, cluster *topo.Cluster, targetIds []str
 		}
 	}
 
-	if len(ts) == 0 {
+	if len(ts) == 0 && !nonEmptyRebalancers[method] {
 		return nil, fmt.Errorf("No available empty target replicasets.")
 	}
 
@@ -64,7 +247,78 @@ func GenerateRebalancePlan(method string, cluster *topo.Cluster, targetIds []str
 	if rebalancer == nil {
 		return nil, fmt.Errorf("Rebalancing method %s not exist.", method)
 	}
-	plans := rebalancer(ss, ts)
+	if opts == nil {
+		opts = &RebalanceOptions{}
+	}
+	if slotCostRebalancers[method] && opts.SlotCost == nil {
+		cost, err := SampleSlotCost(ss)
+		if err != nil {
+			return nil, err
+		}
+		opts.SlotCost = cost
+	}
+	plans := rebalancer(ss, ts, opts)
+
+	return plans, nil
+}
 
+// 缩容：将指定Master的所有slot分给其余的Master，
+// 每次把一个slot分给 slot数/权重 最小的Master，只迁出被下线的分片
+func GenerateDrainPlan(cluster *topo.Cluster, masterId string, opts *RebalanceOptions) ([]*MigratePlan, error) {
+	regions := meta.AllRegions()
+
+	drain := cluster.FindNode(masterId)
+	if drain == nil || !drain.IsMaster() {
+		return nil, fmt.Errorf("Master %s not found.", masterId)
+	}
+
+	ts := []*topo.Node{}
+	for _, rs := range cluster.ReplicaSets() {
+		master := rs.Master
+		if master.Id == masterId {
+			continue
+		}
+		if master.Fail || !rs.IsCoverAllRegions(regions) || master.Free {
+			continue
+		}
+		if nodeWeight(master, opts) > 0 {
+			ts = append(ts, master)
+		}
+	}
+	if len(ts) == 0 {
+		return nil, fmt.Errorf("No available masters to take over slots of %s.", masterId)
+	}
+
+	counts := make([]int, len(ts))
+	for i, node := range ts {
+		counts[i] = node.NumSlots()
+	}
+	assign := make([]int, len(ts))
+	for n := drain.NumSlots(); n > 0; n-- {
+		min := -1
+		for i, node := range ts {
+			w := nodeWeight(node, opts)
+			if min == -1 || counts[i]*nodeWeight(ts[min], opts) < counts[min]*w {
+				min = i
+			}
+		}
+		counts[min]++
+		assign[min]++
+	}
+
+	plans := []*MigratePlan{}
+	ranges := drain.Ranges
+	for i, node := range ts {
+		if assign[i] == 0 {
+			continue
+		}
+		var tail []topo.Range
+		tail, ranges = cutTailSlots(ranges, assign[i])
+		plans = append(plans, &MigratePlan{
+			SourceId: masterId,
+			TargetId: node.Id,
+			Ranges:   tail,
+		})
+	}
 	return plans, nil
 }
@@ -2,6 +2,8 @@ package migrate
 
 import (
 	"math"
+	"sort"
+	"strconv"
 
 	"github.com/ksarch-saas/cc/topo"
 )
@@ -76,3 +78,250 @@ func CutTailRebalancer(ss []*topo.Node, ts []*topo.Node) (plans []*MigratePlan)
 
 	return plans
 }
+
+// 节点权重，优先使用参数中指定的，其次是tag中的weight属性，默认为1，忽略负数
+func nodeWeight(node *topo.Node, opts *RebalanceOptions) int {
+	if opts != nil {
+		if w, ok := opts.Weights[node.Id]; ok && w >= 0 {
+			return w
+		}
+	}
+	if v := node.TagAttr("weight"); v != "" {
+		w, err := strconv.Atoi(v)
+		if err == nil && w >= 0 {
+			return w
+		}
+	}
+	return 1
+}
+
+// 从ranges尾部取n个slot，返回取出的ranges和剩余的ranges
+func cutTailSlots(ranges []topo.Range, n int) (tail []topo.Range, remain []topo.Range) {
+	remain = append([]topo.Range{}, ranges...)
+	for n > 0 && len(remain) > 0 {
+		last := remain[len(remain)-1]
+		if last.NumSlots() <= n {
+			tail = append(tail, last)
+			remain = remain[:len(remain)-1]
+			n -= last.NumSlots()
+		} else {
+			tail = append(tail, topo.Range{last.Right - n + 1, last.Right})
+			remain[len(remain)-1] = topo.Range{last.Left, last.Right - n}
+			n = 0
+		}
+	}
+	return tail, remain
+}
+
+type weightedNode struct {
+	node   *topo.Node
+	ranges []topo.Range
+	weight int
+	diff   int // 当前slot数与期望slot数之差，>0需要迁出，<0需要迁入
+}
+
+func absInt(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// 按需要迁移的slot数从多到少排序
+type byAbsDiff []*weightedNode
+
+func (s byAbsDiff) Len() int           { return len(s) }
+func (s byAbsDiff) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byAbsDiff) Less(i, j int) bool { return absInt(s[i].diff) > absInt(s[j].diff) }
+
+type slotRemainder struct {
+	idx int
+	val int
+}
+
+type byRemainder []slotRemainder
+
+func (s byRemainder) Len() int           { return len(s) }
+func (s byRemainder) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byRemainder) Less(i, j int) bool { return s[i].val > s[j].val }
+
+// 按权重分配slots，每个Master最终持有的slot数与权重成正比，
+// 只迁移超出期望的部分，迁移量最少；源和目标都可以是非空的Master，
+// 一个Master可能分给多个Master，这些计划共用Source，由rebalance依次执行
+func WeightedRebalancer(ss []*topo.Node, ts []*topo.Node, opts *RebalanceOptions) (plans []*MigratePlan) {
+	nodes := []*weightedNode{}
+	totalSlots := 0
+	totalWeight := 0
+	for _, node := range append(append([]*topo.Node{}, ss...), ts...) {
+		w := nodeWeight(node, opts)
+		nodes = append(nodes, &weightedNode{node: node, ranges: node.Ranges, weight: w})
+		totalSlots += node.NumSlots()
+		totalWeight += w
+	}
+	if len(nodes) == 0 || totalWeight == 0 {
+		return
+	}
+
+	// 最大余数法计算每个节点期望的slot数
+	rems := []slotRemainder{}
+	assigned := 0
+	for i, wn := range nodes {
+		expect := totalSlots * wn.weight / totalWeight
+		wn.diff = wn.node.NumSlots() - expect
+		assigned += expect
+		rems = append(rems, slotRemainder{i, totalSlots * wn.weight % totalWeight})
+	}
+	sort.Stable(byRemainder(rems))
+	for i := 0; i < totalSlots-assigned; i++ {
+		nodes[rems[i].idx].diff--
+	}
+
+	donors := []*weightedNode{}
+	receivers := []*weightedNode{}
+	for _, wn := range nodes {
+		if wn.diff > 0 {
+			donors = append(donors, wn)
+		} else if wn.diff < 0 {
+			receivers = append(receivers, wn)
+		}
+	}
+	sort.Stable(byAbsDiff(donors))
+	sort.Stable(byAbsDiff(receivers))
+
+	for _, d := range donors {
+		for _, r := range receivers {
+			if d.diff == 0 {
+				break
+			}
+			if r.diff == 0 {
+				continue
+			}
+			n := d.diff
+			if -r.diff < n {
+				n = -r.diff
+			}
+			var tail []topo.Range
+			tail, d.ranges = cutTailSlots(d.ranges, n)
+			d.diff -= n
+			r.diff += n
+			plans = append(plans, &MigratePlan{
+				SourceId: d.node.Id,
+				TargetId: r.node.Id,
+				Ranges:   tail,
+			})
+		}
+	}
+	return plans
+}
+
+type costNode struct {
+	node   *topo.Node
+	cost   int64
+	expect int64
+}
+
+type slotMove struct {
+	source *costNode
+	target *costNode
+	slots  []int
+}
+
+// 将slot列表合并为连续的ranges
+func slotsToRanges(slots []int) []topo.Range {
+	ranges := []topo.Range{}
+	sorted := append([]int{}, slots...)
+	sort.Ints(sorted)
+	for _, slot := range sorted {
+		n := len(ranges)
+		if n > 0 && ranges[n-1].Right+1 == slot {
+			ranges[n-1].Right = slot
+		} else {
+			ranges = append(ranges, topo.Range{Left: slot, Right: slot})
+		}
+	}
+	return ranges
+}
+
+// 按slot的代价(key数或估算的字节数)均衡，而不是按slot个数，
+// 每个Master期望的代价与权重成正比；从超出的Master尾部开始挑选slot，
+// 迁给差得最多的Master，单个slot超过剩余超出量时跳过，避免来回迁移；
+// 每对(源,目标)生成一个计划
+func KeysRebalancer(ss []*topo.Node, ts []*topo.Node, opts *RebalanceOptions) (plans []*MigratePlan) {
+	if opts == nil || opts.SlotCost == nil {
+		return
+	}
+	nodes := []*costNode{}
+	weights := []int64{}
+	totalCost := int64(0)
+	totalWeight := int64(0)
+	for _, node := range append(append([]*topo.Node{}, ss...), ts...) {
+		cn := &costNode{node: node}
+		for _, r := range node.Ranges {
+			for slot := r.Left; slot <= r.Right; slot++ {
+				cn.cost += opts.SlotCost[slot]
+			}
+		}
+		w := int64(nodeWeight(node, opts))
+		nodes = append(nodes, cn)
+		weights = append(weights, w)
+		totalCost += cn.cost
+		totalWeight += w
+	}
+	if totalWeight == 0 || totalCost == 0 {
+		return
+	}
+	for i, cn := range nodes {
+		cn.expect = totalCost * weights[i] / totalWeight
+	}
+
+	moves := []*slotMove{}
+	addMove := func(s, t *costNode, slot int) {
+		for _, m := range moves {
+			if m.source == s && m.target == t {
+				m.slots = append(m.slots, slot)
+				return
+			}
+		}
+		moves = append(moves, &slotMove{s, t, []int{slot}})
+	}
+
+	for _, d := range nodes {
+		if d.cost <= d.expect {
+			continue
+		}
+		slots := []int{}
+		for _, r := range d.node.Ranges {
+			for slot := r.Left; slot <= r.Right; slot++ {
+				slots = append(slots, slot)
+			}
+		}
+		for i := len(slots) - 1; i >= 0 && d.cost > d.expect; i-- {
+			slot := slots[i]
+			c := opts.SlotCost[slot]
+			if c == 0 || c > d.cost-d.expect {
+				continue
+			}
+			var r *costNode
+			for _, cn := range nodes {
+				if cn.cost < cn.expect && (r == nil || cn.expect-cn.cost > r.expect-r.cost) {
+					r = cn
+				}
+			}
+			if r == nil {
+				break
+			}
+			d.cost -= c
+			r.cost += c
+			addMove(d, r, slot)
+		}
+	}
+
+	for _, m := range moves {
+		plans = append(plans, &MigratePlan{
+			SourceId: m.source.node.Id,
+			TargetId: m.target.node.Id,
+			Ranges:   slotsToRanges(m.slots),
+		})
+	}
+	return plans
+}
@@ -0,0 +1,190 @@
+package migrate
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ksarch-saas/cc/log"
+	"github.com/ksarch-saas/cc/meta"
+	"github.com/ksarch-saas/cc/redis"
+	"github.com/ksarch-saas/cc/topo"
+	"github.com/ksarch-saas/cc/utils/clock"
+)
+
+const (
+	THROTTLE_MAX_LEVEL       = 10 // 达到该级别时暂停迁移
+	THROTTLE_STEP_DELAY      = 100 * time.Millisecond
+	THROTTLE_SAMPLE_INTERVAL = 1 * time.Second
+	// 负载低于阈值的该比例时才降级，避免在阈值附近来回抖动
+	THROTTLE_RECOVER_RATIO = 0.8
+)
+
+// 节点负载采样
+type nodeLoad struct {
+	summary topo.SummaryInfo
+	calls   int64
+	usec    int64
+	latency float64 // 两次采样之间命令的平均耗时(us)
+}
+
+// Throttle 根据Source和Target节点的负载自适应调整迁移速度，
+// 负载超过AppConfig中的阈值时升级，恢复后逐级降级；
+// 级别越高每批迁移之间sleep越久，最高级别时暂停迁移
+type Throttle struct {
+	level      int32
+	lastSample time.Time
+	loads      map[string]*nodeLoad
+	sampler    func(addr string, prev *nodeLoad) (*nodeLoad, error)
+}
+
+func NewThrottle() *Throttle {
+	return &Throttle{
+		loads:   map[string]*nodeLoad{},
+		sampler: fetchNodeLoad,
+	}
+}
+
+func (tr *Throttle) Level() int {
+	return int(atomic.LoadInt32(&tr.level))
+}
+
+func (tr *Throttle) setLevel(level int) {
+	atomic.StoreInt32(&tr.level, int32(level))
+}
+
+func (tr *Throttle) Paused() bool {
+	return tr.Level() >= THROTTLE_MAX_LEVEL
+}
+
+func (tr *Throttle) Delay() time.Duration {
+	return time.Duration(tr.Level()) * THROTTLE_STEP_DELAY
+}
+
+func throttleEnabled(app *meta.AppConfig) bool {
+	return app.MigrateThrottleOpsPerSec > 0 ||
+		app.MigrateThrottleUsedMemory > 0 ||
+		app.MigrateThrottleLatencyUs > 0
+}
+
+// 采样节点负载，latency由INFO commandstats中累计的calls和usec差值计算
+func fetchNodeLoad(addr string, prev *nodeLoad) (*nodeLoad, error) {
+	info, err := redis.Default().FetchInfo(context.Background(), addr, "all")
+	if err != nil {
+		return nil, err
+	}
+	load := &nodeLoad{}
+	for key, val := range *info {
+		load.summary.SetField(key, val)
+		if !strings.HasPrefix(key, "cmdstat_") {
+			continue
+		}
+		// cmdstat_get:calls=10,usec=100,usec_per_call=10.00
+		for _, kv := range strings.Split(val, ",") {
+			xs := strings.Split(kv, "=")
+			if len(xs) != 2 {
+				continue
+			}
+			v, _ := strconv.ParseInt(xs[1], 10, 64)
+			switch xs[0] {
+			case "calls":
+				load.calls += v
+			case "usec":
+				load.usec += v
+			}
+		}
+	}
+	if prev != nil && load.calls > prev.calls {
+		load.latency = float64(load.usec-prev.usec) / float64(load.calls-prev.calls)
+	}
+	return load, nil
+}
+
+// 负载与阈值的最大比值，超过1表示过载
+func loadRatio(load *nodeLoad, app *meta.AppConfig) float64 {
+	ratio := 0.0
+	if app.MigrateThrottleOpsPerSec > 0 {
+		r := float64(load.summary.InstantaneousOpsPerSec) / float64(app.MigrateThrottleOpsPerSec)
+		if r > ratio {
+			ratio = r
+		}
+	}
+	if app.MigrateThrottleUsedMemory > 0 {
+		r := float64(load.summary.UsedMemory) / float64(app.MigrateThrottleUsedMemory)
+		if r > ratio {
+			ratio = r
+		}
+	}
+	if app.MigrateThrottleLatencyUs > 0 {
+		r := load.latency / float64(app.MigrateThrottleLatencyUs)
+		if r > ratio {
+			ratio = r
+		}
+	}
+	return ratio
+}
+
+// Sample 采样各节点负载并调整级别，距上次采样不足THROTTLE_SAMPLE_INTERVAL时直接返回
+func (tr *Throttle) Sample(taskName string, addrs []string) {
+	app := meta.GetAppConfig()
+	if !throttleEnabled(app) {
+		if tr.Level() > 0 {
+			tr.setLevel(0)
+		}
+		return
+	}
+	now := clock.Now()
+	if now.Sub(tr.lastSample) < THROTTLE_SAMPLE_INTERVAL {
+		return
+	}
+	tr.lastSample = now
+
+	ratio := 0.0
+	for _, addr := range addrs {
+		load, err := tr.sampler(addr, tr.loads[addr])
+		if err != nil {
+			log.Warningf(taskName, "Throttle fetch info of %s failed, %v", addr, err)
+			continue
+		}
+		tr.loads[addr] = load
+		if r := loadRatio(load, app); r > ratio {
+			ratio = r
+		}
+	}
+
+	level := tr.Level()
+	if ratio > 1 && level < THROTTLE_MAX_LEVEL {
+		level++
+	} else if ratio < THROTTLE_RECOVER_RATIO && level > 0 {
+		level--
+	} else {
+		return
+	}
+	tr.setLevel(level)
+	if level == THROTTLE_MAX_LEVEL {
+		log.Warningf(taskName, "Throttle paused migrating, load ratio %.2f", ratio)
+	} else {
+		log.Infof(taskName, "Throttle level changed to %d, load ratio %.2f", level, ratio)
+	}
+}
+
+// 迁移每批key之前调用，根据当前级别sleep，最高级别时阻塞直到负载恢复
+func (t *MigrateTask) throttleWait() {
+	tr := t.throttle
+	addrs := []string{t.SourceNode().Addr(), t.TargetNode().Addr()}
+	tr.Sample(t.TaskName(), addrs)
+	for tr.Paused() {
+		// 取消时不再等待，迁移完当前slot后由Run处理状态
+		if t.CurrentState() == StateCancelling {
+			return
+		}
+		t.streamPub(true)
+		time.Sleep(THROTTLE_SAMPLE_INTERVAL)
+		tr.Sample(t.TaskName(), addrs)
+	}
+	if d := tr.Delay(); d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,156 @@
+package migrate
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ksarch-saas/cc/meta"
+	"github.com/ksarch-saas/cc/utils/clock"
+)
+
+func TestLoadRatio(t *testing.T) {
+	app := &meta.AppConfig{
+		MigrateThrottleOpsPerSec:  1000,
+		MigrateThrottleUsedMemory: 1 << 30,
+		MigrateThrottleLatencyUs:  100,
+	}
+	tests := []struct {
+		ops     int
+		memory  int64
+		latency float64
+		app     *meta.AppConfig
+		ratio   float64
+	}{
+		{0, 0, 0, app, 0},
+		{500, 0, 0, app, 0.5},
+		// 取各项中比值最大的
+		{500, 1 << 29, 150, app, 1.5},
+		{2000, 1 << 29, 50, app, 2},
+		{0, 1 << 31, 0, app, 2},
+		// 阈值为0的项不参与计算
+		{2000, 1 << 31, 150, &meta.AppConfig{MigrateThrottleLatencyUs: 100}, 1.5},
+		{2000, 1 << 31, 150, &meta.AppConfig{}, 0},
+	}
+	for i, test := range tests {
+		load := &nodeLoad{latency: test.latency}
+		load.summary.InstantaneousOpsPerSec = test.ops
+		load.summary.UsedMemory = test.memory
+		if r := loadRatio(load, test.app); r != test.ratio {
+			t.Errorf("case %d: expect ratio %v, got %v", i, test.ratio, r)
+		}
+	}
+}
+
+// 按地址返回设定的ops并记录采样次数，没有设定的地址采样失败
+type fakeSampler struct {
+	ops   map[string]int
+	calls int
+}
+
+func (s *fakeSampler) sample(addr string, prev *nodeLoad) (*nodeLoad, error) {
+	s.calls++
+	ops, ok := s.ops[addr]
+	if !ok {
+		return nil, errors.New("fake: connection refused")
+	}
+	load := &nodeLoad{}
+	load.summary.InstantaneousOpsPerSec = ops
+	return load, nil
+}
+
+func setupThrottle(t *testing.T, app *meta.AppConfig) (*Throttle, *fakeSampler, *clock.Fake) {
+	app.AppName = "test"
+	app.MasterRegion = "bj"
+	app.Regions = []string{"bj"}
+	meta.RunWithZk("test", "bj", meta.NewFakeZk(), app)
+	fake := clock.NewFake(time.Date(2016, 1, 1, 0, 0, 0, 0, time.Local))
+	clock.Set(fake)
+
+	s := &fakeSampler{ops: map[string]int{}}
+	tr := NewThrottle()
+	tr.sampler = s.sample
+	return tr, s, fake
+}
+
+func TestThrottleLevel(t *testing.T) {
+	tr, s, fake := setupThrottle(t, &meta.AppConfig{MigrateThrottleOpsPerSec: 1000})
+	defer clock.Set(nil)
+
+	addrs := []string{"source", "target"}
+	// 每次采样后推进时钟，返回当前级别
+	sample := func(source, target int) int {
+		s.ops["source"], s.ops["target"] = source, target
+		tr.Sample("task", addrs)
+		fake.Advance(THROTTLE_SAMPLE_INTERVAL)
+		return tr.Level()
+	}
+
+	// 任一节点过载时逐级升级
+	for i := 1; i <= 3; i++ {
+		if level := sample(100, 1200); level != i {
+			t.Fatalf("expect level %d, got %d", i, level)
+		}
+	}
+	if tr.Delay() != 3*THROTTLE_STEP_DELAY || tr.Paused() {
+		t.Errorf("unexpected delay %v at level 3", tr.Delay())
+	}
+	// 在阈值和THROTTLE_RECOVER_RATIO之间保持不变
+	if level := sample(900, 800); level != 3 {
+		t.Errorf("level should be kept, got %d", level)
+	}
+	if level := sample(700, 100); level != 2 {
+		t.Errorf("level should be lowered, got %d", level)
+	}
+
+	// 达到最高级别时暂停，不再升级
+	for i := 0; i < THROTTLE_MAX_LEVEL; i++ {
+		sample(2000, 0)
+	}
+	if tr.Level() != THROTTLE_MAX_LEVEL || !tr.Paused() {
+		t.Fatalf("should be paused, level %d", tr.Level())
+	}
+	if level := sample(100, 100); level != THROTTLE_MAX_LEVEL-1 || tr.Paused() {
+		t.Errorf("should resume after load recovered, level %d", level)
+	}
+
+	// 采样间隔内不重复采样
+	calls := s.calls
+	s.ops["source"] = 2000
+	tr.Sample("task", addrs)
+	fake.Advance(THROTTLE_SAMPLE_INTERVAL / 2)
+	tr.Sample("task", addrs)
+	if s.calls != calls+2 || tr.Level() != THROTTLE_MAX_LEVEL {
+		t.Errorf("should sample once in interval, %d calls, level %d", s.calls-calls, tr.Level())
+	}
+}
+
+func TestThrottleSampleFailure(t *testing.T) {
+	tr, s, fake := setupThrottle(t, &meta.AppConfig{MigrateThrottleOpsPerSec: 1000})
+	defer clock.Set(nil)
+
+	// 采样失败的节点不计入负载
+	s.ops["source"] = 2000
+	tr.Sample("task", []string{"source", "target"})
+	if tr.Level() != 1 {
+		t.Fatalf("expect level 1, got %d", tr.Level())
+	}
+	fake.Advance(THROTTLE_SAMPLE_INTERVAL)
+	tr.Sample("task", []string{"target"})
+	if tr.Level() != 0 {
+		t.Errorf("expect level 0 when no node sampled, got %d", tr.Level())
+	}
+}
+
+func TestThrottleDisabled(t *testing.T) {
+	tr, s, _ := setupThrottle(t, &meta.AppConfig{})
+	defer clock.Set(nil)
+
+	// 关闭限速后直接恢复
+	tr.setLevel(THROTTLE_MAX_LEVEL)
+	s.ops["source"] = 2000
+	tr.Sample("task", []string{"source"})
+	if tr.Level() != 0 || s.calls != 0 {
+		t.Errorf("throttle disabled, level %d, %d calls", tr.Level(), s.calls)
+	}
+}
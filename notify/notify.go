@@ -0,0 +1,280 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/ksarch-saas/cc/meta"
+	"github.com/ksarch-saas/cc/state"
+	"github.com/ksarch-saas/cc/streams"
+	"github.com/ksarch-saas/cc/utils/clock"
+)
+
+/// 告警通知
+/// 订阅LogStream中的EVENT日志、NodeStateStream和MigrateStateStream，
+/// 识别出Failover开始/结束、节点FAIL/恢复、迁移失败和Leader变更，
+/// 以JSON POST到AppConfig中配置的webhook
+/// 同一节点的同类告警在静默时间内只发送一次，之后的告警带上期间被抑制的次数；
+/// 发送失败时按指数退避重试，每个告警带唯一的Id，接收方可以据此去重
+
+const (
+	KindFailoverBegin  = "FailoverBegin"
+	KindFailoverEnd    = "FailoverEnd"
+	KindNodeFail       = "NodeFail"
+	KindNodeRecover    = "NodeRecover"
+	KindMigrateFailed  = "MigrateFailed"
+	KindLeaderChanged  = "LeaderChanged"
+	QUEUE_SIZE         = 1024
+	SEND_TIMEOUT       = 5 * time.Second
+	DEFAULT_BACKOFF    = time.Second
+	LEADER_CHECK_CYCLE = time.Second
+)
+
+// 迁移任务进入这些状态时告警
+var migrateFailedStates = map[string]bool{
+	"TargetNodeFailure": true,
+	"BlockedOnKey":      true,
+}
+
+type Event struct {
+	Id         string
+	App        string
+	Kind       string
+	Target     string // 节点地址、迁移任务名或CLUSTER
+	Message    string
+	Time       time.Time
+	Suppressed int // 上次发送后在静默时间内被抑制的同类告警数
+}
+
+type Config struct {
+	App             string
+	Webhooks        []string
+	Retries         int
+	SilenceInterval time.Duration
+}
+
+// 从ZK中的AppConfig读取告警配置
+func AppConfig() *Config {
+	app := meta.GetAppConfig()
+	return &Config{
+		App:             app.AppName,
+		Webhooks:        app.AlertWebhooks,
+		Retries:         app.AlertRetries,
+		SilenceInterval: app.AlertSilenceInterval,
+	}
+}
+
+type silence struct {
+	sentAt     time.Time
+	suppressed int
+}
+
+type Notifier struct {
+	Config  func() *Config
+	Client  *http.Client
+	Backoff time.Duration // 首次重试前的等待时间，之后每次翻倍
+
+	queue chan *Event
+	seq   int64
+
+	mutex      sync.Mutex
+	silences   map[string]*silence // Kind+Target -> 最近一次发送
+	nodeStates map[string]string   // 节点Id -> 最近一次的状态
+	migrates   map[string]string   // 迁移任务 -> 最近一次的状态
+	leader     string
+}
+
+func NewNotifier(config func() *Config) *Notifier {
+	return &Notifier{
+		Config:     config,
+		Client:     &http.Client{Timeout: SEND_TIMEOUT},
+		Backoff:    DEFAULT_BACKOFF,
+		queue:      make(chan *Event, QUEUE_SIZE),
+		silences:   map[string]*silence{},
+		nodeStates: map[string]string{},
+		migrates:   map[string]string{},
+	}
+}
+
+// 订阅各Stream，启动发送和Leader检查
+func (n *Notifier) Start() {
+	streams.LogStream.Sub(n.HandleLog)
+	streams.NodeStateStream.Sub(n.HandleNodeState)
+	streams.MigrateStateStream.Sub(n.HandleMigrateState)
+	go n.Run()
+	go n.watchLeader()
+}
+
+// 依次发送队列中的告警
+func (n *Notifier) Run() {
+	for e := range n.queue {
+		n.send(e)
+	}
+}
+
+/// Stream回调，只做识别和入队，不能阻塞Stream
+
+func (n *Notifier) HandleLog(i interface{}) bool {
+	data := i.(*streams.LogStreamData)
+	if data.Level != "EVENT" {
+		return true
+	}
+	// 见ClusterState.UpdateRegionNodes
+	if strings.HasPrefix(data.Message, "Fail state changed") {
+		if strings.HasSuffix(data.Message, "-> true") {
+			n.Notify(KindNodeFail, data.Target, data.Message)
+		} else {
+			n.Notify(KindNodeRecover, data.Target, data.Message)
+		}
+	}
+	return true
+}
+
+func (n *Notifier) HandleNodeState(i interface{}) bool {
+	data := i.(*streams.NodeStateStreamData)
+	n.mutex.Lock()
+	last, ok := n.nodeStates[data.Id]
+	n.nodeStates[data.Id] = data.State
+	n.mutex.Unlock()
+	if !ok || last == data.State {
+		return true
+	}
+	// 主的Failover在WAIT_FAILOVER_END状态下进行
+	if data.State == state.StateWaitFailoverEnd {
+		n.Notify(KindFailoverBegin, data.Addr(),
+			fmt.Sprintf("Failover begin, %s(%s) %s -> %s", data.Id, data.Role, last, data.State))
+	} else if last == state.StateWaitFailoverEnd {
+		n.Notify(KindFailoverEnd, data.Addr(),
+			fmt.Sprintf("Failover end, %s(%s) %s -> %s", data.Id, data.Role, last, data.State))
+	}
+	return true
+}
+
+func (n *Notifier) HandleMigrateState(i interface{}) bool {
+	data := i.(*streams.MigrateStateStreamData)
+	name := fmt.Sprintf("Mig(%s_To_%s)", shortId(data.SourceId), shortId(data.TargetId))
+	n.mutex.Lock()
+	last := n.migrates[name]
+	n.migrates[name] = data.State
+	n.mutex.Unlock()
+	if last == data.State || !migrateFailedStates[data.State] {
+		return true
+	}
+	msg := fmt.Sprintf("Migrate %s at slot %d", data.State, data.CurrSlot)
+	if data.BlockedKey != "" {
+		msg += ", blocked key:" + data.BlockedKey
+	}
+	n.Notify(KindMigrateFailed, name, msg)
+	return true
+}
+
+func shortId(id string) string {
+	if len(id) > 6 {
+		return id[:6]
+	}
+	return id
+}
+
+func (n *Notifier) watchLeader() {
+	for {
+		n.CheckLeader(meta.ClusterLeaderZNodeName(), meta.IsClusterLeader())
+		clock.Sleep(LEADER_CHECK_CYCLE)
+	}
+}
+
+// 由新的集群Leader发出Leader变更的告警，旧Leader可能已经不在了
+func (n *Notifier) CheckLeader(leader string, isLeader bool) {
+	n.mutex.Lock()
+	last := n.leader
+	n.leader = leader
+	n.mutex.Unlock()
+	if last != "" && last != leader && isLeader {
+		n.Notify(KindLeaderChanged, "CLUSTER",
+			fmt.Sprintf("Cluster leader changed, %s -> %s", last, leader))
+	}
+}
+
+/// 静默和发送
+
+// 静默时间内的同类告警只计数，否则放入发送队列，返回是否入队
+func (n *Notifier) Notify(kind, target, message string) bool {
+	conf := n.Config()
+	if len(conf.Webhooks) == 0 {
+		return false
+	}
+	now := clock.Now()
+	key := kind + "|" + target
+
+	n.mutex.Lock()
+	s := n.silences[key]
+	if s != nil && now.Sub(s.sentAt) < conf.SilenceInterval {
+		s.suppressed++
+		n.mutex.Unlock()
+		return false
+	}
+	suppressed := 0
+	if s != nil {
+		suppressed = s.suppressed
+	}
+	n.silences[key] = &silence{sentAt: now}
+	n.mutex.Unlock()
+
+	e := &Event{
+		Id:         fmt.Sprintf("%s-%d-%d", conf.App, now.UnixNano(), atomic.AddInt64(&n.seq, 1)),
+		App:        conf.App,
+		Kind:       kind,
+		Target:     target,
+		Message:    message,
+		Time:       now,
+		Suppressed: suppressed,
+	}
+	select {
+	case n.queue <- e:
+		return true
+	default:
+		glog.Warningf("notify: queue full, drop %s %s", kind, target)
+		return false
+	}
+}
+
+func (n *Notifier) send(e *Event) {
+	conf := n.Config()
+	data, err := json.Marshal(e)
+	if err != nil {
+		glog.Warningf("notify: encode event failed, %v", err)
+		return
+	}
+	for _, url := range conf.Webhooks {
+		backoff := n.Backoff
+		for i := 0; ; i++ {
+			err = n.post(url, data)
+			if err == nil || i >= conf.Retries {
+				break
+			}
+			clock.Sleep(backoff)
+			backoff *= 2
+		}
+		if err != nil {
+			glog.Warningf("notify: send %s %s to %s failed, %v", e.Kind, e.Target, url, err)
+		}
+	}
+}
+
+func (n *Notifier) post(url string, data []byte) error {
+	resp, err := n.Client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returns %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package notify
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ksarch-saas/cc/state"
+	"github.com/ksarch-saas/cc/streams"
+	"github.com/ksarch-saas/cc/topo"
+	"github.com/ksarch-saas/cc/utils/clock"
+)
+
+// 记录收到的告警，前failures次请求返回500
+type webhook struct {
+	mutex    sync.Mutex
+	events   []*Event
+	requests int
+	failures int
+	ch       chan *Event
+}
+
+func (h *webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.requests++
+	if h.requests <= h.failures {
+		w.WriteHeader(500)
+		return
+	}
+	var e Event
+	json.NewDecoder(r.Body).Decode(&e)
+	h.events = append(h.events, &e)
+	h.ch <- &e
+}
+
+func (h *webhook) wait(t *testing.T) *Event {
+	select {
+	case e := <-h.ch:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not called")
+		return nil
+	}
+}
+
+func setup(failures int) (*Notifier, *webhook, *clock.Fake, func()) {
+	fake := clock.NewFake(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC))
+	old := clock.Set(fake)
+	h := &webhook{failures: failures, ch: make(chan *Event, 100)}
+	srv := httptest.NewServer(h)
+	n := NewNotifier(func() *Config {
+		return &Config{
+			App:             "test",
+			Webhooks:        []string{srv.URL},
+			Retries:         3,
+			SilenceInterval: time.Minute,
+		}
+	})
+	go n.Run()
+	return n, h, fake, func() {
+		srv.Close()
+		clock.Set(old)
+	}
+}
+
+func TestNotifyRetryAndSilence(t *testing.T) {
+	n, h, fake, teardown := setup(2)
+	defer teardown()
+
+	fail := &streams.LogStreamData{Level: "EVENT", Target: "127.0.0.1:7000", Message: "Fail state changed, false -> true"}
+	n.HandleLog(fail)
+	e := h.wait(t)
+	if e.Kind != KindNodeFail || e.Target != "127.0.0.1:7000" || e.App != "test" {
+		t.Errorf("unexpected event %+v", e)
+	}
+	if h.requests != 3 {
+		t.Errorf("should succeed on the 3rd request, got %d", h.requests)
+	}
+
+	// 静默时间内只计数
+	n.HandleLog(fail)
+	n.HandleLog(fail)
+	// 其他类型不受影响
+	n.HandleLog(&streams.LogStreamData{Level: "EVENT", Target: "127.0.0.1:7000", Message: "Fail state changed, true -> false"})
+	if e := h.wait(t); e.Kind != KindNodeRecover {
+		t.Errorf("expect recover event, got %+v", e)
+	}
+	// 非EVENT日志忽略
+	n.HandleLog(&streams.LogStreamData{Level: "INFO", Target: "127.0.0.1:7000", Message: "Fail state changed, false -> true"})
+
+	fake.Advance(2 * time.Minute)
+	n.HandleLog(fail)
+	e = h.wait(t)
+	if e.Kind != KindNodeFail || e.Suppressed != 2 {
+		t.Errorf("expect 2 suppressed alerts, got %+v", e)
+	}
+	if len(h.events) != 3 {
+		t.Errorf("expect 3 events, got %d", len(h.events))
+	}
+}
+
+func TestNotifyFailoverMigrateAndLeader(t *testing.T) {
+	n, h, _, teardown := setup(0)
+	defer teardown()
+
+	node := &topo.Node{Ip: "127.0.0.1", Port: 7000, Id: "abcdefgh", Role: "master"}
+	for _, s := range []string{state.StateRunning, state.StateOffline, state.StateWaitFailoverBegin,
+		state.StateWaitFailoverEnd, state.StateWaitFailoverEnd, state.StateOffline} {
+		n.HandleNodeState(&streams.NodeStateStreamData{Node: node, State: s})
+	}
+	if e := h.wait(t); e.Kind != KindFailoverBegin {
+		t.Errorf("expect failover begin, got %+v", e)
+	}
+	if e := h.wait(t); e.Kind != KindFailoverEnd || e.Target != "127.0.0.1:7000" {
+		t.Errorf("expect failover end, got %+v", e)
+	}
+
+	mig := &streams.MigrateStateStreamData{SourceId: "aaaaaaaa", TargetId: "bbbbbbbb", State: "Migrating"}
+	n.HandleMigrateState(mig)
+	mig.State = "BlockedOnKey"
+	mig.BlockedKey = "k1"
+	n.HandleMigrateState(mig)
+	n.HandleMigrateState(mig)
+	if e := h.wait(t); e.Kind != KindMigrateFailed || e.Target != "Mig(aaaaaa_To_bbbbbb)" {
+		t.Errorf("expect migrate failed, got %+v", e)
+	}
+
+	n.CheckLeader("cc_bj_01", false)
+	n.CheckLeader("cc_bj_02", false)
+	n.CheckLeader("cc_bj_03", true)
+	if e := h.wait(t); e.Kind != KindLeaderChanged || e.Message != "Cluster leader changed, cc_bj_02 -> cc_bj_03" {
+		t.Errorf("expect leader changed, got %+v", e)
+	}
+
+	select {
+	case e := <-h.ch:
+		t.Errorf("unexpected event %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
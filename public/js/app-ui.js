@@ -35,6 +35,10 @@ var migrateSocket = Rx.DOM.fromWebSocket(
   WS_HOST +'/migrate/state', null, openingObserver, closingObserver);
 var RxMigration = migrateSocket.map(function(e){ return JSON.parse(e.data); });
 
+var rebalanceSocket = Rx.DOM.fromWebSocket(
+  WS_HOST +'/rebalance/state', null, openingObserver, closingObserver);
+var RxRebalance = rebalanceSocket.map(function(e){ return JSON.parse(e.data); });
+
 var logSocket = Rx.DOM.fromWebSocket(
   WS_HOST +'/log', null, openingObserver, closingObserver);
 var RxLog = logSocket.map(function(e){ 
@@ -686,6 +690,54 @@ var MigrationTaskPanel = React.createClass({
   }
 });
 
+var RebalancePanel = React.createClass({
+  getInitialState: function() {
+    return {task: null};
+  },
+  componentDidMount: function() {
+    var self = this;
+    RxRebalance.subscribe(
+      function (obj) {
+        self.setState({task: obj});
+      },
+      function (e) {
+        console.log('Error: ', e);
+      },
+      function (){
+        console.log('Closed');
+      });
+  },
+  render: function() {
+    var task = this.state.task;
+    if (!task || task.TotalSlots == 0)
+      return null;
+    var percent = Math.floor(task.DoneSlots * 100 / task.TotalSlots);
+    var eta = '-';
+    if (task.EndTime)
+      eta = 'Done';
+    else if (task.ETA)
+      eta = new Date(task.ETA).toLocaleString();
+    var barStyle = {
+      width: percent + "%",
+      minWidth: "2em"
+    };
+    return (
+      <div className="ui segment">
+        <h4>Rebalance</h4>
+        <div className="ui indicating progress">
+          <div className="bar" style={barStyle}>
+            <div className="progress">{percent}%</div>
+          </div>
+          <div className="label">
+            {task.DoneSlots}/{task.TotalSlots} slots, {task.KeysMoved} keys,
+            {' '}{Math.round(task.Throughput)} keys/s, ETA {eta}
+          </div>
+        </div>
+      </div>
+    );
+  }
+});
+
 var LogPanel = React.createClass({
   getInitialState: function() {
     return {logs: []};
@@ -760,6 +812,7 @@ var Main = React.createClass({
           <h4>AppInfo</h4>
           <AppInfo info={data.body} />
         </div>
+        <RebalancePanel />
         <div className="ui segment">
           <h4>LogPanel</h4>
           <LogPanel />
@@ -0,0 +1,195 @@
+package redis
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/ksarch-saas/cc/topo"
+	"github.com/ksarch-saas/cc/utils/clock"
+)
+
+/// Client封装了对Redis节点的所有操作，每个操作都接受context，
+/// 截止时间和取消会传递到连接的读写上，读操作按统一的RetryPolicy重试
+/// state、migrate和inspector通过Default()获取Client，测试时可用SetDialer替换
+
+type Client interface {
+	IsAlive(ctx context.Context, addr string) bool
+
+	/// Cluster
+	SetAsMasterWaitSyncDone(ctx context.Context, addr string, waitSyncDone bool) error
+	ClusterNodes(ctx context.Context, addr string) (string, error)
+	ClusterNodesWithoutExtra(ctx context.Context, addr string) (string, error)
+	FetchClusterInfo(ctx context.Context, addr string) (topo.ClusterInfo, error)
+	ClusterChmod(ctx context.Context, addr, id, op string) (string, error)
+	DisableRead(ctx context.Context, addr, id string) (string, error)
+	EnableRead(ctx context.Context, addr, id string) (string, error)
+	DisableWrite(ctx context.Context, addr, id string) (string, error)
+	EnableWrite(ctx context.Context, addr, id string) (string, error)
+	ClusterFailover(ctx context.Context, addr string) (string, error)
+	ClusterManualFailover(ctx context.Context, addr string) (string, error)
+	ClusterTakeover(ctx context.Context, addr string) (string, error)
+	ClusterReplicate(ctx context.Context, addr, targetId string) (string, error)
+	ClusterMeet(ctx context.Context, seedAddr, newIp string, newPort int) (string, error)
+	ClusterForget(ctx context.Context, seedAddr, nodeId string) (string, error)
+	ClusterReset(ctx context.Context, addr string, hard bool) (string, error)
+	AddSlotRange(ctx context.Context, addr string, start, end int) (string, error)
+	FlushAll(ctx context.Context, addr string) (string, error)
+	Slot2Node(ctx context.Context, addr string, slot int, dest string) (string, error)
+
+	/// Info
+	FetchInfo(ctx context.Context, addr, section string) (*RedisInfo, error)
+	FetchReplOffset(ctx context.Context, addr string) (int64, error)
+
+	/// Migrate
+	SetSlot(ctx context.Context, addr string, slot int, action, toId string) error
+	CountKeysInSlot(ctx context.Context, addr string, slot int) (int, error)
+	CountKeysInSlots(ctx context.Context, addr string, slots []int) (map[int]int, error)
+	GetKeysInSlot(ctx context.Context, addr string, slot, num int) ([]string, error)
+	Migrate(ctx context.Context, addr, toIp string, toPort int, key string, timeout int) (string, error)
+	MigrateKey(ctx context.Context, addr, toIp string, toPort int, key string, timeout int) error
+	DialMigrateConn(ctx context.Context, addr string) (*MigrateConn, error)
+}
+
+// 重试策略，首次重试前等待Backoff，之后每次翻倍，不超过MaxBackoff
+type RetryPolicy struct {
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// 执行fn直到成功、次数用完或者ctx结束，返回最后一次的错误
+func (p RetryPolicy) Do(ctx context.Context, fn func() error) error {
+	backoff := p.Backoff
+	var err error
+	for i := 0; i < p.Attempts || i == 0; i++ {
+		if i > 0 {
+			clock.Sleep(backoff)
+			backoff *= 2
+			if backoff > p.MaxBackoff {
+				backoff = p.MaxBackoff
+			}
+		}
+		if ctx.Err() != nil {
+			if err == nil {
+				err = ctx.Err()
+			}
+			return err
+		}
+		err = fn()
+		if err == nil || err == context.Canceled || err == context.DeadlineExceeded {
+			return err
+		}
+	}
+	return err
+}
+
+type Options struct {
+	ConnTimeout  time.Duration
+	ReadTimeout  time.Duration // 每次读的超时，context的截止时间更早时以context为准
+	WriteTimeout time.Duration
+	MaxIdle      int // 每个地址最多保留的空闲连接
+	IdleTimeout  time.Duration
+	Retry        RetryPolicy
+}
+
+func DefaultOptions() *Options {
+	return &Options{
+		ConnTimeout:  CONN_TIMEOUT,
+		ReadTimeout:  READ_TIMEOUT,
+		WriteTimeout: WRITE_TIMEOUT,
+		MaxIdle:      3,
+		IdleTimeout:  240 * time.Second,
+		Retry: RetryPolicy{
+			Attempts:   NUM_RETRY,
+			Backoff:    100 * time.Millisecond,
+			MaxBackoff: time.Second,
+		},
+	}
+}
+
+// 支持context的Dialer，Pools实现了该接口
+type ContextDialer interface {
+	DialContext(ctx context.Context, addr string) (redis.Conn, error)
+}
+
+// 可以建立不经过连接池的连接，Pools实现了该接口
+type DirectDialer interface {
+	DialDirect(ctx context.Context, addr string, readTimeout time.Duration) (redis.Conn, error)
+}
+
+type client struct {
+	dialer Dialer
+	opts   *Options
+}
+
+// 使用连接池的Client
+func NewClient(opts *Options) Client {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	return &client{dialer: NewPools(opts), opts: opts}
+}
+
+// 通过指定Dialer获取连接的Client
+func NewClientWithDialer(d Dialer, opts *Options) Client {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	return &client{dialer: d, opts: opts}
+}
+
+func (c *client) dial(ctx context.Context, addr string) (redis.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if d, ok := c.dialer.(ContextDialer); ok {
+		return d.DialContext(ctx, addr)
+	}
+	return c.dialer.Dial(addr)
+}
+
+func (c *client) dialDirect(ctx context.Context, addr string, readTimeout time.Duration) (redis.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if d, ok := c.dialer.(DirectDialer); ok {
+		return d.DialDirect(ctx, addr, readTimeout)
+	}
+	return c.dialer.Dial(addr)
+}
+
+func (c *client) retry(ctx context.Context, fn func() error) error {
+	return c.opts.Retry.Do(ctx, fn)
+}
+
+var (
+	defaultMutex  sync.RWMutex
+	defaultClient Client = NewClient(nil)
+)
+
+func Default() Client {
+	defaultMutex.RLock()
+	defer defaultMutex.RUnlock()
+	return defaultClient
+}
+
+// 替换默认的Client，返回原来的
+func SetDefault(c Client) Client {
+	defaultMutex.Lock()
+	defer defaultMutex.Unlock()
+	old := defaultClient
+	defaultClient = c
+	return old
+}
+
+// 默认Client使用的连接池，替换成其他Dialer时返回nil
+func DefaultPools() *Pools {
+	c, ok := Default().(*client)
+	if !ok {
+		return nil
+	}
+	ps, _ := c.dialer.(*Pools)
+	return ps
+}
@@ -0,0 +1,207 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 只支持PING和INFO的服务端，hang为true时不回复
+type testServer struct {
+	ln   net.Listener
+	hang bool
+}
+
+func newTestServer(t *testing.T, hang bool) *testServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{ln: ln, hang: hang}
+	go s.serve()
+	return s
+}
+
+func (s *testServer) addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *testServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *testServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := []string{}
+		for i := 0; i < n; i++ {
+			r.ReadString('\n')
+			arg, _ := r.ReadString('\n')
+			args = append(args, strings.TrimSpace(arg))
+		}
+		if s.hang && strings.ToLower(args[0]) != "ping" {
+			continue
+		}
+		switch strings.ToLower(args[0]) {
+		case "ping":
+			conn.Write([]byte("+PONG\r\n"))
+		case "info":
+			body := "role:master\r\nconnected_slaves:0\r\n"
+			conn.Write([]byte("$" + strconv.Itoa(len(body)) + "\r\n" + body + "\r\n"))
+		default:
+			conn.Write([]byte("-ERR unknown command\r\n"))
+		}
+	}
+}
+
+func TestClientConcurrent(t *testing.T) {
+	s := newTestServer(t, false)
+	defer s.ln.Close()
+
+	c := NewClient(nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				info, err := c.FetchInfo(context.Background(), s.addr(), "replication")
+				if err != nil || info.Get("role") != "master" {
+					t.Errorf("fetch info failed, %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestClientDeadline(t *testing.T) {
+	s := newTestServer(t, true)
+	defer s.ln.Close()
+
+	c := NewClient(nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := c.FetchInfo(ctx, s.addr(), "replication")
+	if err == nil {
+		t.Fatal("should fail when the server does not reply")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("should return soon after the deadline, took %v", d)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	p := RetryPolicy{Attempts: 3, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	n := 0
+	err := p.Do(context.Background(), func() error {
+		n++
+		return errors.New("failed")
+	})
+	if err == nil || n != 3 {
+		t.Errorf("should try 3 times, got %d, %v", n, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	n = 0
+	err = p.Do(ctx, func() error {
+		n++
+		return nil
+	})
+	if err != context.Canceled || n != 0 {
+		t.Errorf("should not run after cancelled, got %d, %v", n, err)
+	}
+}
+
+func TestPoolsStatsAndEvict(t *testing.T) {
+	s := newTestServer(t, false)
+	defer s.ln.Close()
+
+	ps := NewPools(nil)
+	c := NewClientWithDialer(ps, nil)
+	for i := 0; i < 3; i++ {
+		if !c.IsAlive(context.Background(), s.addr()) {
+			t.Fatal("server should be alive")
+		}
+	}
+	// 关闭的端口
+	dead := newTestServer(t, false)
+	dead.ln.Close()
+	c.IsAlive(context.Background(), dead.addr())
+
+	stats := map[string]*PoolStats{}
+	for _, st := range ps.Stats() {
+		stats[st.Addr] = st
+	}
+	st := stats[s.addr()]
+	if st == nil || st.Dials != 1 || st.Commands != 3 || st.Idle != 1 || st.Active != 0 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+	if n := st.Latency.Buckets[len(st.Latency.Buckets)-1].Count; n != 3 {
+		t.Errorf("latency histogram should count 3 commands, got %d", n)
+	}
+	if st := stats[dead.addr()]; st == nil || st.DialErrors != 1 {
+		t.Errorf("dial error should be counted, got %+v", st)
+	}
+
+	evicted := ps.Evict([]string{s.addr()}, 0)
+	if len(evicted) != 1 || evicted[0] != dead.addr() {
+		t.Errorf("only the dead address should be evicted, got %v", evicted)
+	}
+	if len(ps.Stats()) != 1 {
+		t.Errorf("one pool should be left, got %d", len(ps.Stats()))
+	}
+}
+
+// 记录解除绑定后是否还被设置了deadline
+type unboundConn struct {
+	net.Conn
+	unbound int32
+	late    int32
+}
+
+func (c *unboundConn) SetDeadline(t time.Time) error {
+	if atomic.LoadInt32(&c.unbound) == 1 {
+		atomic.StoreInt32(&c.late, 1)
+	}
+	return nil
+}
+
+func TestDeadlineConnUnbind(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		nc := &unboundConn{}
+		dc := &deadlineConn{Conn: nc}
+		ctx, cancel := context.WithCancel(context.Background())
+		unbind := dc.bind(ctx)
+		go cancel()
+		unbind()
+		atomic.StoreInt32(&nc.unbound, 1)
+		cancel()
+		time.Sleep(10 * time.Microsecond)
+		if atomic.LoadInt32(&nc.late) == 1 {
+			t.Fatal("deadline set after unbind")
+		}
+	}
+}
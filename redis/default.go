@@ -0,0 +1,125 @@
+package redis
+
+import (
+	"context"
+
+	"github.com/ksarch-saas/cc/topo"
+)
+
+/// 使用默认Client、不带context的包级函数，供cli和controller/command使用
+
+func IsAlive(addr string) bool {
+	return Default().IsAlive(context.Background(), addr)
+}
+
+func SetAsMasterWaitSyncDone(addr string, waitSyncDone bool) error {
+	return Default().SetAsMasterWaitSyncDone(context.Background(), addr, waitSyncDone)
+}
+
+func ClusterNodes(addr string) (string, error) {
+	return Default().ClusterNodes(context.Background(), addr)
+}
+
+func ClusterNodesWithoutExtra(addr string) (string, error) {
+	return Default().ClusterNodesWithoutExtra(context.Background(), addr)
+}
+
+func FetchClusterInfo(addr string) (topo.ClusterInfo, error) {
+	return Default().FetchClusterInfo(context.Background(), addr)
+}
+
+func ClusterChmod(addr, id, op string) (string, error) {
+	return Default().ClusterChmod(context.Background(), addr, id, op)
+}
+
+func DisableRead(addr, id string) (string, error) {
+	return Default().DisableRead(context.Background(), addr, id)
+}
+
+func EnableRead(addr, id string) (string, error) {
+	return Default().EnableRead(context.Background(), addr, id)
+}
+
+func DisableWrite(addr, id string) (string, error) {
+	return Default().DisableWrite(context.Background(), addr, id)
+}
+
+func EnableWrite(addr, id string) (string, error) {
+	return Default().EnableWrite(context.Background(), addr, id)
+}
+
+func ClusterFailover(addr string) (string, error) {
+	return Default().ClusterFailover(context.Background(), addr)
+}
+
+func ClusterManualFailover(addr string) (string, error) {
+	return Default().ClusterManualFailover(context.Background(), addr)
+}
+
+func ClusterTakeover(addr string) (string, error) {
+	return Default().ClusterTakeover(context.Background(), addr)
+}
+
+func ClusterReplicate(addr, targetId string) (string, error) {
+	return Default().ClusterReplicate(context.Background(), addr, targetId)
+}
+
+func ClusterMeet(seedAddr, newIp string, newPort int) (string, error) {
+	return Default().ClusterMeet(context.Background(), seedAddr, newIp, newPort)
+}
+
+func ClusterForget(seedAddr, nodeId string) (string, error) {
+	return Default().ClusterForget(context.Background(), seedAddr, nodeId)
+}
+
+func ClusterReset(addr string, hard bool) (string, error) {
+	return Default().ClusterReset(context.Background(), addr, hard)
+}
+
+func AddSlotRange(addr string, start, end int) (string, error) {
+	return Default().AddSlotRange(context.Background(), addr, start, end)
+}
+
+func FlushAll(addr string) (string, error) {
+	return Default().FlushAll(context.Background(), addr)
+}
+
+func Slot2Node(addr string, slot int, dest string) (string, error) {
+	return Default().Slot2Node(context.Background(), addr, slot, dest)
+}
+
+func FetchInfo(addr, section string) (*RedisInfo, error) {
+	return Default().FetchInfo(context.Background(), addr, section)
+}
+
+func FetchReplOffset(addr string) (int64, error) {
+	return Default().FetchReplOffset(context.Background(), addr)
+}
+
+func SetSlot(addr string, slot int, action, toId string) error {
+	return Default().SetSlot(context.Background(), addr, slot, action, toId)
+}
+
+func CountKeysInSlot(addr string, slot int) (int, error) {
+	return Default().CountKeysInSlot(context.Background(), addr, slot)
+}
+
+func CountKeysInSlots(addr string, slots []int) (map[int]int, error) {
+	return Default().CountKeysInSlots(context.Background(), addr, slots)
+}
+
+func GetKeysInSlot(addr string, slot, num int) ([]string, error) {
+	return Default().GetKeysInSlot(context.Background(), addr, slot, num)
+}
+
+func Migrate(addr, toIp string, toPort int, key string, timeout int) (string, error) {
+	return Default().Migrate(context.Background(), addr, toIp, toPort, key, timeout)
+}
+
+func MigrateKey(addr, toIp string, toPort int, key string, timeout int) error {
+	return Default().MigrateKey(context.Background(), addr, toIp, toPort, key, timeout)
+}
+
+func DialMigrateConn(addr string) (*MigrateConn, error) {
+	return Default().DialMigrateConn(context.Background(), addr)
+}
@@ -0,0 +1,21 @@
+package redis
+
+import (
+	"github.com/garyburd/redigo/redis"
+)
+
+/// 所有命令都通过Dialer获取连接，默认使用连接池连接真实的Redis，
+/// 测试时可替换为redis/fake中模拟的集群，不需要启动Redis
+
+type Dialer interface {
+	Dial(addr string) (redis.Conn, error)
+}
+
+// 默认Client改为通过d获取连接，传入nil时恢复默认的连接池
+func SetDialer(d Dialer) {
+	if d == nil {
+		SetDefault(NewClient(nil))
+		return
+	}
+	SetDefault(NewClientWithDialer(d, nil))
+}
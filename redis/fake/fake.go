@@ -0,0 +1,509 @@
+package fake
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/ksarch-saas/cc/topo"
+)
+
+/// 模拟的Redis集群，实现redis.Dialer，用redis.SetDialer替换后，redis包中的命令都发给它
+/// 支持Failover相关的命令：PING, INFO, CLUSTER NODES/INFO/CHMOD/FAILOVER/REPLICATE/SETSLOT，
+/// 以及迁移空slot用到的CLUSTER COUNTKEYSINSLOT/GETKEYSINSLOT
+/// 拓扑可以用脚本控制：Kill/Revive节点，Partition/Heal地域，SetOffset设置复制偏移量，
+/// Snapshot生成Inspector在某个地域看到的节点列表，用于驱动UpdateRegionCommand
+
+const NumSlots = 16384
+
+var (
+	ErrConnFailed = errors.New("fake: connection refused")
+)
+
+type Node struct {
+	Id       string
+	Ip       string
+	Port     int
+	Tag      string // region:zone:room
+	Role     string
+	ParentId string // 主为"-"
+	Readable bool
+	Writable bool
+	Alive    bool
+	Offset   int64
+
+	takenOverBy string // 挂掉时被哪个节点接管了slots，恢复后作为它的从
+}
+
+func (n *Node) Addr() string {
+	return fmt.Sprintf("%s:%d", n.Ip, n.Port)
+}
+
+func (n *Node) Region() string {
+	return strings.Split(n.Tag, ":")[0]
+}
+
+type Cluster struct {
+	mutex       sync.Mutex
+	nodes       map[string]*Node
+	order       []string // 节点添加顺序，输出稳定
+	owners      [NumSlots]string
+	partitioned map[string]bool
+	// Controller所在地域，分区后连不上其他地域的节点
+	LocalRegion string
+	// Failover后其他从节点是否仍然复制旧主，模拟没有及时收到gossip的情况
+	StaleSiblings bool
+}
+
+func NewCluster(localRegion string) *Cluster {
+	return &Cluster{
+		nodes:       map[string]*Node{},
+		partitioned: map[string]bool{},
+		LocalRegion: localRegion,
+	}
+}
+
+func (c *Cluster) addNode(id, addr, tag string) *Node {
+	n := topo.NewNodeFromString(addr)
+	node := &Node{
+		Id:       id,
+		Ip:       n.Ip,
+		Port:     n.Port,
+		Tag:      tag,
+		Readable: true,
+		Writable: true,
+		Alive:    true,
+	}
+	c.nodes[id] = node
+	c.order = append(c.order, id)
+	return node
+}
+
+// 添加主，负责[first, last]的slots
+func (c *Cluster) AddMaster(id, addr, tag string, first, last int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	node := c.addNode(id, addr, tag)
+	node.Role = "master"
+	node.ParentId = "-"
+	for i := first; i <= last; i++ {
+		c.owners[i] = id
+	}
+}
+
+func (c *Cluster) AddSlave(id, addr, tag, parentId string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	node := c.addNode(id, addr, tag)
+	node.Role = "slave"
+	node.ParentId = parentId
+}
+
+// 返回节点的副本
+func (c *Cluster) Node(id string) *Node {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	node, ok := c.nodes[id]
+	if !ok {
+		return nil
+	}
+	copied := *node
+	return &copied
+}
+
+func (c *Cluster) Kill(id string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.nodes[id].Alive = false
+}
+
+// 恢复节点，slots已被接管的主恢复后作为接管者的从
+func (c *Cluster) Revive(id string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	node := c.nodes[id]
+	node.Alive = true
+	if node.Role == "master" && len(c.ranges(id)) == 0 && node.takenOverBy != "" {
+		node.Role = "slave"
+		node.ParentId = node.takenOverBy
+	}
+	node.takenOverBy = ""
+}
+
+// 地域与其他地域之间断开
+func (c *Cluster) Partition(region string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.partitioned[region] = true
+}
+
+func (c *Cluster) Heal(region string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.partitioned, region)
+}
+
+func (c *Cluster) SetOffset(id string, offset int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.nodes[id].Offset = offset
+}
+
+// Controller所在地域能否连通该地域
+func (c *Cluster) Reachable(region string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.connected(c.LocalRegion, region)
+}
+
+// 两个地域之间是否连通
+func (c *Cluster) connected(r1, r2 string) bool {
+	return r1 == r2 || (!c.partitioned[r1] && !c.partitioned[r2])
+}
+
+func (c *Cluster) ranges(id string) []topo.Range {
+	ranges := []topo.Range{}
+	for i := 0; i < NumSlots; i++ {
+		if c.owners[i] != id {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1].Right == i-1 {
+			ranges[n-1].Right = i
+		} else {
+			ranges = append(ranges, topo.Range{Left: i, Right: i})
+		}
+	}
+	return ranges
+}
+
+// 从节点与主之间的复制是否正常
+func (c *Cluster) linkUp(node *Node) bool {
+	parent, ok := c.nodes[node.ParentId]
+	return ok && parent.Alive && c.connected(node.Region(), parent.Region())
+}
+
+// 地域内的Inspector看到的该地域的节点
+func (c *Cluster) Snapshot(region string) []*topo.Node {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	nodes := []*topo.Node{}
+	for _, id := range c.order {
+		n := c.nodes[id]
+		if n.Region() != region {
+			continue
+		}
+		node := topo.NewNode(n.Ip, n.Port)
+		node.SetId(n.Id)
+		node.SetParentId(n.ParentId)
+		node.SetTag(n.Tag)
+		node.SetRole(n.Role)
+		node.SetReadable(n.Readable)
+		node.SetWritable(n.Writable)
+		node.SetFail(!n.Alive)
+		node.SetPFail(!n.Alive)
+		xs := strings.Split(n.Tag, ":")
+		node.SetRegion(xs[0])
+		if len(xs) >= 3 {
+			node.SetZone(xs[1])
+			node.SetRoom(xs[2])
+		}
+		node.Ranges = c.ranges(n.Id)
+		if n.Role == "slave" {
+			node.MasterLinkStatus = "down"
+			if n.Alive && c.linkUp(n) {
+				node.MasterLinkStatus = "up"
+			}
+		}
+		node.ReplOffset = n.Offset
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+/// redis.Dialer
+
+func (c *Cluster) Dial(addr string) (redis.Conn, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, n := range c.nodes {
+		if n.Addr() != addr {
+			continue
+		}
+		if !n.Alive || !c.connected(c.LocalRegion, n.Region()) {
+			return nil, ErrConnFailed
+		}
+		return &conn{cluster: c, id: n.Id}, nil
+	}
+	return nil, ErrConnFailed
+}
+
+type conn struct {
+	cluster *Cluster
+	id      string
+	pending []interface{}
+}
+
+func (cn *conn) Close() error { return nil }
+func (cn *conn) Err() error   { return nil }
+func (cn *conn) Flush() error { return nil }
+
+func (cn *conn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	c := cn.cluster
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	node := c.nodes[cn.id]
+	if !node.Alive || !c.connected(c.LocalRegion, node.Region()) {
+		return nil, ErrConnFailed
+	}
+	xs := make([]string, len(args))
+	for i, arg := range args {
+		xs[i] = strings.ToLower(fmt.Sprint(arg))
+	}
+	switch strings.ToLower(cmd) {
+	case "ping":
+		return "PONG", nil
+	case "info":
+		return c.info(node), nil
+	case "cluster":
+		if len(xs) == 0 {
+			break
+		}
+		return c.clusterCommand(node, xs[0], args[1:])
+	}
+	return nil, redis.Error(fmt.Sprintf("ERR unknown command '%s'", cmd))
+}
+
+func (cn *conn) Send(cmd string, args ...interface{}) error {
+	reply, err := cn.Do(cmd, args...)
+	if err != nil {
+		cn.pending = append(cn.pending, err)
+	} else {
+		cn.pending = append(cn.pending, reply)
+	}
+	return nil
+}
+
+func (cn *conn) Receive() (interface{}, error) {
+	if len(cn.pending) == 0 {
+		return nil, errors.New("fake: no pending reply")
+	}
+	reply := cn.pending[0]
+	cn.pending = cn.pending[1:]
+	if err, ok := reply.(error); ok {
+		return nil, err
+	}
+	return reply, nil
+}
+
+/// Commands
+
+func (c *Cluster) slaves(id string) []*Node {
+	slaves := []*Node{}
+	for _, sid := range c.order {
+		n := c.nodes[sid]
+		if n.Role == "slave" && n.ParentId == id {
+			slaves = append(slaves, n)
+		}
+	}
+	return slaves
+}
+
+func (c *Cluster) info(node *Node) string {
+	lines := []string{"# Replication", "role:" + node.Role}
+	if node.Role == "master" {
+		online := []*Node{}
+		for _, s := range c.slaves(node.Id) {
+			if s.Alive && c.linkUp(s) {
+				online = append(online, s)
+			}
+		}
+		lines = append(lines, fmt.Sprintf("connected_slaves:%d", len(online)))
+		for i, s := range online {
+			lines = append(lines, fmt.Sprintf("slave%d:ip=%s,port=%d,state=online,offset=%d,lag=0",
+				i, s.Ip, s.Port, s.Offset))
+		}
+		lines = append(lines, fmt.Sprintf("master_repl_offset:%d", node.Offset))
+	} else {
+		link := "down"
+		if c.linkUp(node) {
+			link = "up"
+		}
+		if parent, ok := c.nodes[node.ParentId]; ok {
+			lines = append(lines, "master_host:"+parent.Ip, fmt.Sprintf("master_port:%d", parent.Port))
+		}
+		lines = append(lines, "master_link_status:"+link, "master_sync_in_progress:0",
+			fmt.Sprintf("slave_repl_offset:%d", node.Offset))
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// CLUSTER NODES EXTRA的格式：mod tag id addr flags parent ping pong epoch link slots...
+func (c *Cluster) clusterNodes(myself *Node) string {
+	lines := []string{}
+	for _, id := range c.order {
+		n := c.nodes[id]
+		mod := []byte("--")
+		if n.Readable {
+			mod[0] = 'r'
+		}
+		if n.Writable {
+			mod[1] = 'w'
+		}
+		flags := n.Role
+		if n.Id == myself.Id {
+			flags = "myself," + flags
+		}
+		link := "connected"
+		if !n.Alive || !c.connected(myself.Region(), n.Region()) {
+			flags += ",fail"
+			link = "disconnected"
+		}
+		xs := []string{string(mod), n.Tag, n.Id, n.Addr(), flags, n.ParentId, "0", "0", "0", link}
+		for _, r := range c.ranges(n.Id) {
+			if r.Left == r.Right {
+				xs = append(xs, strconv.Itoa(r.Left))
+			} else {
+				xs = append(xs, fmt.Sprintf("%d-%d", r.Left, r.Right))
+			}
+		}
+		lines = append(lines, strings.Join(xs, " "))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// 从节点接管主的slots，其他从节点跟随新主
+func (c *Cluster) promote(node *Node) {
+	old := c.nodes[node.ParentId]
+	for i := 0; i < NumSlots; i++ {
+		if c.owners[i] == old.Id {
+			c.owners[i] = node.Id
+		}
+	}
+	for _, s := range c.slaves(old.Id) {
+		if s == node {
+			continue
+		}
+		if !c.StaleSiblings && s.Alive && c.connected(s.Region(), node.Region()) {
+			s.ParentId = node.Id
+		}
+	}
+	node.Role = "master"
+	node.ParentId = "-"
+	if old.Alive {
+		old.Role = "slave"
+		old.ParentId = node.Id
+	} else {
+		old.takenOverBy = node.Id
+	}
+}
+
+func (c *Cluster) clusterCommand(node *Node, sub string, args []interface{}) (interface{}, error) {
+	xs := make([]string, len(args))
+	for i, arg := range args {
+		xs[i] = strings.ToLower(fmt.Sprint(arg))
+	}
+	switch sub {
+	case "nodes":
+		return c.clusterNodes(node), nil
+	case "info":
+		return fmt.Sprintf("cluster_state:ok\r\ncluster_known_nodes:%d\r\n", len(c.nodes)), nil
+	case "chmod":
+		if len(xs) != 2 || len(xs[0]) != 2 {
+			break
+		}
+		target, ok := c.nodes[fmt.Sprint(args[1])]
+		if !ok {
+			return nil, redis.Error("ERR Unknown node " + fmt.Sprint(args[1]))
+		}
+		val := xs[0][0] == '+'
+		if xs[0][1] == 'r' {
+			target.Readable = val
+		} else {
+			target.Writable = val
+		}
+		return "OK", nil
+	case "failover":
+		if node.Role != "slave" {
+			return nil, redis.Error("ERR You should send CLUSTER FAILOVER to a slave")
+		}
+		if len(xs) == 0 && !c.linkUp(node) {
+			return nil, redis.Error("ERR Master is down or failed, please use CLUSTER FAILOVER FORCE")
+		}
+		c.promote(node)
+		return "OK", nil
+	case "replicate":
+		if len(args) != 1 {
+			break
+		}
+		target, ok := c.nodes[fmt.Sprint(args[0])]
+		if !ok {
+			return nil, redis.Error("ERR Unknown node " + fmt.Sprint(args[0]))
+		}
+		if target.Role != "master" || target == node {
+			return nil, redis.Error("ERR I can only replicate a master, not a slave.")
+		}
+		if node.Role == "master" && len(c.ranges(node.Id)) > 0 {
+			return nil, redis.Error("ERR To set a master the node must be empty and without assigned slots.")
+		}
+		node.Role = "slave"
+		node.ParentId = target.Id
+		return "OK", nil
+	case "setslot":
+		if len(xs) < 2 {
+			break
+		}
+		slot, err := strconv.Atoi(xs[0])
+		if err != nil || slot < 0 || slot >= NumSlots {
+			return nil, redis.Error("ERR Invalid or out of range slot")
+		}
+		if xs[1] == "node" && len(args) == 3 {
+			c.owners[slot] = fmt.Sprint(args[2])
+		}
+		return "OK", nil
+	// 集群中没有key，迁移时每个slot直接完成
+	case "countkeysinslot":
+		if len(args) != 1 {
+			break
+		}
+		return int64(0), nil
+	case "getkeysinslot":
+		if len(args) != 2 {
+			break
+		}
+		return []interface{}{}, nil
+	}
+	return nil, redis.Error(fmt.Sprintf("ERR Unknown subcommand or wrong number of arguments for '%s'", sub))
+}
+
+/// 用于断言
+
+// 节点ID列表，按添加顺序
+func (c *Cluster) NodeIds() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ids := append([]string{}, c.order...)
+	return ids
+}
+
+// 分片的主，按slot查找
+func (c *Cluster) MasterOf(slot int) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.owners[slot]
+}
+
+// 复制某个节点的从节点ID，排序后返回
+func (c *Cluster) SlavesOf(id string) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ids := []string{}
+	for _, s := range c.slaves(id) {
+		ids = append(ids, s.Id)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,334 @@
+package redis
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+/// 连接池，每个地址一个，注册表和每个池都有锁保护
+/// 连接上的读写超时由deadlineConn控制：每次读写前按context的截止时间和
+/// 读写超时中较早的一个设置deadline，context取消时立即中断正在进行的读写
+
+// 每次读写都重新设置deadline的net.Conn
+type deadlineConn struct {
+	net.Conn
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	mutex     sync.Mutex
+	deadline  time.Time // 来自context，为零表示只按读写超时
+	cancelled bool
+}
+
+func (c *deadlineConn) next(timeout time.Duration) time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.cancelled {
+		return time.Unix(1, 0)
+	}
+	t := time.Time{}
+	if timeout > 0 {
+		t = time.Now().Add(timeout)
+	}
+	if !c.deadline.IsZero() && (t.IsZero() || c.deadline.Before(t)) {
+		t = c.deadline
+	}
+	return t
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(c.next(c.readTimeout))
+	return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	c.Conn.SetWriteDeadline(c.next(c.writeTimeout))
+	return c.Conn.Write(b)
+}
+
+// 在ctx结束前使用连接，返回的函数解除绑定
+func (c *deadlineConn) bind(ctx context.Context) func() {
+	deadline, _ := ctx.Deadline()
+	c.mutex.Lock()
+	c.deadline = deadline
+	c.cancelled = false
+	c.mutex.Unlock()
+
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			c.mutex.Lock()
+			c.cancelled = true
+			c.mutex.Unlock()
+			c.Conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	// 等待goroutine退出，避免连接放回池中后才被设置deadline
+	return func() {
+		close(done)
+		<-exited
+		c.mutex.Lock()
+		c.deadline = time.Time{}
+		c.mutex.Unlock()
+	}
+}
+
+func dialDeadlineConn(ctx context.Context, addr string, opts *Options, readTimeout time.Duration) (redis.Conn, *deadlineConn, error) {
+	timeout := opts.ConnTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		if d := deadline.Sub(time.Now()); d < timeout {
+			timeout = d
+		}
+	}
+	if timeout <= 0 {
+		return nil, nil, context.DeadlineExceeded
+	}
+	nc, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	dc := &deadlineConn{Conn: nc, readTimeout: readTimeout, writeTimeout: opts.WriteTimeout}
+	return redis.NewConn(dc, 0, 0), dc, nil
+}
+
+// 池中的一个连接
+type rawConn struct {
+	conn   redis.Conn
+	dc     *deadlineConn
+	usedAt time.Time
+}
+
+type pool struct {
+	addr    string
+	opts    *Options
+	mutex   sync.Mutex
+	idle    []*rawConn // 最近归还的在后面
+	active  int        // 借出的连接数
+	evicted bool       // 已从注册表中移除，归还的连接直接关闭
+	stats   poolStats
+}
+
+func (p *pool) get(ctx context.Context) (*poolConn, error) {
+	start := time.Now()
+	defer func() {
+		p.recordWait(time.Since(start))
+	}()
+
+	p.mutex.Lock()
+	// 先丢掉空闲太久的
+	now := time.Now()
+	for len(p.idle) > 0 && p.opts.IdleTimeout > 0 && now.Sub(p.idle[0].usedAt) > p.opts.IdleTimeout {
+		p.idle[0].conn.Close()
+		p.idle = p.idle[1:]
+	}
+	var raw *rawConn
+	if n := len(p.idle); n > 0 {
+		raw = p.idle[n-1]
+		p.idle = p.idle[:n-1]
+	}
+	p.active++
+	p.mutex.Unlock()
+
+	if raw != nil {
+		pc := &poolConn{raw: raw, pool: p}
+		pc.unbind = raw.dc.bind(ctx)
+		if _, err := raw.conn.Do("PING"); err == nil {
+			return pc, nil
+		}
+		pc.unbind()
+		raw.conn.Close()
+	}
+
+	conn, dc, err := dialDeadlineConn(ctx, p.addr, p.opts, p.opts.ReadTimeout)
+	p.recordDial(err)
+	if err != nil {
+		p.mutex.Lock()
+		p.active--
+		p.mutex.Unlock()
+		return nil, err
+	}
+	pc := &poolConn{raw: &rawConn{conn: conn, dc: dc}, pool: p}
+	pc.unbind = dc.bind(ctx)
+	return pc, nil
+}
+
+func (p *pool) put(raw *rawConn, broken bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.active--
+	if broken || p.evicted || len(p.idle) >= p.opts.MaxIdle {
+		raw.conn.Close()
+		return
+	}
+	raw.usedAt = time.Now()
+	p.idle = append(p.idle, raw)
+}
+
+func (p *pool) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.evicted = true
+	for _, raw := range p.idle {
+		raw.conn.Close()
+	}
+	p.idle = nil
+}
+
+// 借出的连接，Close时归还，有错误或者还有未读的回复时直接关闭
+type poolConn struct {
+	raw     *rawConn
+	pool    *pool
+	unbind  func()
+	pending int
+	closed  bool
+}
+
+func (pc *poolConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	pc.pending = 0
+	start := time.Now()
+	reply, err := pc.raw.conn.Do(cmd, args...)
+	pc.pool.recordCommand(time.Since(start), err)
+	return reply, err
+}
+
+func (pc *poolConn) Send(cmd string, args ...interface{}) error {
+	pc.pending++
+	return pc.raw.conn.Send(cmd, args...)
+}
+
+func (pc *poolConn) Receive() (interface{}, error) {
+	pc.pending--
+	return pc.raw.conn.Receive()
+}
+
+func (pc *poolConn) Flush() error { return pc.raw.conn.Flush() }
+func (pc *poolConn) Err() error   { return pc.raw.conn.Err() }
+
+func (pc *poolConn) Close() error {
+	if pc.closed {
+		return nil
+	}
+	pc.closed = true
+	pc.unbind()
+	pc.pool.put(pc.raw, pc.raw.conn.Err() != nil || pc.pending != 0)
+	return nil
+}
+
+// 不经过连接池的连接，Close时关闭
+type directConn struct {
+	redis.Conn
+	unbind func()
+	pool   *pool
+}
+
+func (dc *directConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	start := time.Now()
+	reply, err := dc.Conn.Do(cmd, args...)
+	dc.pool.recordCommand(time.Since(start), err)
+	return reply, err
+}
+
+func (dc *directConn) Close() error {
+	dc.unbind()
+	return dc.Conn.Close()
+}
+
+// 所有地址的连接池
+type Pools struct {
+	opts  *Options
+	mutex sync.Mutex
+	pools map[string]*pool
+}
+
+func NewPools(opts *Options) *Pools {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	return &Pools{
+		opts:  opts,
+		pools: map[string]*pool{},
+	}
+}
+
+func (ps *Pools) pool(addr string) *pool {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	p, ok := ps.pools[addr]
+	if !ok {
+		p = &pool{addr: addr, opts: ps.opts}
+		ps.pools[addr] = p
+	}
+	return p
+}
+
+func (ps *Pools) Dial(addr string) (redis.Conn, error) {
+	return ps.DialContext(context.Background(), addr)
+}
+
+func (ps *Pools) DialContext(ctx context.Context, addr string) (redis.Conn, error) {
+	return ps.pool(addr).get(ctx)
+}
+
+// 独立的连接，用于读超时很长或者需要长期占用的场景，readTimeout为0时使用默认的读超时
+func (ps *Pools) DialDirect(ctx context.Context, addr string, readTimeout time.Duration) (redis.Conn, error) {
+	if readTimeout == 0 {
+		readTimeout = ps.opts.ReadTimeout
+	}
+	p := ps.pool(addr)
+	conn, dc, err := dialDeadlineConn(ctx, addr, ps.opts, readTimeout)
+	p.recordDial(err)
+	if err != nil {
+		return nil, err
+	}
+	return &directConn{Conn: conn, unbind: dc.bind(ctx), pool: p}, nil
+}
+
+// 移除不在keep中、且超过idleFor没有使用的连接池，有借出连接的下次再处理，返回被移除的地址
+func (ps *Pools) Evict(keep []string, idleFor time.Duration) []string {
+	kept := map[string]bool{}
+	for _, addr := range keep {
+		kept[addr] = true
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	evicted := []string{}
+	now := time.Now()
+	for addr, p := range ps.pools {
+		if kept[addr] {
+			continue
+		}
+		p.mutex.Lock()
+		idle := p.active == 0 && now.Sub(p.stats.lastUsed) > idleFor
+		p.mutex.Unlock()
+		if !idle {
+			continue
+		}
+		p.close()
+		delete(ps.pools, addr)
+		evicted = append(evicted, addr)
+	}
+	sort.Strings(evicted)
+	return evicted
+}
+
+// 关闭所有空闲连接，借出的连接归还时关闭
+func (ps *Pools) Close() {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	for addr, p := range ps.pools {
+		p.close()
+		delete(ps.pools, addr)
+	}
+}
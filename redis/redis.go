@@ -1,6 +1,7 @@
 package redis
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strconv"
@@ -10,6 +11,7 @@ import (
 	"github.com/garyburd/redigo/redis"
 	"github.com/ksarch-saas/cc/log"
 	"github.com/ksarch-saas/cc/topo"
+	"github.com/ksarch-saas/cc/utils/clock"
 )
 
 var (
@@ -18,7 +20,6 @@ var (
 	ErrPingFailed  = errors.New("redis: ping error")
 	ErrServer      = errors.New("redis: server error")
 	ErrInvalidAddr = errors.New("redis: invalid address string")
-	poolMap        map[string]*redis.Pool //redis connection pool for each server
 )
 
 const (
@@ -33,48 +34,10 @@ const (
 	WRITE_TIMEOUT = 120 * time.Second
 )
 
-func dial(addr string) (redis.Conn, error) {
-	if poolMap == nil {
-		poolMap = make(map[string]*redis.Pool)
-	}
-
-	inner := func(addr string) (redis.Conn, error) {
-		if _, ok := poolMap[addr]; !ok {
-			//not exist in map
-			poolMap[addr] = &redis.Pool{
-				MaxIdle:     3,
-				IdleTimeout: 240 * time.Second,
-				Dial: func() (redis.Conn, error) {
-					c, err := redis.DialTimeout("tcp", addr, CONN_TIMEOUT, READ_TIMEOUT, WRITE_TIMEOUT)
-					if err != nil {
-						return nil, err
-					}
-					return c, nil
-				},
-				TestOnBorrow: func(c redis.Conn, t time.Time) error {
-					_, err := c.Do("PING")
-					return err
-				},
-			}
-		}
-		pool, ok := poolMap[addr]
-		if ok {
-			return pool.Get(), nil
-		} else {
-			return nil, ErrConnFailed
-		}
-	}
-	resp, err := inner(addr)
-	if err == nil {
-		return resp, nil
-	}
-	return nil, err
-}
-
 /// Misc
 
-func IsAlive(addr string) bool {
-	conn, err := dial(addr)
+func (c *client) IsAlive(ctx context.Context, addr string) bool {
+	conn, err := c.dial(ctx, addr)
 	if err != nil {
 		return false
 	}
@@ -88,8 +51,9 @@ func IsAlive(addr string) bool {
 
 /// Cluster
 
-func SetAsMasterWaitSyncDone(addr string, waitSyncDone bool) error {
-	conn, err := dial(addr)
+// waitSyncDone时等待所有从节点同步完成，直到ctx结束
+func (c *client) SetAsMasterWaitSyncDone(ctx context.Context, addr string, waitSyncDone bool) error {
+	conn, err := c.dial(ctx, addr)
 	if err != nil {
 		return err
 	}
@@ -104,9 +68,9 @@ func SetAsMasterWaitSyncDone(addr string, waitSyncDone bool) error {
 		return nil
 	}
 
-	for {
-		info, err := FetchInfo(addr, "replication")
-		time.Sleep(5 * time.Second)
+	for ctx.Err() == nil {
+		info, err := c.FetchInfo(ctx, addr, "replication")
+		clock.Sleep(5 * time.Second)
 		if err == nil {
 			n, err := info.GetInt64("connected_slaves")
 			if err != nil {
@@ -124,45 +88,48 @@ func SetAsMasterWaitSyncDone(addr string, waitSyncDone bool) error {
 			}
 		}
 	}
-	return nil
+	return ctx.Err()
 }
 
-func ClusterNodes(addr string) (string, error) {
-	inner := func(addr string) (string, error) {
-		conn, err := dial(addr)
-		if err != nil {
-			return "", ErrConnFailed
-		}
-		defer conn.Close()
-
-		resp, err := redis.String(conn.Do("cluster", "nodes", "extra"))
-		if err != nil {
-			return "", err
-		}
-		return resp, nil
+// 执行只返回一个字符串的命令
+func (c *client) doString(ctx context.Context, addr string, cmd string, args ...interface{}) (string, error) {
+	conn, err := c.dial(ctx, addr)
+	if err != nil {
+		return "", ErrConnFailed
 	}
-	retry := NUM_RETRY
-	var err error
+	defer conn.Close()
+
+	return redis.String(conn.Do(cmd, args...))
+}
+
+func (c *client) ClusterNodes(ctx context.Context, addr string) (string, error) {
 	var resp string
-	for retry > 0 {
-		resp, err = inner(addr)
-		if err == nil {
-			return resp, nil
-		}
-		retry--
+	err := c.retry(ctx, func() (err error) {
+		resp, err = c.doString(ctx, addr, "cluster", "nodes", "extra")
+		return
+	})
+	if err != nil {
+		return "", err
 	}
-	return "", err
+	return resp, nil
 }
 
-func FetchClusterInfo(addr string) (topo.ClusterInfo, error) {
-	clusterInfo := topo.ClusterInfo{}
-	conn, err := dial(addr)
+// used by cli
+func (c *client) ClusterNodesWithoutExtra(ctx context.Context, addr string) (string, error) {
+	var resp string
+	err := c.retry(ctx, func() (err error) {
+		resp, err = c.doString(ctx, addr, "cluster", "nodes")
+		return
+	})
 	if err != nil {
-		return clusterInfo, ErrConnFailed
+		return "", err
 	}
-	defer conn.Close()
+	return resp, nil
+}
 
-	resp, err := redis.String(conn.Do("cluster", "info"))
+func (c *client) FetchClusterInfo(ctx context.Context, addr string) (topo.ClusterInfo, error) {
+	clusterInfo := topo.ClusterInfo{}
+	resp, err := c.doString(ctx, addr, "cluster", "info")
 	if err != nil {
 		return clusterInfo, err
 	}
@@ -211,170 +178,147 @@ func FetchClusterInfo(addr string) (topo.ClusterInfo, error) {
 	return clusterInfo, nil
 }
 
-func ClusterChmod(addr, id, op string) (string, error) {
-	inner := func(addr, id, op string) (string, error) {
-		conn, err := dial(addr)
-		if err != nil {
-			return "", ErrConnFailed
-		}
-		defer conn.Close()
-
-		resp, err := redis.String(conn.Do("cluster", "chmod", op, id))
-		if err != nil {
-			return "", err
-		}
-		return resp, nil
-	}
-	retry := NUM_RETRY
-	var err error
+func (c *client) ClusterChmod(ctx context.Context, addr, id, op string) (string, error) {
 	var resp string
-	for retry > 0 {
-		resp, err = inner(addr, id, op)
-		if err == nil {
-			return resp, nil
-		}
-		retry--
+	err := c.retry(ctx, func() (err error) {
+		resp, err = c.doString(ctx, addr, "cluster", "chmod", op, id)
+		return
+	})
+	if err != nil {
+		return "", err
 	}
-	return "", err
+	return resp, nil
 }
 
-func DisableRead(addr, id string) (string, error) {
-	return ClusterChmod(addr, id, "-r")
+func (c *client) DisableRead(ctx context.Context, addr, id string) (string, error) {
+	return c.ClusterChmod(ctx, addr, id, "-r")
 }
 
-func EnableRead(addr, id string) (string, error) {
-	return ClusterChmod(addr, id, "+r")
+func (c *client) EnableRead(ctx context.Context, addr, id string) (string, error) {
+	return c.ClusterChmod(ctx, addr, id, "+r")
 }
 
-func DisableWrite(addr, id string) (string, error) {
-	return ClusterChmod(addr, id, "-w")
+func (c *client) DisableWrite(ctx context.Context, addr, id string) (string, error) {
+	return c.ClusterChmod(ctx, addr, id, "-w")
 }
 
-func EnableWrite(addr, id string) (string, error) {
-	return ClusterChmod(addr, id, "+w")
+func (c *client) EnableWrite(ctx context.Context, addr, id string) (string, error) {
+	return c.ClusterChmod(ctx, addr, id, "+w")
 }
 
-func ClusterFailover(addr string) (string, error) {
-	conn, err := dial(addr)
-	if err != nil {
-		return "", ErrConnFailed
-	}
-	defer conn.Close()
-
-	// 先正常Failover试试，如果主挂了再试试Force
-	resp, err := redis.String(conn.Do("cluster", "failover"))
-	if err != nil {
-		if strings.HasPrefix(err.Error(), "ERR Master is down or failed") {
-			resp, err = redis.String(conn.Do("cluster", "failover", "force"))
-		}
-		if err != nil {
-			return "", err
-		}
-	}
-	// 30s
+// 等待节点的角色变为master，最多30s
+func (c *client) waitRoleMaster(ctx context.Context, addr string) error {
 	for i := 0; i < 30; i++ {
-		info, err := FetchInfo(addr, "Replication")
+		info, err := c.FetchInfo(ctx, addr, "Replication")
 		if err != nil {
-			return resp, err
+			return err
 		}
 		if info.Get("role") == "slave" {
-			time.Sleep(1 * time.Second)
+			clock.Sleep(1 * time.Second)
 		} else {
 			break
 		}
 	}
-	return resp, nil
+	return nil
 }
 
-func ClusterTakeover(addr string) (string, error) {
-	conn, err := dial(addr)
+func (c *client) ClusterFailover(ctx context.Context, addr string) (string, error) {
+	conn, err := c.dial(ctx, addr)
 	if err != nil {
 		return "", ErrConnFailed
 	}
 	defer conn.Close()
 
-	resp, err := redis.String(conn.Do("cluster", "failover", "takeover"))
+	// 先正常Failover试试，如果主挂了再试试Force
+	resp, err := redis.String(conn.Do("cluster", "failover"))
 	if err != nil {
-		return "", err
-	}
-
-	// 30s
-	for i := 0; i < 30; i++ {
-		info, err := FetchInfo(addr, "Replication")
-		if err != nil {
-			return resp, err
+		if strings.HasPrefix(err.Error(), "ERR Master is down or failed") {
+			resp, err = redis.String(conn.Do("cluster", "failover", "force"))
 		}
-		if info.Get("role") == "slave" {
-			time.Sleep(1 * time.Second)
-		} else {
-			break
+		if err != nil {
+			return "", err
 		}
 	}
-	return resp, nil
+	return resp, c.waitRoleMaster(ctx, addr)
 }
 
-func ClusterReplicate(addr, targetId string) (string, error) {
-	conn, err := dial(addr)
+// 只发送CLUSTER FAILOVER，不带FORCE，也不等待角色变化
+func (c *client) ClusterManualFailover(ctx context.Context, addr string) (string, error) {
+	return c.doString(ctx, addr, "cluster", "failover")
+}
+
+// 主返回master_repl_offset，从返回slave_repl_offset
+func (c *client) FetchReplOffset(ctx context.Context, addr string) (int64, error) {
+	info, err := c.FetchInfo(ctx, addr, "Replication")
 	if err != nil {
-		return "", ErrConnFailed
+		return -1, err
 	}
-	defer conn.Close()
+	if info.Get("role") == "master" {
+		return info.GetInt64("master_repl_offset")
+	}
+	return info.GetInt64("slave_repl_offset")
+}
 
-	resp, err := redis.String(conn.Do("cluster", "replicate", targetId))
+func (c *client) ClusterTakeover(ctx context.Context, addr string) (string, error) {
+	resp, err := c.doString(ctx, addr, "cluster", "failover", "takeover")
 	if err != nil {
 		return "", err
 	}
+	return resp, c.waitRoleMaster(ctx, addr)
+}
 
-	return resp, nil
+func (c *client) ClusterReplicate(ctx context.Context, addr, targetId string) (string, error) {
+	return c.doString(ctx, addr, "cluster", "replicate", targetId)
 }
 
-func ClusterMeet(seedAddr, newIp string, newPort int) (string, error) {
-	conn, err := dial(seedAddr)
-	if err != nil {
-		return "", ErrConnFailed
-	}
-	defer conn.Close()
+func (c *client) ClusterMeet(ctx context.Context, seedAddr, newIp string, newPort int) (string, error) {
+	return c.doString(ctx, seedAddr, "cluster", "meet", newIp, newPort)
+}
 
-	resp, err := redis.String(conn.Do("cluster", "meet", newIp, newPort))
-	if err != nil {
-		return "", err
-	}
+func (c *client) ClusterForget(ctx context.Context, seedAddr, nodeId string) (string, error) {
+	return c.doString(ctx, seedAddr, "cluster", "forget", nodeId)
+}
 
-	return resp, nil
+func (c *client) ClusterReset(ctx context.Context, addr string, hard bool) (string, error) {
+	flag := "soft"
+	if hard {
+		flag = "hard"
+	}
+	return c.doString(ctx, addr, "cluster", "reset", flag)
 }
 
-func ClusterForget(seedAddr, nodeId string) (string, error) {
-	conn, err := dial(seedAddr)
+func (c *client) AddSlotRange(ctx context.Context, addr string, start, end int) (string, error) {
+	conn, err := c.dial(ctx, addr)
 	if err != nil {
-		return "", ErrConnFailed
+		return "connect failed", ErrConnFailed
 	}
 	defer conn.Close()
-
-	resp, err := redis.String(conn.Do("cluster", "forget", nodeId))
-	if err != nil {
-		return "", err
+	var resp string
+	for i := start; i <= end; i++ {
+		resp, err = redis.String(conn.Do("cluster", "addslots", i))
+		if err != nil {
+			return resp, err
+		}
 	}
-
 	return resp, nil
 }
 
-func ClusterReset(addr string, hard bool) (string, error) {
-	conn, err := dial(addr)
+func (c *client) FlushAll(ctx context.Context, addr string) (string, error) {
+	conn, err := c.dial(ctx, addr)
 	if err != nil {
-		return "", ErrConnFailed
+		return "connect failed", ErrConnFailed
 	}
 	defer conn.Close()
+	return redis.String(conn.Do("flushall"))
+}
 
-	flag := "soft"
-	if hard {
-		flag = "hard"
-	}
-
-	resp, err := redis.String(conn.Do("cluster", "reset", flag))
+func (c *client) Slot2Node(ctx context.Context, addr string, slot int, dest string) (string, error) {
+	conn, err := c.dial(ctx, addr)
 	if err != nil {
-		return "", err
+		return "connect failed", ErrConnFailed
 	}
-
+	defer conn.Close()
+	resp, _ := redis.String(conn.Do("slot2node", slot, dest))
 	return resp, nil
 }
 
@@ -382,44 +326,32 @@ func ClusterReset(addr string, hard bool) (string, error) {
 
 type RedisInfo map[string]string
 
-func FetchInfo(addr, section string) (*RedisInfo, error) {
-	inner := func(addr, section string) (*RedisInfo, error) {
-		conn, err := dial(addr)
-		if err != nil {
-			return nil, ErrConnFailed
-		}
-		defer conn.Close()
-
-		resp, err := redis.String(conn.Do("info", section))
-		if err != nil {
-			return nil, err
-		}
-		infomap := map[string]string{}
-		lines := strings.Split(resp, "\r\n")
-		for _, line := range lines {
-			xs := strings.Split(line, ":")
-			if len(xs) != 2 {
-				continue
-			}
-			key := xs[0]
-			value := xs[1]
-			infomap[key] = value
+func parseInfo(resp string) *RedisInfo {
+	infomap := map[string]string{}
+	lines := strings.Split(resp, "\r\n")
+	for _, line := range lines {
+		xs := strings.Split(line, ":")
+		if len(xs) != 2 {
+			continue
 		}
-
-		redisInfo := RedisInfo(infomap)
-		return &redisInfo, nil
+		key := xs[0]
+		value := xs[1]
+		infomap[key] = value
 	}
-	retry := NUM_RETRY
-	var err error
-	var redisInfo *RedisInfo
-	for retry > 0 {
-		redisInfo, err = inner(addr, section)
-		if err == nil {
-			return redisInfo, nil
-		}
-		retry--
+	redisInfo := RedisInfo(infomap)
+	return &redisInfo
+}
+
+func (c *client) FetchInfo(ctx context.Context, addr, section string) (*RedisInfo, error) {
+	var resp string
+	err := c.retry(ctx, func() (err error) {
+		resp, err = c.doString(ctx, addr, "info", section)
+		return
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil, err
+	return parseInfo(resp), nil
 }
 
 func (info *RedisInfo) Get(key string) string {
@@ -432,175 +364,391 @@ func (info *RedisInfo) GetInt64(key string) (int64, error) {
 
 /// Migrate
 
-func SetSlot(addr string, slot int, action, toId string) error {
-	conn, err := dial(addr)
-	if err != nil {
-		return ErrConnFailed
-	}
-	defer conn.Close()
-
+func (c *client) SetSlot(ctx context.Context, addr string, slot int, action, toId string) error {
+	var err error
 	if action == SLOT_STABLE {
-		_, err = redis.String(conn.Do("cluster", "setslot", slot, action))
+		_, err = c.doString(ctx, addr, "cluster", "setslot", slot, action)
 	} else {
-		_, err = redis.String(conn.Do("cluster", "setslot", slot, action, toId))
+		_, err = c.doString(ctx, addr, "cluster", "setslot", slot, action, toId)
 	}
-	if err != nil {
-		return err
-	}
-	return nil
+	return err
 }
 
-func CountKeysInSlot(addr string, slot int) (int, error) {
-	inner := func(addr string, slot int) (int, error) {
-		conn, err := dial(addr)
+func (c *client) CountKeysInSlot(ctx context.Context, addr string, slot int) (int, error) {
+	var resp int
+	err := c.retry(ctx, func() error {
+		conn, err := c.dial(ctx, addr)
 		if err != nil {
-			return 0, ErrConnFailed
+			return ErrConnFailed
 		}
 		defer conn.Close()
 
-		resp, err := redis.Int(conn.Do("cluster", "countkeysinslot", slot))
-		if err != nil {
-			return 0, err
-		}
-		return resp, nil
-	}
-	retry := NUM_RETRY
-	var err error
-	var resp int
-	for retry > 0 {
-		resp, err = inner(addr, slot)
-		if err == nil {
-			return resp, nil
-		}
-		retry--
+		resp, err = redis.Int(conn.Do("cluster", "countkeysinslot", slot))
+		return err
+	})
+	if err != nil {
+		return 0, err
 	}
-	return 0, err
+	return resp, nil
 }
 
-func GetKeysInSlot(addr string, slot, num int) ([]string, error) {
-	inner := func(addr string, slot, num int) ([]string, error) {
-		conn, err := dial(addr)
-		if err != nil {
-			return nil, ErrConnFailed
-		}
-		defer conn.Close()
+// 批量统计slots中的key数，使用pipeline减少RTT
+func (c *client) CountKeysInSlots(ctx context.Context, addr string, slots []int) (map[int]int, error) {
+	conn, err := c.dial(ctx, addr)
+	if err != nil {
+		return nil, ErrConnFailed
+	}
+	defer conn.Close()
 
-		resp, err := redis.Strings(conn.Do("cluster", "getkeysinslot", slot, num))
+	counts := map[int]int{}
+	batch := 1000
+	for len(slots) > 0 {
+		n := batch
+		if len(slots) < n {
+			n = len(slots)
+		}
+		for _, slot := range slots[:n] {
+			conn.Send("cluster", "countkeysinslot", slot)
+		}
+		err = conn.Flush()
 		if err != nil {
 			return nil, err
 		}
-		return resp, nil
+		for _, slot := range slots[:n] {
+			count, err := redis.Int(conn.Receive())
+			if err != nil {
+				return nil, err
+			}
+			counts[slot] = count
+		}
+		slots = slots[n:]
 	}
-	retry := NUM_RETRY
-	var err error
+	return counts, nil
+}
+
+func (c *client) GetKeysInSlot(ctx context.Context, addr string, slot, num int) ([]string, error) {
 	var resp []string
-	for retry > 0 {
-		resp, err = inner(addr, slot, num)
-		if err == nil {
-			return resp, nil
+	err := c.retry(ctx, func() error {
+		conn, err := c.dial(ctx, addr)
+		if err != nil {
+			return ErrConnFailed
 		}
-		retry--
+		defer conn.Close()
+
+		resp, err = redis.Strings(conn.Do("cluster", "getkeysinslot", slot, num))
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil, err
+	return resp, nil
 }
 
-func Migrate(addr, toIp string, toPort int, key string, timeout int) (string, error) {
-	inner := func(addr, toIp string, toPort int, key string, timeout int) (string, error) {
-		conn, err := dial(addr)
+func (c *client) Migrate(ctx context.Context, addr, toIp string, toPort int, key string, timeout int) (string, error) {
+	var resp string
+	err := c.retry(ctx, func() error {
+		conn, err := c.dial(ctx, addr)
 		if err != nil {
-			return "", ErrConnFailed
+			return ErrConnFailed
 		}
 		defer conn.Close()
 
-		resp, err := redis.String(conn.Do("migrate", toIp, toPort, key, 0, timeout))
+		resp, err = redis.String(conn.Do("migrate", toIp, toPort, key, 0, timeout))
 		if err != nil && strings.Contains(err.Error(), "BUSYKEY") {
 			log.Warningf("Migrate", "Found BUSYKEY '%s', will overwrite it.", key)
 			resp, err = redis.String(conn.Do("migrate", toIp, toPort, key, 0, timeout, "replace"))
 		}
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return resp, nil
+}
+
+// 迁移专用的连接，不经过连接池，用于以pipeline方式批量迁移key
+type MigrateConn struct {
+	addr     string
+	conn     redis.Conn
+	sizeMode int // 探测key大小的方式
+}
+
+// ctx结束时连接上的读写都会失败
+func (c *client) DialMigrateConn(ctx context.Context, addr string) (*MigrateConn, error) {
+	conn, err := c.dialDirect(ctx, addr, 0)
+	if err != nil {
+		return nil, ErrConnFailed
+	}
+	return &MigrateConn{addr: addr, conn: conn}, nil
+}
+
+func (c *MigrateConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *MigrateConn) GetKeysInSlot(slot, num int) ([]string, error) {
+	return redis.Strings(c.conn.Do("cluster", "getkeysinslot", slot, num))
+}
+
+func migrateKeysArgs(toIp string, toPort int, keys []string, timeout int, replace bool) []interface{} {
+	args := []interface{}{toIp, toPort, "", 0, timeout}
+	if replace {
+		args = append(args, "replace")
+	}
+	args = append(args, "keys")
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	return args
+}
+
+// 用MIGRATE ... KEYS迁移一组key，keys已不存在时返回NOKEY，视为成功
+func isMigrateKeysDone(err error) bool {
+	return err == nil || strings.HasPrefix(err.Error(), "NOKEY")
+}
+
+// 迁移batches中的所有key，每组key使用一条MIGRATE ... KEYS命令，
+// 每次pipeline最多发送concurrency条MIGRATE命令，最后一次pipeline中附带
+// 下一次的GETKEYSINSLOT，以节省一次RTT。
+// 返回成功迁移的key数目，下一批待迁移的keys，出错时返回出错那组key中的第一个
+func (c *MigrateConn) MigrateKeys(toIp string, toPort int, batches [][]string, timeout int,
+	concurrency int, slot, num int) (int, []string, string, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	nkeys := 0
+	for start := 0; start < len(batches); start += concurrency {
+		end := start + concurrency
+		if end > len(batches) {
+			end = len(batches)
+		}
+		last := end == len(batches)
+
+		for _, keys := range batches[start:end] {
+			err := c.conn.Send("migrate", migrateKeysArgs(toIp, toPort, keys, timeout, false)...)
+			if err != nil {
+				return nkeys, nil, keys[0], err
+			}
+		}
+		if last {
+			err := c.conn.Send("cluster", "getkeysinslot", slot, num)
+			if err != nil {
+				return nkeys, nil, "", err
+			}
+		}
+		err := c.conn.Flush()
 		if err != nil {
-			return "", err
+			return nkeys, nil, batches[start][0], err
+		}
+
+		// 需要读完所有的回复，才能保证连接可以继续使用
+		var firstErr error
+		var failedKey string
+		busy := [][]string{}
+		for _, keys := range batches[start:end] {
+			_, err := redis.String(c.conn.Receive())
+			if err != nil && strings.HasPrefix(err.Error(), "BUSYKEY") {
+				busy = append(busy, keys)
+				continue
+			}
+			if isMigrateKeysDone(err) {
+				nkeys += len(keys)
+			} else if firstErr == nil {
+				firstErr = err
+				failedKey = keys[0]
+			}
+		}
+		var next []string
+		if last {
+			var err error
+			next, err = redis.Strings(c.conn.Receive())
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		// 回复都读完之后，再用REPLACE重试BUSYKEY的那些组
+		for _, keys := range busy {
+			log.Warningf("Migrate", "Found BUSYKEY in keys %v, will overwrite them.", keys)
+			_, err := redis.String(c.conn.Do("migrate", migrateKeysArgs(toIp, toPort, keys, timeout, true)...))
+			if isMigrateKeysDone(err) {
+				nkeys += len(keys)
+			} else if firstErr == nil {
+				firstErr = err
+				failedKey = keys[0]
+			}
+		}
+		if firstErr != nil {
+			return nkeys, nil, failedKey, firstErr
+		}
+		if last {
+			return nkeys, next, "", nil
 		}
-		return resp, nil
 	}
-	retry := NUM_RETRY
-	var err error
-	var resp string
-	for retry > 0 {
-		resp, err = inner(addr, toIp, toPort, key, timeout)
-		if err == nil {
-			return resp, nil
+	return nkeys, nil, "", nil
+}
+
+/// 大key探测
+/// 依次尝试MEMORY USAGE、DEBUG OBJECT的serializedlength、按类型和长度估算，
+/// 不支持的命令(如老版本或禁用了DEBUG)降级到下一种方式，同一连接上记住探测方式
+
+const (
+	sizeByMemoryUsage = iota
+	sizeByDebugObject
+	sizeByLength
+)
+
+// 按类型和长度估算时，每个元素的平均字节数
+const ELEM_SIZE_ESTIMATE = 64
+
+func isUnknownCommand(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "unknown") || strings.Contains(msg, "syntax")
+}
+
+// 返回keys中每个key的大小，单位字节，key不存在时为0
+func (c *MigrateConn) KeySizes(keys []string) ([]int64, error) {
+	for {
+		var sizes []int64
+		var err error
+		switch c.sizeMode {
+		case sizeByMemoryUsage:
+			sizes, err = c.keySizesBy(keys, "memory", "usage")
+		case sizeByDebugObject:
+			sizes, err = c.keySizesBy(keys, "debug", "object")
+		default:
+			sizes, err = c.keySizesByLength(keys)
+		}
+		if err != nil && c.sizeMode < sizeByLength && isUnknownCommand(err) {
+			c.sizeMode++
+			continue
 		}
-		retry--
+		return sizes, err
 	}
-	return "", err
 }
 
-// used by cli
-func ClusterNodesWithoutExtra(addr string) (string, error) {
-	inner := func(addr string) (string, error) {
-		conn, err := dial(addr)
-		if err != nil {
-			return "", ErrConnFailed
+func parseSerializedLength(s string) int64 {
+	for _, field := range strings.Fields(s) {
+		if strings.HasPrefix(field, "serializedlength:") {
+			n, _ := strconv.ParseInt(strings.TrimPrefix(field, "serializedlength:"), 10, 64)
+			return n
 		}
-		defer conn.Close()
+	}
+	return 0
+}
 
-		resp, err := redis.String(conn.Do("cluster", "nodes"))
+func (c *MigrateConn) keySizesBy(keys []string, cmd, subcmd string) ([]int64, error) {
+	for _, key := range keys {
+		err := c.conn.Send(cmd, subcmd, key)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		return resp, nil
 	}
-	retry := NUM_RETRY
-	var err error
-	var resp string
-	for retry > 0 {
-		resp, err = inner(addr)
+	err := c.conn.Flush()
+	if err != nil {
+		return nil, err
+	}
+	// 读完所有回复后再返回错误
+	var firstErr error
+	sizes := make([]int64, len(keys))
+	for i := range keys {
+		reply, err := c.conn.Receive()
 		if err == nil {
-			return resp, nil
+			switch v := reply.(type) {
+			case int64:
+				sizes[i] = v
+			case string:
+				sizes[i] = parseSerializedLength(v)
+			case []byte:
+				sizes[i] = parseSerializedLength(string(v))
+			}
+		} else if !strings.HasPrefix(err.Error(), "ERR no such key") && firstErr == nil {
+			firstErr = err
 		}
-		retry--
 	}
-	return "", err
+	return sizes, firstErr
 }
 
-func AddSlotRange(addr string, start, end int) (string, error) {
-	conn, err := dial(addr)
+func (c *MigrateConn) keySizesByLength(keys []string) ([]int64, error) {
+	for _, key := range keys {
+		err := c.conn.Send("type", key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := c.conn.Flush()
 	if err != nil {
-		return "connect failed", ErrConnFailed
+		return nil, err
 	}
-	defer conn.Close()
-	var resp string
-	for i := start; i <= end; i++ {
-		resp, err = redis.String(conn.Do("cluster", "addslots", i))
-		if err != nil {
-			return resp, err
+	types := make([]string, len(keys))
+	var firstErr error
+	for i := range keys {
+		types[i], err = redis.String(c.conn.Receive())
+		if err != nil && firstErr == nil {
+			firstErr = err
 		}
 	}
-	return resp, nil
-}
+	if firstErr != nil {
+		return nil, firstErr
+	}
 
-func FlushAll(addr string) (string, error) {
-	conn, err := dial(addr)
-	if err != nil {
-		return "connect failed", ErrConnFailed
+	lenCmds := map[string]string{
+		"string": "strlen",
+		"list":   "llen",
+		"set":    "scard",
+		"zset":   "zcard",
+		"hash":   "hlen",
 	}
-	defer conn.Close()
-	resp, err := redis.String(conn.Do("flushall"))
+	for i, key := range keys {
+		cmd, ok := lenCmds[types[i]]
+		if !ok {
+			continue
+		}
+		err := c.conn.Send(cmd, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = c.conn.Flush()
 	if err != nil {
-		return resp, err
+		return nil, err
 	}
-	return resp, nil
+	sizes := make([]int64, len(keys))
+	for i := range keys {
+		if _, ok := lenCmds[types[i]]; !ok {
+			continue
+		}
+		n, err := redis.Int64(c.conn.Receive())
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if types[i] == "string" {
+			sizes[i] = n
+		} else {
+			sizes[i] = n * ELEM_SIZE_ESTIMATE
+		}
+	}
+	return sizes, firstErr
 }
 
-func Slot2Node(addr string, slot int, dest string) (string, error) {
-	conn, err := dial(addr)
+// 单独迁移一个key，timeout单位毫秒，可能远大于READ_TIMEOUT，所以使用独立的连接
+func (c *client) MigrateKey(ctx context.Context, addr, toIp string, toPort int, key string, timeout int) error {
+	readTimeout := time.Duration(timeout)*time.Millisecond + c.opts.ReadTimeout
+	conn, err := c.dialDirect(ctx, addr, readTimeout)
 	if err != nil {
-		return "connect failed", ErrConnFailed
+		return ErrConnFailed
 	}
 	defer conn.Close()
-	resp, err := redis.String(conn.Do("slot2node", slot, dest))
-	if err != nil {
-		return resp, nil
+
+	_, err = redis.String(conn.Do("migrate", toIp, toPort, key, 0, timeout))
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYKEY") {
+		log.Warningf("Migrate", "Found BUSYKEY '%s', will overwrite it.", key)
+		_, err = redis.String(conn.Do("migrate", toIp, toPort, key, 0, timeout, "replace"))
 	}
-	return resp, nil
+	if isMigrateKeysDone(err) {
+		return nil
+	}
+	return err
 }
@@ -0,0 +1,199 @@
+package redis
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+/// 连接池的统计，每个地址一份：借出/空闲连接数、建连次数和失败数、
+/// 命令数、错误和超时数，以及命令耗时和借出连接耗时的直方图
+/// 通过/debug/redis查看
+
+// 直方图各桶的上界
+var latencyBuckets = []time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2 * time.Second,
+	5 * time.Second,
+}
+
+type histogram struct {
+	counts []int64 // 最后一个是+Inf
+	sum    time.Duration
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]int64, len(latencyBuckets)+1)
+	}
+	i := sort.Search(len(latencyBuckets), func(i int) bool { return d <= latencyBuckets[i] })
+	h.counts[i]++
+	h.sum += d
+}
+
+type HistogramBucket struct {
+	Le    string // 上界，单位秒，最后一个是+Inf
+	Count int64  // 不超过上界的总数
+}
+
+type Histogram struct {
+	Buckets []HistogramBucket
+	Count   int64
+	Sum     float64 // 单位秒
+}
+
+func (h *histogram) snapshot() Histogram {
+	s := Histogram{Sum: h.sum.Seconds()}
+	for i := 0; i <= len(latencyBuckets); i++ {
+		if h.counts != nil {
+			s.Count += h.counts[i]
+		}
+		le := "+Inf"
+		if i < len(latencyBuckets) {
+			le = strconv.FormatFloat(latencyBuckets[i].Seconds(), 'f', -1, 64)
+		}
+		s.Buckets = append(s.Buckets, HistogramBucket{Le: le, Count: s.Count})
+	}
+	return s
+}
+
+type poolStats struct {
+	dials      int64
+	dialErrors int64
+	commands   int64
+	errors     int64
+	timeouts   int64
+	latency    histogram
+	wait       histogram
+	lastUsed   time.Time
+}
+
+type PoolStats struct {
+	Addr       string
+	Active     int
+	Idle       int
+	Dials      int64
+	DialErrors int64
+	Commands   int64
+	Errors     int64 // 不含Redis返回的错误回复
+	Timeouts   int64
+	Latency    Histogram // 命令耗时
+	Wait       Histogram // 借出连接的耗时，包括建连
+	LastUsed   time.Time
+}
+
+func isTimeout(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
+
+func (p *pool) recordDial(err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.stats.dials++
+	if err != nil {
+		p.stats.dialErrors++
+		if isTimeout(err) {
+			p.stats.timeouts++
+		}
+	}
+}
+
+func (p *pool) recordWait(d time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.stats.wait.observe(d)
+	p.stats.lastUsed = time.Now()
+}
+
+func (p *pool) recordCommand(d time.Duration, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.stats.commands++
+	p.stats.latency.observe(d)
+	if err == nil {
+		return
+	}
+	// 错误回复说明连接是好的，不计入
+	if _, ok := err.(redis.Error); ok {
+		return
+	}
+	p.stats.errors++
+	if isTimeout(err) {
+		p.stats.timeouts++
+	}
+}
+
+func (p *pool) snapshot() *PoolStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return &PoolStats{
+		Addr:       p.addr,
+		Active:     p.active,
+		Idle:       len(p.idle),
+		Dials:      p.stats.dials,
+		DialErrors: p.stats.dialErrors,
+		Commands:   p.stats.commands,
+		Errors:     p.stats.errors,
+		Timeouts:   p.stats.timeouts,
+		Latency:    p.stats.latency.snapshot(),
+		Wait:       p.stats.wait.snapshot(),
+		LastUsed:   p.stats.lastUsed,
+	}
+}
+
+// 各地址连接池的统计，按地址排序
+func (ps *Pools) Stats() []*PoolStats {
+	ps.mutex.Lock()
+	pools := make([]*pool, 0, len(ps.pools))
+	for _, p := range ps.pools {
+		pools = append(pools, p)
+	}
+	ps.mutex.Unlock()
+
+	stats := make([]*PoolStats, 0, len(pools))
+	for _, p := range pools {
+		stats = append(stats, p.snapshot())
+	}
+	sort.Sort(byAddr(stats))
+	return stats
+}
+
+type byAddr []*PoolStats
+
+func (a byAddr) Len() int           { return len(a) }
+func (a byAddr) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byAddr) Less(i, j int) bool { return a[i].Addr < a[j].Addr }
+
+// 不在集群中的地址，连接池空闲这么久之后移除
+const POOL_EVICT_IDLE = 5 * time.Minute
+
+// 移除默认连接池中不在keep里的地址，返回被移除的地址
+func EvictPools(keep []string) []string {
+	ps := DefaultPools()
+	if ps == nil {
+		return nil
+	}
+	return ps.Evict(keep, POOL_EVICT_IDLE)
+}
+
+// 默认连接池的统计
+func Stats() []*PoolStats {
+	ps := DefaultPools()
+	if ps == nil {
+		return []*PoolStats{}
+	}
+	return ps.Stats()
+}
@@ -1,24 +1,39 @@
 package state
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sort"
+	"sync"
 	"time"
 
+	"github.com/ksarch-saas/cc/fsm"
 	"github.com/ksarch-saas/cc/log"
+	"github.com/ksarch-saas/cc/metrics"
 	"github.com/ksarch-saas/cc/redis"
 	"github.com/ksarch-saas/cc/topo"
+	"github.com/ksarch-saas/cc/utils/clock"
 )
 
 var (
 	ErrNodeNotExist = errors.New("cluster: node not exist")
 )
 
+const (
+	FETCH_OFFSET_TIMEOUT = 10 * time.Second
+	FAILOVER_TIMEOUT     = 20 * time.Minute
+)
+
 type ClusterState struct {
 	version    int64                 // 更新消息处理次数
 	cluster    *topo.Cluster         // 集群拓扑快照
 	nodeStates map[string]*NodeState // 节点状态机
+
+	repairMu      sync.Mutex
+	repairReports []*RepairReport // 最近的Failover后修复报告
+
+	tasks sync.WaitGroup // 后台执行的Failover任务
 }
 
 func NewClusterState() *ClusterState {
@@ -35,7 +50,7 @@ func (cs *ClusterState) AllNodeStates() map[string]*NodeState {
 
 func (cs *ClusterState) UpdateRegionNodes(region string, nodes []*topo.Node) {
 	cs.version++
-	now := time.Now()
+	now := clock.Now()
 
 	log.Verbosef("CLUSTER", "Update region %s %d nodes", region, len(nodes))
 
@@ -61,6 +76,9 @@ func (cs *ClusterState) UpdateRegionNodes(region string, nodes []*topo.Node) {
 			}
 			nodeState.node = n
 		}
+		if !n.Fail && n.ReplOffset > 0 {
+			nodeState.replOffset = n.ReplOffset
+		}
 		nodeState.updateTime = now
 	}
 
@@ -111,6 +129,15 @@ func (cs *ClusterState) FindNodeState(nodeId string) *NodeState {
 	return cs.nodeStates[nodeId]
 }
 
+// 节点的状态转换记录
+func (cs *ClusterState) NodeHistory(nodeId string) ([]fsm.TransitionRecord, error) {
+	ns := cs.FindNodeState(nodeId)
+	if ns == nil {
+		return nil, ErrNodeNotExist
+	}
+	return ns.History(), nil
+}
+
 func (cs *ClusterState) DebugDump() {
 	var keys []string
 	for k := range cs.nodeStates {
@@ -169,8 +196,8 @@ type reploff struct {
 }
 
 // 失败返回-1
-func fetchReplOffset(addr string) int64 {
-	info, err := redis.FetchInfo(addr, "Replication")
+func fetchReplOffset(ctx context.Context, addr string) int64 {
+	info, err := redis.Default().FetchInfo(ctx, addr, "Replication")
 	if err != nil {
 		return -1
 	}
@@ -193,10 +220,12 @@ func fetchReplOffset(addr string) int64 {
 func (cs *ClusterState) FetchReplOffsetInReplicaSet(rs *topo.ReplicaSet) map[string]int64 {
 	nodes := rs.AllNodes()
 	c := make(chan reploff, len(nodes))
+	ctx, cancel := context.WithTimeout(context.Background(), FETCH_OFFSET_TIMEOUT)
+	defer cancel()
 
 	for _, node := range nodes {
 		go func(id, addr string) {
-			offset := fetchReplOffset(addr)
+			offset := fetchReplOffset(ctx, addr)
 			c <- reploff{id, offset}
 		}(node.Id, node.Addr())
 	}
@@ -209,6 +238,19 @@ func (cs *ClusterState) FetchReplOffsetInReplicaSet(rs *topo.ReplicaSet) map[str
 	return rmap
 }
 
+// 在后台执行任务，WaitTasks等待所有任务结束
+func (cs *ClusterState) runTask(task func()) {
+	cs.tasks.Add(1)
+	go func() {
+		defer cs.tasks.Done()
+		task()
+	}()
+}
+
+func (cs *ClusterState) WaitTasks() {
+	cs.tasks.Wait()
+}
+
 func (cs *ClusterState) RunFailoverTask(oldMasterId, newMasterId string) {
 	new := cs.FindNodeState(newMasterId)
 	old := cs.FindNodeState(oldMasterId)
@@ -223,24 +265,24 @@ func (cs *ClusterState) RunFailoverTask(oldMasterId, newMasterId string) {
 		return
 	}
 
-	// 通过新主广播消息
-	redis.DisableRead(new.Addr(), old.Id())
-	redis.DisableWrite(new.Addr(), old.Id())
-
-	c := make(chan error, 1)
-	go func() {
-		c <- redis.SetAsMasterWaitSyncDone(new.Addr(), true)
-	}()
+	rc := redis.Default()
+	ctx := context.Background()
+	start := clock.Now()
 
-	select {
-	case err := <-c:
-		if err != nil {
-			log.Eventf(old.Addr(), "Failover request done with error(%v).", err)
-		} else {
-			log.Eventf(old.Addr(), "Failover request done, new master %s(%s).", new.Id(), new.Addr())
-		}
-	case <-time.After(20 * time.Minute):
+	// 通过新主广播消息
+	rc.DisableRead(ctx, new.Addr(), old.Id())
+	rc.DisableWrite(ctx, new.Addr(), old.Id())
+
+	failoverCtx, cancel := context.WithTimeout(ctx, FAILOVER_TIMEOUT)
+	err := rc.SetAsMasterWaitSyncDone(failoverCtx, new.Addr(), true)
+	cancel()
+	switch {
+	case err == context.DeadlineExceeded:
 		log.Eventf(old.Addr(), "Failover timedout, new master %s(%s)", new.Id(), new.Addr())
+	case err != nil:
+		log.Eventf(old.Addr(), "Failover request done with error(%v).", err)
+	default:
+		log.Eventf(old.Addr(), "Failover request done, new master %s(%s).", new.Id(), new.Addr())
 	}
 
 	// 重新读取一次，因为可能已经更新了
@@ -250,7 +292,7 @@ func (cs *ClusterState) RunFailoverTask(oldMasterId, newMasterId string) {
 		roleChanged = true
 	} else {
 		for i := 0; i < 10; i++ {
-			info, err := redis.FetchInfo(node.Addr(), "Replication")
+			info, err := rc.FetchInfo(ctx, node.Addr(), "Replication")
 			if err == nil && info.Get("role") == "master" {
 				roleChanged = true
 				break
@@ -258,22 +300,16 @@ func (cs *ClusterState) RunFailoverTask(oldMasterId, newMasterId string) {
 			log.Warningf(old.Addr(),
 				"Role of new master %s(%s) has not yet changed, will check 5 seconds later.",
 				new.Id(), new.Addr())
-			time.Sleep(5 * time.Second)
+			clock.Sleep(5 * time.Second)
 		}
 	}
 
+	metrics.FailoverDuration.Observe(clock.Since(start).Seconds())
 	if roleChanged {
+		metrics.FailoverTotal.Inc("master", "success")
 		log.Eventf(old.Addr(), "New master %s(%s) role change success", node.Id, node.Addr())
-		// 处理迁移过程中的异常问题，将故障节点（旧主）的slots转移到新主上
-		oldNode := cs.FindNode(oldMasterId)
-		if oldNode != nil && oldNode.Fail && oldNode.IsMaster() && len(oldNode.Ranges) != 0 {
-			log.Warningf(old.Addr(),
-				"Some node carries slots info(%v) about the old master, waiting for MigrateManager to fix it.",
-				oldNode.Ranges)
-		} else {
-			log.Info(old.Addr(), "Good, no slot need to be fix after failover.")
-		}
 	} else {
+		metrics.FailoverTotal.Inc("master", "failed")
 		log.Warningf(old.Addr(), "Failover failed, please check cluster state.")
 		log.Warningf(old.Addr(), "The dead master will goto OFFLINE state and then goto WAIT_FAILOVER_BEGIN state to try failover again.")
 	}
@@ -282,5 +318,13 @@ func (cs *ClusterState) RunFailoverTask(oldMasterId, newMasterId string) {
 
 	// 打开新主的写入，因为给slave加Write没有效果
 	// 所以即便Failover失败，也不会产生错误
-	redis.EnableWrite(new.Addr(), new.Id())
+	rc.EnableWrite(ctx, new.Addr(), new.Id())
+
+	// 新主开放写入后再修正分片内的复制关系、残留的旧主slots和从节点读权限
+	if roleChanged {
+		report := cs.RepairAfterFailover(oldMasterId, newMasterId)
+		if report.NumChanged() == 0 {
+			log.Info(old.Addr(), "Good, nothing need to be fixed after failover.")
+		}
+	}
 }
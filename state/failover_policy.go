@@ -0,0 +1,308 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ksarch-saas/cc/log"
+	"github.com/ksarch-saas/cc/meta"
+	"github.com/ksarch-saas/cc/topo"
+	"github.com/ksarch-saas/cc/utils/clock"
+)
+
+/// Failover策略
+/// 主挂掉后，从分片内主地域的从节点中选择新主，选择方式由AppConfig.FailoverPolicy指定:
+/// maxoffset    复制偏移量最大的节点（默认）
+/// zone         优先选择与AppConfig.FailoverPreferredZone（为空时取旧主）相同zone/room的节点
+/// leastloaded  优先选择所在机器上Master最少的节点
+/// priority     按节点Tag中priority属性选择，值越小越优先，未设置的排在最后
+/// 除maxoffset外，条件相同时都按复制偏移量选择
+/// 配置了MaxFailoverLagBytes时，只在复制延迟不超过阈值的从节点中选择，
+/// 延迟相对于分片内最大的偏移量计算，包括主挂掉前最后一次看到的偏移量
+
+var (
+	ErrNoFailoverCandidate = errors.New("cluster: no slave can be used for failover")
+	ErrFailoverLagTooLarge = errors.New("cluster: all slaves lag behind too much for failover")
+)
+
+const (
+	DEFAULT_FAILOVER_POLICY = "maxoffset"
+	LAG_ALERT_INTERVAL      = time.Minute      // 同一节点复制延迟告警的最小间隔
+	LAG_RECHECK_INTERVAL    = 10 * time.Second // 因复制延迟拒绝后，再次访问Redis检查的最小间隔
+	BUDGET_ALERT_INTERVAL   = time.Minute      // 同一节点因Failover预算拒绝的告警最小间隔
+)
+
+type FailoverCandidate struct {
+	Node   *topo.Node
+	Offset int64
+	Lag    int64 // 落后分片内最大偏移量的字节数
+}
+
+type FailoverPolicy interface {
+	Name() string
+	// 从candidates中选出新主，并返回原因，candidates不为空
+	Choose(cs *ClusterState, master *topo.Node, candidates []*FailoverCandidate) (*FailoverCandidate, string)
+}
+
+var failoverPolicies = map[string]FailoverPolicy{}
+
+func RegisterFailoverPolicy(policy FailoverPolicy) {
+	failoverPolicies[policy.Name()] = policy
+}
+
+func init() {
+	RegisterFailoverPolicy(&MaxOffsetPolicy{})
+	RegisterFailoverPolicy(&PreferredZonePolicy{})
+	RegisterFailoverPolicy(&LeastLoadedPolicy{})
+	RegisterFailoverPolicy(&PriorityPolicy{})
+}
+
+// 未知的策略使用默认策略
+func GetFailoverPolicy(name string) FailoverPolicy {
+	if policy, ok := failoverPolicies[name]; ok {
+		return policy
+	}
+	if name != "" {
+		log.Warningf("CLUSTER", "Unknown failover policy %s, use %s", name, DEFAULT_FAILOVER_POLICY)
+	}
+	return failoverPolicies[DEFAULT_FAILOVER_POLICY]
+}
+
+// 按score选择，score越小越好，相同时选复制偏移量大的
+func chooseByScore(candidates []*FailoverCandidate, score func(*FailoverCandidate) int) (*FailoverCandidate, int) {
+	var best *FailoverCandidate
+	bestScore := 0
+	for _, c := range candidates {
+		s := score(c)
+		if best == nil || s < bestScore || (s == bestScore && c.Offset > best.Offset) {
+			best = c
+			bestScore = s
+		}
+	}
+	return best, bestScore
+}
+
+type MaxOffsetPolicy struct{}
+
+func (p *MaxOffsetPolicy) Name() string {
+	return "maxoffset"
+}
+
+func (p *MaxOffsetPolicy) Choose(cs *ClusterState, master *topo.Node, candidates []*FailoverCandidate) (*FailoverCandidate, string) {
+	best, _ := chooseByScore(candidates, func(c *FailoverCandidate) int { return 0 })
+	return best, fmt.Sprintf("max repl offset %d", best.Offset)
+}
+
+type PreferredZonePolicy struct{}
+
+func (p *PreferredZonePolicy) Name() string {
+	return "zone"
+}
+
+func (p *PreferredZonePolicy) Choose(cs *ClusterState, master *topo.Node, candidates []*FailoverCandidate) (*FailoverCandidate, string) {
+	zone, room := master.Zone, master.Room
+	if app := meta.GetAppConfig(); app.FailoverPreferredZone != "" {
+		zone, room = splitZoneRoom(app.FailoverPreferredZone)
+	}
+	best, score := chooseByScore(candidates, func(c *FailoverCandidate) int {
+		if c.Node.Zone != zone {
+			return 2
+		}
+		if room != "" && c.Node.Room != room {
+			return 1
+		}
+		return 0
+	})
+	switch score {
+	case 0:
+		return best, fmt.Sprintf("in preferred zone %s room %s, repl offset %d", zone, room, best.Offset)
+	case 1:
+		return best, fmt.Sprintf("in preferred zone %s, repl offset %d", zone, best.Offset)
+	}
+	return best, fmt.Sprintf("no slave in preferred zone %s, max repl offset %d", zone, best.Offset)
+}
+
+// zone或zone:room
+func splitZoneRoom(s string) (string, string) {
+	xs := strings.SplitN(s, ":", 2)
+	if len(xs) == 2 {
+		return xs[0], xs[1]
+	}
+	return xs[0], ""
+}
+
+type LeastLoadedPolicy struct{}
+
+func (p *LeastLoadedPolicy) Name() string {
+	return "leastloaded"
+}
+
+func (p *LeastLoadedPolicy) Choose(cs *ClusterState, master *topo.Node, candidates []*FailoverCandidate) (*FailoverCandidate, string) {
+	// 统计每台机器上存活的Master数
+	masters := map[string]int{}
+	for _, ns := range cs.AllNodeStates() {
+		node := ns.node
+		if node.IsMaster() && !node.Fail && !node.Free {
+			masters[node.Ip]++
+		}
+	}
+	best, score := chooseByScore(candidates, func(c *FailoverCandidate) int {
+		return masters[c.Node.Ip]
+	})
+	return best, fmt.Sprintf("%d masters on host %s, repl offset %d", score, best.Node.Ip, best.Offset)
+}
+
+type PriorityPolicy struct{}
+
+func (p *PriorityPolicy) Name() string {
+	return "priority"
+}
+
+// 未设置priority的节点排在最后
+const lowestPriority = math.MaxInt32
+
+func nodePriority(node *topo.Node) int {
+	n, err := strconv.Atoi(node.TagAttr("priority"))
+	if err != nil {
+		return lowestPriority
+	}
+	return n
+}
+
+func (p *PriorityPolicy) Choose(cs *ClusterState, master *topo.Node, candidates []*FailoverCandidate) (*FailoverCandidate, string) {
+	best, score := chooseByScore(candidates, func(c *FailoverCandidate) int {
+		return nodePriority(c.Node)
+	})
+	if score == lowestPriority {
+		return best, fmt.Sprintf("no priority set, max repl offset %d", best.Offset)
+	}
+	return best, fmt.Sprintf("priority %d, repl offset %d", score, best.Offset)
+}
+
+// 收集分片内指定地域中可用的从节点，获取不到复制偏移量的节点不参与选择
+func (cs *ClusterState) failoverCandidates(rs *topo.ReplicaSet, region string) []*FailoverCandidate {
+	rmap := cs.FetchReplOffsetInReplicaSet(rs)
+
+	// 主已经挂了，参考偏移量取主最后一次看到的偏移量和各节点的最大值
+	var maxOffset int64
+	if ns := cs.FindNodeState(rs.Master.Id); ns != nil {
+		maxOffset = ns.replOffset
+	}
+	for _, offset := range rmap {
+		if offset > maxOffset {
+			maxOffset = offset
+		}
+	}
+
+	candidates := []*FailoverCandidate{}
+	for id, offset := range rmap {
+		node := cs.FindNode(id)
+		if node == nil || node.IsMaster() || node.Region != region || offset < 0 {
+			continue
+		}
+		candidates = append(candidates, &FailoverCandidate{node, offset, maxOffset - offset})
+	}
+	return candidates
+}
+
+// 复制延迟不超过maxLag的候选节点，maxLag为0时不过滤
+func withinLag(candidates []*FailoverCandidate, maxLag int64) []*FailoverCandidate {
+	if maxLag <= 0 {
+		return candidates
+	}
+	result := []*FailoverCandidate{}
+	for _, c := range candidates {
+		if c.Lag <= maxLag {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// 自动Failover前检查是否有复制延迟满足要求的从节点，不满足时返回原因
+func (cs *ClusterState) CheckFailoverLag(nodeId string, region string) (bool, string) {
+	maxLag := meta.GetAppConfig().MaxFailoverLagBytes
+	if maxLag <= 0 {
+		return true, ""
+	}
+	rs := cs.FindReplicaSetByNode(nodeId)
+	if rs == nil {
+		return false, "can not find replicaset"
+	}
+	candidates := cs.failoverCandidates(rs, region)
+	if len(candidates) == 0 {
+		return false, ErrNoFailoverCandidate.Error()
+	}
+	if len(withinLag(candidates, maxLag)) > 0 {
+		return true, ""
+	}
+	minLag := candidates[0].Lag
+	for _, c := range candidates {
+		if c.Lag < minLag {
+			minLag = c.Lag
+		}
+	}
+	return false, fmt.Sprintf("%d slaves in %s, min repl lag %d bytes > MaxFailoverLagBytes %d",
+		len(candidates), region, minLag, maxLag)
+}
+
+// 自动Failover前检查复制延迟，拒绝后LAG_RECHECK_INTERVAL内沿用结果，不再每次都访问Redis
+func (ns *NodeState) checkFailoverLag(cs *ClusterState) bool {
+	if clock.Since(ns.lagRefusedAt) < LAG_RECHECK_INTERVAL {
+		return false
+	}
+	ok, reason := cs.CheckFailoverLag(ns.Id(), meta.MasterRegion())
+	if ok {
+		return true
+	}
+	ns.lagRefusedAt = clock.Now()
+	ns.alertFailoverLag(reason)
+	return false
+}
+
+// 拒绝自动Failover时发出告警事件，同一节点LAG_ALERT_INTERVAL内只发一次
+func (ns *NodeState) alertFailoverLag(reason string) {
+	if clock.Since(ns.lagAlertAt) < LAG_ALERT_INTERVAL {
+		return
+	}
+	ns.lagAlertAt = clock.Now()
+	log.Eventf(ns.Addr(), "Refuse auto failover, %s", reason)
+}
+
+// 预算耗尽时每个tick都会拒绝，同一节点BUDGET_ALERT_INTERVAL内只发一次事件
+func (ns *NodeState) alertFailoverBudget(err error) {
+	if clock.Since(ns.budgetAlertAt) < BUDGET_ALERT_INTERVAL {
+		log.Warningf(ns.Addr(), "Refuse auto failover, %v", err)
+		return
+	}
+	ns.budgetAlertAt = clock.Now()
+	log.Eventf(ns.Addr(), "Refuse auto failover, %v", err)
+}
+
+// 按App配置的策略选择新主
+func (cs *ClusterState) ChooseNewMaster(nodeId string, region string) (string, error) {
+	master := cs.FindNode(nodeId)
+	rs := cs.FindReplicaSetByNode(nodeId)
+	if master == nil || rs == nil {
+		return "", ErrNodeNotExist
+	}
+	candidates := cs.failoverCandidates(rs, region)
+	if len(candidates) == 0 {
+		return "", ErrNoFailoverCandidate
+	}
+	// 自动Failover已经检查过延迟，这里只会是手动触发的，没有满足的节点时从所有节点中选择
+	if ok := withinLag(candidates, meta.GetAppConfig().MaxFailoverLagBytes); len(ok) > 0 {
+		candidates = ok
+	} else {
+		log.Warningf(master.Addr(), "No slave within MaxFailoverLagBytes, choose from all %d slaves", len(candidates))
+	}
+	policy := GetFailoverPolicy(meta.GetAppConfig().FailoverPolicy)
+	best, reason := policy.Choose(cs, master, candidates)
+	log.Eventf(master.Addr(), "Failover policy %s choose %s(%s) from %d candidates, %s",
+		policy.Name(), best.Node.Id, best.Node.Addr(), len(candidates), reason)
+	return best.Node.Id, nil
+}
@@ -11,11 +11,15 @@ import (
 )
 
 type NodeState struct {
-	node       *topo.Node        // 节点静态信息
-	updateTime time.Time         // 最近一次更新时间
-	version    int64             // 更新次数
-	fsm        *fsm.StateMachine // 节点状态机
-	mutex      *sync.Mutex
+	node          *topo.Node        // 节点静态信息
+	updateTime    time.Time         // 最近一次更新时间
+	version       int64             // 更新次数
+	fsm           *fsm.StateMachine // 节点状态机
+	mutex         *sync.Mutex
+	replOffset    int64     // 节点存活时最后一次看到的复制偏移量
+	lagAlertAt    time.Time // 最近一次因复制延迟拒绝Failover的告警时间
+	lagRefusedAt  time.Time // 最近一次检查复制延迟并拒绝Failover的时间
+	budgetAlertAt time.Time // 最近一次因Failover预算拒绝Failover的告警时间
 }
 
 func NewNodeState(node *topo.Node, version int64) *NodeState {
@@ -56,6 +60,10 @@ func (ns *NodeState) CurrentState() string {
 	return ns.fsm.CurrentState()
 }
 
+func (ns *NodeState) History() []fsm.TransitionRecord {
+	return ns.fsm.History()
+}
+
 func (ns *NodeState) Node() *topo.Node {
 	return ns.node
 }
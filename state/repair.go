@@ -0,0 +1,265 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ksarch-saas/cc/log"
+	"github.com/ksarch-saas/cc/meta"
+	"github.com/ksarch-saas/cc/redis"
+	"github.com/ksarch-saas/cc/topo"
+	"github.com/ksarch-saas/cc/utils/clock"
+)
+
+/// Failover后的拓扑修复，新主角色切换成功后执行：
+/// 1. 分片内（包括其他地域）没有直接复制新主的从节点，重新挂到新主下，
+///    已恢复的旧主如果仍是主或者挂在别的节点下，也挂到新主下
+/// 2. 仍认为旧主持有slots的节点，把这些slots设置到新主
+/// 3. 开启AutoEnableSlaveRead时，复制正常但不可读的从节点打开读，旧主除外
+/// 复制关系和slots以节点实时返回的信息为准，不依赖可能过期的拓扑快照
+
+const (
+	REPAIR_REPLICATE   = "replicate"
+	REPAIR_SETSLOT     = "setslot"
+	REPAIR_ENABLE_READ = "enableread"
+	REPAIR_SKIP        = "skip"
+
+	MAX_REPAIR_REPORTS = 16
+	REPAIR_TIMEOUT     = 2 * time.Minute
+)
+
+type RepairAction struct {
+	NodeId string
+	Addr   string
+	Action string
+	Detail string
+	Error  string `json:",omitempty"`
+}
+
+type RepairReport struct {
+	OldMasterId string
+	NewMasterId string
+	StartTime   time.Time
+	EndTime     time.Time
+	Actions     []*RepairAction
+}
+
+func (r *RepairReport) add(node *topo.Node, action, detail string, err error) {
+	a := &RepairAction{NodeId: node.Id, Addr: node.Addr(), Action: action, Detail: detail}
+	if err != nil {
+		a.Error = err.Error()
+		log.Warningf(node.Addr(), "Repair after failover, %s %s failed, %v", action, detail, err)
+	} else if action != REPAIR_SKIP {
+		log.Eventf(node.Addr(), "Repair after failover, %s %s", action, detail)
+	}
+	r.Actions = append(r.Actions, a)
+}
+
+// 修改过拓扑的操作数，不含跳过和失败的
+func (r *RepairReport) NumChanged() int {
+	n := 0
+	for _, a := range r.Actions {
+		if a.Action != REPAIR_SKIP && a.Error == "" {
+			n++
+		}
+	}
+	return n
+}
+
+// 分片成员：新主、旧主，以及复制关系上挂在它们下面的所有节点（包括级联的）
+func (cs *ClusterState) replicaSetMembers(oldMasterId, newMasterId string) []*topo.Node {
+	members := map[string]*topo.Node{}
+	for _, id := range []string{oldMasterId, newMasterId} {
+		if n := cs.FindNode(id); n != nil {
+			members[id] = n
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for id, ns := range cs.AllNodeStates() {
+			if _, ok := members[id]; ok {
+				continue
+			}
+			if _, ok := members[ns.node.ParentId]; ok {
+				members[id] = ns.node
+				changed = true
+			}
+		}
+	}
+	nodes := []*topo.Node{}
+	for _, n := range members {
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+// 解析CLUSTER NODES EXTRA，返回各节点的一行，按节点ID索引
+func parseClusterNodesExtra(resp string) map[string][]string {
+	lines := map[string][]string{}
+	for _, line := range strings.Split(resp, "\n") {
+		xs := strings.Split(strings.TrimSpace(line), " ")
+		if len(xs) < 10 {
+			continue
+		}
+		lines[xs[2]] = xs
+	}
+	return lines
+}
+
+// 一行中的slots，忽略迁移中的[slot->-id]和[slot-<-id]
+func slotsOfLine(xs []string) []int {
+	slots := []int{}
+	for _, word := range xs[10:] {
+		if word == "" || strings.HasPrefix(word, "[") {
+			continue
+		}
+		bounds := strings.Split(word, "-")
+		left, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			continue
+		}
+		right := left
+		if len(bounds) == 2 {
+			right, err = strconv.Atoi(bounds[1])
+			if err != nil {
+				continue
+			}
+		}
+		for i := left; i <= right; i++ {
+			slots = append(slots, i)
+		}
+	}
+	return slots
+}
+
+func (cs *ClusterState) RepairAfterFailover(oldMasterId, newMasterId string) *RepairReport {
+	report := &RepairReport{
+		OldMasterId: oldMasterId,
+		NewMasterId: newMasterId,
+		StartTime:   clock.Now(),
+	}
+	defer func() {
+		report.EndTime = clock.Now()
+		cs.addRepairReport(report)
+	}()
+
+	newMaster := cs.FindNode(newMasterId)
+	if newMaster == nil {
+		log.Warningf(oldMasterId, "Repair after failover, new master %s lost", newMasterId)
+		return report
+	}
+
+	rc := redis.Default()
+	ctx, cancel := context.WithTimeout(context.Background(), REPAIR_TIMEOUT)
+	defer cancel()
+
+	// 以新主看到的视图为准判断读权限
+	var view map[string][]string
+	resp, err := rc.ClusterNodes(ctx, newMaster.Addr())
+	if err != nil {
+		log.Warningf(newMaster.Addr(), "Repair after failover, fetch cluster nodes failed, %v", err)
+	} else {
+		view = parseClusterNodesExtra(resp)
+	}
+
+	for _, node := range cs.replicaSetMembers(oldMasterId, newMasterId) {
+		if node.Id == newMasterId {
+			continue
+		}
+		if node.Fail {
+			report.add(node, REPAIR_SKIP, "node is down", nil)
+			continue
+		}
+		info, err := rc.FetchInfo(ctx, node.Addr(), "Replication")
+		if err != nil {
+			report.add(node, REPAIR_REPLICATE, "fetch replication info", err)
+			continue
+		}
+		role := info.Get("role")
+		parentAddr := net.JoinHostPort(info.Get("master_host"), info.Get("master_port"))
+		if role == "master" && node.Id != oldMasterId {
+			report.add(node, REPAIR_SKIP, "node is master", nil)
+			continue
+		}
+		if role == "master" || parentAddr != newMaster.Addr() {
+			from := "master"
+			if role != "master" {
+				from = parentAddr
+			}
+			_, err = rc.ClusterReplicate(ctx, node.Addr(), newMasterId)
+			report.add(node, REPAIR_REPLICATE, fmt.Sprintf("%s -> %s", from, newMaster.Addr()), err)
+			continue
+		}
+		// 复制关系正确，同步完成后恢复读；旧主的读在Failover时被关闭，
+		// 与UpdateRegion一样遵循AutoEnableSlaveRead，由它在旧主恢复后处理
+		if node.Id == oldMasterId || !meta.GetAppConfig().AutoEnableSlaveRead {
+			continue
+		}
+		xs, ok := view[node.Id]
+		if ok && xs[0][0] != 'r' && info.Get("master_link_status") == "up" {
+			_, err = rc.EnableRead(ctx, newMaster.Addr(), node.Id)
+			report.add(node, REPAIR_ENABLE_READ, "link up", err)
+		}
+	}
+
+	cs.repairStaleSlots(ctx, rc, report, oldMasterId, newMasterId)
+
+	log.Eventf(newMaster.Addr(), "Repair after failover done, old master %s, %d changes, %d actions",
+		oldMasterId, report.NumChanged(), len(report.Actions))
+	return report
+}
+
+// 集群内各存活节点上，仍属于旧主的slots设置到新主
+func (cs *ClusterState) repairStaleSlots(ctx context.Context, rc redis.Client, report *RepairReport, oldMasterId, newMasterId string) {
+	for _, ns := range cs.AllNodeStates() {
+		node := ns.node
+		if node.Fail || node.Id == oldMasterId {
+			continue
+		}
+		resp, err := rc.ClusterNodes(ctx, node.Addr())
+		if err != nil {
+			report.add(node, REPAIR_SETSLOT, "fetch cluster nodes", err)
+			continue
+		}
+		xs, ok := parseClusterNodesExtra(resp)[oldMasterId]
+		if !ok {
+			continue
+		}
+		slots := slotsOfLine(xs)
+		if len(slots) == 0 {
+			continue
+		}
+		for _, slot := range slots {
+			err = rc.SetSlot(ctx, node.Addr(), slot, redis.SLOT_NODE, newMasterId)
+			if err != nil {
+				break
+			}
+		}
+		report.add(node, REPAIR_SETSLOT,
+			fmt.Sprintf("%d slots(%s) of %s -> %s", len(slots), strings.Join(xs[10:], " "), oldMasterId, newMasterId), err)
+	}
+}
+
+func (cs *ClusterState) addRepairReport(report *RepairReport) {
+	cs.repairMu.Lock()
+	defer cs.repairMu.Unlock()
+	cs.repairReports = append(cs.repairReports, report)
+	if len(cs.repairReports) > MAX_REPAIR_REPORTS {
+		cs.repairReports = cs.repairReports[len(cs.repairReports)-MAX_REPAIR_REPORTS:]
+	}
+}
+
+// 最近的修复报告，从新到旧
+func (cs *ClusterState) RepairReports() []*RepairReport {
+	cs.repairMu.Lock()
+	defer cs.repairMu.Unlock()
+	reports := make([]*RepairReport, 0, len(cs.repairReports))
+	for i := len(cs.repairReports) - 1; i >= 0; i-- {
+		reports = append(reports, cs.repairReports[i])
+	}
+	return reports
+}
@@ -2,6 +2,7 @@ package state
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/ksarch-saas/cc/fsm"
 )
@@ -92,3 +93,42 @@ func (s Input) String() string {
 	)
 	return str
 }
+
+var inputFieldNames = map[string]InputField{
+	"T":    T,
+	"F":    F,
+	"FAIL": FAIL,
+	"FINE": FINE,
+	"S":    S,
+	"M":    M,
+	"*":    ANY,
+	"ANY":  ANY,
+}
+
+// 解析String()的输出格式，如：(T,*,FAIL,M,*)，命令使用CmdNames中的名字
+func ParseInput(str string) (fsm.Input, error) {
+	str = strings.TrimSpace(str)
+	str = strings.TrimSuffix(strings.TrimPrefix(str, "("), ")")
+	xs := strings.Split(str, ",")
+	if len(xs) != 5 {
+		return nil, fmt.Errorf("input should have 5 fields")
+	}
+	fields := make([]InputField, 5)
+	for i, x := range xs {
+		x = strings.TrimSpace(x)
+		f, ok := inputFieldNames[x]
+		if i == 4 && x != "*" && x != "ANY" {
+			ok = false
+			for cmd, name := range CmdNames {
+				if name == x {
+					f, ok = cmd, true
+				}
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown input field %s", x)
+		}
+		fields[i] = f
+	}
+	return Input{fields[0], fields[1], fields[2], fields[3], fields[4]}, nil
+}
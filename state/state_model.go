@@ -1,12 +1,17 @@
 package state
 
 import (
-	"time"
+	"context"
+	"net"
+	"strings"
 
 	"github.com/ksarch-saas/cc/fsm"
 	"github.com/ksarch-saas/cc/log"
 	"github.com/ksarch-saas/cc/meta"
+	"github.com/ksarch-saas/cc/metrics"
 	"github.com/ksarch-saas/cc/redis"
+	"github.com/ksarch-saas/cc/topo"
+	"github.com/ksarch-saas/cc/utils/clock"
 )
 
 const (
@@ -22,6 +27,15 @@ func getNodeState(i interface{}) *NodeState {
 	return ns
 }
 
+// 节点所在机器名，反解失败时使用IP，topo.Node.Hostname()失败会panic
+func nodeHostname(node *topo.Node) string {
+	names, err := net.LookupAddr(node.Ip)
+	if err != nil || len(names) == 0 {
+		return node.Ip
+	}
+	return strings.TrimSuffix(names[0], ".")
+}
+
 var (
 	RunningState = &fsm.State{
 		Name: StateRunning,
@@ -55,7 +69,7 @@ var (
 				AppName:   meta.AppName(),
 				NodeId:    ns.Id(),
 				NodeAddr:  ns.Addr(),
-				Timestamp: time.Now(),
+				Timestamp: clock.Now(),
 				Region:    ns.Region(),
 				Tag:       ns.Tag(),
 				Role:      ns.Role(),
@@ -174,16 +188,20 @@ var (
 			return false
 		}
 		app := meta.GetAppConfig()
-		if lastTime != nil && time.Since(*lastTime) < app.AutoFailoverInterval {
+		if lastTime != nil && clock.Since(*lastTime) < app.AutoFailoverInterval {
 			log.Warningf(ns.Addr(), "Failover too soon, lastTime: %v", *lastTime)
 			return false
 		}
+		// 从节点的复制延迟，需要访问Redis所以放在最后，手动执行Failover时不检查
+		if ctx.Input.Command != CMD_FAILOVER_BEGIN_SIGNAL && !ns.checkFailoverLag(cs) {
+			return false
+		}
 
 		record := &meta.FailoverRecord{
 			AppName:   meta.AppName(),
 			NodeId:    ns.Id(),
 			NodeAddr:  ns.Addr(),
-			Timestamp: time.Now(),
+			Timestamp: clock.Now(),
 			Region:    ns.Region(),
 			Tag:       ns.Tag(),
 			Ranges:    ns.Ranges(),
@@ -193,10 +211,34 @@ var (
 			log.Warning(ns.Addr(), "Can not mark FAILOVER_DOING status")
 			return false
 		}
+		// Failover预算，在持有FAILOVER_DOING时扣除，手动执行Failover时不检查
+		if ctx.Input.Command != CMD_FAILOVER_BEGIN_SIGNAL {
+			err = meta.ConsumeFailoverBudget(meta.AppName(), nodeHostname(ns.node))
+			if err != nil {
+				ns.alertFailoverBudget(err)
+				meta.UnmarkFailoverDoing()
+				return false
+			}
+		}
 		log.Info(ns.Addr(), "Can do failover for master")
 		return true
 	}
 
+	// Master故障，进行Failover之后，故障的节点仍然被标记为master。
+	// 所以我们需要判断这个Master是否已经被处理过了。
+	// 判断依据是节点处于FAIL状态，且没有slots
+	OfflineMasterFailoverConstraint = func(i interface{}) bool {
+		ctx := i.(StateContext)
+		ns := ctx.NodeState
+
+		if ns.node.IsStandbyMaster() {
+			return false
+		}
+		log.Warningf(ns.Addr(), "Found offline non standby master, will try to failover(%v,%v).",
+			ns.Role(), ns.Ranges())
+		return true
+	}
+
 	MasterGotoOfflineConstraint = func(i interface{}) bool {
 		ctx := i.(StateContext)
 		ns := ctx.NodeState
@@ -213,16 +255,19 @@ var (
 		cs := ctx.ClusterState
 		ns := ctx.NodeState
 
+		rc := redis.Default()
 		for _, n := range cs.AllNodeStates() {
 			if n.Addr() == ns.Addr() {
 				continue
 			}
-			resp, err := redis.DisableRead(n.Addr(), ns.Id())
+			resp, err := rc.DisableRead(context.Background(), n.Addr(), ns.Id())
 			if err == nil {
 				log.Infof(ns.Addr(), "Disable read of slave: %s %s", resp, ns.Id())
-				break
+				metrics.FailoverTotal.Inc("slave", "success")
+				return
 			}
 		}
+		metrics.FailoverTotal.Inc("slave", "failed")
 	}
 
 	MasterFailoverHandler = func(i interface{}) {
@@ -231,13 +276,13 @@ var (
 		ns := ctx.NodeState
 
 		masterRegion := meta.MasterRegion()
-		masterId, err := cs.MaxReploffSlibing(ns.Id(), masterRegion, true)
+		masterId, err := cs.ChooseNewMaster(ns.Id(), masterRegion)
 		if err != nil {
-			log.Warningf(ns.Addr(), "No slave can be used for failover %s", ns.Id())
+			log.Warningf(ns.Addr(), "No slave can be used for failover %s, %v", ns.Id(), err)
 			// 放到另一个线程做，避免死锁
-			go ns.AdvanceFSM(cs, CMD_FAILOVER_END_SIGNAL)
+			cs.runTask(func() { ns.AdvanceFSM(cs, CMD_FAILOVER_END_SIGNAL) })
 		} else {
-			go cs.RunFailoverTask(ns.Id(), masterId)
+			cs.runTask(func() { cs.RunFailoverTask(ns.Id(), masterId) })
 		}
 	}
 
@@ -246,12 +291,13 @@ var (
 		cs := ctx.ClusterState
 		ns := ctx.NodeState
 
+		rc := redis.Default()
 		for _, n := range cs.AllNodeStates() {
-			resp, err := redis.DisableRead(n.Addr(), ns.Id())
+			resp, err := rc.DisableRead(context.Background(), n.Addr(), ns.Id())
 			if err == nil {
 				log.Infof(ns.Addr(), "Disable read of the already dead master: %s %s", resp, ns.Id())
 			}
-			resp, err = redis.DisableWrite(n.Addr(), ns.Id())
+			resp, err = rc.DisableWrite(context.Background(), n.Addr(), ns.Id())
 			if err == nil {
 				log.Infof(ns.Addr(), "Disable read of the already dead master: %s %s", resp, ns.Id())
 				break
@@ -260,196 +306,173 @@ var (
 	}
 )
 
+/// StateModel
+/// 状态转换定义在redisNodeStateModelDef中，约束条件和Apply函数按名字注册，
+/// 加载时会检查不可达状态和同优先级下输入重叠的转换，可通过/fsm/model.dot查看
+
+const redisNodeStateModelDef = `
+name: redis-node
+initial: RUNNING
+states: [RUNNING, WAIT_FAILOVER_BEGIN, WAIT_FAILOVER_END, OFFLINE]
+transitions:
+  ## State: (Running)
+
+  # (a0) Running封禁了，进入Offline状态
+  - name: a0
+    from: RUNNING
+    to: OFFLINE
+    input: (F,F,*,*,*)
+    priority: 0
+
+  # (a1) 节点挂了，且未封禁
+  - name: a1
+    from: RUNNING
+    to: WAIT_FAILOVER_BEGIN
+    input: (T,*,FAIL,*,*)
+    priority: 0
+
+  # (a2) 节点挂了，且未封禁
+  - name: a2
+    from: RUNNING
+    to: WAIT_FAILOVER_BEGIN
+    input: (*,T,FAIL,*,*)
+    priority: 0
+
+  # (a3) 节点挂了，从，且未封禁，且可以自动进行Failover
+  - name: a3
+    from: RUNNING
+    to: WAIT_FAILOVER_END
+    input: (T,*,FAIL,S,*)
+    priority: 1
+    constraint: SlaveAutoFailoverConstraint
+    apply: SlaveFailoverHandler
+
+  # (a4) 节点挂了，主，未封禁，且可以自动进行Failover
+  - name: a4
+    from: RUNNING
+    to: WAIT_FAILOVER_END
+    input: (T,T,FAIL,M,*)
+    priority: 1
+    constraint: MasterAutoFailoverConstraint
+    apply: MasterFailoverHandler
+
+  ## State: (WaitFailoverBegin)
+
+  # (b0) 节点恢复了
+  - name: b0
+    from: WAIT_FAILOVER_BEGIN
+    to: RUNNING
+    input: (*,*,FINE,*,*)
+    priority: 0
+
+  # (b10) 主节点，Autofailover或手动继续执行Failover
+  - name: b10
+    from: WAIT_FAILOVER_BEGIN
+    to: WAIT_FAILOVER_END
+    input: (*,*,FAIL,M,*)
+    priority: 0
+    constraint: MasterAutoFailoverConstraint
+    apply: MasterFailoverHandler
+
+  # (b11) 主节点，已经处理过了
+  - name: b11
+    from: WAIT_FAILOVER_BEGIN
+    to: OFFLINE
+    input: (*,*,FAIL,M,*)
+    priority: 0
+    constraint: MasterGotoOfflineConstraint
+    apply: MasterGotoOfflineHandler
+
+  # (b2) 从节点，AutoFailover或手动继续执行Failover
+  - name: b2
+    from: WAIT_FAILOVER_BEGIN
+    to: WAIT_FAILOVER_END
+    input: (*,*,FAIL,S,*)
+    priority: 0
+    constraint: SlaveAutoFailoverConstraint
+    apply: SlaveFailoverHandler
+
+  # (b3) 从节点，已经处于封禁状态，转到OFFLINE
+  - name: b3
+    from: WAIT_FAILOVER_BEGIN
+    to: OFFLINE
+    input: (F,F,FAIL,S,*)
+    priority: 1
+
+  ## State: (WaitFailoverEnd)
+
+  # (c0) 等待Failover执行结束信号
+  - name: c0
+    from: WAIT_FAILOVER_END
+    to: OFFLINE
+    input: (*,*,*,*,FAILOVER_END_SIGNAL)
+    priority: 0
+
+  # (c1) 从挂了，且已经封禁
+  - name: c1
+    from: WAIT_FAILOVER_END
+    to: OFFLINE
+    input: (F,F,FAIL,S,*)
+    priority: 1
+
+  # (c2) 从在Failover过程中恢复了，结束FailoverEnd状态
+  - name: c2
+    from: WAIT_FAILOVER_END
+    to: OFFLINE
+    input: (*,*,FINE,S,*)
+    priority: 0
+
+  ## State: (Offline)
+
+  # (d0) 节点恢复读标记
+  - name: d0
+    from: OFFLINE
+    to: RUNNING
+    input: (T,*,*,*,*)
+    priority: 0
+
+  # (d1) 节点恢复写标记
+  - name: d1
+    from: OFFLINE
+    to: RUNNING
+    input: (*,T,*,*,*)
+    priority: 0
+
+  # (d2) 是主节，且挂了，需要进行Failover
+  - name: d2
+    from: OFFLINE
+    to: WAIT_FAILOVER_BEGIN
+    input: (F,F,FAIL,M,*)
+    priority: 0
+    constraint: OfflineMasterFailoverConstraint
+`
+
 var (
-	RedisNodeStateModel = fsm.NewStateModel()
+	RedisNodeStateModel *fsm.StateModel
 )
 
 func init() {
-	RedisNodeStateModel.AddState(RunningState)
-	RedisNodeStateModel.AddState(WaitFailoverBeginState)
-	RedisNodeStateModel.AddState(WaitFailoverEndState)
-	RedisNodeStateModel.AddState(OfflineState)
-
-	/// State: (WaitFailoverRunning)
-
-	// (a0) Running封禁了，进入Offline状态
-	RedisNodeStateModel.AddTransition(&fsm.Transition{
-		From:       StateRunning,
-		To:         StateOffline,
-		Input:      Input{F, F, ANY, ANY, ANY},
-		Priority:   0,
-		Constraint: nil,
-		Apply:      nil,
-	})
-
-	// (a1) 节点挂了，且未封禁
-	RedisNodeStateModel.AddTransition(&fsm.Transition{
-		From:       StateRunning,
-		To:         StateWaitFailoverBegin,
-		Input:      Input{T, ANY, FAIL, ANY, ANY},
-		Priority:   0,
-		Constraint: nil,
-		Apply:      nil,
-	})
-
-	// (a2) 节点挂了，且未封禁
-	RedisNodeStateModel.AddTransition(&fsm.Transition{
-		From:       StateRunning,
-		To:         StateWaitFailoverBegin,
-		Input:      Input{ANY, T, FAIL, ANY, ANY},
-		Priority:   0,
-		Constraint: nil,
-		Apply:      nil,
-	})
-
-	// (a3) 节点挂了，从，且未封禁，且可以自动进行Failover
-	RedisNodeStateModel.AddTransition(&fsm.Transition{
-		From:       StateRunning,
-		To:         StateWaitFailoverEnd,
-		Input:      Input{T, ANY, FAIL, S, ANY},
-		Priority:   1,
-		Constraint: SlaveAutoFailoverConstraint,
-		Apply:      SlaveFailoverHandler,
-	})
-
-	// (a4) 节点挂了，主，未封禁，且可以自动进行Failover
-	RedisNodeStateModel.AddTransition(&fsm.Transition{
-		From:       StateRunning,
-		To:         StateWaitFailoverEnd,
-		Input:      Input{T, T, FAIL, M, ANY},
-		Priority:   1,
-		Constraint: MasterAutoFailoverConstraint,
-		Apply:      MasterFailoverHandler,
-	})
-
-	/// State: (WaitFailoverBegin)
-
-	// (b0) 节点恢复了
-	RedisNodeStateModel.AddTransition(&fsm.Transition{
-		From:       StateWaitFailoverBegin,
-		To:         StateRunning,
-		Input:      Input{ANY, ANY, FINE, ANY, ANY},
-		Priority:   0,
-		Constraint: nil,
-		Apply:      nil,
-	})
-
-	// (b10) 主节点，Autofailover或手动继续执行Failover
-	RedisNodeStateModel.AddTransition(&fsm.Transition{
-		From:       StateWaitFailoverBegin,
-		To:         StateWaitFailoverEnd,
-		Input:      Input{ANY, ANY, FAIL, M, ANY},
-		Priority:   0,
-		Constraint: MasterAutoFailoverConstraint,
-		Apply:      MasterFailoverHandler,
-	})
-
-	// (b11) 主节点，已经处理过了
-	RedisNodeStateModel.AddTransition(&fsm.Transition{
-		From:       StateWaitFailoverBegin,
-		To:         StateOffline,
-		Input:      Input{ANY, ANY, FAIL, M, ANY},
-		Priority:   0,
-		Constraint: MasterGotoOfflineConstraint,
-		Apply:      MasterGotoOfflineHandler,
-	})
-
-	// (b2) 从节点，AutoFailover或手动继续执行Failover
-	RedisNodeStateModel.AddTransition(&fsm.Transition{
-		From:       StateWaitFailoverBegin,
-		To:         StateWaitFailoverEnd,
-		Input:      Input{ANY, ANY, FAIL, S, ANY},
-		Priority:   0,
-		Constraint: SlaveAutoFailoverConstraint,
-		Apply:      SlaveFailoverHandler,
-	})
-
-	// (b3) 从节点，已经处于封禁状态，转到OFFLINE
-	RedisNodeStateModel.AddTransition(&fsm.Transition{
-		From:       StateWaitFailoverBegin,
-		To:         StateOffline,
-		Input:      Input{F, F, FAIL, S, ANY},
-		Priority:   1,
-		Constraint: nil,
-		Apply:      nil,
-	})
-
-	/// State: (WaitFailoverEnd)
-
-	// (c0) 等待Failover执行结束信号
-	RedisNodeStateModel.AddTransition(&fsm.Transition{
-		From:       StateWaitFailoverEnd,
-		To:         StateOffline,
-		Input:      Input{ANY, ANY, ANY, ANY, CMD_FAILOVER_END_SIGNAL},
-		Priority:   0,
-		Constraint: nil,
-		Apply:      nil,
-	})
-
-	// (c1) 从挂了，且已经封禁
-	RedisNodeStateModel.AddTransition(&fsm.Transition{
-		From:       StateWaitFailoverEnd,
-		To:         StateOffline,
-		Input:      Input{F, F, FAIL, S, ANY},
-		Priority:   1,
-		Constraint: nil,
-		Apply:      nil,
-	})
-
-	// (c2) 从在Failover过程中恢复了，结束FailoverEnd状态
-	RedisNodeStateModel.AddTransition(&fsm.Transition{
-		From:       StateWaitFailoverEnd,
-		To:         StateOffline,
-		Input:      Input{ANY, ANY, FINE, S, ANY},
-		Priority:   0,
-		Constraint: nil,
-		Apply:      nil,
-	})
-
-	/// State: (Offline)
-
-	// (d0) 节点恢复读标记
-	RedisNodeStateModel.AddTransition(&fsm.Transition{
-		From:       StateOffline,
-		To:         StateRunning,
-		Input:      Input{T, ANY, ANY, ANY, ANY},
-		Priority:   0,
-		Constraint: nil,
-		Apply:      nil,
-	})
-
-	// (d1) 节点恢复写标记
-	RedisNodeStateModel.AddTransition(&fsm.Transition{
-		From:       StateOffline,
-		To:         StateRunning,
-		Input:      Input{ANY, T, ANY, ANY, ANY},
-		Priority:   0,
-		Constraint: nil,
-		Apply:      nil,
-	})
-
-	// (d2) 是主节，且挂了，需要进行Failover
-	RedisNodeStateModel.AddTransition(&fsm.Transition{
-		From:     StateOffline,
-		To:       StateWaitFailoverBegin,
-		Input:    Input{F, F, FAIL, M, ANY},
-		Priority: 0,
-		Constraint: func(i interface{}) bool {
-			// Master故障，进行Failover之后，故障的节点仍然被标记为master。
-			// 所以我们需要判断这个Master是否已经被处理过了。
-			// 判断依据是节点处于FAIL状态，且没有slots
-			ctx := i.(StateContext)
-			ns := ctx.NodeState
+	r := fsm.NewRegistry(ParseInput)
 
-			if ns.node.IsStandbyMaster() {
-				return false
-			}
-			log.Warningf(ns.Addr(), "Found offline non standby master, will try to failover(%v,%v).",
-				ns.Role(), ns.Ranges())
-			return true
-		},
-		Apply: nil,
-	})
+	r.RegisterState(RunningState)
+	r.RegisterState(WaitFailoverBeginState)
+	r.RegisterState(WaitFailoverEndState)
+	r.RegisterState(OfflineState)
+
+	r.RegisterConstraint("SlaveAutoFailoverConstraint", SlaveAutoFailoverConstraint)
+	r.RegisterConstraint("MasterAutoFailoverConstraint", MasterAutoFailoverConstraint)
+	r.RegisterConstraint("OfflineMasterFailoverConstraint", OfflineMasterFailoverConstraint)
+	r.RegisterConstraint("MasterGotoOfflineConstraint", MasterGotoOfflineConstraint)
+
+	r.RegisterApply("SlaveFailoverHandler", SlaveFailoverHandler)
+	r.RegisterApply("MasterFailoverHandler", MasterFailoverHandler)
+	r.RegisterApply("MasterGotoOfflineHandler", MasterGotoOfflineHandler)
+
+	model, err := fsm.LoadStateModel([]byte(redisNodeStateModelDef), r)
+	if err != nil {
+		panic(err)
+	}
+	RedisNodeStateModel = model
 }
 
 type StateContext struct {
@@ -19,6 +19,9 @@ type MigrateStateStreamData struct {
 	Ranges         []topo.Range
 	CurrRangeIndex int
 	CurrSlot       int
+	CurrSlotKeys   int // 当前slot已迁移的key数
+	ThrottleLevel  int // 迁移限速级别
+	BlockedKey     string
 }
 
 type LogStreamData struct {
@@ -231,6 +231,21 @@ func (s *Node) SetTag(val string) *Node {
 	return s
 }
 
+// Tag格式为 region:zone:room[:k1=v1,k2=v2]，第四段为可选的节点属性
+func (s *Node) TagAttr(key string) string {
+	xs := strings.Split(s.Tag, ":")
+	if len(xs) != 4 {
+		return ""
+	}
+	for _, kv := range strings.Split(xs[3], ",") {
+		ys := strings.SplitN(kv, "=", 2)
+		if len(ys) == 2 && ys[0] == key {
+			return ys[1]
+		}
+	}
+	return ""
+}
+
 func (s *Node) SetRegion(val string) *Node {
 	s.Region = val
 	return s
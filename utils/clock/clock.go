@@ -0,0 +1,120 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+/// 可替换的时钟，Failover等依赖时间的逻辑通过它获取时间和等待，
+/// 测试时替换为虚拟时钟，Sleep直接推进时间，不需要真的等待
+
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+var (
+	mutex sync.RWMutex
+	clock Clock = realClock{}
+)
+
+// 替换当前时钟，返回原来的时钟，传入nil时恢复为真实时钟
+func Set(c Clock) Clock {
+	mutex.Lock()
+	defer mutex.Unlock()
+	old := clock
+	if c == nil {
+		c = realClock{}
+	}
+	clock = c
+	return old
+}
+
+func current() Clock {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return clock
+}
+
+func Now() time.Time {
+	return current().Now()
+}
+
+func Since(t time.Time) time.Duration {
+	return current().Now().Sub(t)
+}
+
+func Sleep(d time.Duration) {
+	current().Sleep(d)
+}
+
+func After(d time.Duration) <-chan time.Time {
+	return current().After(d)
+}
+
+/// 虚拟时钟
+
+type timer struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+type Fake struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*timer
+}
+
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.now
+}
+
+// 虚拟时钟上的Sleep推进时间后立即返回
+func (f *Fake) Sleep(d time.Duration) {
+	f.Advance(d)
+}
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	t := &timer{f.now.Add(d), make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- f.now
+		return t.c
+	}
+	f.timers = append(f.timers, t)
+	return t.c
+}
+
+// 推进时间，并触发到期的After
+func (f *Fake) Advance(d time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.now = f.now.Add(d)
+	sort.Sort(byDeadline(f.timers))
+	i := 0
+	for ; i < len(f.timers) && !f.timers[i].deadline.After(f.now); i++ {
+		f.timers[i].c <- f.now
+	}
+	f.timers = f.timers[i:]
+}
+
+type byDeadline []*timer
+
+func (a byDeadline) Len() int           { return len(a) }
+func (a byDeadline) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byDeadline) Less(i, j int) bool { return a[i].deadline.Before(a[j].deadline) }